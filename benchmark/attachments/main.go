@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/attachments"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/attachments/main.go export -out ./export -folders INBOX,Archive
+//	go run benchmark/attachments/main.go export -out ./export -folders INBOX -uids 12,15 -include 'image/*' -max-size 10485760
+func main() {
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	if len(os.Args) < 2 || os.Args[1] != "export" {
+		log.Ctx(ctx).Fatal().Msg("Usage: attachments export [flags]")
+	}
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	outDir := flags.String("out", "attachments", "directory for the objects and manifest.jsonl")
+	folders := flags.String("folders", "INBOX", "comma separated folders to export")
+	uidList := flags.String("uids", "", "comma separated UIDs; only valid with a single folder")
+	include := flags.String("include", "", "comma separated MIME type patterns to export, e.g. image/*")
+	exclude := flags.String("exclude", "", "comma separated MIME type patterns to skip")
+	minSize := flags.Int64("min-size", 0, "skip attachments smaller than this many bytes")
+	maxSize := flags.Int64("max-size", 0, "skip attachments larger than this many bytes")
+	flags.Parse(os.Args[2:])
+
+	folderNames := splitList(*folders)
+	uids := imap.UIDSet{{Start: 1, Stop: 0}}
+	if *uidList != "" {
+		if len(folderNames) != 1 {
+			log.Ctx(ctx).Fatal().Msg("-uids needs exactly one folder")
+		}
+		uids = nil
+		for _, s := range splitList(*uidList) {
+			uid, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				log.Ctx(ctx).Fatal().Err(err).Str("uid", s).Msg("Invalid UID")
+			}
+			uids.AddNum(imap.UID(uid))
+		}
+	}
+
+	exporter, err := attachments.NewExporter(*outDir, attachments.Filter{
+		Include: splitList(*include),
+		Exclude: splitList(*exclude),
+		MinSize: *minSize,
+		MaxSize: *maxSize,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer exporter.Close()
+
+	// Connect and login
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	imapClient, err := cfg.Dial()
+	if err != nil {
+		panic(err)
+	}
+	log.Ctx(ctx).Debug().Str("username", username).Msg("Logged in to IMAP server")
+
+	for _, folderName := range folderNames {
+		if _, err := imapClient.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+			log.Ctx(ctx).Error().Err(err).Str("folderName", folderName).Msg("Error selecting folder, skipping it")
+			continue
+		}
+		count := exportFolder(ctx, imapClient, exporter, folderName, uids)
+		log.Ctx(ctx).Info().Str("folderName", folderName).Int("attachments", count).Msg("Exported folder")
+	}
+
+	// Logout
+	err = imapClient.Logout().Wait()
+	log.Ctx(ctx).Debug().Msg("Logged out of IMAP server")
+	if err != nil {
+		log.Ctx(ctx).Error().Err(err).Msg("Error logging out of IMAP server. We will directly close the connection")
+	}
+}
+
+func exportFolder(ctx context.Context, imapClient *imapclient.Client, exporter *attachments.Exporter, folderName string, uids imap.UIDSet) int {
+	fetchCmd := imapClient.Fetch(uids, &imap.FetchOptions{
+		UID:         true,
+		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+	})
+	defer fetchCmd.Close()
+
+	count := 0
+	for {
+		msg := fetchCmd.Next()
+		if msg == nil {
+			break
+		}
+
+		// Stream the body into the exporter while the fetch is still active,
+		// then record it once the UID is known.
+		var uid imap.UID
+		var entries []attachments.ManifestEntry
+		for {
+			item := msg.Next()
+			if item == nil {
+				break
+			}
+			switch item := item.(type) {
+			case imapclient.FetchItemDataUID:
+				uid = item.UID
+			case imapclient.FetchItemDataBodySection:
+				var err error
+				entries, err = exporter.Export(item.Literal)
+				if err != nil {
+					log.Ctx(ctx).Warn().Err(err).Str("folderName", folderName).Msg("Failed to export every attachment of a message")
+				}
+			}
+		}
+		if err := exporter.Record(folderName, uid, entries); err != nil {
+			panic(err)
+		}
+		count += len(entries)
+	}
+	if err := fetchCmd.Close(); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("folderName", folderName).Msg("Fetch failed")
+	}
+	return count
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/batch"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/batch/main.go -chunk 500 -inflight 4
+//	go run benchmark/batch/main.go -folder INBOX -ordered
+//
+// Fetches envelopes and flags of every message in a folder with the batch
+// fetcher, once with a single chunk in flight and once with -inflight chunks,
+// and checks that each UID was delivered exactly once.
+func main() {
+	folderName := flag.String("folder", "INBOX", "folder to fetch from")
+	chunkSize := flag.Int("chunk", batch.DefaultChunkSize, "UIDs per FETCH")
+	inFlight := flag.Int("inflight", batch.DefaultInFlight, "chunks in flight")
+	ordered := flag.Bool("ordered", false, "deliver messages in chunk order")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+
+	opts := &batch.Options{ChunkSize: *chunkSize, Ordered: *ordered}
+	if err := run(ctx, cfg, *folderName, opts, *inFlight); err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Benchmark failed")
+	}
+}
+
+func run(ctx context.Context, cfg session.Config, folderName string, opts *batch.Options, inFlight int) error {
+	c, err := cfg.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return err
+	}
+	data, err := c.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		return err
+	}
+	uids := data.AllUIDs()
+
+	raw := make([]uint32, len(uids))
+	for i, uid := range uids {
+		raw[i] = uint32(uid)
+	}
+	chunks := batch.Plan(raw, opts)
+	log.Ctx(ctx).Info().
+		Int("uids", len(uids)).
+		Int("ranges", len(batch.Compress(raw))).
+		Int("chunks", len(chunks)).
+		Msg("Planned batch fetch")
+	for i, chunk := range chunks {
+		if i == 3 {
+			log.Ctx(ctx).Debug().Msgf("... %d more chunks", len(chunks)-i)
+			break
+		}
+		log.Ctx(ctx).Debug().Int("chunk", i+1).Msgf("UID FETCH %s", batch.SetString(chunk))
+	}
+
+	for _, n := range []int{1, inFlight} {
+		o := *opts
+		o.InFlight = n
+		elapsed, err := fetchAll(ctx, c, uids, &o)
+		if err != nil {
+			return err
+		}
+		log.Ctx(ctx).Info().Int("inFlight", n).Dur("elapsed", elapsed).Msg("Fetched every message once")
+	}
+	return nil
+}
+
+func fetchAll(ctx context.Context, c *imapclient.Client, uids []imap.UID, opts *batch.Options) (time.Duration, error) {
+	seen := make(map[imap.UID]int, len(uids))
+	var last imap.UID
+	outOfOrder := 0
+	opts.Progress = func(p batch.Progress) {
+		log.Ctx(ctx).Debug().
+			Int("chunk", p.ChunksDone).
+			Int("chunks", p.Chunks).
+			Int("messages", p.Messages).
+			Int("retries", p.Retries).
+			Msg("Fetched chunk")
+	}
+
+	start := time.Now()
+	err := batch.Fetch(ctx, c, uids, &imap.FetchOptions{Envelope: true, Flags: true}, opts, func(msg *imapclient.FetchMessageBuffer) error {
+		seen[msg.UID]++
+		if msg.UID < last {
+			outOfOrder++
+		}
+		last = msg.UID
+		return nil
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		return elapsed, err
+	}
+
+	for _, uid := range uids {
+		if seen[uid] != 1 {
+			return elapsed, fmt.Errorf("UID %d delivered %d times", uid, seen[uid])
+		}
+	}
+	if opts.Ordered && outOfOrder > 0 {
+		return elapsed, fmt.Errorf("%d messages delivered out of order", outOfOrder)
+	}
+	return elapsed, nil
+}
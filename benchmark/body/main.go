@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/quzhi1/imap-playground/internal/body"
+	"github.com/quzhi1/imap-playground/internal/parser"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Usage:
+//
+//	go run benchmark/body/main.go
+//	go run benchmark/body/main.go -update
+//	go run benchmark/body/main.go -eml ./tmp.eml
+//
+// Runs every .html and .txt sample under -dir through the body processor
+// and compares the result with the .json golden file next to it. -update
+// rewrites the golden files instead. -eml processes one raw message and
+// prints the result.
+func main() {
+	dir := flag.String("dir", "internal/body/testdata", "directory with samples and golden files")
+	update := flag.Bool("update", false, "rewrite the golden files")
+	eml := flag.String("eml", "", "process this .eml file and print the result")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	if *eml != "" {
+		f, err := os.Open(*eml)
+		if err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Failed to open message")
+		}
+		defer f.Close()
+		msg, err := parser.Parse(f)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Failed to parse the whole message, using what was parsed")
+		}
+		if msg == nil {
+			os.Exit(1)
+		}
+		printJSON(body.FromMessage(msg))
+		return
+	}
+
+	samples, err := filepath.Glob(filepath.Join(*dir, "*"))
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to list samples")
+	}
+	failed := 0
+	for _, sample := range samples {
+		ext := filepath.Ext(sample)
+		if ext != ".html" && ext != ".txt" {
+			continue
+		}
+		raw, err := os.ReadFile(sample)
+		if err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Failed to read sample")
+		}
+		var result *body.Result
+		if ext == ".html" {
+			result = body.SplitHTML(string(raw))
+		} else {
+			result = body.SplitText(string(raw))
+		}
+		got, _ := json.MarshalIndent(result, "", "  ")
+		got = append(got, '\n')
+
+		golden := strings.TrimSuffix(sample, ext) + ".json"
+		if *update {
+			if err := os.WriteFile(golden, got, 0o644); err != nil { //nolint:gosec // golden files are not secret
+				log.Ctx(ctx).Fatal().Err(err).Msg("Failed to write golden file")
+			}
+			log.Ctx(ctx).Info().Str("file", filepath.Base(golden)).Msg("Updated")
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Missing golden file, run with -update")
+		}
+		if !bytes.Equal(got, want) {
+			failed++
+			log.Ctx(ctx).Error().Str("file", filepath.Base(sample)).Str("got", string(got)).Msg("Differs from golden file")
+			continue
+		}
+		log.Ctx(ctx).Info().Str("file", filepath.Base(sample)).Msg("OK")
+	}
+	if failed > 0 {
+		log.Ctx(ctx).Fatal().Int("failed", failed).Msg("Golden files differ")
+	}
+}
+
+func printJSON(v any) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v) //nolint:errcheck
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/anonymize"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+var fixtureName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Usage:
+//
+//	go run benchmark/capture/main.go -uid 176 -name outlook-winmail
+//	go run benchmark/capture/main.go -folder Archive -uid 42 -name bad-charset -dir internal/parser/testdata/broken
+//	go run benchmark/capture/main.go -eml ./tmp.eml -name forwarded-twice
+//
+// Fetches one live message (or reads an .eml file), anonymizes it and writes
+// it as <dir>/<name>.eml, then runs the parser suite with -update to write
+// the expected <name>.json next to it. Check the notes it logs and read
+// both files before committing them.
+func main() {
+	folderName := flag.String("folder", "INBOX", "folder to fetch from")
+	uid := flag.Uint("uid", 0, "UID of the message to capture")
+	emlPath := flag.String("eml", "", "anonymize this .eml file instead of fetching from the server")
+	name := flag.String("name", "", "fixture name, e.g. outlook-winmail")
+	dir := flag.String("dir", "internal/parser/testdata/corpus", "fixture directory")
+	force := flag.Bool("force", false, "overwrite an existing fixture")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	if !fixtureName.MatchString(*name) {
+		log.Ctx(ctx).Fatal().Str("name", *name).Msg("Pass -name with lower-case letters, digits and dashes")
+	}
+	path := filepath.Join(*dir, *name+".eml")
+	if _, err := os.Stat(path); err == nil && !*force {
+		log.Ctx(ctx).Fatal().Str("path", path).Msg("Fixture exists, pass -force to overwrite it")
+	}
+
+	var raw []byte
+	var err error
+	switch {
+	case *emlPath != "":
+		raw, err = os.ReadFile(*emlPath)
+	case *uid != 0:
+		raw, err = fetchRaw(ctx, *folderName, imap.UID(*uid))
+	default:
+		log.Ctx(ctx).Fatal().Msg("Pass either -eml or -uid")
+	}
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to get message")
+	}
+
+	anonymizer := anonymize.New()
+	anonymized := anonymizer.Message(raw)
+	if err := os.WriteFile(path, anonymized, 0o644); err != nil { //nolint:gosec // fixtures are not secret
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to write fixture")
+	}
+	log.Ctx(ctx).Info().Str("path", path).Int("size", len(raw)).Int("anonymizedSize", len(anonymized)).Msg("Wrote fixture")
+	for _, note := range anonymizer.Notes {
+		log.Ctx(ctx).Warn().Msg("Review: " + note)
+	}
+
+	// The expected output is whatever the parser suite writes, so it is
+	// always in the format the suite compares against.
+	pattern := "TestCorpus/^" + regexp.QuoteMeta(filepath.Base(*dir)) + "$/^" + regexp.QuoteMeta(*name) + "$"
+	cmd := exec.Command("go", "test", "./internal/parser", "-run", pattern, "-update") //nolint:gosec // arguments are checked above
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to write the expected output")
+	}
+	log.Ctx(ctx).Info().Str("path", filepath.Join(*dir, *name+".json")).Msg("Wrote expected output")
+}
+
+func fetchRaw(ctx context.Context, folderName string, uid imap.UID) ([]byte, error) {
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	imapClient, err := cfg.Dial()
+	if err != nil {
+		return nil, err
+	}
+	log.Ctx(ctx).Debug().Str("username", username).Msg("Logged in to IMAP server")
+
+	// defer logout
+	defer func() {
+		if err := imapClient.Logout().Wait(); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Error logging out of IMAP server")
+		}
+	}()
+
+	if _, err := imapClient.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return nil, err
+	}
+	messages, err := imapClient.Fetch(imap.UIDSetNum(uid), &imap.FetchOptions{
+		UID:         true,
+		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+	}).Collect()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		for _, raw := range msg.BodySection {
+			return raw, nil
+		}
+	}
+	log.Ctx(ctx).Fatal().Str("folderName", folderName).Uint32("uid", uint32(uid)).Msg("No message fetched")
+	return nil, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/mailsync"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/condstore/main.go -folder INBOX
+//	go run benchmark/condstore/main.go -folder INBOX -pause 1m
+//
+// Syncs a folder with flags into two state directories, one using CONDSTORE
+// and one ignoring it, then syncs both again, twice, comparing the bytes on
+// the wire. Nothing is changed on the server: use -pause to flag a few
+// messages in another client before the second sync, or compare the
+// unchanged runs. TestSyncFlags in internal/mailsync changes flags on a
+// fake server that fakes CONDSTORE.
+func main() {
+	folderName := flag.String("folder", "INBOX", "folder to sync")
+	pause := flag.Duration("pause", 0, "wait this long after the first sync, to change flags in another client")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+
+	stores := make(map[bool]*mailsync.Store)
+	for _, cond := range []bool{true, false} {
+		dir, err := os.MkdirTemp("", "condstore-")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(dir)
+		if stores[cond], err = mailsync.OpenStore(dir); err != nil {
+			panic(err)
+		}
+	}
+
+	syncBoth := func(step string) {
+		results := make(map[bool]int64)
+		for _, cond := range []bool{true, false} {
+			n, res, err := measure(ctx, cfg, stores[cond], &mailsync.Options{
+				Folders:     []string{*folderName},
+				Flags:       true,
+				NoCondStore: !cond,
+			})
+			if err != nil {
+				log.Ctx(ctx).Fatal().Err(err).Msg("Sync failed")
+			}
+			results[cond] = n
+			log.Ctx(ctx).Info().
+				Str("step", step).
+				Bool("condstore", res.CondStore).
+				Int("new", res.New).
+				Int("flagsFetched", res.FlagsChanged).
+				Bool("unchanged", res.Unchanged).
+				Int64("bytes", n).
+				Msg("Synced")
+		}
+		if results[false] > 0 {
+			log.Ctx(ctx).Info().
+				Str("step", step).
+				Int64("saved", results[false]-results[true]).
+				Str("ratio", fmt.Sprintf("%.1f%%", 100*float64(results[true])/float64(results[false]))).
+				Msg("CONDSTORE bytes compared with fetching every flag")
+		}
+	}
+
+	syncBoth("initial")
+	if *pause > 0 {
+		log.Ctx(ctx).Info().Dur("pause", *pause).Msg("Change some flags in another client now")
+		time.Sleep(*pause)
+	}
+	syncBoth("changed")
+	syncBoth("unchanged")
+}
+
+// measure runs one sync and returns the bytes sent and received and the
+// folder's result.
+func measure(ctx context.Context, cfg session.Config, store *mailsync.Store, opts *mailsync.Options) (int64, mailsync.FolderResult, error) {
+	counter := &byteCounter{}
+	cfg.DebugWriter = counter
+	report, err := mailsync.Sync(ctx, cfg.Dial, store, nopHandler{}, opts)
+	if err != nil {
+		return 0, mailsync.FolderResult{}, err
+	}
+	for name, reason := range report.Failed {
+		return 0, mailsync.FolderResult{}, fmt.Errorf("%s: %s", name, reason)
+	}
+	return counter.n.Load(), report.Folders[0], nil
+}
+
+// byteCounter counts what the client's DebugWriter sees, which is everything
+// sent and received.
+type byteCounter struct {
+	n atomic.Int64
+}
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	b.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+type nopHandler struct{}
+
+func (nopHandler) Reset(string) error                                   { return nil }
+func (nopHandler) Message(string, *imapclient.FetchMessageBuffer) error { return nil }
+func (nopHandler) Expunged(string, []imap.UID) error                    { return nil }
+func (nopHandler) Flags(string, imap.UID, []imap.Flag) error            { return nil }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/quzhi1/imap-playground/internal/dedupe"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/dedupe/main.go -c 4 -prefer INBOX,Archive
+//	go run benchmark/dedupe/main.go -folders INBOX,Archive -delete
+//
+// Scans every folder, groups the copies of each message by fingerprint and
+// prints the report as JSON. Nothing is changed unless -delete is given;
+// then the extra copies in the report are removed, after their flags are
+// copied onto the kept copy. internal/dedupe's tests cover the same on a
+// local fake server.
+func main() {
+	concurrency := flag.Int("c", 4, "maximum number of IMAP connections")
+	folders := flag.String("folders", "", "comma-separated folders to scan (default: all but virtual ones)")
+	prefer := flag.String("prefer", "INBOX", "comma-separated folders whose copy is kept, best first")
+	remove := flag.Bool("delete", false, "delete the extra copies after printing the report")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	report, err := dedupe.Scan(ctx, cfg.Dial, &dedupe.Options{
+		Concurrency: *concurrency,
+		Folders:     split(*folders),
+		Prefer:      split(*prefer),
+	})
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Scan failed")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		panic(err)
+	}
+	for name, reason := range report.Failed {
+		log.Ctx(ctx).Warn().Str("folderName", name).Str("error", reason).Msg("Folder not scanned")
+	}
+	for _, id := range report.ReusedIDs {
+		log.Ctx(ctx).Warn().Str("message_id", id).Msg("Message-ID carried by different messages")
+	}
+	log.Ctx(ctx).Info().
+		Int("folders", report.Folders).
+		Int("messages", report.Messages).
+		Int("duplicated", len(report.Groups)).
+		Int("extra", report.ExtraCopies()).
+		Msg("Scanned account")
+
+	if !*remove {
+		if report.ExtraCopies() > 0 {
+			log.Ctx(ctx).Info().Msg("Dry run, pass -delete to remove the extra copies")
+		}
+		return
+	}
+	result, err := dedupe.Delete(ctx, cfg.Dial, report)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Delete failed")
+	}
+	for name, reason := range result.Failed {
+		log.Ctx(ctx).Warn().Str("folderName", name).Str("error", reason).Msg("Folder skipped")
+	}
+	for fp, reason := range result.Skipped {
+		log.Ctx(ctx).Warn().Str("fingerprint", fp).Str("error", reason).Msg("Copies kept")
+	}
+	log.Ctx(ctx).Info().
+		Int("deleted", result.Deleted).
+		Int("flagged", result.Flagged).
+		Msg("Deleted extra copies")
+}
+
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
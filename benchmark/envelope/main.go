@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	imapv1 "github.com/emersion/go-imap"
+	clientv1 "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-message/textproto"
+	imapfork "github.com/quzhi1/go-imap"
+	clientfork "github.com/quzhi1/go-imap/client"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/envelope/main.go -folder INBOX -n 50
+//	go run benchmark/envelope/main.go -v
+//
+// Builds the normalized envelope of the most recent messages four ways: from
+// the go-imap v2 ENVELOPE, the go-imap v1 ENVELOPE, the v1 fork ENVELOPE and
+// the parsed header, and reports where they disagree. References is not
+// compared, since ENVELOPE does not carry it. The same check on fixed tricky
+// headers runs in go test ./internal/envelope.
+func main() {
+	folderName := flag.String("folder", "INBOX", "folder to fetch from")
+	count := flag.Int("n", 20, "number of most recent messages")
+	verbose := flag.Bool("v", false, "print every normalized envelope")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+
+	fromV2, fromHeader, err := fetchV2(ctx, cfg, *folderName, *count)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to fetch with go-imap v2")
+	}
+	if len(fromHeader) == 0 {
+		log.Ctx(ctx).Info().Str("folderName", *folderName).Msg("No messages")
+		return
+	}
+	var uids []uint32
+	for uid := range fromHeader {
+		uids = append(uids, uid)
+	}
+	fromV1, err := fetchV1(*folderName, uids)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to fetch with go-imap v1")
+	}
+	fromFork, err := fetchFork(*folderName, uids)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to fetch with the go-imap v1 fork")
+	}
+
+	mismatches := 0
+	for uid, want := range fromHeader {
+		want.References = nil
+		wantJSON, _ := json.Marshal(want)
+		if *verbose {
+			log.Ctx(ctx).Info().Uint32("uid", uid).RawJSON("envelope", wantJSON).Msg("Normalized envelope")
+		}
+		for source, got := range map[string]*envelope.Envelope{"v2": fromV2[uid], "v1": fromV1[uid], "fork": fromFork[uid]} {
+			gotJSON, _ := json.Marshal(got)
+			if !bytes.Equal(gotJSON, wantJSON) {
+				mismatches++
+				log.Ctx(ctx).Warn().
+					Uint32("uid", uid).
+					Str("source", source).
+					RawJSON("got", gotJSON).
+					RawJSON("want", wantJSON).
+					Msg("Envelope differs from the parsed header")
+			}
+		}
+	}
+	if mismatches > 0 {
+		log.Ctx(ctx).Fatal().Int("mismatches", mismatches).Msg("Envelopes differ")
+	}
+	log.Ctx(ctx).Info().Int("messages", len(fromHeader)).Msg("v1, fork, v2 and header envelopes agree")
+}
+
+// fetchV2 fetches the ENVELOPE and the header of the count most recent
+// messages in folderName.
+func fetchV2(ctx context.Context, cfg session.Config, folderName string, count int) (envelopes, fromHeader map[uint32]*envelope.Envelope, err error) {
+	c, err := cfg.Dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return nil, nil, err
+	}
+	data, err := c.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	uids := data.AllUIDs()
+	if len(uids) > count {
+		uids = uids[len(uids)-count:]
+	}
+	if len(uids) == 0 {
+		return nil, nil, nil
+	}
+
+	section := &imap.FetchItemBodySection{Specifier: imap.PartSpecifierHeader, Peek: true}
+	messages, err := c.Fetch(imap.UIDSetNum(uids...), &imap.FetchOptions{
+		UID:         true,
+		Envelope:    true,
+		BodySection: []*imap.FetchItemBodySection{section},
+	}).Collect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	envelopes = make(map[uint32]*envelope.Envelope)
+	fromHeader = make(map[uint32]*envelope.Envelope)
+	for _, msg := range messages {
+		envelopes[uint32(msg.UID)] = envelope.FromV2(msg.Envelope)
+		for _, raw := range msg.BodySection {
+			header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+			if err != nil {
+				return nil, nil, fmt.Errorf("UID %d: %w", msg.UID, err)
+			}
+			env, errs := envelope.FromHeader(header)
+			for _, err := range errs {
+				log.Ctx(ctx).Warn().Uint32("uid", uint32(msg.UID)).Err(err).Msg("Header field not understood")
+			}
+			fromHeader[uint32(msg.UID)] = env
+		}
+	}
+	return envelopes, fromHeader, nil
+}
+
+func fetchV1(folderName string, uids []uint32) (map[uint32]*envelope.Envelope, error) {
+	c, err := clientv1.DialTLS(imapAddress, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec // We support self-signed imap server
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout() //nolint:errcheck
+	if err := c.Login(username, password); err != nil {
+		return nil, err
+	}
+	if _, err := c.Select(folderName, true); err != nil {
+		return nil, err
+	}
+
+	set := new(imapv1.SeqSet)
+	set.AddNum(uids...)
+	messages := make(chan *imapv1.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(set, []imapv1.FetchItem{imapv1.FetchUid, imapv1.FetchEnvelope}, messages)
+	}()
+	envelopes := make(map[uint32]*envelope.Envelope)
+	for msg := range messages {
+		envelopes[msg.Uid] = envelope.FromV1(msg.Envelope)
+	}
+	return envelopes, <-done
+}
+
+func fetchFork(folderName string, uids []uint32) (map[uint32]*envelope.Envelope, error) {
+	c, err := clientfork.DialTLS(imapAddress, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec // We support self-signed imap server
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout() //nolint:errcheck
+	if err := c.Login(username, password); err != nil {
+		return nil, err
+	}
+	if _, err := c.Select(folderName, true); err != nil {
+		return nil, err
+	}
+
+	set := new(imapfork.SeqSet)
+	set.AddNum(uids...)
+	messages := make(chan *imapfork.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(set, []imapfork.FetchItem{imapfork.FetchUid, imapfork.FetchEnvelope}, messages)
+	}()
+	envelopes := make(map[uint32]*envelope.Envelope)
+	for msg := range messages {
+		envelopes[msg.Uid] = envelope.FromV1Fork(msg.Envelope)
+	}
+	return envelopes, <-done
+}
@@ -1,16 +1,14 @@
 package main
 
 import (
-	"io"
 	"log"
 	"os"
-	"reflect"
-	"strings"
+	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
-	"github.com/emersion/go-message"
-	"github.com/emersion/go-message/mail"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/stream"
 )
 
 const (
@@ -56,99 +54,28 @@ func main() {
 	}
 	log.Printf("%s contains %v messages", folder, selectedMbox.NumMessages)
 
-	// Start fetch message command
-	uid := imap.UIDSetNum(uid)
-	fetchCmd := c.Fetch(uid, &imap.FetchOptions{
-		Envelope:     true,
-		Flags:        true,
-		UID:          true,
-		InternalDate: true,
-		BodySection:  []*imap.FetchItemBodySection{{Peek: true}},
-	})
-	defer func() {
-		if fetchCmd == nil {
-			log.Println("fetchCmd is nil. Skipping closing.")
-			return
-		}
-		if err := fetchCmd.Close(); err != nil {
-			log.Println("Error closing fetch stream")
-		}
-	}()
-
-	// Fetch message
-	for {
-		msg := fetchCmd.Next()
-		if msg == nil {
-			break
-		}
-
-		// Iterate over the fetched data items
-		var envelope *imap.Envelope
-		var flags []imap.Flag
-		var uid *imap.UID
-		var emlStr string
-		var emlErr error
-		var internalDate int64
-		for {
-			// Iterate over the fetched data items
-			item := msg.Next()
-			if item == nil {
-				break
-			}
-
-			switch item := item.(type) {
-			case imapclient.FetchItemDataEnvelope:
-				envelope = item.Envelope
-			case imapclient.FetchItemDataFlags:
-				flags = item.Flags
-			case imapclient.FetchItemDataUID:
-				uid = &item.UID
-			case imapclient.FetchItemDataInternalDate:
-				internalDate = item.Time.Unix()
-			case imapclient.FetchItemDataBodySection:
-				// Why are we loading the entire eml string instead of passing the *mail.Reader?
-				// Because *mail.Reader cannot be passed into `loadMessage` without EOF error.
-				// I spent 2 days debugging this issue, still can't figure out why.
-				// It is still OK to load the entire eml string into memory,
-				// because message attachment will be at most 20 MB.
-				var b []byte
-				b, emlErr = io.ReadAll(item.Literal)
-				emlStr = string(b)
-			default:
-				log.Printf("Unknown fetch item type : %s", reflect.TypeOf(item).String())
-			}
+	// Fetch and parse the message while the fetch stream is on it
+	err = stream.Fetch(c, imap.UIDSetNum(uid), nil, func(msg *stream.Message) error {
+		log.Printf("flags: %v", msg.Flags)
+		log.Printf("uid: %v", msg.UID)
+		log.Printf("internalDate: %d", msg.InternalDate.Unix())
+		log.Printf("size: %d", msg.Size)
+		log.Printf("messageID from raw mime: %s", msg.Parsed.MessageID)
+		log.Printf("subject: %s", msg.Parsed.Subject)
+		log.Printf("from: %s", envelope.FormatList(msg.Parsed.From))
+		log.Printf("to: %s", envelope.FormatList(msg.Parsed.To))
+		if msg.Parsed.Date != nil {
+			log.Printf("date: %s", msg.Parsed.Local().Format(time.RFC1123Z))
 		}
-
-		// Skip message if there is an error reading the eml
-		if emlErr != nil {
-			log.Printf("error reading email eml, skipping this message: %v", emlErr)
-			continue
+		for _, part := range msg.Parts {
+			log.Printf("attachment: %s (%s, %d bytes, spilled to disk: %t)", part.Filename, part.ContentType, part.Size, part.Spilled())
 		}
-		log.Printf("flags: %v", flags)
-		log.Printf("uid: %v", uid)
-		log.Printf("internalDate: %d", internalDate)
-		log.Printf("emlStr is empty? %t", emlStr == "")
-		log.Printf("messageID from envelope: %s", envelope.MessageID)
-		log.Printf("subject: %s", envelope.Subject)
-
-		// Read the eml string
-		emlStrReader := strings.NewReader(emlStr)
-		var mailReader *mail.Reader
-		mailReader, err := mail.CreateReader(emlStrReader)
-		if err != nil {
-			if message.IsUnknownCharset(err) {
-				log.Fatalln("Unknown charset.")
-			} else {
-				log.Fatalln("Failed to create mail reader.")
-			}
+		for _, problem := range msg.Parsed.Problems {
+			log.Printf("problem in part %s: %s", problem.Part, problem.Problem)
 		}
-		defer func() {
-			if err = mailReader.Close(); err != nil {
-				log.Fatalln("Failed to close mail reader")
-			}
-		}()
-
-		messageIdFromRawMimie := mailReader.Header.Get("Message-ID")
-		log.Printf("messageID from raw mime: %s", messageIdFromRawMimie)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("failed to fetch message: %v", err)
 	}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/flagsync"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// change is a local flag change from -change, "INBOX:12:+\Flagged".
+type change struct {
+	folder string
+	uid    imap.UID
+	store  *imap.StoreFlags
+}
+
+// Usage:
+//
+//	go run benchmark/flagsync/main.go -dir ./flagsync -folders INBOX,Archive
+//	go run benchmark/flagsync/main.go -dir ./flagsync -change 'INBOX:12:+\Flagged' -change 'INBOX:13:-\Seen'
+//	go run benchmark/flagsync/main.go -dir ./flagsync -policy union
+//
+// Keeps flags in agreement between a local store and the server in both
+// directions. The folders are synced into -dir; -change edits the local
+// flags of a message already synced before the sync pushes them. Every
+// change applied is logged to <dir>/changes.log. internal/flagsync's
+// tests change flags on both sides of a fake server under each policy.
+func main() {
+	dir := flag.String("dir", "./flagsync", "local flag store")
+	folders := flag.String("folders", "INBOX", "comma-separated folders to sync")
+	policyName := flag.String("policy", "server", "who wins when both sides changed a message: server, local or union")
+	var changes []change
+	flag.Func("change", `local change before the sync, "folder:uid:+flag", ":-flag" or ":=flag flag"`, func(s string) error {
+		c, err := parseChange(s)
+		if err == nil {
+			changes = append(changes, c)
+		}
+		return err
+	})
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	policy, err := flagsync.ParsePolicy(*policyName)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Bad policy")
+	}
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	store, err := flagsync.Open(*dir)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to open flag store")
+	}
+	defer store.Close()
+
+	c, err := cfg.Dial()
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to connect")
+	}
+	defer func() {
+		if err := c.Logout().Wait(); err != nil {
+			c.Close()
+		}
+	}()
+	opts := &flagsync.Options{Policy: policy}
+
+	for _, ch := range changes {
+		if err := store.Change(ch.folder, []imap.UID{ch.uid}, ch.store); err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Failed to change local flags")
+		}
+	}
+	syncAll(ctx, c, store, strings.Split(*folders, ","), opts)
+
+	log.Ctx(ctx).Info().Str("log", store.Dir()+"/changes.log").Msg("Change log")
+	logged, err := store.ReadLog()
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to read change log")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, c := range logged {
+		if err := enc.Encode(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func syncAll(ctx context.Context, c *imapclient.Client, store *flagsync.Store, folders []string, opts *flagsync.Options) {
+	for _, folder := range folders {
+		start := time.Now()
+		res, err := flagsync.Sync(ctx, c, store, folder, opts)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("folderName", folder).Msg("Failed to sync flags, skipping folder")
+			continue
+		}
+		log.Ctx(ctx).Info().
+			Str("folderName", folder).
+			Bool("reset", res.Reset).
+			Int("new", res.New).
+			Int("expunged", res.Expunged).
+			Int("pulled", res.Pulled).
+			Int("pushed", res.Pushed).
+			Int("conflicts", res.Conflicts).
+			Int("refused", res.Refused).
+			Bool("condstore", res.CondStore).
+			Dur("elapsed", time.Since(start)).
+			Msg("Synced flags")
+	}
+}
+
+func parseChange(s string) (change, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return change{}, fmt.Errorf("want folder:uid:+flag, got %q", s)
+	}
+	uid, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return change{}, fmt.Errorf("bad UID in %q", s)
+	}
+	store := &imap.StoreFlags{}
+	switch parts[2][0] {
+	case '+':
+		store.Op = imap.StoreFlagsAdd
+	case '-':
+		store.Op = imap.StoreFlagsDel
+	case '=':
+		store.Op = imap.StoreFlagsSet
+	default:
+		return change{}, fmt.Errorf("want +, - or = before the flags in %q", s)
+	}
+	for _, f := range strings.Fields(parts[2][1:]) {
+		store.Flags = append(store.Flags, imap.Flag(f))
+	}
+	return change{folder: parts[0], uid: imap.UID(uid), store: store}, nil
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 )
 
 var imapAddress = "imap.mail.yahoo.com:993"
@@ -125,7 +126,7 @@ func runFlow(username, password string, writer *csv.Writer) {
 	message := fetchMessageById(c, 190467)
 	// fetchMessageById(c, 190467)
 	fetchLatency := time.Now().UnixMilli() - start
-	log.Printf("Fetch message. Subject: %s, latency: %d", message.Envelope.Subject, fetchLatency)
+	log.Printf("Fetch message. Subject: %s, latency: %d", envelope.FromV1(message.Envelope).Subject, fetchLatency)
 
 	// Search (only return uids)
 	start = time.Now().UnixMilli()
@@ -7,6 +7,7 @@ import (
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 )
 
 const max_concurrent = 1000
@@ -71,7 +72,7 @@ func loginSelectFetch(wg *sync.WaitGroup) {
 		if err != nil {
 			log.Fatalf("failed to fetch first message in Archive: %v", err)
 		}
-		log.Printf("subject of first message in Archive: %v", messages[0].Envelope.Subject)
+		log.Printf("subject of first message in Archive: %v", envelope.FromV2(messages[0].Envelope).Subject)
 	}
 
 	// Logout
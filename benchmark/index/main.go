@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/index"
+	"github.com/quzhi1/imap-playground/internal/mailsync"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/index/main.go build -dir ./index
+//	go run benchmark/index/main.go build -dir ./index -folders INBOX,Archive
+//	go run benchmark/index/main.go query -dir ./index -from alice -since 2024-01-01 -limit 20
+//	go run benchmark/index/main.go query -dir ./index -attachment-type application/pdf -sort -size
+//	go run benchmark/index/main.go query -dir ./index -thread '<root@example.com>' -sort date
+//
+// build syncs the account into a local index of envelopes, flags, sizes,
+// threads and attachment metadata; run it again to pick up only what
+// changed. The sync state lives in the index directory. query answers from
+// the index alone, without connecting, and prints one page of matches as
+// JSON. go test ./internal/index builds one from a local fake server.
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "build" && os.Args[1] != "query") {
+		fmt.Fprintln(os.Stderr, "usage: main.go build|query [flags]")
+		os.Exit(2)
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	dir := fs.String("dir", "./index", "index directory")
+	folders := fs.String("folders", "", "build: comma-separated folders to index (default: all); query: folders to match")
+	from := fs.String("from", "", "query: sender address or name contains this")
+	to := fs.String("to", "", "query: a recipient (To, Cc or Bcc) address or name contains this")
+	subject := fs.String("subject", "", "query: subject contains this")
+	thread := fs.String("thread", "", "query: thread ID")
+	since := fs.String("since", "", "query: dated on or after this day (2006-01-02)")
+	before := fs.String("before", "", "query: dated before this day (2006-01-02)")
+	flags := fs.String("flags", "", "query: comma-separated flags that must be set")
+	notFlags := fs.String("not-flags", "", "query: comma-separated flags that must not be set")
+	minSize := fs.Int64("min-size", 0, "query: minimum size in bytes")
+	maxSize := fs.Int64("max-size", 0, "query: maximum size in bytes")
+	attachment := fs.String("attachment", "", "query: an attachment filename contains this")
+	attachmentType := fs.String("attachment-type", "", "query: an attachment content type starts with this")
+	withAttachments := fs.Bool("with-attachments", false, "query: only messages with attachments")
+	sortBy := fs.String("sort", "-date", "query: comma-separated sort fields, '-' for descending (date, internal_date, size, subject, from, folder, uid)")
+	limit := fs.Int("limit", 50, "query: page size")
+	page := fs.Int("page", 1, "query: page number, from 1")
+	fs.Parse(os.Args[2:]) //nolint:errcheck // ExitOnError
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	ix, err := index.Open(*dir)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to open index")
+	}
+	defer ix.Close()
+
+	if cmd == "build" {
+		build(ctx, ix, *folders)
+		return
+	}
+
+	q := &index.Query{
+		From:           *from,
+		To:             *to,
+		AnyRecipient:   true,
+		Subject:        *subject,
+		ThreadID:       *thread,
+		MinSize:        *minSize,
+		MaxSize:        *maxSize,
+		Attachment:     *attachment,
+		AttachmentType: *attachmentType,
+		Sort:           *sortBy,
+		Limit:          *limit,
+		Offset:         (max(*page, 1) - 1) * *limit,
+	}
+	if *folders != "" {
+		q.Folders = strings.Split(*folders, ",")
+	}
+	for _, d := range []struct {
+		value string
+		field *time.Time
+	}{{*since, &q.Since}, {*before, &q.Before}} {
+		if d.value == "" {
+			continue
+		}
+		if *d.field, err = time.Parse(time.DateOnly, d.value); err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Bad date")
+		}
+	}
+	for _, f := range []struct {
+		value string
+		field *[]imap.Flag
+	}{{*flags, &q.Flags}, {*notFlags, &q.NotFlags}} {
+		for _, flag := range strings.Split(f.value, ",") {
+			if flag != "" {
+				*f.field = append(*f.field, imap.Flag(flag))
+			}
+		}
+	}
+	if *withAttachments {
+		q.HasAttachments = withAttachments
+	}
+	start := time.Now()
+	res, err := ix.Query(q)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Query failed")
+	}
+	log.Ctx(ctx).Info().
+		Int("total", res.Total).
+		Int("page", *page).
+		Int("entries", len(res.Entries)).
+		Int("indexed", ix.Len()).
+		Dur("elapsed", time.Since(start)).
+		Msg("Query done")
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(res); err != nil {
+		panic(err)
+	}
+}
+
+func build(ctx context.Context, ix *index.Index, folders string) {
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	store, err := mailsync.OpenStore(filepath.Join(ix.Dir(), "state"))
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to open sync state")
+	}
+	opts := &mailsync.Options{Fetch: index.FetchOptions, Flags: true}
+	if folders != "" {
+		opts.Folders = strings.Split(folders, ",")
+	}
+	start := time.Now()
+	report, err := mailsync.Sync(ctx, cfg.Dial, store, ix, opts)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Sync failed")
+	}
+	for _, f := range report.Folders {
+		log.Ctx(ctx).Info().
+			Str("folderName", f.Folder).
+			Bool("full", f.Full).
+			Int("new", f.New).
+			Int("expunged", f.Expunged).
+			Int("flagsChanged", f.FlagsChanged).
+			Msg("Indexed folder")
+	}
+	for name, reason := range report.Failed {
+		log.Ctx(ctx).Warn().Str("folderName", name).Str("error", reason).Msg("Folder not indexed")
+	}
+	log.Ctx(ctx).Info().Int("messages", ix.Len()).Str("dir", ix.Dir()).Dur("elapsed", time.Since(start)).Msg("Index built")
+}
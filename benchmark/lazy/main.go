@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/lazy"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/quzhi1/imap-playground/internal/stream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/lazy/main.go -folder INBOX -n 50
+//
+// Fetches the most recent messages twice, once whole (BODY.PEEK[]) and once
+// lazily (BODYSTRUCTURE, then only the text sections), and compares bytes
+// on the wire, latency and the text both ways produce.
+func main() {
+	folderName := flag.String("folder", "INBOX", "folder to fetch from")
+	count := flag.Int("n", 20, "number of most recent messages")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+
+	if err := run(ctx, cfg, *folderName, *count); err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Benchmark failed")
+	}
+}
+
+func run(ctx context.Context, cfg session.Config, folderName string, count int) error {
+	uids, err := recentUIDs(cfg, folderName, count)
+	if err != nil {
+		return err
+	}
+	log.Ctx(ctx).Info().Int("messages", len(uids)).Str("folderName", folderName).Msg("Benchmarking")
+
+	// Whole-message fetch
+	wholeTexts := make(map[imap.UID]string)
+	wholeBytes, wholeTime, err := measure(cfg, folderName, func(c *imapclient.Client) error {
+		return stream.Fetch(c, imap.UIDSetNum(uids...), nil, func(msg *stream.Message) error {
+			wholeTexts[msg.UID] = msg.Parsed.Text + "\x00" + msg.Parsed.HTML
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Lazy fetch
+	var messages []*lazy.Message
+	lazyBytes, lazyTime, err := measure(cfg, folderName, func(c *imapclient.Client) error {
+		messages, err = lazy.FetchText(c, imap.UIDSetNum(uids...), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+	for _, msg := range messages {
+		if wholeTexts[msg.UID] != msg.Text+"\x00"+msg.HTML {
+			mismatches++
+			log.Ctx(ctx).Warn().Uint32("uid", uint32(msg.UID)).Msg("Lazy text differs from whole-message text")
+		}
+		for _, problem := range msg.Problems {
+			log.Ctx(ctx).Warn().Uint32("uid", uint32(msg.UID)).Msg(problem)
+		}
+	}
+
+	log.Ctx(ctx).Info().
+		Int64("bytes", wholeBytes).
+		Dur("elapsed", wholeTime).
+		Msg("Whole message (BODY.PEEK[])")
+	log.Ctx(ctx).Info().
+		Int64("bytes", lazyBytes).
+		Dur("elapsed", lazyTime).
+		Int("textMismatches", mismatches).
+		Msg("Lazy (BODYSTRUCTURE + text sections)")
+	if wholeBytes > 0 {
+		log.Ctx(ctx).Info().
+			Str("bytesSaved", fmt.Sprintf("%.1f%%", 100*(1-float64(lazyBytes)/float64(wholeBytes)))).
+			Msg("Lazy fetch savings")
+	}
+
+	// Fetch one attachment on demand
+	for _, msg := range messages {
+		if len(msg.Attachments) == 0 {
+			continue
+		}
+		part := msg.Attachments[0]
+		sum := sha256.New()
+		var written int64
+		partBytes, partTime, err := measure(cfg, folderName, func(c *imapclient.Client) error {
+			written, err = lazy.FetchPart(c, msg.UID, part, sum)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Ctx(ctx).Info().
+			Uint32("uid", uint32(msg.UID)).
+			Str("section", part.Section).
+			Str("filename", part.Filename).
+			Int64("decodedBytes", written).
+			Int64("bytes", partBytes).
+			Dur("elapsed", partTime).
+			Str("sha256", fmt.Sprintf("%x", sum.Sum(nil))).
+			Msg("Fetched attachment on demand")
+		break
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%d messages have different text", mismatches)
+	}
+	return nil
+}
+
+func recentUIDs(cfg session.Config, folderName string, count int) ([]imap.UID, error) {
+	c, err := cfg.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return nil, err
+	}
+	data, err := c.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		return nil, err
+	}
+	uids := data.AllUIDs()
+	if len(uids) > count {
+		uids = uids[len(uids)-count:]
+	}
+	return uids, nil
+}
+
+// measure runs fn on a fresh connection with folderName selected, and returns
+// the bytes sent and received while fn ran and how long it took.
+func measure(cfg session.Config, folderName string, fn func(*imapclient.Client) error) (int64, time.Duration, error) {
+	counter := &byteCounter{}
+	cfg.DebugWriter = counter
+	c, err := cfg.Dial()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return 0, 0, err
+	}
+
+	counter.n.Store(0)
+	start := time.Now()
+	err = fn(c)
+	return counter.n.Load(), time.Since(start), err
+}
+
+// byteCounter counts what the client's DebugWriter sees, which is everything
+// sent and received.
+type byteCounter struct {
+	n atomic.Int64
+}
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	b.n.Add(int64(len(p)))
+	return len(p), nil
+}
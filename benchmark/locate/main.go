@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/quzhi1/imap-playground/internal/locate"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/locate/main.go [-c 4] [-scan | -search] <message-id> [<message-id>...]
+//
+// By default a folder is scanned only for the IDs the server refuses to
+// search for, or when the server's HEADER search turns out not to find a
+// message it has; -search trusts the search, -scan skips it.
+func main() {
+	concurrency := flag.Int("c", 4, "maximum number of IMAP connections")
+	scan := flag.Bool("scan", false, "skip HEADER search and compare every Message-ID locally")
+	searchOnly := flag.Bool("search", false, "trust HEADER search and never scan")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	if flag.NArg() == 0 {
+		log.Ctx(ctx).Fatal().Msg("Pass at least one Message-ID")
+	}
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	mode := locate.ModeAuto
+	switch {
+	case *scan:
+		mode = locate.ModeScan
+	case *searchOnly:
+		mode = locate.ModeSearch
+	}
+	result, err := locate.Locate(ctx, cfg.Dial, flag.Args(), &locate.Options{
+		Concurrency: *concurrency,
+		Mode:        mode,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, match := range result.Matches {
+		log.Ctx(ctx).Info().
+			Str("message_id", match.MessageID).
+			Str("folderName", match.Folder).
+			Uint32("UIDVALIDITY", match.UIDValidity).
+			Uint32("uid", uint32(match.UID)).
+			Msg("Found message")
+	}
+	if len(result.Matches) == 0 {
+		log.Ctx(ctx).Warn().Msg("No messages found")
+	}
+	for name, reason := range result.Failed {
+		log.Ctx(ctx).Warn().Str("folderName", name).Str("error", reason).Msg("Folder not searched")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		panic(err)
+	}
+}
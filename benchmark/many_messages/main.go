@@ -7,6 +7,8 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/quzhi1/imap-playground/internal/batch"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -58,42 +60,36 @@ func main() {
 	log.Ctx(ctx).Debug().Str("folderName", folderName).Uint32("UIDVALIDITY", folder.UidValidity).Msg("Selected folder")
 
 	// Get messages
-	log.Ctx(ctx).Debug().Msgf("Fetching message: 1:421")
-	seqset := new(imap.SeqSet)
-	for i := 1; i <= 421; i++ {
-		seqset.AddNum(uint32(i))
+	uids, err := imapClient.UidSearch(imap.NewSearchCriteria())
+	if err != nil {
+		panic(err)
 	}
+	log.Ctx(ctx).Debug().Int("count", len(uids)).Msg("Fetching messages")
 	items := []imap.FetchItem{
 		imap.FetchEnvelope,
 		imap.FetchFlags,
 	}
-	messageChans := make(chan *imap.Message, 10)
-	done := make(chan error, 1)
-	go func() {
-		done <- imapClient.UidFetch(seqset, items, messageChans)
-	}()
-	if err := <-done; err != nil {
-		panic(err)
+	opts := &batch.Options{
+		Progress: func(p batch.Progress) {
+			log.Ctx(ctx).Info().
+				Int("chunk", p.ChunksDone).
+				Int("chunks", p.Chunks).
+				Int("messages", p.Messages).
+				Int("retries", p.Retries).
+				Msg("Fetched chunk")
+		},
 	}
-
-	// Print the messages
-	for msg := range messageChans {
-		if msg == nil {
-			log.Ctx(ctx).Fatal().Msg("Server didn't returned message")
-		} else if msg.Envelope == nil {
+	err = batch.FetchV1(imapClient, uids, items, opts, func(msg *imap.Message) error {
+		if msg.Envelope == nil {
 			log.Ctx(ctx).Fatal().Msg("Server didn't returned message envelope")
 		}
-		log.Ctx(ctx).Info().Msgf("MessageId: %s", msg.Envelope.MessageId)
-		log.Ctx(ctx).Info().Msgf("Date: %s", msg.Envelope.Date)
-		log.Ctx(ctx).Info().Msgf("From: %v", msg.Envelope.From)
-		log.Ctx(ctx).Info().Msgf("Sender: %v", msg.Envelope.Sender)
-		log.Ctx(ctx).Info().Msgf("To: %v", msg.Envelope.To)
-		log.Ctx(ctx).Info().Msgf("Cc: %v", msg.Envelope.Cc)
-		log.Ctx(ctx).Info().Msgf("Bcc: %v", msg.Envelope.Bcc)
-		log.Ctx(ctx).Info().Msgf("ReplyTo: %v", msg.Envelope.ReplyTo)
-		log.Ctx(ctx).Info().Msgf("Subject: %s", msg.Envelope.Subject)
+		log.Ctx(ctx).Info().EmbedObject(envelope.FromV1(msg.Envelope)).Msg("Envelope")
 
 		log.Ctx(ctx).Info().Strs("flags", msg.Flags).Msg("List flags")
+		return nil
+	})
+	if err != nil {
+		panic(err)
 	}
 	// Logout
 	err = imapClient.Logout()
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/mbox"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/mbox/main.go export -folder INBOX -since 2024-01-01 -o inbox.mbox
+//	go run benchmark/mbox/main.go export -folder Archive -from alice@example.com -flagged -o alice.mbox
+//	go run benchmark/mbox/main.go import -folder Restored inbox.mbox
+//
+// export writes a folder, or the messages of it that match the search
+// flags, to an mboxrd file with flags in Status/X-Status/X-Keywords and
+// INTERNALDATE in the From line. import APPENDs the messages of an mbox
+// file to a folder, creating it, with their flags and dates. It saves a
+// checkpoint next to the file (-checkpoint to move it) after every message;
+// run the same command again after a crash or Ctrl-C to continue where it
+// stopped. go test ./internal/mbox round-trips a folder through both on a
+// local fake server.
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "export" && os.Args[1] != "import") {
+		fmt.Fprintln(os.Stderr, "usage: main.go export|import [flags]")
+		os.Exit(2)
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	folderName := fs.String("folder", "INBOX", "folder to export from or import into")
+	out := fs.String("o", "", "mbox file to write (export; default stdout)")
+	checkpoint := fs.String("checkpoint", "", "checkpoint file (import; default <mbox>.checkpoint)")
+	since := fs.String("since", "", "export messages received on or after this date (2006-01-02)")
+	before := fs.String("before", "", "export messages received before this date (2006-01-02)")
+	from := fs.String("from", "", "export messages whose From contains this")
+	to := fs.String("to", "", "export messages whose To contains this")
+	subject := fs.String("subject", "", "export messages whose Subject contains this")
+	text := fs.String("text", "", "export messages containing this in the header or body")
+	flagged := fs.Bool("flagged", false, "export flagged messages only")
+	unseen := fs.Bool("unseen", false, "export unread messages only")
+	fs.Parse(os.Args[2:]) //nolint:errcheck // ExitOnError
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx, stop := signal.NotifyContext(logger.WithContext(context.Background()), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	c, err := cfg.Dial()
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to connect")
+	}
+	defer c.Logout() //nolint:errcheck
+
+	start := time.Now()
+	if cmd == "export" {
+		criteria := &imap.SearchCriteria{}
+		for _, d := range []struct {
+			value string
+			field *time.Time
+		}{{*since, &criteria.Since}, {*before, &criteria.Before}} {
+			if d.value == "" {
+				continue
+			}
+			if *d.field, err = time.Parse(time.DateOnly, d.value); err != nil {
+				log.Ctx(ctx).Fatal().Err(err).Msg("Bad date")
+			}
+		}
+		for key, value := range map[string]string{"From": *from, "To": *to, "Subject": *subject} {
+			if value != "" {
+				criteria.Header = append(criteria.Header, imap.SearchCriteriaHeaderField{Key: key, Value: value})
+			}
+		}
+		if *text != "" {
+			criteria.Text = []string{*text}
+		}
+		if *flagged {
+			criteria.Flag = append(criteria.Flag, imap.FlagFlagged)
+		}
+		if *unseen {
+			criteria.NotFlag = append(criteria.NotFlag, imap.FlagSeen)
+		}
+
+		f := os.Stdout
+		if *out != "" {
+			if f, err = os.Create(*out); err != nil {
+				log.Ctx(ctx).Fatal().Err(err).Msg("Failed to create mbox file")
+			}
+			defer f.Close()
+		}
+		w := mbox.NewWriter(f)
+		n, err := mbox.Export(ctx, c, *folderName, w, &mbox.ExportOptions{
+			Criteria: criteria,
+			Progress: func(done, total int) {
+				if done%500 == 0 || done == total {
+					log.Ctx(ctx).Info().Str("folderName", *folderName).Int("done", done).Int("total", total).Msg("Exporting")
+				}
+			},
+		})
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+		if err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Export failed")
+		}
+		log.Ctx(ctx).Info().Str("folderName", *folderName).Int("messages", n).Dur("elapsed", time.Since(start)).Msg("Export done")
+		return
+	}
+
+	if fs.NArg() != 1 {
+		log.Ctx(ctx).Fatal().Msg("import needs one mbox file")
+	}
+	path := fs.Arg(0)
+	if *checkpoint == "" {
+		*checkpoint = path + ".checkpoint"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to open mbox file")
+	}
+	defer f.Close()
+	last := time.Now()
+	res, err := mbox.Import(ctx, c, *folderName, f, &mbox.ImportOptions{
+		Checkpoint: *checkpoint,
+		Create:     true,
+		Progress: func(p mbox.Progress) {
+			if time.Since(last) < 2*time.Second && p.Offset < p.Size {
+				return
+			}
+			last = time.Now()
+			log.Ctx(ctx).Info().
+				Str("folderName", *folderName).
+				Int("imported", p.Imported).
+				Str("done", fmt.Sprintf("%.1f%%", 100*float64(p.Offset)/float64(max(p.Size, 1)))).
+				Msg("Importing")
+		},
+	})
+	if errors.Is(err, context.Canceled) {
+		log.Ctx(ctx).Warn().Int("imported", res.Imported).Str("checkpoint", *checkpoint).Msg("Import stopped; run again to resume")
+		return
+	}
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Str("checkpoint", *checkpoint).Msg("Import failed; run again to resume")
+	}
+	log.Ctx(ctx).Info().
+		Str("folderName", *folderName).
+		Int("imported", res.Imported).
+		Int("resumed", res.Resumed).
+		Dur("elapsed", time.Since(start)).
+		Msg("Import done")
+}
@@ -3,25 +3,19 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"errors"
-	"io"
 	"os"
-	"regexp"
-	"strings"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-message"
-	"github.com/emersion/go-message/mail"
 	"github.com/google/uuid"
+	"github.com/quzhi1/imap-playground/internal/body"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/parser"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var (
-	contentTypeRegex = regexp.MustCompile(".*name=\"(\\S+)\"")
-	multipartError   = "multipart:"
-	encodingError    = "encoding error"
 	// username = os.Getenv("YAHOO_EMAIL_ADDRESS")
 	// password = os.Getenv("YAHOO_APP_PASSWORD")
 	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
@@ -30,11 +24,9 @@ var (
 
 const (
 	// imapAddress = "imap.mail.yahoo.com:993"
-	imapAddress          = "imap.mail.me.com:993"
-	folderName           = "INBOX"
-	HTMLContentType      = "text/html"
-	PlainTextContentType = "text/plain"
-	uid                  = 176
+	imapAddress = "imap.mail.me.com:993"
+	folderName  = "INBOX"
+	uid         = 176
 )
 
 func main() {
@@ -99,7 +91,8 @@ func main() {
 		if msg == nil {
 			log.Ctx(ctx).Fatal().Msg("Server didn't returned message")
 		} else if msg.Envelope != nil {
-			log.Ctx(ctx).Info().Time("date", msg.Envelope.Date).Str("message_id", msg.Envelope.MessageId).Msg("Got message")
+			env := envelope.FromV1(msg.Envelope)
+			log.Ctx(ctx).Info().Time("date", env.Local()).Str("message_id", env.MessageID).Msg("Got message")
 		} else {
 			log.Ctx(ctx).Warn().Msg("Envelope is nil")
 		}
@@ -109,76 +102,52 @@ func main() {
 			log.Ctx(ctx).Fatal().Msg("Server didn't returned message body")
 		}
 
-		// Create a new mail reader
-		mr, err := mail.CreateReader(r)
+		// Parse the message
+		parsed, err := parser.Parse(r)
 		if err != nil {
-			panic(err)
+			log.Ctx(ctx).Warn().Err(err).Msg("Failed to parse the whole message, printing what was parsed")
+		}
+		if parsed == nil {
+			continue
 		}
 
 		// Print email headers
-		headerMap := mr.Header.Header.Map()
-		for key, value := range headerMap {
-			log.Ctx(ctx).Info().Str("key", key).Str("value", strings.Join(value, ",")).Msg("Raw header")
+		for _, field := range parsed.Headers {
+			log.Ctx(ctx).Info().Str("key", field.Key).Str("value", field.Value).Msg("Raw header")
 		}
 
 		// Print some info about the message
-		log.Ctx(ctx).Info().Msgf("MessageId: %s", msg.Envelope.MessageId)
-		log.Ctx(ctx).Info().Msgf("Date: %s", msg.Envelope.Date)
-		log.Ctx(ctx).Info().Msgf("From: %v", msg.Envelope.From)
-		log.Ctx(ctx).Info().Msgf("Sender: %v", msg.Envelope.Sender)
-		log.Ctx(ctx).Info().Msgf("To: %v", msg.Envelope.To)
-		log.Ctx(ctx).Info().Msgf("Cc: %v", msg.Envelope.Cc)
-		log.Ctx(ctx).Info().Msgf("Bcc: %v", msg.Envelope.Bcc)
-		log.Ctx(ctx).Info().Msgf("ReplyTo: %v", msg.Envelope.ReplyTo)
-		log.Ctx(ctx).Info().Msgf("Subject: %s", msg.Envelope.Subject)
+		log.Ctx(ctx).Info().EmbedObject(envelope.FromV1(msg.Envelope)).Msg("Envelope")
 
 		log.Ctx(ctx).Info().Strs("flags", msg.Flags).Msg("List flags")
 
 		// Print internal date
 		log.Ctx(ctx).Info().Msgf("InternalDate: %s", msg.InternalDate)
 
-		// Process each message's part
-		for {
-			part, err := mr.NextPart()
-			if errors.Is(err, io.EOF) {
-				break
-			} else if err != nil {
-				shouldBreak := false
-				switch {
-				case message.IsUnknownCharset(err):
-					log.Ctx(ctx).Warn().Err(err).Msg("Ignore unknown charset")
-				case strings.Contains(err.Error(), multipartError):
-					log.Ctx(ctx).Warn().Err(err).Msg("Ignore multipart error")
-					shouldBreak = true
-				case strings.Contains(err.Error(), encodingError):
-					log.Ctx(ctx).Warn().Err(err).Msg("Ignore encoding error")
-					shouldBreak = true
-				default:
-					log.Ctx(ctx).Error().Err(err).Msg("Error reading message part")
-					panic(err)
-				}
-
-				if shouldBreak {
-					break
-				}
-			}
-
-			switch partHeader := part.Header.(type) {
-			case *mail.InlineHeader:
-				contentType := partHeader.Header.Header.Get("Content-Type")
-				switch {
-				case strings.Contains(contentType, PlainTextContentType):
-					textBody := readerToString(ctx, part.Body)
-					log.Ctx(ctx).Debug().Str("text", textBody).Msg("Found text body")
-				case strings.Contains(contentType, HTMLContentType):
-					htmlBody := readerToString(ctx, part.Body)
-					log.Ctx(ctx).Debug().Str("html", htmlBody).Msg("Found html body")
-				default:
-					printAttachment(ctx, partHeader.Header, part)
-				}
-			case *mail.AttachmentHeader:
-				printAttachment(ctx, partHeader.Header, part)
-			}
+		// Print bodies and attachments
+		for _, warning := range parsed.Warnings {
+			log.Ctx(ctx).Warn().Str("warning", warning).Msg("Parser warning")
+		}
+		if parsed.Text != "" {
+			log.Ctx(ctx).Debug().Str("text", parsed.Text).Msg("Found text body")
+		}
+		if parsed.HTML != "" {
+			log.Ctx(ctx).Debug().Str("html", body.HTMLToText(parsed.HTML)).Msg("Found html body")
+		}
+		cleaned := body.FromMessage(parsed)
+		log.Ctx(ctx).Info().
+			Str("new", cleaned.New).
+			Str("signature", cleaned.Signature).
+			Int("quotedLength", len(cleaned.Quoted)).
+			Msg("New text of the message")
+		for _, cal := range parsed.Calendars {
+			printCalendar(ctx, cal)
+		}
+		for _, attachment := range parsed.Attachments {
+			printAttachment(ctx, attachment)
+		}
+		for _, attachment := range parsed.Inline {
+			printAttachment(ctx, attachment)
 		}
 	}
 
@@ -208,58 +177,43 @@ func listFolder(ctx context.Context, client *client.Client) []imap.MailboxInfo {
 	return result
 }
 
-func printAttachment(ctx context.Context, header message.Header, part *mail.Part) {
-	contentType := header.Header.Get("Content-Type")
-
+func printAttachment(ctx context.Context, attachment *parser.Attachment) {
 	// Get or generate file ID
-	var fileID string
-	if header.Header.Has("X-Attachment-Id") {
-		fileID = header.Header.Get("X-Attachment-Id")
-	} else {
+	fileID := attachment.AttachmentID
+	if fileID == "" {
 		fileID = uuid.New().String()
 	}
 
-	// Read file name
-	var fileName string
-	match := contentTypeRegex.FindStringSubmatch(contentType)
-	if match != nil {
-		// Extract the captured string from the first submatch
-		fileName = match[1]
-	} else {
-		log.Ctx(ctx).Warn().
-			Str("content_type", contentType).
-			Str("file_id", fileID).
-			Msg("Attachment has file name in Content-Type header, setting it to empty")
-	}
-
-	// Read content disposition
-	var contentDisposition string
-	if header.Header.Has("Content-Disposition") {
-		contentDisposition = header.Header.Get("Content-Disposition")
-	} else {
-		log.Ctx(ctx).Warn().
-			Str("content_type", contentType).
-			Str("file_id", fileID).
-			Msg("Attachment has no Content-Disposition header, setting it to empty")
-	}
-
-	// Read file content
-	content := readerToString(ctx, part.Body)
 	log.Ctx(ctx).Debug().
-		Str("content_type", contentType).
+		Str("content_type", attachment.ContentType).
 		Str("file_id", fileID).
-		Str("file_name", fileName).
-		Str("content_disposition", contentDisposition).
-		Str("content", content).
+		Str("file_name", attachment.Filename).
+		Str("content_disposition", attachment.ContentDisposition).
+		Str("content_id", attachment.ContentID).
+		Int64("size", attachment.Size).
 		Msg("Found attachment")
 }
 
-func readerToString(ctx context.Context, reader io.Reader) string {
-	buf := new(strings.Builder)
-	_, err := io.Copy(buf, reader)
-	if err != nil {
-		log.Ctx(ctx).Error().Err(err).Msg("Failed to read file content, setting it to empty")
-
+func printCalendar(ctx context.Context, cal *parser.PartCalendar) {
+	for _, event := range cal.Events {
+		logEvent := log.Ctx(ctx).Info().
+			Str("part", cal.Part).
+			Str("method", cal.Method).
+			Str("uid", event.UID).
+			Str("summary", event.Summary).
+			Str("status", event.Status)
+		if event.Start != nil {
+			logEvent = logEvent.Time("start", event.Start.Time)
+		}
+		if event.Organizer != nil {
+			logEvent = logEvent.Str("organizer", event.Organizer.Email)
+		}
+		logEvent.Int("attendees", len(event.Attendees)).Msg("Found calendar event")
+		for _, attendee := range event.Attendees {
+			log.Ctx(ctx).Debug().Str("email", attendee.Email).Str("partstat", attendee.PartStat).Msg("  Attendee")
+		}
+	}
+	for _, warning := range cal.Warnings {
+		log.Ctx(ctx).Warn().Str("part", cal.Part).Msg("Calendar: " + warning)
 	}
-	return buf.String()
 }
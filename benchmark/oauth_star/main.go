@@ -6,6 +6,7 @@ import (
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-sasl"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"os"
@@ -106,6 +107,6 @@ func main() {
 
 	// Print the messages
 	for msg := range messageChans {
-		log.Ctx(ctx).Info().Strs("flags", msg.Flags).Str("subject", msg.Envelope.Subject).Msg("Reading message")
+		log.Ctx(ctx).Info().Strs("flags", msg.Flags).Str("subject", envelope.NormalizeSubject(msg.Envelope.Subject)).Msg("Reading message")
 	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/parser"
+	"github.com/quzhi1/imap-playground/internal/secure"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+	// passphrase unlocks the PGP secret keys in -keys.
+	passphrase = os.Getenv("PGP_PASSPHRASE")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/parse/main.go -eml message.eml
+//	go run benchmark/parse/main.go -folder INBOX -uid 176
+//	go run benchmark/parse/main.go -dir internal/parser/testdata/broken
+//	go run benchmark/parse/main.go -eml signed.eml -trust ./trust -keys ./keys
+//	go run benchmark/parse/main.go -eml invite.eml -calendars
+func main() {
+	emlPath := flag.String("eml", "", "parse this .eml file instead of fetching from the server")
+	dir := flag.String("dir", "", "parse every .eml file in this directory and report what was salvaged")
+	folderName := flag.String("folder", "INBOX", "folder to fetch from")
+	uid := flag.Uint("uid", 0, "UID of the message to fetch")
+	trustDir := flag.String("trust", "", "directory of trusted root certificates (.pem) and PGP public keys (.asc)")
+	keyDir := flag.String("keys", "", "directory of S/MIME certificates with private keys (.pem) and PGP secret keys (.asc) for decryption")
+	calendars := flag.Bool("calendars", false, "print only the calendar events of the message")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	secureConfig, err := secure.Load(*trustDir, *keyDir, []byte(passphrase))
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to load trust store and keys")
+	}
+	opts := &parser.Options{Secure: secureConfig}
+
+	if *dir != "" {
+		if err := parseDir(ctx, *dir, opts); err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Failed to parse directory")
+		}
+		return
+	}
+
+	var parsed *parser.Message
+	switch {
+	case *emlPath != "":
+		parsed, err = parseFile(*emlPath, opts)
+	case *uid != 0:
+		parsed, err = parseLive(ctx, *folderName, imap.UID(*uid), opts)
+	default:
+		log.Ctx(ctx).Fatal().Msg("Pass either -eml or -uid")
+	}
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Message was only partially parsed")
+	}
+	if parsed == nil {
+		os.Exit(1)
+	}
+
+	var out any = parsed
+	if *calendars {
+		out = parsed.Calendars
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(out); err != nil {
+		panic(err)
+	}
+}
+
+func parseFile(path string, opts *parser.Options) (*parser.Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parser.ParseWithOptions(f, opts)
+}
+
+// parseDir parses every .eml file in dir and logs how much of each message
+// survived and which problems the parser worked around.
+func parseDir(ctx context.Context, dir string, opts *parser.Options) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		parsed, err := parseFile(path, opts)
+		if parsed == nil {
+			log.Ctx(ctx).Error().Err(err).Str("file", path).Msg("Nothing salvaged")
+			continue
+		}
+		log.Ctx(ctx).Info().
+			Err(err).
+			Str("file", filepath.Base(path)).
+			Str("subject", parsed.Subject).
+			Int("textLength", len(parsed.Text)).
+			Int("htmlLength", len(parsed.HTML)).
+			Int("attachments", len(parsed.Attachments)+len(parsed.Inline)).
+			Int("problems", len(parsed.Problems)).
+			Msg("Parsed")
+		for _, attachment := range parsed.Attachments {
+			log.Ctx(ctx).Info().Str("filename", attachment.Filename).Int64("size", attachment.Size).Msg("  Attachment")
+		}
+		for _, sec := range parsed.Security {
+			event := log.Ctx(ctx).Info().Str("part", sec.Part).Str("type", sec.Type).Bool("decrypted", sec.Decrypted)
+			if sec.Signature != nil {
+				event = event.Str("status", string(sec.Signature.Status)).Str("signer", sec.Signature.Signer.Email)
+			}
+			event.Str("error", sec.Error).Msg("  Security")
+		}
+		for _, problem := range parsed.Problems {
+			log.Ctx(ctx).Warn().Str("part", problem.Part).Str("contentType", problem.ContentType).Msg("  " + problem.Problem)
+		}
+	}
+	return nil
+}
+
+func parseLive(ctx context.Context, folderName string, uid imap.UID, opts *parser.Options) (*parser.Message, error) {
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	imapClient, err := cfg.Dial()
+	if err != nil {
+		return nil, err
+	}
+	log.Ctx(ctx).Debug().Str("username", username).Msg("Logged in to IMAP server")
+
+	// defer logout
+	defer func() {
+		if err := imapClient.Logout().Wait(); err != nil {
+			log.Ctx(ctx).Error().Err(err).Msg("Error logging out of IMAP server")
+		}
+	}()
+
+	if _, err := imapClient.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return nil, err
+	}
+
+	fetchCmd := imapClient.Fetch(imap.UIDSetNum(uid), &imap.FetchOptions{
+		UID:         true,
+		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+	})
+
+	// Parse the literal while the fetch stream is still active
+	var parsed *parser.Message
+	var parseErr error
+	for msg := fetchCmd.Next(); msg != nil; msg = fetchCmd.Next() {
+		for item := msg.Next(); item != nil; item = msg.Next() {
+			if body, ok := item.(imapclient.FetchItemDataBodySection); ok {
+				parsed, parseErr = parser.ParseWithOptions(body.Literal, opts)
+			}
+		}
+	}
+	if err := fetchCmd.Close(); err != nil {
+		return nil, err
+	}
+	if parsed == nil && parseErr == nil {
+		log.Ctx(ctx).Warn().Str("folderName", folderName).Uint32("uid", uint32(uid)).Msg("No message fetched")
+	}
+	return parsed, parseErr
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 )
 
 // var imapAddress = "imap.mail.yahoo.com:993"
@@ -109,6 +110,7 @@ func search(username, password string) {
 			log.Printf("Server didn't returned message")
 			break
 		}
-		log.Printf("MessageId: %s, subject: %s, date: %d", msg.Envelope.MessageId, msg.Envelope.Subject, msg.Envelope.Date.Unix())
+		env := envelope.FromV1(msg.Envelope)
+		log.Printf("MessageId: %s, subject: %s, date: %s", env.MessageID, env.Subject, env.Local().Format(time.RFC3339))
 	}
 }
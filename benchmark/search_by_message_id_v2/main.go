@@ -7,6 +7,7 @@ import (
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -109,4 +110,5 @@ func main() {
 		log.Ctx(ctx).Warn().Msg("No messages fetched")
 		return
 	}
+	log.Ctx(ctx).Info().EmbedObject(envelope.FromV2(fetchedMsgs[0].Envelope)).Msg("Fetched message")
 }
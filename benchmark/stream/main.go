@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/quzhi1/imap-playground/internal/stream"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/stream/main.go -folder INBOX -min-size 10 -n 5
+//
+// Fetches the most recent messages larger than -min-size MB through
+// stream.Fetch in one FETCH, and reports for each how many parts spilled to
+// disk, and overall how long it took and how far the heap grew. The same
+// fetch on generated messages, with the spilled bodies checked byte for
+// byte, runs in go test ./internal/stream.
+func main() {
+	folderName := flag.String("folder", "INBOX", "folder to fetch from")
+	minSizeMB := flag.Int64("min-size", 10, "only fetch messages larger than this many MB")
+	count := flag.Int("n", 5, "number of most recent large messages")
+	memoryLimit := flag.Int64("limit", stream.DefaultMemoryLimit, "bytes of one part kept in memory before spilling")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx := logger.WithContext(context.Background())
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+
+	opts := &stream.Options{MemoryLimit: *memoryLimit}
+	if err := run(ctx, cfg, *folderName, *minSizeMB<<20, *count, opts); err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Streaming benchmark failed")
+	}
+}
+
+func run(ctx context.Context, cfg session.Config, folderName string, minSize int64, count int, opts *stream.Options) error {
+	c, err := cfg.Dial()
+	if err != nil {
+		return err
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(folderName, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return err
+	}
+	data, err := c.UIDSearch(&imap.SearchCriteria{Larger: minSize}, nil).Wait()
+	if err != nil {
+		return err
+	}
+	uids := data.AllUIDs()
+	if len(uids) > count {
+		uids = uids[len(uids)-count:]
+	}
+	if len(uids) == 0 {
+		log.Ctx(ctx).Info().Str("folderName", folderName).Int64("minSize", minSize).Msg("No message that large")
+		return nil
+	}
+
+	stop := watchHeap()
+	start := time.Now()
+	var total int64
+	err = stream.Fetch(c, imap.UIDSetNum(uids...), opts, func(msg *stream.Message) error {
+		total += msg.Size
+		spilled := 0
+		for _, part := range msg.Parts {
+			if part.Spilled() {
+				spilled++
+			}
+		}
+		log.Ctx(ctx).Info().
+			Uint32("uid", uint32(msg.UID)).
+			Int64("literalBytes", msg.Size).
+			Int("parts", len(msg.Parts)).
+			Int("spilled", spilled).
+			Int("problems", len(msg.Parsed.Problems)).
+			Msg("Fetched message")
+		return nil
+	})
+	elapsed := time.Since(start)
+	growth := stop()
+	if err != nil {
+		return err
+	}
+	log.Ctx(ctx).Info().
+		Int("messages", len(uids)).
+		Int64("bytes", total).
+		Dur("elapsed", elapsed).
+		Uint64("heapGrowthMB", growth>>20).
+		Msg("Fetched every message")
+	return nil
+}
+
+// watchHeap samples the heap until stop is called. stop returns how far the
+// heap grew above where it was when watching started.
+func watchHeap() (stop func() uint64) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	var peak atomic.Uint64
+	peak.Store(baseline)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak.Load() {
+					peak.Store(stats.HeapAlloc)
+				}
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-finished
+		return peak.Load() - baseline
+	}
+}
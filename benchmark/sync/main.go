@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/maildir"
+	"github.com/quzhi1/imap-playground/internal/mailsync"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	username = os.Getenv("ICLOUD_EMAIL_ADDRESS")
+	password = os.Getenv("ICLOUD_APP_PASSWORD")
+)
+
+const (
+	imapAddress = "imap.mail.me.com:993"
+)
+
+// Usage:
+//
+//	go run benchmark/sync/main.go -state ./sync-state
+//	go run benchmark/sync/main.go -state ./sync-state -folders INBOX,Archive
+//	go run benchmark/sync/main.go -state ./sync-state -flags
+//	go run benchmark/sync/main.go -state ./sync-state -flags -maildir ./mail
+//	go run benchmark/sync/main.go -state ./sync-state -c 4
+//	go run benchmark/sync/main.go -policy policy.json -dry-run
+//	go run benchmark/sync/main.go -state ./sync-state -policy policy.json
+//
+// Syncs the account incrementally: the state directory keeps UIDVALIDITY,
+// UIDNEXT and the known UIDs of each folder, so a run fetches only new
+// messages and lists the expunged ones. Run it twice against the same
+// state to see the second run fetch nothing; internal/mailsync's tests
+// cover new mail, expunges and recreated folders on a local fake server.
+// With -maildir the messages are stored in a Maildir++ tree instead of
+// logged; keep the same -state with the same -maildir.
+// With -c the folders are spread over that many connections, INBOX and
+// recently changed folders first, and the report times each folder.
+// -policy reads a sync policy (see mailsync.Policy) that picks folders and
+// messages; -dry-run prints what it would do with each folder, with
+// message counts, and syncs nothing. A checkpoint is saved after every
+// chunk of new messages, so a run that is killed or interrupted (Ctrl-C,
+// SIGTERM) resumes where it stopped when run again with the same -state.
+func main() {
+	stateDir := flag.String("state", "./sync-state", "state directory")
+	folders := flag.String("folders", "", "comma-separated folders to sync (default: all)")
+	syncFlags := flag.Bool("flags", false, "sync the flags of known messages too (CONDSTORE when advertised)")
+	maildirPath := flag.String("maildir", "", "store messages in this Maildir++ directory instead of logging them")
+	delim := flag.String("delim", "/", "the server's hierarchy delimiter, used to nest Maildir++ folders")
+	concurrency := flag.Int("c", 1, "maximum number of IMAP connections")
+	policyFile := flag.String("policy", "", "JSON sync policy (default: every message of every folder)")
+	dryRun := flag.Bool("dry-run", false, "print the plan for each folder and exit without syncing")
+	flag.Parse()
+
+	// Init logger
+	logger := zerolog.
+		New(os.Stdout).
+		With().
+		Timestamp().
+		Logger().
+		Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	ctx, stop := signal.NotifyContext(logger.WithContext(context.Background()), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cfg := session.Config{
+		Address:  imapAddress,
+		Username: username,
+		Password: password,
+	}
+	store, err := mailsync.OpenStore(*stateDir)
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Failed to open state directory")
+	}
+
+	opts := &mailsync.Options{Flags: *syncFlags, Concurrency: *concurrency}
+	if *folders != "" {
+		opts.Folders = strings.Split(*folders, ",")
+	}
+	if *policyFile != "" {
+		if opts.Policy, err = mailsync.LoadPolicy(*policyFile); err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Bad sync policy")
+		}
+	}
+	if *dryRun {
+		plans, err := mailsync.Plan(ctx, cfg.Dial, opts)
+		if err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Failed to plan sync")
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(plans); err != nil {
+			panic(err)
+		}
+		return
+	}
+	var handler mailsync.Handler = &logHandler{ctx: ctx}
+	if *maildirPath != "" {
+		md, err := maildir.Open(*maildirPath, &maildir.Options{Delimiter: *delim})
+		if err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Failed to open Maildir")
+		}
+		defer md.Close()
+		handler = md
+		opts.Fetch = maildir.FetchOptions
+	}
+	run(ctx, cfg, store, handler, opts)
+}
+
+// run syncs once and prints the report.
+func run(ctx context.Context, cfg session.Config, store *mailsync.Store, handler mailsync.Handler, opts *mailsync.Options) {
+	start := time.Now()
+	report, err := mailsync.Sync(ctx, cfg.Dial, store, handler, opts)
+	if errors.Is(err, context.Canceled) {
+		log.Ctx(ctx).Warn().Str("state", store.Dir()).Msg("Interrupted; run again with the same state to resume")
+		return
+	}
+	if err != nil {
+		log.Ctx(ctx).Fatal().Err(err).Msg("Sync failed")
+	}
+	for _, f := range report.Folders {
+		log.Ctx(ctx).Info().
+			Str("folderName", f.Folder).
+			Bool("full", f.Full).
+			Bool("unchanged", f.Unchanged).
+			Int("new", f.New).
+			Int("expunged", f.Expunged).
+			Int("resumed", f.Resumed).
+			Int("skipped", f.Skipped).
+			Int("flagsChanged", f.FlagsChanged).
+			Bool("condstore", f.CondStore).
+			Msg("Synced folder")
+	}
+	for name, reason := range report.Failed {
+		log.Ctx(ctx).Warn().Str("folderName", name).Str("error", reason).Msg("Folder not synced")
+	}
+	for name, reason := range report.Skipped {
+		log.Ctx(ctx).Info().Str("folderName", name).Str("reason", reason).Msg("Folder skipped by policy")
+	}
+	for _, t := range report.Timings {
+		log.Ctx(ctx).Debug().
+			Str("folderName", t.Folder).
+			Int("conn", t.Conn).
+			Int64("startedMs", t.StartedMS).
+			Int64("elapsedMs", t.ElapsedMS).
+			Msg("Folder timing")
+	}
+	log.Ctx(ctx).Info().
+		Str("state", store.Dir()).
+		Int("connections", report.Connections).
+		Dur("elapsed", time.Since(start)).
+		Msg("Sync done")
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		panic(err)
+	}
+}
+
+// logHandler logs what the sync finds instead of storing it.
+type logHandler struct {
+	ctx context.Context
+}
+
+func (h *logHandler) Reset(folder string) error {
+	log.Ctx(h.ctx).Info().Str("folderName", folder).Msg("Dropping local copy of folder")
+	return nil
+}
+
+func (h *logHandler) Message(folder string, msg *imapclient.FetchMessageBuffer) error {
+	event := log.Ctx(h.ctx).Debug().Str("folderName", folder).Uint32("uid", uint32(msg.UID))
+	if msg.Envelope != nil {
+		event = event.EmbedObject(envelope.FromV2(msg.Envelope))
+	}
+	event.Msg("New message")
+	return nil
+}
+
+func (h *logHandler) Expunged(folder string, uids []imap.UID) error {
+	log.Ctx(h.ctx).Debug().Str("folderName", folder).Any("uids", uids).Msg("Expunged messages")
+	return nil
+}
+
+func (h *logHandler) Flags(folder string, uid imap.UID, flags []imap.Flag) error {
+	log.Ctx(h.ctx).Debug().Str("folderName", folder).Uint32("uid", uint32(uid)).Any("flags", flags).Msg("Flags changed")
+	return nil
+}
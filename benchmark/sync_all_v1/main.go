@@ -8,6 +8,8 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/quzhi1/imap-playground/internal/batch"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -107,8 +109,6 @@ func loadMsgs(ctx context.Context, imapClient *client.Client, uids []uint32) {
 	if len(uids) == 0 {
 		return
 	}
-	seqset := new(imap.SeqSet)
-	seqset.AddNum(uids...)
 	section := imap.BodySectionName{Peek: true}
 	items := []imap.FetchItem{
 		imap.FetchEnvelope,
@@ -116,20 +116,22 @@ func loadMsgs(ctx context.Context, imapClient *client.Client, uids []uint32) {
 		imap.FetchInternalDate,
 		section.FetchItem(),
 	}
-	messageChans := make(chan *imap.Message, 10000)
-	done := make(chan error, 1)
-	go func() {
-		done <- imapClient.UidFetch(seqset, items, messageChans)
-	}()
-	if err := <-done; err != nil {
-		panic(err)
+	opts := &batch.Options{
+		// Whole bodies, so keep chunks small
+		ChunkSize: 100,
+		Progress: func(p batch.Progress) {
+			log.Ctx(ctx).Debug().
+				Int("chunk", p.ChunksDone).
+				Int("chunks", p.Chunks).
+				Int("messages", p.Messages).
+				Int("retries", p.Retries).
+				Msg("Fetched chunk")
+		},
 	}
-	// Print the messages
-	for msg := range messageChans {
-		if msg == nil {
-			log.Ctx(ctx).Fatal().Msg("Server didn't returned message")
-		} else if msg.Envelope != nil {
-			log.Ctx(ctx).Info().Time("date", msg.Envelope.Date).Str("message_id", msg.Envelope.MessageId).Msg("Got message")
+	err := batch.FetchV1(imapClient, uids, items, opts, func(msg *imap.Message) error {
+		env := envelope.FromV1(msg.Envelope)
+		if env != nil {
+			log.Ctx(ctx).Info().Time("date", env.Local()).Str("message_id", env.MessageID).Msg("Got message")
 		} else {
 			log.Ctx(ctx).Warn().Msg("Envelope is nil")
 		}
@@ -139,6 +141,12 @@ func loadMsgs(ctx context.Context, imapClient *client.Client, uids []uint32) {
 			log.Ctx(ctx).Fatal().Msg("Server didn't returned message body")
 		}
 
-		log.Ctx(ctx).Info().Msgf("Subject: %s", msg.Envelope.Subject)
+		if env != nil {
+			log.Ctx(ctx).Info().Msgf("Subject: %s", env.Subject)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
 	}
 }
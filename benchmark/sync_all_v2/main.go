@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"flag"
 	"os"
 	"reflect"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/mailsync"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -26,7 +29,32 @@ const (
 	encodingError        = "encoding error"
 )
 
+// defaultPolicy is what this program always did: every folder, messages
+// sent in the last 90 days.
+var defaultPolicy = &mailsync.Policy{Rule: mailsync.Rule{Window: &mailsync.Window{Days: 90}}}
+
+// Usage:
+//
+//	go run benchmark/sync_all_v2/main.go
+//	go run benchmark/sync_all_v2/main.go -policy policy.json -dry-run
+//	go run benchmark/sync_all_v2/main.go -policy policy.json
+//
+// Fetches every folder's messages within the sync policy, by default
+// those sent in the last 90 days. A policy file (see mailsync.Policy) can
+// change the window, search by INTERNALDATE, skip or fetch only headers
+// of Junk and Trash, filter folders and cap message sizes. -dry-run logs
+// what the policy would do with each folder and how many messages it
+// would take, and fetches nothing. A folder that cannot be selected or
+// searched is logged and skipped.
+//
+// Every run starts from zero over one connection. benchmark/sync applies
+// the same policy through mailsync.Sync, which keeps state between runs,
+// resumes after a crash and uses several connections.
 func main() {
+	policyFile := flag.String("policy", "", "JSON sync policy (default: messages sent in the last 90 days)")
+	dryRun := flag.Bool("dry-run", false, "log the plan for each folder and exit without fetching")
+	flag.Parse()
+
 	// Init logger
 	logger := zerolog.
 		New(os.Stdout).
@@ -36,6 +64,14 @@ func main() {
 		Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	ctx := logger.WithContext(context.Background())
 
+	policy := defaultPolicy
+	if *policyFile != "" {
+		var err error
+		if policy, err = mailsync.LoadPolicy(*policyFile); err != nil {
+			log.Ctx(ctx).Fatal().Err(err).Msg("Bad sync policy")
+		}
+	}
+
 	// Connect to imap server
 	// Default method.
 	log.Ctx(ctx).Debug().Str("imapAddress", imapAddress).Msg("Connecting to IMAP server")
@@ -89,21 +125,46 @@ func main() {
 		panic(err)
 	}
 
+	now := time.Now()
 	for _, folder := range folders {
+		plan := policy.Folder(folder, now)
+		if plan.Skip != "" {
+			log.Ctx(ctx).Info().Str("folderName", folder.Mailbox).Str("reason", plan.Skip).Msg("Skipping folder")
+			continue
+		}
+
 		// Select folder
-		_, err := imapClient.Select(folder.Mailbox, &imap.SelectOptions{
+		selected, err := imapClient.Select(folder.Mailbox, &imap.SelectOptions{
 			ReadOnly: true,
 		}).Wait()
 		if err != nil {
-			panic("error selecting " + folder.Mailbox + " " + err.Error())
+			log.Ctx(ctx).Warn().Err(err).Str("folderName", folder.Mailbox).Msg("Failed to select folder, skipping it")
+			continue
 		}
 
-		// Search for messages in the last 7 days
-		uids := searchOneFolder(ctx, imapClient, folder.Mailbox)
+		// Search for the messages the policy takes
+		uids, err := searchOneFolder(ctx, imapClient, plan)
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("folderName", folder.Mailbox).Msg("Failed to search folder, skipping it")
+			continue
+		}
+		if *dryRun {
+			log.Ctx(ctx).Info().
+				Str("folderName", folder.Mailbox).
+				Str("role", string(plan.Role)).
+				Str("search", plan.Search).
+				Str("since", plan.Since).
+				Int64("maxSize", plan.MaxSize).
+				Bool("headersOnly", plan.HeadersOnly).
+				Uint32("messages", selected.NumMessages).
+				Int("matching", len(uids)).
+				Msg("Plan")
+			continue
+		}
 		log.Ctx(ctx).Info().Str("folderName", folder.Mailbox).Any("uids", uids).Msg("Found messages")
 
 		// Load message
-		loadMsgs(ctx, imapClient, uids)
+		loadMsgs(ctx, imapClient, uids, plan.HeadersOnly)
 	}
 
 	// Logout
@@ -114,21 +175,21 @@ func main() {
 	}
 }
 
-func searchOneFolder(ctx context.Context, imapClient *imapclient.Client, folderName string) []imap.UID {
-	// Search for messages in the last 90 days
-	criteria := imap.SearchCriteria{
-		SentSince: time.Now().AddDate(0, 0, -90),
+func searchOneFolder(ctx context.Context, imapClient *imapclient.Client, plan *mailsync.FolderPlan) ([]imap.UID, error) {
+	criteria := plan.Criteria()
+	if criteria == nil {
+		criteria = &imap.SearchCriteria{}
 	}
-	log.Ctx(ctx).Debug().Str("folderName", folderName).Msg("Searching folder")
-	searchResponses, err := imapClient.UIDSearch(&criteria, nil).Wait()
+	log.Ctx(ctx).Debug().Str("folderName", plan.Folder).Msg("Searching folder")
+	searchResponses, err := imapClient.UIDSearch(criteria, nil).Wait()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return searchResponses.AllUIDs()
+	return searchResponses.AllUIDs(), nil
 }
 
-func loadMsgs(ctx context.Context, imapClient *imapclient.Client, uids []imap.UID) {
+func loadMsgs(ctx context.Context, imapClient *imapclient.Client, uids []imap.UID, headersOnly bool) {
 	if len(uids) == 0 {
 		return
 	}
@@ -141,6 +202,9 @@ func loadMsgs(ctx context.Context, imapClient *imapclient.Client, uids []imap.UI
 		UID:         true,
 		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
 	}
+	if headersOnly {
+		fetchOptions.BodySection[0].Specifier = imap.PartSpecifierHeader
+	}
 	fetchCmd := imapClient.Fetch(seqSet, fetchOptions)
 	defer fetchCmd.Close()
 
@@ -161,8 +225,7 @@ func loadMsgs(ctx context.Context, imapClient *imapclient.Client, uids []imap.UI
 			case imapclient.FetchItemDataEnvelope:
 				// log.Ctx(ctx).Debug().Any("from", item.Envelope.From).Msg("Reading envelope")
 				log.Ctx(ctx).Debug().
-					Str("message_id", item.Envelope.MessageID).
-					Str("subject", item.Envelope.Subject).
+					EmbedObject(envelope.FromV2(item.Envelope)).
 					Msg("Reading message ID")
 			case imapclient.FetchItemDataBodySection:
 				// b, err := io.ReadAll(item.Literal)
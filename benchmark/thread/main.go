@@ -3,13 +3,12 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"io"
 	"os"
-	"strings"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-message/mail"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/parser"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -88,22 +87,14 @@ func main() {
 			log.Ctx(ctx).Fatal().Msg("Server didn't returned message body")
 		}
 
-		// Create a new mail reader
-		mr, err := mail.CreateReader(r)
+		// Parse the message
+		parsed, err := parser.Parse(r)
 		if err != nil {
 			panic(err)
 		}
 
 		// Print some info about the message
-		log.Ctx(ctx).Info().Msgf("MessageId: %s", msg.Envelope.MessageId)
-		log.Ctx(ctx).Info().Msgf("Date: %s", msg.Envelope.Date)
-		log.Ctx(ctx).Info().Msgf("From: %v", msg.Envelope.From)
-		log.Ctx(ctx).Info().Msgf("Sender: %v", msg.Envelope.Sender)
-		log.Ctx(ctx).Info().Msgf("To: %v", msg.Envelope.To)
-		log.Ctx(ctx).Info().Msgf("Cc: %v", msg.Envelope.Cc)
-		log.Ctx(ctx).Info().Msgf("Bcc: %v", msg.Envelope.Bcc)
-		log.Ctx(ctx).Info().Msgf("ReplyTo: %v", msg.Envelope.ReplyTo)
-		log.Ctx(ctx).Info().Msgf("Subject: %s", msg.Envelope.Subject)
+		log.Ctx(ctx).Info().EmbedObject(envelope.FromV1(msg.Envelope)).Msg("Envelope")
 
 		log.Ctx(ctx).Info().Strs("flags", msg.Flags).Msg("List flags")
 
@@ -111,38 +102,16 @@ func main() {
 		log.Ctx(ctx).Info().Msgf("InternalDate: %s", msg.InternalDate)
 
 		// References
-		if mr.Header.Has("References") {
-			log.Ctx(ctx).Info().Msgf("References: %v", mr.Header.Get("References"))
+		if len(parsed.References) > 0 {
+			log.Ctx(ctx).Info().Msgf("References: %v", parsed.References)
 		}
 
-		// Process each message's part
-		for {
-			p, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				panic(err)
-			}
-
-			switch h := p.Header.(type) {
-			case *mail.InlineHeader:
-				log.Ctx(ctx).Info().Msgf("Got text Content-Type: %s", h.Header.Header.Get("Content-Type"))
-				// This is the message's text (can be plain-text or HTML)
-				b, _ := io.ReadAll(p.Body)
-				log.Ctx(ctx).Info().Msgf("Got text: %v", string(b))
-			case *mail.AttachmentHeader:
-				// This is an attachment
-				filename, _ := h.Filename()
-				log.Ctx(ctx).Info().Msgf("Got attachment: %v", filename)
-
-				// Print attachment
-				buf := new(strings.Builder)
-				_, err := io.Copy(buf, p.Body)
-				if err != nil {
-					panic(err)
-				}
-				log.Ctx(ctx).Info().Msgf("Attachment: %s", buf.String())
-			}
+		// Print bodies and attachments
+		log.Ctx(ctx).Info().Msgf("Got text: %v", parsed.Text)
+		log.Ctx(ctx).Info().Msgf("Got html: %v", parsed.HTML)
+		for _, attachment := range parsed.Attachments {
+			log.Ctx(ctx).Info().Msgf("Got attachment: %v", attachment.Filename)
+			log.Ctx(ctx).Info().Msgf("Attachment: %s", attachment.Content)
 		}
 	}
 
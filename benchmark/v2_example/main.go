@@ -6,6 +6,7 @@ import (
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/envelope"
 )
 
 func main() {
@@ -83,7 +84,7 @@ func main() {
 		if err != nil {
 			log.Fatalf("failed to fetch first message in Archive: %v", err)
 		}
-		log.Printf("subject of first message in Archive: %v", messages[0].Envelope.Subject)
+		log.Printf("subject of first message in Archive: %v", envelope.FromV2(messages[0].Envelope).Subject)
 	}
 
 	// Search all
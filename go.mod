@@ -5,6 +5,8 @@ go 1.22
 // replace github.com/emersion/go-imap/v2 => ../go-imap
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/emersion/go-ical v0.0.0-20250609112844-439c63cef608
 	github.com/emersion/go-imap v1.2.1
 	github.com/emersion/go-imap/v2 v2.0.0-beta.4
 	github.com/emersion/go-message v0.18.1
@@ -13,11 +15,16 @@ require (
 	github.com/quzhi1/go-imap v1.2.2-0.20231005213635-00463e5d5729
 	github.com/quzhi1/go-sasl v1.0.0
 	github.com/rs/zerolog v1.32.0
+	github.com/smallstep/pkcs7 v0.2.3
+	github.com/teambition/rrule-go v1.8.2
+	golang.org/x/net v0.10.0
+	golang.org/x/text v0.14.0
 )
 
 require (
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 )
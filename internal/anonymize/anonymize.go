@@ -0,0 +1,355 @@
+// Package anonymize strips personal data from a raw message so it can be
+// checked in as a parser fixture. What the parser reacts to is kept byte for
+// byte: boundaries and where they sit, part headers, transfer encodings,
+// line endings, charset labels and non-ASCII bytes, and the damage a broken
+// message has. Addresses become userN@example.com, Message-IDs and
+// Content-IDs are hashed, text is scrambled letter by letter, and the
+// content of non-text parts is masked.
+package anonymize
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+
+	"github.com/quzhi1/imap-playground/internal/envelope"
+)
+
+// Anonymizer rewrites one message. The same address, name or ID maps to the
+// same fake everywhere in it, so threading headers and cid: links still
+// line up.
+type Anonymizer struct {
+	addresses map[string]string
+	names     map[string]string
+	dropped   int
+
+	// Notes lists what someone should look at before the fixture is
+	// committed, such as non-ASCII text that was kept as it was.
+	Notes []string
+}
+
+// New returns an Anonymizer.
+func New() *Anonymizer {
+	return &Anonymizer{
+		addresses: make(map[string]string),
+		names:     make(map[string]string),
+	}
+}
+
+// Message anonymizes a whole raw message.
+func (a *Anonymizer) Message(raw []byte) []byte {
+	out := a.entity(raw)
+	if a.dropped > 0 {
+		a.note("dropped %d header fields (Received, DKIM, X-*, ...)", a.dropped)
+	}
+	return out
+}
+
+// keptFields are copied as they are; they describe structure, not people.
+var keptFields = map[string]bool{
+	"mime-version":              true,
+	"content-transfer-encoding": true,
+	"content-language":          true,
+	"date":                      true,
+	"x-attachment-id":           true,
+}
+
+var addressFields = map[string]bool{
+	"from": true, "to": true, "cc": true, "bcc": true, "reply-to": true, "sender": true,
+	"return-path": true, "delivered-to": true, "resent-from": true, "resent-to": true,
+	"resent-cc": true, "resent-sender": true, "disposition-notification-to": true,
+}
+
+var idFields = map[string]bool{
+	"message-id": true, "in-reply-to": true, "references": true, "content-id": true,
+	"resent-message-id": true,
+}
+
+// entity anonymizes one MIME entity: a message or a body part.
+func (a *Anonymizer) entity(raw []byte) []byte {
+	fields, body := splitHeader(raw)
+	var out bytes.Buffer
+	var mediaType, encoding string
+	var params map[string]string
+	for _, f := range fields {
+		switch f.key {
+		case "content-type":
+			mediaType, params = parseContentType(f.value())
+		case "content-transfer-encoding":
+			encoding = strings.ToLower(strings.TrimSpace(f.value()))
+		}
+		out.Write(a.field(f))
+	}
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	out.Write(a.body(mediaType, params, encoding, body))
+	return out.Bytes()
+}
+
+func (a *Anonymizer) body(mediaType string, params map[string]string, encoding string, body []byte) []byte {
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		return a.multipart(body, params["boundary"])
+	case mediaType == "message/rfc822" && encoding != "base64" && encoding != "quoted-printable":
+		return a.entity(body)
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/ics":
+		return a.text(mediaType, encoding, body)
+	}
+	if encoding == "base64" {
+		if out, ok := a.tnef(body); ok {
+			return out
+		}
+	}
+	return maskBase64(body)
+}
+
+// multipart anonymizes every part between the boundary lines and scrambles
+// the preamble and epilogue. Boundary lines are copied as they are, trailing
+// whitespace included.
+func (a *Anonymizer) multipart(body []byte, boundary string) []byte {
+	dash := "--" + boundary
+	var out, segment bytes.Buffer
+	inPart, closed := false, false
+	flush := func() {
+		if inPart && !closed {
+			out.Write(a.entity(segment.Bytes()))
+		} else {
+			out.Write(scramble(segment.Bytes()))
+		}
+		segment.Reset()
+	}
+	for _, line := range splitLines(body) {
+		trimmed := string(bytes.TrimRight(line, " \t\r\n"))
+		if !closed && (trimmed == dash || trimmed == dash+"--") {
+			flush()
+			out.Write(line)
+			inPart = true
+			closed = trimmed == dash+"--"
+			continue
+		}
+		segment.Write(line)
+	}
+	flush()
+	return out.Bytes()
+}
+
+// text scrambles a text part. Quoted-printable and base64 bodies are decoded
+// first and encoded again the same way, so escapes and line lengths stay
+// valid; a body that does not decode is scrambled or masked in place so its
+// damage survives.
+func (a *Anonymizer) text(mediaType, encoding string, body []byte) []byte {
+	scrambleText := scramble
+	switch mediaType {
+	case "text/html":
+		scrambleText = a.scrambleHTML
+	case "text/calendar", "application/ics":
+		scrambleText = scrambleCalendar
+	}
+	switch encoding {
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err != nil || !validQP(body) {
+			a.note("%s part has damaged quoted-printable, scrambled it in place", mediaType)
+			return scrambleSkipping(body, qpEscape)
+		}
+		a.checkNonASCII(mediaType, decoded)
+		return encodeQP(scrambleText(decoded), lineEnding(body))
+	case "base64":
+		decoded, layout, ok := decodeBase64(body)
+		if !ok {
+			a.note("%s part is not valid base64, masked it instead of scrambling", mediaType)
+			return maskBase64(body)
+		}
+		a.checkNonASCII(mediaType, decoded)
+		return encodeBase64(scrambleText(decoded), layout)
+	default:
+		a.checkNonASCII(mediaType, body)
+		return scrambleText(body)
+	}
+}
+
+func (a *Anonymizer) checkNonASCII(mediaType string, text []byte) {
+	if hasNonASCII(text) {
+		a.note("%s part has non-ASCII text that was kept as it is", mediaType)
+	}
+}
+
+// field rewrites one header field, or drops it.
+func (a *Anonymizer) field(f headerField) []byte {
+	switch {
+	case f.key == "":
+		// The blank line ending the header, or a line that is not a field.
+		return scramble(f.raw)
+	case keptFields[f.key]:
+		return f.raw
+	case f.key == "content-type" || f.key == "content-disposition":
+		return a.params(f.raw)
+	case idFields[f.key]:
+		return f.rewrite(a.ids(f.value()))
+	case addressFields[f.key]:
+		return f.rewrite(a.addressList(f.value()))
+	case f.key == "subject" || f.key == "thread-topic":
+		return f.rewrite(a.subject(f.value()))
+	}
+	a.dropped++
+	return nil
+}
+
+// filenameParam matches name= and filename= parameters, including RFC 2231
+// continuations (filename*0*=) and an unterminated quoted value.
+var filenameParam = regexp.MustCompile(`(?i)([;\s]\s*(?:file)?name(?:\*\d+)?\*?\s*=\s*)("(?:[^"\\]|\\.)*"?|[^;\s]*)`)
+
+// params scrambles the file names in a Content-Type or Content-Disposition
+// field and keeps everything else, folding included.
+func (a *Anonymizer) params(raw []byte) []byte {
+	return filenameParam.ReplaceAllFunc(raw, func(m []byte) []byte {
+		sub := filenameParam.FindSubmatch(m)
+		value := string(sub[2])
+		quoted := strings.HasPrefix(value, `"`)
+		closed := quoted && len(value) > 1 && strings.HasSuffix(value, `"`)
+		value = strings.TrimPrefix(value, `"`)
+		if closed {
+			value = strings.TrimSuffix(value, `"`)
+		}
+		value = a.filename(value, bytes.Contains(sub[1], []byte("*")))
+		if quoted {
+			value = `"` + value
+		}
+		if closed {
+			value += `"`
+		}
+		return append(append([]byte(nil), sub[1]...), value...)
+	})
+}
+
+// filename scrambles a file name but keeps its extension, the charset prefix
+// of an RFC 2231 value and its %XX escapes. winmail.dat is kept: it is what
+// Outlook calls every TNEF part, and the parser goes by it.
+func (a *Anonymizer) filename(name string, extended bool) string {
+	if strings.EqualFold(name, "winmail.dat") {
+		return name
+	}
+	if strings.Contains(name, "=?") {
+		a.note("kept RFC 2047 encoded file name %q", name)
+		return name
+	}
+	prefix := ""
+	if extended {
+		if i := strings.Index(name, "''"); i >= 0 {
+			prefix, name = name[:i+2], name[i+2:]
+		}
+	}
+	ext := ""
+	if i := strings.LastIndexByte(name, '.'); i >= 0 && len(name)-i <= 6 {
+		name, ext = name[:i], name[i:]
+	}
+	return prefix + string(scrambleSkipping([]byte(name), percentEscape)) + ext
+}
+
+// ids replaces every Message-ID in an ID field by a hash of it.
+func (a *Anonymizer) ids(value string) string {
+	ids := envelope.NormalizeMessageIDs(value)
+	if len(ids) == 0 {
+		return string(scramble([]byte(value)))
+	}
+	hashed := make([]string, len(ids))
+	for i, id := range ids {
+		hashed[i] = "<" + hashID(id) + ">"
+	}
+	return strings.Join(hashed, " ")
+}
+
+// hashID returns the fake form of a Message-ID or Content-ID. Both "<id>"
+// and "id" give the same result, so cid: links keep matching their part.
+func hashID(id string) string {
+	sum := sha256.Sum256([]byte(envelope.NormalizeMessageID(id)))
+	return hex.EncodeToString(sum[:6]) + "@example.com"
+}
+
+// addressList replaces every mailbox with userN@example.com and every
+// display name with "Person N". Group syntax is kept. Names that were
+// encoded-words stay encoded, so the fixture still exercises the decoder.
+func (a *Anonymizer) addressList(value string) string {
+	list, err := envelope.ParseAddressList(value)
+	if err != nil {
+		a.note("could not parse every address in %q, scrambled the rest", value)
+		if len(list) == 0 {
+			return string(scramble([]byte(value)))
+		}
+	}
+	encode := strings.Contains(value, "=?")
+	for i, addr := range list {
+		if addr.Address != "" {
+			list[i].Address = a.fake(a.addresses, addr.Address, "user%d@example.com")
+		}
+		if addr.Name != "" {
+			list[i].Name = a.fake(a.names, addr.Name, "Person %d")
+			if encode {
+				// The envelope icon keeps the name non-ASCII, otherwise
+				// Encode would return it unencoded.
+				list[i].Name = mime.BEncoding.Encode("utf-8", list[i].Name+" ✉")
+			}
+		}
+	}
+	return envelope.FormatList(list)
+}
+
+func (a *Anonymizer) fake(seen map[string]string, original, format string) string {
+	key := strings.ToLower(original)
+	if fake, ok := seen[key]; ok {
+		return fake
+	}
+	fake := fmt.Sprintf(format, len(seen)+1)
+	seen[key] = fake
+	return fake
+}
+
+var replyPrefix = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|sv|tr|wg)\s*:\s*)*`)
+
+// subject scrambles a subject but keeps reply and forward prefixes. A
+// subject that was encoded-words is written back as one.
+func (a *Anonymizer) subject(value string) string {
+	decoded := envelope.NormalizeSubject(value)
+	prefix := replyPrefix.FindString(decoded)
+	subject := prefix + string(scramble([]byte(decoded[len(prefix):])))
+	if hasNonASCII([]byte(subject)) {
+		a.note("subject has non-ASCII text that was kept as it is")
+	}
+	if strings.Contains(value, "=?") {
+		return mime.QEncoding.Encode("utf-8", subject)
+	}
+	return subject
+}
+
+func (a *Anonymizer) note(format string, args ...any) {
+	note := fmt.Sprintf(format, args...)
+	for _, n := range a.Notes {
+		if n == note {
+			return
+		}
+	}
+	a.Notes = append(a.Notes, note)
+}
+
+func parseContentType(value string) (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil && mediaType == "" {
+		// Keep looking for the boundary; the parser does its best with a
+		// broken Content-Type as well.
+		mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+		params = map[string]string{}
+		if m := boundaryParam.FindStringSubmatch(value); m != nil {
+			params["boundary"] = m[1]
+		}
+	}
+	return strings.ToLower(mediaType), params
+}
+
+var boundaryParam = regexp.MustCompile(`(?i)boundary\s*=\s*"?([^";\r\n]+)`)
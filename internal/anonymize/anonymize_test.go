@@ -0,0 +1,124 @@
+package anonymize
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/quzhi1/imap-playground/internal/parser"
+)
+
+// TestKeepsStructure anonymizes every parser fixture and checks that the
+// parser still sees the same message: the same parts with the same types,
+// sizes and charsets, and the same problems.
+func TestKeepsStructure(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "parser", "testdata", "*", "*.eml"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no parser fixtures: %v", err)
+	}
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		anonymized := New().Message(raw)
+		want, got := shape(t, raw), shape(t, anonymized)
+		if want != got {
+			t.Errorf("%s: structure changed\nwant:\n%s\ngot:\n%s", path, want, got)
+		}
+	}
+}
+
+// TestRemovesPersonalData checks that names, addresses, IDs and text do not
+// survive.
+func TestRemovesPersonalData(t *testing.T) {
+	raw := []byte("From: \"Zhi Qu\" <zhi.qu@company.com>\r\n" +
+		"To: =?utf-8?Q?J=C3=BCrgen?= <jurgen@company.de>, Zhi Qu <ZHI.QU@company.com>\r\n" +
+		"Subject: Re: Quarterly numbers\r\n" +
+		"Message-ID: <secret-id@company.com>\r\n" +
+		"In-Reply-To: <secret-id@Company.com>\r\n" +
+		"Received: from mail.company.com\r\n" +
+		"X-Mailer: Company Mail\r\n" +
+		"Content-Type: multipart/related; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<div class=3D\"gmail_quote\"><a href=3D\"https://company.com/q3\">Quarterly</a> <img src=3D\"cid:chart@company.com\"></div>\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png; name=\"quarterly.png\"\r\n" +
+		"Content-ID: <chart@company.com>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--b--\r\n")
+	anonymizer := New()
+	out := string(anonymizer.Message(raw))
+	for _, secret := range []string{"Zhi", "zhi", "company", "Company", "Quarterly", "quarterly", "secret", "Jürgen", "iVBOR", "Received", "X-Mailer"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q survived:\n%s", secret, out)
+		}
+	}
+	for _, kept := range []string{"Re: ", "gmail_quote", "https://", ".png", "boundary=\"b\"", "--b--\r\n"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("%q was lost:\n%s", kept, out)
+		}
+	}
+
+	msg, err := parser.Parse(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.From) != 1 || len(msg.To) != 2 || msg.From[0].Address != msg.To[1].Address {
+		t.Errorf("the same address should map to the same fake: from %v, to %v", msg.From, msg.To)
+	}
+	if len(msg.InReplyTo) != 1 || msg.InReplyTo[0] != msg.MessageID {
+		t.Errorf("In-Reply-To %v should still point at Message-ID %s", msg.InReplyTo, msg.MessageID)
+	}
+	if len(msg.Inline) != 1 || !strings.Contains(msg.HTML, "cid:"+msg.Inline[0].ContentID) {
+		t.Errorf("cid: link should still match the Content-ID: %q, %v", msg.HTML, msg.Inline)
+	}
+	if len(anonymizer.Notes) == 0 {
+		t.Error("dropped fields should be noted")
+	}
+}
+
+// shape describes what the parser made of raw, leaving out the content.
+func shape(t *testing.T, raw []byte) string {
+	t.Helper()
+	msg, err := parser.Parse(bytes.NewReader(raw))
+	if msg == nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	var b strings.Builder
+	describe(&b, msg)
+	if err != nil {
+		fmt.Fprintf(&b, "error\n")
+	}
+	return b.String()
+}
+
+func describe(b *strings.Builder, msg *parser.Message) {
+	// Hashed cid: links change the length of an HTML body, so only its
+	// presence is compared.
+	fmt.Fprintf(b, "from %d to %d cc %d text %d html %v\n", len(msg.From), len(msg.To), len(msg.Cc), len(msg.Text), msg.HTML != "")
+	for _, c := range msg.Charsets {
+		fmt.Fprintf(b, "charset %s %s %s\n", c.ContentType, c.Label, c.Charset)
+	}
+	for _, list := range [][]*parser.Attachment{msg.Attachments, msg.Inline} {
+		for _, a := range list {
+			fmt.Fprintf(b, "attachment %s %s %d named=%v\n", a.ContentType, a.ContentDisposition, a.Size, a.Filename != "")
+		}
+	}
+	for _, p := range msg.Problems {
+		fmt.Fprintf(b, "problem %s %s %s\n", p.Part, p.ContentType, p.Problem)
+	}
+	fmt.Fprintf(b, "warnings %d\n", len(msg.Warnings))
+	for _, embedded := range msg.Embedded {
+		describe(b, embedded)
+	}
+}
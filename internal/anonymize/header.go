@@ -0,0 +1,99 @@
+package anonymize
+
+import (
+	"bytes"
+	"strings"
+)
+
+// headerField is one header field with its folded lines and line endings.
+type headerField struct {
+	// key is the lower-cased field name. It is empty for the blank line that
+	// ends the header.
+	key string
+	raw []byte
+}
+
+// value returns the unfolded field value.
+func (f headerField) value() string {
+	i := bytes.IndexByte(f.raw, ':')
+	if i < 0 {
+		return ""
+	}
+	v := strings.ReplaceAll(string(f.raw[i+1:]), "\r\n", "")
+	return strings.TrimSpace(strings.ReplaceAll(v, "\n", ""))
+}
+
+// rewrite returns the field with a new value on one line, keeping the
+// original spelling of the name and the line ending.
+func (f headerField) rewrite(value string) []byte {
+	name := f.raw[:bytes.IndexByte(f.raw, ':')]
+	return []byte(string(name) + ": " + value + lineEnding(f.raw))
+}
+
+// splitHeader splits an entity into its header fields and body. Like the
+// parser, it ends the header at the blank line or at the first line that
+// cannot be a header field, whichever comes first; that line then starts the
+// body.
+func splitHeader(raw []byte) ([]headerField, []byte) {
+	var fields []headerField
+	offset := 0
+	for _, line := range splitLines(raw) {
+		switch {
+		case offset == 0 && bytes.HasPrefix(line, []byte("From ")):
+			// An mbox separator line, not part of the message.
+		case len(bytes.TrimRight(line, "\r\n")) == 0:
+			fields = append(fields, headerField{raw: line})
+			return fields, raw[offset+len(line):]
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			last := &fields[len(fields)-1]
+			last.raw = append(last.raw, line...)
+		case isHeaderField(line):
+			key := strings.ToLower(strings.TrimSpace(string(line[:bytes.IndexByte(line, ':')])))
+			fields = append(fields, headerField{key: key, raw: append([]byte(nil), line...)})
+		default:
+			return fields, raw[offset:]
+		}
+		offset += len(line)
+	}
+	return fields, nil
+}
+
+func isHeaderField(line []byte) bool {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range bytes.TrimRight(line[:i], " \t") {
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// splitLines splits b after every "\n", keeping the line endings.
+func splitLines(b []byte) [][]byte {
+	var lines [][]byte
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			lines = append(lines, b)
+			break
+		}
+		lines = append(lines, b[:i+1])
+		b = b[i+1:]
+	}
+	return lines
+}
+
+func lineEnding(b []byte) string {
+	i := bytes.IndexByte(b, '\n')
+	switch {
+	case i < 0:
+		return ""
+	case i > 0 && b[i-1] == '\r':
+		return "\r\n"
+	default:
+		return "\n"
+	}
+}
@@ -0,0 +1,135 @@
+package anonymize
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/quzhi1/imap-playground/internal/tnef"
+)
+
+// rtfControl matches RTF control words, hex escapes and control symbols,
+// which are kept so the RTF stays RTF.
+var rtfControl = regexp.MustCompile(`\\[A-Za-z]+-?[0-9]*|\\'[0-9A-Fa-f]{2}|\\.`)
+
+// tnef anonymizes a base64 winmail.dat. Its attributes and properties are
+// kept in order; names and text are scrambled, file content is zeroed, and
+// a truncated or damaged stream stays truncated or damaged. It reports
+// false for a part that is not TNEF.
+func (a *Anonymizer) tnef(body []byte) ([]byte, bool) {
+	decoded, layout, ok := decodeBase64(body)
+	if !ok {
+		return nil, false
+	}
+	out, ok := a.tnefStream(decoded)
+	if !ok {
+		return nil, false
+	}
+	return encodeBase64(out, layout), true
+}
+
+func (a *Anonymizer) tnefStream(data []byte) ([]byte, bool) {
+	s, err := tnef.ReadStream(data)
+	if s == nil {
+		return nil, false
+	}
+	// Whatever follows the last whole attribute is the header of a cut-off
+	// one, kept, and the start of its value, zeroed.
+	tail := bytes.Clone(data[len(s.Bytes()):])
+	if err != nil && len(tail) > 9 {
+		clear(tail[9:])
+	}
+	for i, attr := range s.Attributes {
+		s.Attributes[i].Data = a.tnefAttribute(attr)
+	}
+	return append(s.Bytes(), tail...), true
+}
+
+func (a *Anonymizer) tnefAttribute(attr tnef.Attribute) []byte {
+	switch attr.ID {
+	case tnef.AttTNEFVersion, tnef.AttOEMCodepage, tnef.AttMessageClass, tnef.AttAttachRendData:
+		return attr.Data
+	case tnef.AttSubject, tnef.AttBody:
+		return scramble(attr.Data)
+	case tnef.AttAttachTitle:
+		return a.cFilename(attr.Data)
+	case tnef.AttMAPIProps, tnef.AttAttachment:
+		props, err := tnef.ReadProperties(attr.Data)
+		if err != nil {
+			a.note("TNEF attribute %#08x has damaged properties, zeroed it", attr.ID)
+			return make([]byte, len(attr.Data))
+		}
+		for i := range props {
+			a.tnefProperty(&props[i])
+		}
+		return tnef.WriteProperties(props)
+	}
+	// Attachment data, dates, the sender and anything unknown.
+	return make([]byte, len(attr.Data))
+}
+
+func (a *Anonymizer) tnefProperty(p *tnef.Property) {
+	for i, v := range p.Values {
+		p.Values[i] = a.tnefValue(p, v)
+	}
+}
+
+func (a *Anonymizer) tnefValue(p *tnef.Property, v []byte) []byte {
+	named := p.Name != nil
+	switch p.Type &^ tnef.MultiValued {
+	case tnef.TypeString8, tnef.TypeUnicode:
+		unicode := p.Type&^tnef.MultiValued == tnef.TypeUnicode
+		s := string(bytes.TrimRight(v, "\x00"))
+		if unicode {
+			s = tnef.DecodeUTF16(v)
+		}
+		switch {
+		case named:
+			s = string(scramble([]byte(s)))
+		case p.ID == tnef.PropMessageClass || p.ID == tnef.PropAttachMIMETag:
+			return v
+		case p.ID == tnef.PropAttachLongName || p.ID == tnef.PropAttachFilename || p.ID == tnef.PropDisplayName:
+			s = a.filename(s, false)
+		case p.ID == tnef.PropAttachContentID:
+			s = hashID(s)
+		default:
+			s = string(scramble([]byte(s)))
+		}
+		if unicode {
+			return tnef.EncodeUTF16(s)
+		}
+		if bytes.HasSuffix(v, []byte{0}) {
+			return append([]byte(s), 0)
+		}
+		return []byte(s)
+	case tnef.TypeBinary:
+		switch {
+		case named:
+		case p.ID == tnef.PropRTFCompressed:
+			rtf, err := tnef.DecompressRTF(v)
+			if err != nil {
+				a.note("TNEF RTF body does not decompress, zeroed it")
+				break
+			}
+			return tnef.UncompressedRTF(scrambleSkipping(rtf, rtfControl))
+		case p.ID == tnef.PropBodyHTML:
+			return a.scrambleHTML(v)
+		}
+	case tnef.TypeObject:
+		// An attached Outlook item is a TNEF stream after a 16-byte IID.
+		if len(v) >= 16 {
+			if item, ok := a.tnefStream(v[16:]); ok {
+				return append(bytes.Clone(v[:16]), item...)
+			}
+		}
+	default:
+		// Numbers, flags and times.
+		return v
+	}
+	return make([]byte, len(v))
+}
+
+// cFilename scrambles a NUL-terminated file name.
+func (a *Anonymizer) cFilename(b []byte) []byte {
+	name := bytes.TrimRight(b, "\x00")
+	return append([]byte(a.filename(string(name), false)), b[len(name):]...)
+}
@@ -0,0 +1,118 @@
+package attachments
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/parser"
+)
+
+const manifestName = "manifest.jsonl"
+
+// ManifestEntry is one exported attachment. The manifest has one entry per
+// attachment per message, so a body stored once can be listed many times.
+type ManifestEntry struct {
+	Folder       string   `json:"folder"`
+	UID          imap.UID `json:"uid"`
+	MessageID    string   `json:"message_id,omitempty"`
+	Filename     string   `json:"filename"`
+	ContentType  string   `json:"content_type"`
+	Size         int64    `json:"size"`
+	SHA256       string   `json:"sha256"`
+	AttachmentID string   `json:"attachment_id,omitempty"`
+	Path         string   `json:"path"`
+}
+
+// Exporter streams attachments of parsed messages into a Store and appends
+// them to manifest.jsonl in the same directory.
+type Exporter struct {
+	store    *Store
+	filter   Filter
+	manifest *os.File
+	enc      *json.Encoder
+}
+
+// NewExporter opens (or continues) an export in dir.
+func NewExporter(dir string, filter Filter) (*Exporter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	manifest, err := os.OpenFile(filepath.Join(dir, manifestName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		store:    &Store{Dir: dir},
+		filter:   filter,
+		manifest: manifest,
+		enc:      json.NewEncoder(manifest),
+	}, nil
+}
+
+// Export parses one raw message from r and stores every attachment the filter
+// allows. The returned entries have no Folder or UID yet; the caller fills
+// them in and passes them to Record. This lets the caller stream the body
+// before the FETCH response has delivered the UID.
+func (e *Exporter) Export(r io.Reader) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	handler := func(attachment *parser.Attachment, body io.Reader) error {
+		if !e.filter.AllowsType(attachment.ContentType) {
+			return nil
+		}
+		obj, err := e.store.Put(body, e.filter.MaxSize)
+		if errors.Is(err, ErrTooLarge) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !e.filter.AllowsSize(obj.Size) {
+			if obj.New {
+				return e.store.Remove(obj)
+			}
+			return nil
+		}
+
+		filename := parser.SanitizeFilename(attachment.Filename)
+		if filename == "" {
+			filename = parser.FallbackFilename(attachment.ContentType)
+		}
+		entries = append(entries, ManifestEntry{
+			Filename:     filename,
+			ContentType:  attachment.ContentType,
+			Size:         obj.Size,
+			SHA256:       obj.SHA256,
+			AttachmentID: attachment.AttachmentID,
+			Path:         obj.Path,
+		})
+		return nil
+	}
+
+	msg, err := parser.ParseWithOptions(r, &parser.Options{AttachmentHandler: handler})
+	if msg != nil {
+		for i := range entries {
+			entries[i].MessageID = msg.MessageID
+		}
+	}
+	return entries, err
+}
+
+// Record appends entries to the manifest.
+func (e *Exporter) Record(folder string, uid imap.UID, entries []ManifestEntry) error {
+	for _, entry := range entries {
+		entry.Folder = folder
+		entry.UID = uid
+		if err := e.enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the manifest.
+func (e *Exporter) Close() error {
+	return e.manifest.Close()
+}
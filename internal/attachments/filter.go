@@ -0,0 +1,43 @@
+package attachments
+
+import (
+	"path"
+	"strings"
+)
+
+// Filter decides which attachments get exported.
+type Filter struct {
+	// Include and Exclude are MIME type patterns such as "image/*" or
+	// "application/pdf". An empty Include list means every type.
+	Include []string
+	Exclude []string
+	// MinSize and MaxSize are in bytes. Zero means no limit.
+	MinSize int64
+	MaxSize int64
+}
+
+// AllowsType reports whether mediaType passes the include/exclude lists.
+func (f Filter) AllowsType(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	if matchAny(f.Exclude, mediaType) {
+		return false
+	}
+	return len(f.Include) == 0 || matchAny(f.Include, mediaType)
+}
+
+// AllowsSize reports whether size is within [MinSize, MaxSize].
+func (f Filter) AllowsSize(size int64) bool {
+	if f.MinSize > 0 && size < f.MinSize {
+		return false
+	}
+	return f.MaxSize <= 0 || size <= f.MaxSize
+}
+
+func matchAny(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// Package attachments exports attachment bodies to disk.
+package attachments
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrTooLarge is returned by Store.Put when the body is larger than the limit.
+var ErrTooLarge = errors.New("attachments: body exceeds the size limit")
+
+// Store keeps bodies under their SHA-256, so a file that was attached to many
+// messages is only written once.
+type Store struct {
+	Dir string
+}
+
+// Object is a body that has been written to the store.
+type Object struct {
+	SHA256 string
+	Size   int64
+	// Path is relative to the store directory.
+	Path string
+	// New is false if an identical body was already stored.
+	New bool
+}
+
+// Put streams r into the store. A maxSize of 0 means no limit. The body goes
+// to a temporary file first and is only renamed into place once its hash is
+// known, so an interrupted export never leaves a truncated object behind.
+func (s *Store) Put(r io.Reader, maxSize int64) (Object, error) {
+	tmpDir := filepath.Join(s.Dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return Object{}, err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "part-*")
+	if err != nil {
+		return Object{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	src := r
+	if maxSize > 0 {
+		// Read one byte past the limit so we can tell "exactly at" from "over".
+		src = io.LimitReader(r, maxSize+1)
+	}
+	size, err := io.Copy(io.MultiWriter(tmp, hash), src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	if maxSize > 0 && size > maxSize {
+		return Object{}, ErrTooLarge
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	obj := Object{
+		SHA256: sum,
+		Size:   size,
+		Path:   filepath.Join("objects", sum[:2], sum),
+	}
+	dst := filepath.Join(s.Dir, obj.Path)
+	if _, err := os.Stat(dst); err == nil {
+		return obj, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return Object{}, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return Object{}, err
+	}
+	obj.New = true
+	return obj, nil
+}
+
+// Remove deletes an object, e.g. one that turned out to be filtered out.
+func (s *Store) Remove(obj Object) error {
+	return os.Remove(filepath.Join(s.Dir, obj.Path))
+}
@@ -0,0 +1,174 @@
+package attachments
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+func TestPut(t *testing.T) {
+	store := &Store{Dir: t.TempDir()}
+	body := "%PDF-1.4 quarterly report"
+	sum := sha256.Sum256([]byte(body))
+	want := hex.EncodeToString(sum[:])
+
+	first, err := store.Put(strings.NewReader(body), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.New || first.SHA256 != want || first.Size != int64(len(body)) {
+		t.Errorf("first Put = %+v", first)
+	}
+	if wantPath := filepath.Join("objects", want[:2], want); first.Path != wantPath {
+		t.Errorf("path = %s, want %s", first.Path, wantPath)
+	}
+	got, err := os.ReadFile(filepath.Join(store.Dir, first.Path))
+	if err != nil || string(got) != body {
+		t.Fatalf("stored body = %q, %v", got, err)
+	}
+
+	// The same body again is found, not written twice.
+	second, err := store.Put(strings.NewReader(body), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.New || second.Path != first.Path || second.SHA256 != first.SHA256 {
+		t.Errorf("second Put = %+v, want the first object", second)
+	}
+	if n := countObjects(t, store.Dir); n != 1 {
+		t.Errorf("%d objects stored, want 1", n)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(store.Dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+
+	// A body over the limit is not stored; one exactly at it is.
+	if _, err := store.Put(strings.NewReader("too large"), 8); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Put over the limit: %v", err)
+	}
+	if _, err := store.Put(strings.NewReader("at limit"), 8); err != nil {
+		t.Errorf("Put at the limit: %v", err)
+	}
+	if n := countObjects(t, store.Dir); n != 2 {
+		t.Errorf("%d objects stored, want 2", n)
+	}
+}
+
+func TestExporter(t *testing.T) {
+	dir := t.TempDir()
+	exp, err := NewExporter(dir, Filter{Exclude: []string{"image/*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both messages carry the same PDF; the second also has an image the
+	// filter leaves out.
+	for uid, raw := range map[uint32]string{
+		1: message("<one@example.com>", "report.pdf", ""),
+		2: message("<two@example.com>", "copy of report.pdf", "logo.png"),
+	} {
+		entries, err := exp.Export(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := exp.Record("INBOX", imap.UID(uid), entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	byUID := make(map[uint32]ManifestEntry)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("manifest line %q: %v", scanner.Text(), err)
+		}
+		byUID[uint32(entry.UID)] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(byUID) != 2 {
+		t.Fatalf("manifest has %d entries, want 2: %+v", len(byUID), byUID)
+	}
+
+	sum := sha256.Sum256([]byte(pdfBody))
+	hash := hex.EncodeToString(sum[:])
+	for uid, want := range map[uint32]ManifestEntry{
+		1: {Folder: "INBOX", UID: 1, MessageID: "<one@example.com>", Filename: "report.pdf"},
+		2: {Folder: "INBOX", UID: 2, MessageID: "<two@example.com>", Filename: "copy of report.pdf"},
+	} {
+		want.ContentType = "application/pdf"
+		want.Size = int64(len(pdfBody))
+		want.SHA256 = hash
+		want.Path = filepath.Join("objects", hash[:2], hash)
+		if got := byUID[uid]; got != want {
+			t.Errorf("UID %d entry = %+v, want %+v", uid, got, want)
+		}
+	}
+	if n := countObjects(t, dir); n != 1 {
+		t.Errorf("%d objects stored, want 1", n)
+	}
+}
+
+const pdfBody = "%PDF-1.4 quarterly report"
+
+// message builds a message with a PDF attachment named pdfName and, when
+// imageName is set, a PNG attachment too.
+func message(messageID, pdfName, imageName string) string {
+	raw := "From: sender@example.com\r\n" +
+		"To: receiver@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"Message-ID: " + messageID + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"" + pdfName + "\"\r\n" +
+		"\r\n" +
+		pdfBody + "\r\n"
+	if imageName != "" {
+		raw += "--b\r\n" +
+			"Content-Type: image/png\r\n" +
+			"Content-Disposition: attachment; filename=\"" + imageName + "\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"iVBORw0KGgo=\r\n"
+	}
+	return raw + "--b--\r\n"
+}
+
+func countObjects(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(filepath.Join(dir, "objects"), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,227 @@
+// Package batch fetches large UID lists in chunks. UIDs are compressed into
+// ranges, cut into chunks that keep each command short, and on go-imap v2
+// several chunks are kept in flight on one connection. A chunk that fails is
+// retried on its own; the chunks that succeeded are not fetched again.
+package batch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+const (
+	DefaultChunkSize = 500
+	// DefaultMaxSetLength keeps the UID set well below the command line
+	// limits servers enforce (8 KB is common, some Exchange versions allow
+	// less).
+	DefaultMaxSetLength = 2000
+	DefaultInFlight     = 4
+	DefaultRetries      = 2
+)
+
+// Options tunes Fetch and FetchV1.
+type Options struct {
+	// ChunkSize is the most UIDs in one FETCH. Zero means DefaultChunkSize.
+	ChunkSize int
+	// MaxSetLength is the longest UID set string in one FETCH. Zero means
+	// DefaultMaxSetLength.
+	MaxSetLength int
+	// InFlight is how many chunks may be outstanding at once. Zero means
+	// DefaultInFlight. FetchV1 always fetches one chunk at a time.
+	InFlight int
+	// Ordered delivers messages in chunk order. Within a chunk they come in
+	// the order the server sent them, which is usually UID order.
+	Ordered bool
+	// Retries is how many times a failed chunk is fetched again. Zero means
+	// DefaultRetries; use a negative value to disable retries.
+	Retries int
+	// Progress, if set, is called after every chunk.
+	Progress func(Progress)
+}
+
+// Progress reports how far a batch fetch is.
+type Progress struct {
+	Chunks     int
+	ChunksDone int
+	// UIDs is the number of UIDs requested, Messages the number delivered
+	// so far. They differ when UIDs were expunged.
+	UIDs     int
+	Messages int
+	Retries  int
+}
+
+func (opts *Options) withDefaults() Options {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.MaxSetLength <= 0 {
+		o.MaxSetLength = DefaultMaxSetLength
+	}
+	if o.InFlight <= 0 {
+		o.InFlight = DefaultInFlight
+	}
+	if o.Retries == 0 {
+		o.Retries = DefaultRetries
+	} else if o.Retries < 0 {
+		o.Retries = 0
+	}
+	return o
+}
+
+// Plan returns the chunks uids would be fetched in.
+func Plan(uids []uint32, opts *Options) [][]Range {
+	o := opts.withDefaults()
+	return Split(Compress(uids), o.ChunkSize, o.MaxSetLength)
+}
+
+// UIDSet converts ranges to a go-imap v2 UID set.
+func UIDSet(ranges []Range) imap.UIDSet {
+	set := make(imap.UIDSet, len(ranges))
+	for i, r := range ranges {
+		set[i] = imap.UIDRange{Start: imap.UID(r.Start), Stop: imap.UID(r.Stop)}
+	}
+	return set
+}
+
+type chunkResult struct {
+	index    int
+	messages []*imapclient.FetchMessageBuffer
+	retries  int
+	err      error
+}
+
+// Fetch fetches uids from the selected mailbox with fetchOpts and calls fn
+// for every message. fn is never called concurrently. fetchOpts.UID is forced
+// on, since responses are matched to chunks by UID.
+//
+// When a chunk fails or fn returns an error, Fetch starts no more chunks and
+// returns once the chunks in flight have finished.
+//
+// Each chunk is buffered in memory before it is delivered, so fetchOpts
+// should not ask for whole bodies of large messages; use stream.Fetch per
+// chunk for that.
+func Fetch(ctx context.Context, client *imapclient.Client, uids []imap.UID, fetchOpts *imap.FetchOptions, opts *Options, fn func(*imapclient.FetchMessageBuffer) error) error {
+	o := opts.withDefaults()
+	raw := make([]uint32, len(uids))
+	for i, uid := range uids {
+		raw[i] = uint32(uid)
+	}
+	chunks := Split(Compress(raw), o.ChunkSize, o.MaxSetLength)
+	if len(chunks) == 0 {
+		return nil
+	}
+	withUID := *fetchOpts
+	withUID.UID = true
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan chunkResult)
+	slots := make(chan struct{}, o.InFlight)
+	var wg sync.WaitGroup
+	go func() {
+		defer close(results)
+		for i, chunk := range chunks {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func(i int, chunk []Range) {
+				defer wg.Done()
+				result := fetchChunk(ctx, client, UIDSet(chunk), &withUID, o.Retries)
+				result.index = i
+				select {
+				case results <- result:
+				case <-ctx.Done():
+				}
+			}(i, chunk)
+		}
+		wg.Wait()
+	}()
+
+	progress := Progress{Chunks: len(chunks), UIDs: countChunkUIDs(chunks)}
+	pending := make(map[int][]*imapclient.FetchMessageBuffer)
+	next := 0
+	deliver := func(messages []*imapclient.FetchMessageBuffer) error {
+		for _, msg := range messages {
+			if err := fn(msg); err != nil {
+				return err
+			}
+			progress.Messages++
+		}
+		return nil
+	}
+
+	err := func() error {
+		for result := range results {
+			<-slots
+			if result.err != nil {
+				return fmt.Errorf("batch: chunk %d (%s): %w", result.index+1, SetString(chunks[result.index]), result.err)
+			}
+			progress.ChunksDone++
+			progress.Retries += result.retries
+
+			if !o.Ordered {
+				if err := deliver(result.messages); err != nil {
+					return err
+				}
+			} else {
+				pending[result.index] = result.messages
+				for messages, ok := pending[next]; ok; messages, ok = pending[next] {
+					delete(pending, next)
+					next++
+					if err := deliver(messages); err != nil {
+						return err
+					}
+				}
+			}
+			if o.Progress != nil {
+				o.Progress(progress)
+			}
+		}
+		return ctx.Err()
+	}()
+	// Start no more chunks and wait for the ones in flight, so none is
+	// still running on client when Fetch returns.
+	cancel()
+	for range results {
+	}
+	return err
+}
+
+func fetchChunk(ctx context.Context, client *imapclient.Client, set imap.UIDSet, fetchOpts *imap.FetchOptions, retries int) chunkResult {
+	var result chunkResult
+	for attempt := 0; ; attempt++ {
+		result.messages, result.err = client.Fetch(set, fetchOpts).Collect()
+		if result.err == nil || attempt == retries {
+			return result
+		}
+		result.retries++
+		select {
+		case <-time.After(time.Duration(attempt+1) * 500 * time.Millisecond):
+		case <-ctx.Done():
+			result.err = ctx.Err()
+			return result
+		}
+	}
+}
+
+func countChunkUIDs(chunks [][]Range) int {
+	n := 0
+	for _, chunk := range chunks {
+		n += countUIDs(chunk)
+	}
+	return n
+}
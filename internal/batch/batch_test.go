@@ -0,0 +1,413 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	imapv1 "github.com/emersion/go-imap"
+	clientv1 "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+)
+
+func TestCompress(t *testing.T) {
+	tests := []struct {
+		uids []uint32
+		want []Range
+	}{
+		{nil, nil},
+		{[]uint32{5}, []Range{{5, 5}}},
+		{[]uint32{1, 2, 3, 4, 7, 9, 10}, []Range{{1, 4}, {7, 7}, {9, 10}}},
+		{[]uint32{10, 9, 7, 4, 3, 2, 1}, []Range{{1, 4}, {7, 7}, {9, 10}}},
+		{[]uint32{3, 3, 1, 2, 2}, []Range{{1, 3}}},
+		{[]uint32{1, 3, 5}, []Range{{1, 1}, {3, 3}, {5, 5}}},
+		{[]uint32{4294967294, 4294967295}, []Range{{4294967294, 4294967295}}},
+	}
+	for _, tt := range tests {
+		if got := Compress(tt.uids); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Compress(%v) = %v, want %v", tt.uids, got, tt.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name      string
+		ranges    []Range
+		maxUIDs   int
+		maxLength int
+		want      string
+	}{
+		{"no limits", []Range{{1, 100}, {200, 200}}, 0, 0, "1:100,200"},
+		{"range cut in the middle", []Range{{1, 10}}, 4, 0, "1:4|5:8|9:10"},
+		{"ranges packed up to the count", []Range{{1, 2}, {4, 5}, {7, 9}}, 4, 0, "1:2,4:5|7:9"},
+		{"count reached exactly", []Range{{1, 4}, {6, 6}}, 4, 0, "1:4|6"},
+		{"set length", []Range{{1, 1}, {3, 3}, {5, 5}, {7, 7}}, 0, 3, "1,3|5,7"},
+		{"range longer than the set length", []Range{{100, 200}, {300, 300}}, 0, 4, "100:200|300"},
+		{"both limits", []Range{{1, 10}, {20, 20}, {30, 30}}, 5, 6, "1:5|6:10|20,30"},
+		{"nothing", nil, 4, 4, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, chunk := range Split(tt.ranges, tt.maxUIDs, tt.maxLength) {
+				got = append(got, SetString(chunk))
+				if tt.maxUIDs > 0 && countUIDs(chunk) > tt.maxUIDs {
+					t.Errorf("chunk %s has more than %d UIDs", SetString(chunk), tt.maxUIDs)
+				}
+			}
+			if s := joinChunks(got); s != tt.want {
+				t.Errorf("Split = %s, want %s", s, tt.want)
+			}
+		})
+	}
+}
+
+func joinChunks(chunks []string) string {
+	var b bytes.Buffer
+	for i, c := range chunks {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		b.WriteString(c)
+	}
+	return b.String()
+}
+
+func TestParseSet(t *testing.T) {
+	tests := []struct {
+		set     string
+		want    []Range
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"7", []Range{{7, 7}}, false},
+		{"1:4,7,9:10", []Range{{1, 4}, {7, 7}, {9, 10}}, false},
+		{"10:9,3", []Range{{9, 10}, {3, 3}}, false},
+		{"4294967295", []Range{{4294967295, 4294967295}}, false},
+		{"1:*", nil, true},
+		{"0", nil, true},
+		{"1,,2", nil, true},
+		{"a:b", nil, true},
+		{"4294967296", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSet(tt.set)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSet(%q) error = %v, want error %v", tt.set, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSet(%q) = %v, want %v", tt.set, got, tt.want)
+		}
+	}
+}
+
+func TestSetString(t *testing.T) {
+	tests := []struct {
+		ranges []Range
+		want   string
+	}{
+		{nil, ""},
+		{[]Range{{3, 3}}, "3"},
+		{[]Range{{1, 4}, {7, 7}, {9, 10}}, "1:4,7,9:10"},
+	}
+	for _, tt := range tests {
+		got := SetString(tt.ranges)
+		if got != tt.want {
+			t.Errorf("SetString(%v) = %q, want %q", tt.ranges, got, tt.want)
+		}
+		back, err := ParseSet(got)
+		if err != nil || !reflect.DeepEqual(back, tt.ranges) {
+			t.Errorf("ParseSet(%q) = %v, %v, want %v", got, back, err, tt.ranges)
+		}
+	}
+}
+
+// setup seeds the fake server's INBOX with 50 messages and expunges every
+// tenth, so the UIDs have gaps. It returns the UIDs left.
+func setup(t *testing.T) (*fakeserver.Server, []imap.UID) {
+	t.Helper()
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	var uids []imap.UID
+	for i := 1; i <= 50; i++ {
+		raw := fmt.Sprintf("Subject: Message %d\r\nMessage-ID: <batch-%d@example.com>\r\n\r\nBody %d\r\n", i, i, i)
+		if _, err := server.Append("INBOX", []byte(raw), nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 != 0 {
+			uids = append(uids, imap.UID(i))
+		}
+	}
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	deleted := imap.UIDSetNum(10, 20, 30, 40, 50)
+	if err := c.Store(deleted, &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagDeleted}, Silent: true}, nil).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expunge().Close(); err != nil {
+		t.Fatal(err)
+	}
+	return server, uids
+}
+
+// dial logs into server over conn wrapped in hook and selects INBOX.
+func dial(t *testing.T, server *fakeserver.Server, hook *fetchHook) *imapclient.Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.Conn = conn
+	hook.r = bufio.NewReader(conn)
+	c := imapclient.New(hook, nil)
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login(fakeserver.Username, fakeserver.Password).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFetch(t *testing.T) {
+	server, uids := setup(t)
+	c := dial(t, server, &fetchHook{})
+
+	// Ask for the expunged UIDs too: they are simply not delivered.
+	all := make([]imap.UID, 50)
+	for i := range all {
+		all[i] = imap.UID(i + 1)
+	}
+	var got []imap.UID
+	var last Progress
+	err := Fetch(context.Background(), c, all, &imap.FetchOptions{Envelope: true}, &Options{
+		ChunkSize: 7,
+		InFlight:  4,
+		Ordered:   true,
+		Progress:  func(p Progress) { last = p },
+	}, func(msg *imapclient.FetchMessageBuffer) error {
+		if msg.Envelope == nil || msg.Envelope.Subject != fmt.Sprintf("Message %d", msg.UID) {
+			t.Errorf("UID %d has envelope %+v", msg.UID, msg.Envelope)
+		}
+		got = append(got, msg.UID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, uids) {
+		t.Errorf("delivered %v, want %v in order", got, uids)
+	}
+	want := Progress{Chunks: 8, ChunksDone: 8, UIDs: 50, Messages: len(uids)}
+	if last != want {
+		t.Errorf("progress = %+v, want %+v", last, want)
+	}
+}
+
+// TestFetchRetry fails the first FETCH after the server has sent its
+// messages. The chunk is fetched again and every message delivered once.
+func TestFetchRetry(t *testing.T) {
+	server, uids := setup(t)
+	hook := &fetchHook{failFirst: true}
+	c := dial(t, server, hook)
+
+	seen := make(map[imap.UID]int)
+	var last Progress
+	err := Fetch(context.Background(), c, uids, &imap.FetchOptions{Flags: true}, &Options{
+		ChunkSize: 10,
+		Progress:  func(p Progress) { last = p },
+	}, func(msg *imapclient.FetchMessageBuffer) error {
+		seen[msg.UID]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range uids {
+		if seen[uid] != 1 {
+			t.Errorf("UID %d delivered %d times", uid, seen[uid])
+		}
+	}
+	if last.Retries != 1 || last.ChunksDone != last.Chunks {
+		t.Errorf("progress = %+v, want one retry", last)
+	}
+
+	// Without retries the failure is returned.
+	hook.reset(true)
+	err = Fetch(context.Background(), c, uids, &imap.FetchOptions{Flags: true}, &Options{Retries: -1}, func(*imapclient.FetchMessageBuffer) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("Fetch without retries hid the failed chunk")
+	}
+}
+
+// TestFetchStops checks that Fetch returns fn's error only after the chunks
+// in flight have finished, so the connection is free for the next command.
+func TestFetchStops(t *testing.T) {
+	server, uids := setup(t)
+	hook := &fetchHook{slow: true}
+	c := dial(t, server, hook)
+
+	stop := errors.New("stop")
+	err := Fetch(context.Background(), c, uids, &imap.FetchOptions{Envelope: true}, &Options{
+		ChunkSize: 3,
+		InFlight:  4,
+	}, func(*imapclient.FetchMessageBuffer) error {
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("Fetch = %v, want fn's error", err)
+	}
+	started, finished := hook.counts()
+	if started == 0 || started != finished {
+		t.Errorf("%d FETCH commands sent, %d finished", started, finished)
+	}
+	if started == len(Plan(uint32s(uids), &Options{ChunkSize: 3})) {
+		t.Errorf("all %d chunks were fetched after fn failed", started)
+	}
+	if err := c.Noop().Wait(); err != nil {
+		t.Errorf("NOOP after Fetch: %v", err)
+	}
+}
+
+func TestFetchV1Retry(t *testing.T) {
+	server, uids := setup(t)
+	conn, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &fetchHook{Conn: conn, r: bufio.NewReader(conn), failFirst: true}
+	c, err := clientv1.New(hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if err := c.Login(fakeserver.Username, fakeserver.Password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[uint32]int)
+	var got []uint32
+	var last Progress
+	err = FetchV1(c, uint32s(uids), []imapv1.FetchItem{imapv1.FetchEnvelope}, &Options{
+		ChunkSize: 10,
+		Progress:  func(p Progress) { last = p },
+	}, func(msg *imapv1.Message) error {
+		seen[msg.Uid]++
+		got = append(got, msg.Uid)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range uids {
+		if seen[uint32(uid)] != 1 {
+			t.Errorf("UID %d delivered %d times", uid, seen[uint32(uid)])
+		}
+	}
+	if !reflect.DeepEqual(got, uint32s(uids)) {
+		t.Errorf("delivered %v, want UID order", got)
+	}
+	if last.Retries != 1 || last.Messages != len(uids) {
+		t.Errorf("progress = %+v, want one retry and %d messages", last, len(uids))
+	}
+}
+
+func uint32s(uids []imap.UID) []uint32 {
+	raw := make([]uint32, len(uids))
+	for i, uid := range uids {
+		raw[i] = uint32(uid)
+	}
+	return raw
+}
+
+// fetchHook counts the UID FETCH commands sent and finished. With failFirst
+// the first one to finish is answered NO instead of OK, after its messages
+// have been read. With slow every FETCH but the first takes 20ms longer to
+// finish.
+type fetchHook struct {
+	net.Conn
+	r *bufio.Reader
+	// line is what is left of the line being read.
+	line []byte
+
+	mu        sync.Mutex
+	failFirst bool
+	slow      bool
+	started   int
+	finished  int
+}
+
+func (h *fetchHook) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("UID FETCH")) {
+		h.mu.Lock()
+		h.started++
+		h.mu.Unlock()
+	}
+	return h.Conn.Write(b)
+}
+
+// Read hands out the server's responses a line at a time, so a status line
+// can be changed before the client sees it.
+func (h *fetchHook) Read(b []byte) (int, error) {
+	if len(h.line) == 0 {
+		line, err := h.r.ReadBytes('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		if fields := bytes.Fields(line); len(fields) > 2 && !bytes.Equal(fields[0], []byte("*")) && bytes.Contains(line, []byte("FETCH completed")) {
+			h.mu.Lock()
+			h.finished++
+			if h.failFirst && bytes.Equal(fields[1], []byte("OK")) {
+				h.failFirst = false
+				line = bytes.Replace(line, []byte(" OK "), []byte(" NO "), 1)
+			}
+			slow := h.finished > 1 && h.slow
+			h.mu.Unlock()
+			if slow {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		h.line = line
+	}
+	n := copy(b, h.line)
+	h.line = h.line[n:]
+	return n, nil
+}
+
+func (h *fetchHook) counts() (started, finished int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.started, h.finished
+}
+
+func (h *fetchHook) reset(failFirst bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failFirst, h.started, h.finished = failFirst, 0, 0
+}
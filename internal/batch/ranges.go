@@ -0,0 +1,153 @@
+package batch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range is an inclusive UID range; Start == Stop is a single UID.
+type Range struct {
+	Start, Stop uint32
+}
+
+// Len is the number of UIDs in the range.
+func (r Range) Len() int {
+	return int(r.Stop-r.Start) + 1
+}
+
+func (r Range) String() string {
+	if r.Start == r.Stop {
+		return strconv.FormatUint(uint64(r.Start), 10)
+	}
+	return strconv.FormatUint(uint64(r.Start), 10) + ":" + strconv.FormatUint(uint64(r.Stop), 10)
+}
+
+// Compress sorts and de-duplicates uids and merges consecutive ones into
+// ranges, so 1,2,3,4,7,9,10 becomes 1:4,7,9:10.
+func Compress(uids []uint32) []Range {
+	if len(uids) == 0 {
+		return nil
+	}
+	sorted := append([]uint32(nil), uids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	ranges := []Range{{sorted[0], sorted[0]}}
+	for _, uid := range sorted[1:] {
+		last := &ranges[len(ranges)-1]
+		switch {
+		case uid == last.Stop:
+		case uid == last.Stop+1:
+			last.Stop = uid
+		default:
+			ranges = append(ranges, Range{uid, uid})
+		}
+	}
+	return ranges
+}
+
+// Split cuts ranges into chunks of at most maxUIDs UIDs whose set string
+// ("1:4,7,9:10") is at most maxLength bytes. Ranges longer than maxUIDs are
+// cut in the middle. A zero limit means no limit.
+func Split(ranges []Range, maxUIDs, maxLength int) [][]Range {
+	var chunks [][]Range
+	var current []Range
+	count, length := 0, 0
+	flush := func() {
+		if len(current) > 0 {
+			chunks = append(chunks, current)
+		}
+		current, count, length = nil, 0, 0
+	}
+
+	for _, r := range ranges {
+		for {
+			piece := r
+			if maxUIDs > 0 && count+piece.Len() > maxUIDs {
+				if room := maxUIDs - count; room > 0 {
+					piece.Stop = piece.Start + uint32(room) - 1
+				} else {
+					flush()
+					continue
+				}
+			}
+			pieceLength := len(piece.String())
+			if len(current) > 0 {
+				pieceLength++ // comma
+			}
+			if maxLength > 0 && length+pieceLength > maxLength && len(current) > 0 {
+				flush()
+				continue
+			}
+			current = append(current, piece)
+			count += piece.Len()
+			length += pieceLength
+			if piece.Stop == r.Stop {
+				break
+			}
+			r.Start = piece.Stop + 1
+		}
+	}
+	flush()
+	return chunks
+}
+
+// SetString renders ranges the way they appear in a command.
+func SetString(ranges []Range) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseSet reads a set string written by SetString. It accepts ranges in
+// any order, but not "*".
+func ParseSet(s string) ([]Range, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ranges []Range
+	for _, part := range strings.Split(s, ",") {
+		start, stop, isRange := strings.Cut(part, ":")
+		if !isRange {
+			stop = start
+		}
+		first, err := strconv.ParseUint(start, 10, 32)
+		if err != nil || first == 0 {
+			return nil, fmt.Errorf("batch: bad UID set %q", s)
+		}
+		last, err := strconv.ParseUint(stop, 10, 32)
+		if err != nil || last == 0 {
+			return nil, fmt.Errorf("batch: bad UID set %q", s)
+		}
+		if first > last {
+			first, last = last, first
+		}
+		ranges = append(ranges, Range{uint32(first), uint32(last)})
+	}
+	return ranges, nil
+}
+
+// Expand lists every UID in ranges.
+func Expand(ranges []Range) []uint32 {
+	uids := make([]uint32, 0, countUIDs(ranges))
+	for _, r := range ranges {
+		for uid := r.Start; ; uid++ {
+			uids = append(uids, uid)
+			if uid == r.Stop {
+				break
+			}
+		}
+	}
+	return uids
+}
+
+func countUIDs(ranges []Range) int {
+	n := 0
+	for _, r := range ranges {
+		n += r.Len()
+	}
+	return n
+}
@@ -0,0 +1,83 @@
+package batch
+
+import (
+	"fmt"
+	"time"
+
+	imapv1 "github.com/emersion/go-imap"
+	clientv1 "github.com/emersion/go-imap/client"
+)
+
+// SeqSet converts ranges to a go-imap v1 sequence set, for UidFetch.
+func SeqSet(ranges []Range) *imapv1.SeqSet {
+	set := new(imapv1.SeqSet)
+	for _, r := range ranges {
+		set.AddRange(r.Start, r.Stop)
+	}
+	return set
+}
+
+// FetchV1 is Fetch for go-imap v1 clients. The v1 client cannot pipeline
+// commands, so chunks are fetched one after another and always in order.
+// Messages are read while the command runs, so no channel buffer has to be
+// sized for the whole result.
+func FetchV1(client *clientv1.Client, uids []uint32, items []imapv1.FetchItem, opts *Options, fn func(*imapv1.Message) error) error {
+	o := opts.withDefaults()
+	chunks := Split(Compress(uids), o.ChunkSize, o.MaxSetLength)
+	progress := Progress{Chunks: len(chunks), UIDs: countChunkUIDs(chunks)}
+
+	// Retried chunks are deduplicated by UID, so the UID must be fetched.
+	withUID := append([]imapv1.FetchItem{imapv1.FetchUid}, items...)
+
+	for i, chunk := range chunks {
+		// A retried chunk may repeat messages delivered by the failed
+		// attempt; skip those.
+		delivered := make(map[uint32]bool)
+		var err error
+		for attempt := 0; ; attempt++ {
+			var fnErr error
+			err, fnErr = fetchChunkV1(client, SeqSet(chunk), withUID, func(msg *imapv1.Message) error {
+				if delivered[msg.Uid] {
+					return nil
+				}
+				delivered[msg.Uid] = true
+				progress.Messages++
+				return fn(msg)
+			})
+			if fnErr != nil {
+				return fnErr
+			}
+			if err == nil || attempt == o.Retries {
+				break
+			}
+			progress.Retries++
+			time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+		}
+		if err != nil {
+			return fmt.Errorf("batch: chunk %d (%s): %w", i+1, SetString(chunk), err)
+		}
+		progress.ChunksDone++
+		if o.Progress != nil {
+			o.Progress(progress)
+		}
+	}
+	return nil
+}
+
+// fetchChunkV1 returns the error of the command and the error of fn
+// separately, since only the first is worth a retry.
+func fetchChunkV1(client *clientv1.Client, set *imapv1.SeqSet, items []imapv1.FetchItem, fn func(*imapv1.Message) error) (fetchErr, fnErr error) {
+	messages := make(chan *imapv1.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.UidFetch(set, items, messages)
+	}()
+
+	for msg := range messages {
+		if fnErr == nil {
+			fnErr = fn(msg)
+		}
+		// Keep draining after an error, or UidFetch blocks forever.
+	}
+	return <-done, fnErr
+}
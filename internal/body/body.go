@@ -0,0 +1,154 @@
+// Package body turns message bodies into clean text for previews and
+// indexing. HTML is rendered as readable text, and quoted replies and
+// signatures are split off so callers can keep only what the sender wrote.
+// HTML bodies are split on the markers mail clients leave (Gmail's
+// gmail_quote, Apple Mail and Thunderbird cite blockquotes, Outlook's reply
+// header div), then the remaining text goes through the same line rules as
+// plain text bodies.
+package body
+
+import (
+	"strings"
+
+	"github.com/quzhi1/imap-playground/internal/parser"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Result is a body split into its parts. Text is the whole body as text;
+// New, Quoted and Signature together cover it.
+type Result struct {
+	Text      string `json:"text"`
+	New       string `json:"new"`
+	Quoted    string `json:"quoted,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// FromMessage processes the body of a parsed message. The HTML body is
+// preferred when there is one, since its quote markers are more reliable
+// than text heuristics.
+func FromMessage(msg *parser.Message) *Result {
+	if strings.TrimSpace(msg.HTML) != "" {
+		return SplitHTML(msg.HTML)
+	}
+	return SplitText(msg.Text)
+}
+
+// SplitHTML renders an HTML body as text and splits it like SplitText, using
+// the quote and signature markers of common mail clients first.
+func SplitHTML(body string) *Result {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return SplitText(body)
+	}
+
+	// Number the nodes in document order, so "everything after the Outlook
+	// reply header" is every node numbered after it.
+	order := make(map[*html.Node]int)
+	cut := -1
+	var number func(*html.Node)
+	number = func(n *html.Node) {
+		order[n] = len(order)
+		if cut < 0 && isCut(n) {
+			cut = order[n]
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			number(c)
+		}
+	}
+	number(doc)
+	afterCut := func(n *html.Node) bool {
+		return cut >= 0 && order[n] >= cut
+	}
+	quote := func(n *html.Node) bool {
+		return isQuote(n) || afterCut(n)
+	}
+
+	whole := &renderer{}
+	whole.node(doc)
+
+	fresh := &renderer{skip: func(n *html.Node) bool { return quote(n) || isSignature(n) }}
+	fresh.node(doc)
+
+	quoted := &renderer{}
+	renderMatching(quoted, doc, quote)
+	signature := &renderer{}
+	renderMatching(signature, doc, func(n *html.Node) bool { return isSignature(n) && !afterCut(n) })
+
+	// The part left over can still carry quotes the client did not mark,
+	// e.g. a forwarded plain text reply pasted into an HTML message.
+	result := SplitText(fresh.String())
+	result.Text = whole.String()
+	result.Quoted = joinParts(result.Quoted, quoted.String())
+	// Thunderbird keeps the "-- " delimiter inside its signature div.
+	sig := strings.TrimPrefix(signature.String(), "--\n")
+	result.Signature = joinParts(result.Signature, sig)
+	return result
+}
+
+// renderMatching renders every outermost node for which match is true.
+func renderMatching(r *renderer, n *html.Node, match func(*html.Node) bool) {
+	if match(n) {
+		r.node(n)
+		r.block(2)
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		renderMatching(r, c, match)
+	}
+}
+
+// isQuote reports whether n holds quoted text.
+func isQuote(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch {
+	case hasClass(n, "gmail_quote"), hasClass(n, "gmail_quote_container"):
+		// Gmail: the attribution line and the quoted blockquote.
+		return true
+	case n.DataAtom == atom.Blockquote && strings.EqualFold(attr(n, "type"), "cite"):
+		// Apple Mail and Thunderbird.
+		return true
+	case hasClass(n, "moz-cite-prefix"), hasClass(n, "yahoo_quoted"), hasClass(n, "protonmail_quote"):
+		return true
+	}
+	return false
+}
+
+// isCut reports whether n starts a quoted message that runs to the end of
+// the document. Outlook does not wrap the quote; it puts a header block in
+// front of it.
+func isCut(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch attr(n, "id") {
+	case "divRplyFwdMsg", "appendonsend", "stopSpelling":
+		return true
+	}
+	return hasClass(n, "OutlookMessageHeader")
+}
+
+// isSignature reports whether n is a signature block.
+func isSignature(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	switch attr(n, "id") {
+	case "Signature", "signature":
+		return true
+	}
+	return hasClass(n, "gmail_signature") || hasClass(n, "moz-signature")
+}
+
+func joinParts(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	default:
+		return a + "\n\n" + b
+	}
+}
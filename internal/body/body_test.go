@@ -0,0 +1,87 @@
+package body
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden .json files from the processor output")
+
+// TestGolden runs every .html and .txt sample under testdata through the
+// body processor and compares the result with the .json file next to it.
+// Run with -update to rewrite them after a deliberate change, and review
+// the diff.
+func TestGolden(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join("testdata", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, sample := range samples {
+		ext := filepath.Ext(sample)
+		if ext != ".html" && ext != ".txt" {
+			continue
+		}
+		n++
+		t.Run(filepath.Base(sample), func(t *testing.T) {
+			raw, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result *Result
+			if ext == ".html" {
+				result = SplitHTML(string(raw))
+			} else {
+				result = SplitText(string(raw))
+			}
+			got, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(sample, ext) + ".json"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil { //nolint:gosec // golden files are not secret
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s:\n%s", golden, firstDifference(want, got))
+			}
+		})
+	}
+	if n == 0 {
+		t.Fatal("no samples under testdata")
+	}
+}
+
+// firstDifference describes the first line where want and got differ.
+func firstDifference(want, got []byte) string {
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(string(got), "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("line %d:\n  want: %s\n  got:  %s", i+1, w, g)
+		}
+	}
+	return "same lines, different bytes"
+}
@@ -0,0 +1,319 @@
+package body
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText renders an HTML body as readable plain text. Paragraphs and
+// headings are separated by blank lines, links keep their target in
+// parentheses, list items get "- " or "1. " markers, table cells are joined
+// with " | " one row per line, and blockquotes are prefixed with "> ".
+// Scripts, styles and elements hidden with display:none (preheaders) are
+// dropped.
+func HTMLToText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		// html.Parse only fails on reader errors, which a string cannot have.
+		return body
+	}
+	r := &renderer{}
+	r.node(doc)
+	return r.String()
+}
+
+// renderer writes the text form of a node tree. skip, when set, leaves out
+// a node and everything below it.
+type renderer struct {
+	b    strings.Builder
+	skip func(*html.Node) bool
+
+	// newlines is how many line breaks are owed before the next text, and
+	// breakDepth how many prefix elements blank lines among them get: a
+	// blank line before a blockquote has no "> ", one inside it does.
+	newlines   int
+	breakDepth int
+	// space is an owed space between two inline runs.
+	space bool
+	// prefix is written at the start of every line: "> " per blockquote
+	// and indentation per list level. marker replaces the last prefix
+	// element on the first line of a list item.
+	prefix []string
+	marker string
+	pre    int
+	lists  []int
+}
+
+func (r *renderer) String() string {
+	return strings.TrimSpace(r.b.String())
+}
+
+func (r *renderer) node(n *html.Node) {
+	if r.skip != nil && r.skip(n) {
+		return
+	}
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.DocumentNode:
+		r.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+	if hidden(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Title, atom.Template, atom.Meta, atom.Link, atom.Noscript:
+	case atom.Br:
+		r.owe(r.newlines + 1)
+	case atom.Hr:
+		r.block(1)
+		r.write("---")
+		r.block(1)
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		r.block(2)
+		r.children(n)
+		r.block(2)
+	case atom.Pre:
+		r.block(2)
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.block(2)
+	case atom.Blockquote:
+		r.block(2)
+		r.prefix = append(r.prefix, "> ")
+		r.children(n)
+		r.prefix = r.prefix[:len(r.prefix)-1]
+		r.block(2)
+	case atom.Ul, atom.Ol:
+		r.block(1)
+		r.lists = append(r.lists, 0)
+		if n.DataAtom == atom.Ol {
+			r.lists[len(r.lists)-1] = 1
+			if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+				r.lists[len(r.lists)-1] = start
+			}
+		}
+		r.children(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		r.block(1)
+	case atom.Li:
+		r.listItem(n)
+	case atom.Table:
+		r.block(2)
+		r.children(n)
+		r.block(2)
+	case atom.Tr:
+		r.block(1)
+		r.children(n)
+		r.block(1)
+	case atom.Td, atom.Th:
+		if previousElement(n, atom.Td, atom.Th) != nil {
+			r.write(" | ")
+		}
+		r.children(n)
+	case atom.A:
+		r.link(n)
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			r.inline("[" + alt + "]")
+		}
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Main,
+		atom.Aside, atom.Center, atom.Dl, atom.Dt, atom.Dd, atom.Figure, atom.Figcaption,
+		atom.Address, atom.Form, atom.Fieldset, atom.Caption, atom.Thead, atom.Tbody, atom.Tfoot:
+		r.block(1)
+		r.children(n)
+		r.block(1)
+	default:
+		r.children(n)
+	}
+}
+
+func (r *renderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.node(c)
+	}
+}
+
+func (r *renderer) listItem(n *html.Node) {
+	marker := "- "
+	if len(r.lists) > 0 && r.lists[len(r.lists)-1] > 0 {
+		marker = strconv.Itoa(r.lists[len(r.lists)-1]) + ". "
+		r.lists[len(r.lists)-1]++
+	}
+	r.block(1)
+	r.prefix = append(r.prefix, strings.Repeat(" ", len(marker)))
+	r.marker = marker
+	r.children(n)
+	r.marker = ""
+	r.prefix = r.prefix[:len(r.prefix)-1]
+	r.block(1)
+}
+
+func (r *renderer) link(n *html.Node) {
+	start := r.b.Len()
+	r.children(n)
+	label := strings.TrimSpace(r.b.String()[start:])
+	href := strings.TrimSpace(attr(n, "href"))
+	switch {
+	case href == "", strings.HasPrefix(href, "#"), strings.HasPrefix(strings.ToLower(href), "javascript:"):
+	case label == "":
+		r.inline(href)
+	case label == href, "mailto:"+label == href, "http://"+label == href, "https://"+label == href,
+		"http://"+label+"/" == href, "https://"+label+"/" == href:
+	default:
+		r.write(" (" + href + ")")
+	}
+}
+
+// block ends the current line and owes n line breaks (2 for a blank line)
+// before the next text.
+func (r *renderer) block(n int) {
+	if n > r.newlines {
+		r.owe(n)
+	}
+	r.space = false
+}
+
+func (r *renderer) owe(n int) {
+	if r.newlines == 0 {
+		r.breakDepth = len(r.prefix)
+	}
+	r.newlines = n
+	r.space = false
+}
+
+// text writes a text node, collapsing whitespace outside <pre>.
+func (r *renderer) text(s string) {
+	if r.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				r.owe(r.newlines + 1)
+			}
+			if line != "" {
+				r.write(line)
+			}
+		}
+		return
+	}
+	for i, word := range strings.Fields(s) {
+		if i > 0 || startsWithSpace(s) {
+			r.space = true
+		}
+		r.inline(word)
+	}
+	if len(s) > 0 && endsWithSpace(s) {
+		r.space = true
+	}
+}
+
+// inline writes s after an owed space.
+func (r *renderer) inline(s string) {
+	if r.space && r.newlines == 0 && r.b.Len() > 0 {
+		r.b.WriteByte(' ')
+	}
+	r.space = false
+	r.write(s)
+}
+
+// write writes s as is, after any owed line breaks and the line prefix.
+func (r *renderer) write(s string) {
+	if r.newlines > 0 || r.b.Len() == 0 {
+		if r.b.Len() > 0 {
+			n := r.newlines
+			if n > 2 {
+				n = 2
+			}
+			for i := 0; i < n; i++ {
+				if i > 0 {
+					depth := r.breakDepth
+					if depth > len(r.prefix) {
+						depth = len(r.prefix)
+					}
+					r.b.WriteString(strings.TrimRight(strings.Join(r.prefix[:depth], ""), " "))
+				}
+				r.b.WriteByte('\n')
+			}
+		}
+		r.newlines = 0
+		r.writePrefix()
+	}
+	r.b.WriteString(s)
+}
+
+func (r *renderer) writePrefix() {
+	if len(r.prefix) == 0 {
+		return
+	}
+	last := len(r.prefix) - 1
+	r.b.WriteString(strings.Join(r.prefix[:last], ""))
+	if r.marker != "" && strings.TrimSpace(r.prefix[last]) == "" {
+		r.b.WriteString(r.marker)
+		r.marker = ""
+	} else {
+		r.b.WriteString(r.prefix[last])
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, c := range strings.Fields(attr(n, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func hidden(n *html.Node) bool {
+	style := strings.ReplaceAll(strings.ToLower(attr(n, "style")), " ", "")
+	return strings.Contains(style, "display:none") || hasAttr(n, "hidden")
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func previousElement(n *html.Node, atoms ...atom.Atom) *html.Node {
+	for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type != html.ElementNode {
+			continue
+		}
+		for _, a := range atoms {
+			if s.DataAtom == a {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+func startsWithSpace(s string) bool {
+	return s != "" && strings.TrimLeft(s[:1], " \t\r\n\f") == ""
+}
+
+func endsWithSpace(s string) bool {
+	return s != "" && strings.TrimRight(s[len(s)-1:], " \t\r\n\f") == ""
+}
@@ -0,0 +1,148 @@
+package body
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// attribution matches the line mail clients put above a quoted reply,
+	// in the languages seen in the test accounts. Gmail and Apple Mail
+	// wrap it, so it is matched against two joined lines as well.
+	attribution = regexp.MustCompile(`(?i)^(on\s.+\swrote|le\s.+\sa\sécrit|am\s.+\sschrieb\s.*|el\s.+\sescribió|il\s.+\sha\sscritto)\s?:$`)
+	// separator matches lines that start a quoted or forwarded message.
+	separator = regexp.MustCompile(`(?i)^(-{2,}\s*(original message|ursprüngliche nachricht|message d'origine|forwarded message)\s*-{2,}|begin forwarded message:)$`)
+	// underscores is the line Outlook puts above its From:/Sent: block.
+	underscores = regexp.MustCompile(`^_{10,}$`)
+	// headerLine matches the fields of an Outlook-style quoted header block.
+	headerLine = regexp.MustCompile(`(?i)^\*?(from|sent|date|to|cc|subject|de|envoyé|von|gesendet|an|betreff|objet)\s?:\*?\s`)
+	fromLine   = regexp.MustCompile(`(?i)^\*?(from|de|von)\s?:`)
+	// mobileSignature matches the one-line signatures phones and apps add.
+	mobileSignature = regexp.MustCompile(`(?i)^(sent from my .+|sent from (mail|outlook) for .+|get outlook for .+|sent from yahoo mail.*|envoyé de mon .+|von meinem .+ gesendet)$`)
+)
+
+// maxSignatureLines is the most lines after a "-- " delimiter that are
+// still taken for a signature; anything longer is more likely a message
+// that happens to contain the delimiter.
+const maxSignatureLines = 15
+
+// SplitText splits a plain text body into the new part, the quoted part and
+// the signature. Everything from the first attribution line ("On ... wrote:"),
+// Outlook separator or quoted header block onwards is quoted, as are lines
+// starting with ">" before it, so an interleaved reply keeps only the lines
+// the sender wrote. The signature is the text after the last "-- " line, or
+// a trailing "Sent from my iPhone"-style line.
+func SplitText(text string) *Result {
+	text = normalizeNewlines(text)
+	lines := strings.Split(text, "\n")
+	result := &Result{Text: strings.TrimSpace(text)}
+
+	cut := quoteStart(lines)
+	var fresh, quoted []string
+	for i, line := range lines {
+		if i >= cut || strings.HasPrefix(line, ">") {
+			quoted = append(quoted, line)
+		} else {
+			fresh = append(fresh, line)
+		}
+	}
+
+	fresh, signature := splitSignature(fresh)
+	result.New = joinLines(fresh)
+	result.Quoted = joinLines(quoted)
+	result.Signature = joinLines(signature)
+	return result
+}
+
+// quoteStart returns the index of the first line of the quoted part, or
+// len(lines) if there is none.
+func quoteStart(lines []string) int {
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ">") {
+			continue
+		}
+		if attribution.MatchString(line) || separator.MatchString(line) {
+			return i
+		}
+		if next := nextNonEmpty(lines, i); next >= 0 {
+			joined := line + " " + strings.TrimSpace(lines[next])
+			if len(joined) < 200 && attribution.MatchString(joined) {
+				return i
+			}
+		}
+		if underscores.MatchString(line) {
+			if next := nextNonEmpty(lines, i); next >= 0 && headerLine.MatchString(strings.TrimSpace(lines[next])+" ") {
+				return i
+			}
+		}
+		if headerBlock(lines, i) {
+			return i
+		}
+	}
+	return len(lines)
+}
+
+// headerBlock reports whether lines[i] starts a From:/Sent:/To:/Subject:
+// block, which is how Outlook quotes the message it replies to.
+func headerBlock(lines []string, i int) bool {
+	if !fromLine.MatchString(strings.TrimSpace(lines[i])) {
+		return false
+	}
+	fields := 0
+	for j := i; j < len(lines) && j < i+6; j++ {
+		if headerLine.MatchString(strings.TrimSpace(lines[j]) + " ") {
+			fields++
+		}
+	}
+	return fields >= 3
+}
+
+func splitSignature(lines []string) (body, signature []string) {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	for i := end - 1; i >= 0 && i >= end-maxSignatureLines-1; i-- {
+		if strings.TrimRight(lines[i], " ") == "--" {
+			return lines[:i], lines[i+1 : end]
+		}
+	}
+	if end > 0 && mobileSignature.MatchString(strings.TrimSpace(lines[end-1])) {
+		return lines[:end-1], lines[end-1 : end]
+	}
+	return lines, nil
+}
+
+func nextNonEmpty(lines []string, i int) int {
+	for j := i + 1; j < len(lines) && j <= i+2; j++ {
+		if strings.TrimSpace(lines[j]) != "" {
+			return j
+		}
+	}
+	return -1
+}
+
+// joinLines joins lines, trims blank lines at both ends and squeezes runs of
+// blank lines to one.
+func joinLines(lines []string) string {
+	var out []string
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			blank = len(out) > 0
+			continue
+		}
+		if blank {
+			out = append(out, "")
+			blank = false
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+func normalizeNewlines(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+}
@@ -0,0 +1,354 @@
+// Package calendar reads iCalendar (RFC 5545) invitations, replies and
+// cancellations, as sent in text/calendar parts by Exchange, iCloud and
+// Google, into typed events. Times are resolved to real instants even when
+// the sender names its time zones the Windows way or only defines them in a
+// VTIMEZONE block.
+package calendar
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+)
+
+// Calendar is one VCALENDAR object.
+type Calendar struct {
+	// Method is the iTIP method (RFC 5546): REQUEST for an invitation or an
+	// update, REPLY for an attendee's answer, CANCEL, PUBLISH, COUNTER, ...
+	// It is empty for a plain calendar file.
+	Method    string   `json:"method,omitempty"`
+	ProductID string   `json:"product_id,omitempty"`
+	Events    []*Event `json:"events"`
+	// Warnings lists what could not be read exactly, such as an unknown
+	// time zone.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Event is one VEVENT.
+type Event struct {
+	UID string `json:"uid"`
+	// Sequence is the revision; an update or cancellation carries a higher
+	// one than the invitation it replaces.
+	Sequence int `json:"sequence,omitempty"`
+	// RecurrenceID is set when the event is one occurrence of a recurring
+	// event, and names the occurrence it replaces or answers.
+	RecurrenceID *Time `json:"recurrence_id,omitempty"`
+	// Status is TENTATIVE, CONFIRMED or CANCELLED.
+	Status      string `json:"status,omitempty"`
+	Summary     string `json:"summary,omitempty"`
+	Description string `json:"description,omitempty"`
+	Location    string `json:"location,omitempty"`
+	URL         string `json:"url,omitempty"`
+
+	Start *Time `json:"start,omitempty"`
+	// End is exclusive. It is worked out from DURATION, or from the start of
+	// an all-day event, when there is no DTEND.
+	End        *Time       `json:"end,omitempty"`
+	Recurrence *Recurrence `json:"recurrence,omitempty"`
+
+	Organizer *Attendee  `json:"organizer,omitempty"`
+	Attendees []Attendee `json:"attendees,omitempty"`
+	// Stamp is when the sender created this iCalendar object (DTSTAMP).
+	Stamp *time.Time `json:"stamp,omitempty"`
+}
+
+// Time is a DTSTART, DTEND or similar value.
+type Time struct {
+	// Time is the instant, in the event's time zone when it is known.
+	Time time.Time `json:"time"`
+	// TZID is the zone name given in the calendar, e.g. "Pacific Standard
+	// Time" or "Europe/Berlin".
+	TZID string `json:"tzid,omitempty"`
+	// AllDay is set for a DATE value; Time is then midnight UTC of that day.
+	AllDay bool `json:"all_day,omitempty"`
+	// Floating is set when the value has no zone, or a zone that could not
+	// be resolved: Time holds the wall clock as if it were UTC.
+	Floating bool `json:"floating,omitempty"`
+}
+
+// Attendee is an ATTENDEE or the ORGANIZER.
+type Attendee struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+	// Role is CHAIR, REQ-PARTICIPANT, OPT-PARTICIPANT or NON-PARTICIPANT.
+	Role string `json:"role,omitempty"`
+	// PartStat is the participation status: NEEDS-ACTION, ACCEPTED,
+	// DECLINED, TENTATIVE or DELEGATED. It is empty for the organizer.
+	PartStat string `json:"partstat,omitempty"`
+	RSVP     bool   `json:"rsvp,omitempty"`
+	// Type is INDIVIDUAL, GROUP, RESOURCE, ROOM or UNKNOWN.
+	Type string `json:"type,omitempty"`
+	// SentBy is who acts for the organizer or attendee, e.g. an assistant.
+	SentBy string `json:"sent_by,omitempty"`
+}
+
+// Recurrence is how an event repeats.
+type Recurrence struct {
+	// Rule is the RRULE as given, e.g. "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10".
+	Rule string `json:"rule"`
+	// Frequency is SECONDLY to YEARLY.
+	Frequency string     `json:"frequency"`
+	Interval  int        `json:"interval,omitempty"`
+	Count     int        `json:"count,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	// ByDay holds weekdays with an optional ordinal, e.g. "MO" or "-1FR".
+	ByDay      []string `json:"by_day,omitempty"`
+	ByMonthDay []int    `json:"by_month_day,omitempty"`
+	ByMonth    []int    `json:"by_month,omitempty"`
+	// Exceptions are the occurrences removed (EXDATE).
+	Exceptions []Time `json:"exceptions,omitempty"`
+	// Additions are extra occurrences (RDATE).
+	Additions []Time `json:"additions,omitempty"`
+}
+
+// Parse reads one VCALENDAR object. Properties that cannot be read are
+// skipped and noted in Warnings; only a calendar that cannot be read at all
+// is an error.
+func Parse(r io.Reader) (cal *Calendar, err error) {
+	// go-ical indexes past the end of some truncated parameter lists.
+	defer func() {
+		if r := recover(); r != nil {
+			cal, err = nil, fmt.Errorf("calendar: malformed calendar: %v", r)
+		}
+	}()
+	raw, err := ical.NewDecoder(r).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("calendar: %w", err)
+	}
+	cal = &Calendar{
+		Method:    strings.ToUpper(propValue(raw.Props, ical.PropMethod)),
+		ProductID: propValue(raw.Props, ical.PropProductID),
+		Events:    []*Event{},
+	}
+	zones := newZones(raw.Component, cal)
+	for _, child := range raw.Children {
+		if child.Name == ical.CompEvent {
+			cal.Events = append(cal.Events, readEvent(child, zones, cal))
+		}
+	}
+	return cal, nil
+}
+
+func readEvent(comp *ical.Component, zones *zones, cal *Calendar) *Event {
+	props := comp.Props
+	event := &Event{
+		UID:         propValue(props, ical.PropUID),
+		Status:      strings.ToUpper(propValue(props, ical.PropStatus)),
+		Summary:     text(props, ical.PropSummary),
+		Description: text(props, ical.PropDescription),
+		Location:    text(props, ical.PropLocation),
+		URL:         propValue(props, ical.PropURL),
+	}
+	if seq := propValue(props, ical.PropSequence); seq != "" {
+		n, err := strconv.Atoi(seq)
+		if err != nil {
+			cal.warn("event %s: SEQUENCE %q is not a number", event.UID, seq)
+		}
+		event.Sequence = n
+	}
+	readTime := func(name string) *Time {
+		prop := props.Get(name)
+		if prop == nil {
+			return nil
+		}
+		t, err := zones.time(prop)
+		if err != nil {
+			cal.warn("event %s: %s: %v", event.UID, name, err)
+			return nil
+		}
+		return &t
+	}
+	event.Start = readTime(ical.PropDateTimeStart)
+	event.End = readTime(ical.PropDateTimeEnd)
+	event.RecurrenceID = readTime(ical.PropRecurrenceID)
+	if stamp := readTime(ical.PropDateTimeStamp); stamp != nil {
+		event.Stamp = &stamp.Time
+	}
+	if event.End == nil && event.Start != nil {
+		event.End = impliedEnd(props, event.Start, event.UID, cal)
+	}
+
+	if prop := props.Get(ical.PropOrganizer); prop != nil {
+		organizer := attendee(prop)
+		event.Organizer = &organizer
+	}
+	for i := range props.Values(ical.PropAttendee) {
+		event.Attendees = append(event.Attendees, attendee(&props.Values(ical.PropAttendee)[i]))
+	}
+
+	if prop := props.Get(ical.PropRecurrenceRule); prop != nil {
+		recurrence, err := readRule(prop.Value)
+		if err != nil {
+			cal.warn("event %s: RRULE: %v", event.UID, err)
+		} else {
+			event.Recurrence = recurrence
+		}
+	}
+	if event.Recurrence != nil {
+		event.Recurrence.Exceptions = timeList(props.Values(ical.PropExceptionDates), zones, event.UID, cal)
+		event.Recurrence.Additions = timeList(props.Values(ical.PropRecurrenceDates), zones, event.UID, cal)
+	}
+	return event
+}
+
+// impliedEnd follows RFC 5545 section 3.6.1: the end is the start plus
+// DURATION, or the next day for an all-day event, or the start itself.
+func impliedEnd(props ical.Props, start *Time, uid string, cal *Calendar) *Time {
+	end := *start
+	if prop := props.Get(ical.PropDuration); prop != nil {
+		d, err := prop.Duration()
+		if err != nil {
+			cal.warn("event %s: DURATION: %v", uid, err)
+			return nil
+		}
+		end.Time = end.Time.Add(d)
+	} else if start.AllDay {
+		end.Time = end.Time.AddDate(0, 0, 1)
+	}
+	return &end
+}
+
+func attendee(prop *ical.Prop) Attendee {
+	a := Attendee{
+		Email:    mailto(prop.Value),
+		Name:     prop.Params.Get(ical.ParamCommonName),
+		Role:     strings.ToUpper(prop.Params.Get(ical.ParamRole)),
+		PartStat: strings.ToUpper(prop.Params.Get(ical.ParamParticipationStatus)),
+		RSVP:     strings.EqualFold(prop.Params.Get(ical.ParamRSVP), "TRUE"),
+		Type:     strings.ToUpper(prop.Params.Get(ical.ParamCalendarUserType)),
+		SentBy:   mailto(prop.Params.Get(ical.ParamSentBy)),
+	}
+	if prop.Name == ical.PropAttendee && a.PartStat == "" {
+		// The default for events, RFC 5545 section 3.2.12.
+		a.PartStat = "NEEDS-ACTION"
+	}
+	return a
+}
+
+func mailto(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 7 && strings.EqualFold(value[:7], "mailto:") {
+		return value[7:]
+	}
+	return value
+}
+
+func readRule(rule string) (*Recurrence, error) {
+	r := &Recurrence{Rule: rule}
+	for _, part := range strings.Split(rule, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		var err error
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.Frequency = strings.ToUpper(value)
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+		case "UNTIL":
+			var until time.Time
+			until, err = parseUntil(value)
+			r.Until = &until
+		case "BYDAY":
+			r.ByDay = strings.Split(strings.ToUpper(value), ",")
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = intList(value)
+		case "BYMONTH":
+			r.ByMonth, err = intList(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if r.Frequency == "" {
+		return nil, fmt.Errorf("no FREQ in %q", rule)
+	}
+	return r, nil
+}
+
+func parseUntil(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad date %q", value)
+}
+
+func intList(value string) ([]int, error) {
+	var list []int
+	for _, s := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// timeList reads EXDATE or RDATE properties, each of which may hold several
+// comma-separated values.
+func timeList(props []ical.Prop, zones *zones, uid string, cal *Calendar) []Time {
+	var list []Time
+	for _, prop := range props {
+		for _, value := range strings.Split(prop.Value, ",") {
+			one := prop
+			one.Value = strings.TrimSpace(value)
+			t, err := zones.time(&one)
+			if err != nil {
+				cal.warn("event %s: %s: %v", uid, prop.Name, err)
+				continue
+			}
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func propValue(props ical.Props, name string) string {
+	if prop := props.Get(name); prop != nil {
+		return strings.TrimSpace(prop.Value)
+	}
+	return ""
+}
+
+// text unescapes a TEXT value. Unlike ical.Prop.Text it keeps unknown
+// escapes such as Outlook's "\:" instead of failing.
+func text(props ical.Props, name string) string {
+	prop := props.Get(name)
+	if prop == nil {
+		return ""
+	}
+	var b strings.Builder
+	value := prop.Value
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' || i+1 == len(value) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		case '\\', ';', ',':
+			b.WriteByte(value[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+func (cal *Calendar) warn(format string, args ...any) {
+	cal.Warnings = append(cal.Warnings, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,130 @@
+package calendar
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func parse(t *testing.T, body string) *Calendar {
+	t.Helper()
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" + strings.ReplaceAll(body, "\n", "\r\n") + "END:VCALENDAR\r\n"
+	cal, err := Parse(strings.NewReader(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cal
+}
+
+// customZone is a VTIMEZONE under a name no zone database knows, so only
+// its own rules can resolve it. Its rules start in 1601, as Exchange's do.
+const customZone = `BEGIN:VTIMEZONE
+TZID:Office Time
+BEGIN:STANDARD
+DTSTART:16010101T030000
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=10
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:16010101T020000
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=3
+END:DAYLIGHT
+END:VTIMEZONE
+`
+
+func TestTimeZones(t *testing.T) {
+	tests := []struct {
+		name     string
+		dtstart  string
+		want     string
+		floating bool
+	}{
+		{"utc", "DTSTART:20240305T100000Z", "2024-03-05T10:00:00Z", false},
+		{"iana", "DTSTART;TZID=Europe/Berlin:20240705T100000", "2024-07-05T10:00:00+02:00", false},
+		{"vendor prefix", "DTSTART;TZID=/mozilla.org/20050126_1/America/New_York:20240105T100000", "2024-01-05T10:00:00-05:00", false},
+		{"windows name", `DTSTART;TZID="W. Europe Standard Time":20240105T100000`, "2024-01-05T10:00:00+01:00", false},
+		{"vtimezone winter", "DTSTART;TZID=Office Time:20240105T100000", "2024-01-05T10:00:00+01:00", false},
+		{"vtimezone summer", "DTSTART;TZID=Office Time:20240705T100000", "2024-07-05T10:00:00+02:00", false},
+		{"vtimezone after change", "DTSTART;TZID=Office Time:20241030T100000", "2024-10-30T10:00:00+01:00", false},
+		{"floating", "DTSTART:20240105T100000", "2024-01-05T10:00:00Z", true},
+		{"unknown zone", "DTSTART;TZID=Somewhere:20240105T100000", "2024-01-05T10:00:00Z", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := parse(t, customZone+"BEGIN:VEVENT\nUID:1\n"+tt.dtstart+"\nEND:VEVENT\n")
+			start := cal.Events[0].Start
+			if start == nil {
+				t.Fatalf("no start, warnings %q", cal.Warnings)
+			}
+			if got := start.Time.Format(time.RFC3339); got != tt.want || start.Floating != tt.floating {
+				t.Errorf("start = %s floating=%v, want %s floating=%v", got, start.Floating, tt.want, tt.floating)
+			}
+			if tt.name == "unknown zone" && len(cal.Warnings) != 1 {
+				t.Errorf("warnings = %q, want one about the zone", cal.Warnings)
+			}
+		})
+	}
+}
+
+func TestImpliedEnd(t *testing.T) {
+	cal := parse(t, `BEGIN:VEVENT
+UID:duration
+DTSTART:20240305T100000Z
+DURATION:PT1H30M
+END:VEVENT
+BEGIN:VEVENT
+UID:all-day
+DTSTART;VALUE=DATE:20240412
+END:VEVENT
+BEGIN:VEVENT
+UID:instant
+DTSTART:20240305T100000Z
+END:VEVENT
+`)
+	want := []string{"2024-03-05T11:30:00Z", "2024-04-13T00:00:00Z", "2024-03-05T10:00:00Z"}
+	for i, event := range cal.Events {
+		if event.End == nil || event.End.Time.Format(time.RFC3339) != want[i] {
+			t.Errorf("%s: end = %+v, want %s", event.UID, event.End, want[i])
+		}
+	}
+}
+
+func TestLenientProperties(t *testing.T) {
+	cal := parse(t, `BEGIN:VEVENT
+UID:lenient
+SEQUENCE:two
+SUMMARY:Review\: Q1\, Q2
+RRULE:COUNT=3
+ATTENDEE;PARTSTAT=declined:MAILTO:lee@example.com
+DTSTART:20240305T100000Z
+END:VEVENT
+`)
+	event := cal.Events[0]
+	if event.Summary != `Review\: Q1, Q2` {
+		t.Errorf("summary = %q", event.Summary)
+	}
+	if event.Recurrence != nil {
+		t.Errorf("recurrence without FREQ = %+v", event.Recurrence)
+	}
+	if len(event.Attendees) != 1 || event.Attendees[0].Email != "lee@example.com" || event.Attendees[0].PartStat != "DECLINED" {
+		t.Errorf("attendees = %+v", event.Attendees)
+	}
+	if len(cal.Warnings) != 2 {
+		t.Errorf("warnings = %q, want SEQUENCE and RRULE", cal.Warnings)
+	}
+}
+
+func TestBroken(t *testing.T) {
+	if _, err := Parse(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\n")); err == nil {
+		t.Error("truncated calendar parsed without error")
+	}
+	if _, err := Parse(strings.NewReader("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nATTENDEE;CN=")); err == nil {
+		t.Error("truncated parameter parsed without error")
+	}
+	if _, err := Parse(strings.NewReader("BEGIN:VCARD\r\nEND:VCARD\r\n")); err == nil {
+		t.Error("vCard parsed as a calendar")
+	}
+}
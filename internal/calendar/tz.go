@@ -0,0 +1,304 @@
+package calendar
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/teambition/rrule-go"
+
+	// Zone names must resolve the same way on every host.
+	_ "time/tzdata"
+)
+
+const (
+	dateLayout  = "20060102"
+	localLayout = "20060102T150405"
+	utcLayout   = "20060102T150405Z"
+)
+
+// zone turns a wall-clock time, held as if it were UTC, into an instant.
+type zone interface {
+	at(wall time.Time) time.Time
+}
+
+type locationZone struct {
+	loc *time.Location
+}
+
+func (z locationZone) at(wall time.Time) time.Time {
+	return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, z.loc)
+}
+
+// definedZone is a VTIMEZONE: a set of STANDARD and DAYLIGHT observances,
+// each starting at DTSTART and recurring by RRULE or RDATE. At any moment
+// the observance with the latest onset applies.
+type definedZone struct {
+	name        string
+	observances []observance
+}
+
+type observance struct {
+	// start and onsets are wall-clock times held as UTC, like the times
+	// they are compared with.
+	start  time.Time
+	rule   *rrule.ROption
+	onsets []time.Time
+	offset int
+}
+
+// latest returns the last onset at or before wall.
+func (o observance) latest(wall time.Time) (time.Time, bool) {
+	var best time.Time
+	if !o.start.After(wall) {
+		best = o.start
+	}
+	if o.rule != nil {
+		if t := o.ruleBefore(wall); t.After(best) {
+			best = t
+		}
+	}
+	for _, t := range o.onsets {
+		if !t.After(wall) && t.After(best) {
+			best = t
+		}
+	}
+	return best, !best.IsZero()
+}
+
+// ruleBefore returns the last occurrence of the rule at or before wall.
+// rrule stops iterating a few hundred years after DTSTART, and Exchange
+// starts its rules in 1601, so yearly rules are moved to start shortly
+// before wall, keeping their interval.
+func (o observance) ruleBefore(wall time.Time) time.Time {
+	opt := *o.rule
+	opt.Dtstart = o.start
+	if opt.Freq == rrule.YEARLY && opt.Count == 0 {
+		interval := max(opt.Interval, 1)
+		if years := (wall.Year() - 2 - o.start.Year()) / interval * interval; years > 0 {
+			opt.Dtstart = o.start.AddDate(years, 0, 0)
+		}
+	}
+	rule, err := rrule.NewRRule(opt)
+	if err != nil {
+		return time.Time{}
+	}
+	return rule.Before(wall, true)
+}
+
+func (z *definedZone) at(wall time.Time) time.Time {
+	offset, onset := z.observances[0].offset, time.Time{}
+	for _, o := range z.observances {
+		if t, ok := o.latest(wall); ok && t.After(onset) {
+			offset, onset = o.offset, t
+		}
+	}
+	return locationZone{time.FixedZone(z.name, offset)}.at(wall)
+}
+
+// zones resolves the TZIDs of one calendar.
+type zones struct {
+	defined  map[string]*definedZone
+	resolved map[string]zone
+	cal      *Calendar
+}
+
+func newZones(comp *ical.Component, cal *Calendar) *zones {
+	z := &zones{defined: map[string]*definedZone{}, resolved: map[string]zone{}, cal: cal}
+	for _, child := range comp.Children {
+		if child.Name != ical.CompTimezone {
+			continue
+		}
+		tzid := propValue(child.Props, ical.PropTimezoneID)
+		defined, err := readTimezone(tzid, child)
+		if err != nil {
+			cal.warn("VTIMEZONE %q: %v", tzid, err)
+			continue
+		}
+		z.defined[tzid] = defined
+	}
+	return z
+}
+
+func readTimezone(tzid string, comp *ical.Component) (*definedZone, error) {
+	defined := &definedZone{name: tzid}
+	for _, child := range comp.Children {
+		if child.Name != ical.CompTimezoneStandard && child.Name != ical.CompTimezoneDaylight {
+			continue
+		}
+		start, err := time.Parse(localLayout, propValue(child.Props, ical.PropDateTimeStart))
+		if err != nil {
+			return nil, fmt.Errorf("%s DTSTART: %w", child.Name, err)
+		}
+		offset, err := parseOffset(propValue(child.Props, ical.PropTimezoneOffsetTo))
+		if err != nil {
+			return nil, fmt.Errorf("%s TZOFFSETTO: %w", child.Name, err)
+		}
+		o := observance{start: start, offset: offset}
+		if rule := propValue(child.Props, ical.PropRecurrenceRule); rule != "" {
+			opt, err := rrule.StrToROption(rule)
+			if err != nil {
+				return nil, fmt.Errorf("%s RRULE: %w", child.Name, err)
+			}
+			opt.Dtstart = start
+			if _, err := rrule.NewRRule(*opt); err != nil {
+				return nil, fmt.Errorf("%s RRULE: %w", child.Name, err)
+			}
+			o.rule = opt
+		}
+		for _, prop := range child.Props.Values(ical.PropRecurrenceDates) {
+			for _, value := range strings.Split(prop.Value, ",") {
+				if t, err := time.Parse(localLayout, strings.TrimSpace(value)); err == nil {
+					o.onsets = append(o.onsets, t)
+				}
+			}
+		}
+		defined.observances = append(defined.observances, o)
+	}
+	if len(defined.observances) == 0 {
+		return nil, fmt.Errorf("no STANDARD or DAYLIGHT rules")
+	}
+	return defined, nil
+}
+
+// parseOffset reads a UTC offset such as "-0800" or "+053000" into seconds.
+func parseOffset(value string) (int, error) {
+	if len(value) < len("+hhmm") || (value[0] != '+' && value[0] != '-') {
+		return 0, fmt.Errorf("bad offset %q", value)
+	}
+	hours, err1 := strconv.Atoi(value[1:3])
+	minutes, err2 := strconv.Atoi(value[3:5])
+	seconds := 0
+	var err3 error
+	if len(value) >= 7 {
+		seconds, err3 = strconv.Atoi(value[5:7])
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, fmt.Errorf("bad offset %q", value)
+	}
+	offset := hours*3600 + minutes*60 + seconds
+	if value[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
+
+// time reads a DATE or DATE-TIME property.
+func (z *zones) time(prop *ical.Prop) (Time, error) {
+	value := strings.TrimSpace(prop.Value)
+	if prop.ValueType() == ical.ValueDate || len(value) == len(dateLayout) {
+		t, err := time.Parse(dateLayout, value)
+		return Time{Time: t, AllDay: true}, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(utcLayout, value)
+		return Time{Time: t}, err
+	}
+	wall, err := time.Parse(localLayout, value)
+	if err != nil {
+		return Time{}, err
+	}
+	tzid := prop.Params.Get(ical.ParamTimezoneID)
+	if tzid == "" {
+		return Time{Time: wall, Floating: true}, nil
+	}
+	zone := z.zone(tzid)
+	if zone == nil {
+		return Time{Time: wall, TZID: tzid, Floating: true}, nil
+	}
+	return Time{Time: zone.at(wall), TZID: tzid}, nil
+}
+
+// zone resolves tzid: an IANA name, possibly behind a vendor prefix such as
+// "/mozilla.org/20050126_1/"; else the calendar's own VTIMEZONE; else a
+// Windows zone name, which is what Exchange uses. Unknown zones are warned
+// about once and read as floating.
+func (z *zones) zone(tzid string) zone {
+	if resolved, ok := z.resolved[tzid]; ok {
+		return resolved
+	}
+	var resolved zone
+	if loc := loadIANA(tzid); loc != nil {
+		resolved = locationZone{loc}
+	} else if defined, ok := z.defined[tzid]; ok {
+		resolved = defined
+	} else if name, ok := windowsZones[strings.TrimSpace(tzid)]; ok {
+		if loc, err := time.LoadLocation(name); err == nil {
+			resolved = locationZone{loc}
+		}
+	}
+	if resolved == nil {
+		z.cal.warn("unknown time zone %q, reading its times as floating", tzid)
+	}
+	z.resolved[tzid] = resolved
+	return resolved
+}
+
+func loadIANA(tzid string) *time.Location {
+	name := strings.TrimSpace(tzid)
+	for name != "" {
+		if strings.Contains(name, "/") || name == "UTC" || name == "GMT" {
+			if loc, err := time.LoadLocation(name); err == nil {
+				return loc
+			}
+		}
+		// Drop a leading path segment and try again.
+		i := strings.IndexByte(name[1:], '/')
+		if i < 0 {
+			return nil
+		}
+		name = name[i+2:]
+	}
+	return nil
+}
+
+// windowsZones maps the Windows zone names Exchange and Outlook put in
+// TZID to IANA zones, after CLDR's windowsZones.xml (territory 001).
+var windowsZones = map[string]string{
+	"Dateline Standard Time":          "Etc/GMT+12",
+	"Hawaiian Standard Time":          "Pacific/Honolulu",
+	"Alaskan Standard Time":           "America/Anchorage",
+	"Pacific Standard Time":           "America/Los_Angeles",
+	"US Mountain Standard Time":       "America/Phoenix",
+	"Mountain Standard Time":          "America/Denver",
+	"Central America Standard Time":   "America/Guatemala",
+	"Central Standard Time":           "America/Chicago",
+	"Canada Central Standard Time":    "America/Regina",
+	"SA Pacific Standard Time":        "America/Bogota",
+	"Eastern Standard Time":           "America/New_York",
+	"US Eastern Standard Time":        "America/Indianapolis",
+	"Atlantic Standard Time":          "America/Halifax",
+	"Newfoundland Standard Time":      "America/St_Johns",
+	"E. South America Standard Time":  "America/Sao_Paulo",
+	"Argentina Standard Time":         "America/Buenos_Aires",
+	"UTC":                             "Etc/UTC",
+	"GMT Standard Time":               "Europe/London",
+	"Greenwich Standard Time":         "Atlantic/Reykjavik",
+	"W. Europe Standard Time":         "Europe/Berlin",
+	"Central Europe Standard Time":    "Europe/Budapest",
+	"Romance Standard Time":           "Europe/Paris",
+	"Central European Standard Time":  "Europe/Warsaw",
+	"W. Central Africa Standard Time": "Africa/Lagos",
+	"GTB Standard Time":               "Europe/Bucharest",
+	"E. Europe Standard Time":         "Europe/Chisinau",
+	"FLE Standard Time":               "Europe/Kiev",
+	"Egypt Standard Time":             "Africa/Cairo",
+	"South Africa Standard Time":      "Africa/Johannesburg",
+	"Israel Standard Time":            "Asia/Jerusalem",
+	"Turkey Standard Time":            "Europe/Istanbul",
+	"Russian Standard Time":           "Europe/Moscow",
+	"Arabian Standard Time":           "Asia/Dubai",
+	"Pakistan Standard Time":          "Asia/Karachi",
+	"India Standard Time":             "Asia/Calcutta",
+	"SE Asia Standard Time":           "Asia/Bangkok",
+	"China Standard Time":             "Asia/Shanghai",
+	"Singapore Standard Time":         "Asia/Singapore",
+	"Taipei Standard Time":            "Asia/Taipei",
+	"W. Australia Standard Time":      "Australia/Perth",
+	"Tokyo Standard Time":             "Asia/Tokyo",
+	"Korea Standard Time":             "Asia/Seoul",
+	"AUS Eastern Standard Time":       "Australia/Sydney",
+	"New Zealand Standard Time":       "Pacific/Auckland",
+}
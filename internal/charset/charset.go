@@ -0,0 +1,208 @@
+// Package charset decodes legacy and mislabeled charsets into UTF-8.
+//
+// Importing the package sets message.CharsetReader, the same way
+// github.com/emersion/go-message/charset does, so go-message decodes headers
+// and bodies through Default.
+package charset
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	UTF8  = "utf-8"
+	ASCII = "us-ascii"
+)
+
+// Default is the registry the parser and go-message use.
+var Default = NewRegistry()
+
+func init() {
+	message.CharsetReader = Default.Reader
+}
+
+// Registry maps charset labels to decoders.
+type Registry struct {
+	mu        sync.RWMutex
+	encodings map[string]encoding.Encoding
+	aliases   map[string]string
+}
+
+// NewRegistry returns a registry with the charsets and aliases we have met
+// on real servers (263.net, OVH, Exchange) already registered.
+func NewRegistry() *Registry {
+	r := &Registry{
+		encodings: make(map[string]encoding.Encoding),
+		aliases:   make(map[string]string),
+	}
+	r.Register(UTF8, unicode.UTF8, "utf8", "unicode-1-1-utf-8", "x-utf_8j")
+	r.Register(ASCII, charmap.Windows1252, "ascii", "ansi_x3.4-1968", "iso646-us", "us", "646")
+	// GB18030 is a superset of GBK, which is a superset of GB2312. Senders
+	// routinely label GBK text as gb2312, so all three decode as GB18030.
+	r.Register("gb18030", simplifiedchinese.GB18030, "gb2312", "gbk", "x-gbk", "cp936", "ms936", "euc-cn", "x-euc-cn", "csgb2312", "chinese")
+	r.Register("hz-gb-2312", simplifiedchinese.HZGB2312, "hz")
+	r.Register("big5", traditionalchinese.Big5, "big5-hkscs", "x-big5", "cn-big5", "csbig5", "cp950")
+	r.Register("iso-2022-jp", japanese.ISO2022JP, "csiso2022jp", "iso-2022-jp-1", "iso-2022-jp-2", "iso-2022-jp-3")
+	r.Register("shift_jis", japanese.ShiftJIS, "shift-jis", "sjis", "x-sjis", "ms_kanji", "cp932", "windows-31j", "csshiftjis")
+	r.Register("euc-jp", japanese.EUCJP, "x-euc-jp", "eucjp", "cseucpkdfmtjapanese")
+	r.Register("euc-kr", korean.EUCKR, "ks_c_5601-1987", "ks_c_5601", "ksc5601", "cp949", "x-windows-949")
+	// Windows-1252 is a superset of ISO-8859-1 for every byte mail clients
+	// actually send, and Outlook labels 1252 text as latin1 all the time.
+	r.Register("windows-1252", charmap.Windows1252, "cp1252", "x-cp1252", "win-1252", "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "l1", "ibm819", "cp819")
+	r.Register("iso-8859-15", charmap.ISO8859_15, "latin9", "iso8859-15")
+	r.Register("iso-8859-8", charmap.ISO8859_8, "iso-8859-8-i", "iso-8859-8-e", "visual", "logical")
+	r.Register("windows-1250", charmap.Windows1250, "cp1250", "x-cp1250")
+	r.Register("windows-1251", charmap.Windows1251, "cp1251", "x-cp1251")
+	r.Register("koi8-r", charmap.KOI8R, "koi8")
+	// A BOM picks the byte order; without one, utf-16 is big-endian
+	// (RFC 2781).
+	r.Register("utf-16", unicode.UTF16(unicode.BigEndian, unicode.UseBOM))
+	r.Register("utf-16be", unicode.UTF16(unicode.BigEndian, unicode.UseBOM))
+	r.Register("utf-16le", unicode.UTF16(unicode.LittleEndian, unicode.UseBOM))
+	return r
+}
+
+// Register adds an encoding under name and any number of aliases.
+func (r *Registry) Register(name string, enc encoding.Encoding, aliases ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = normalizeLabel(name)
+	r.encodings[name] = enc
+	for _, alias := range aliases {
+		r.aliases[normalizeLabel(alias)] = name
+	}
+}
+
+// Normalize returns the canonical name for label, or the cleaned-up label
+// itself if the registry does not know it.
+func (r *Registry) Normalize(label string) string {
+	label = normalizeLabel(label)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name, ok := r.aliases[label]; ok {
+		return name
+	}
+	return label
+}
+
+// Lookup returns the canonical name and encoding for label. Labels the
+// registry does not know are looked up in the IANA and WHATWG tables.
+func (r *Registry) Lookup(label string) (string, encoding.Encoding, error) {
+	name := r.Normalize(label)
+	r.mu.RLock()
+	enc, ok := r.encodings[name]
+	r.mu.RUnlock()
+	if ok {
+		return name, enc, nil
+	}
+	if enc, err := ianaindex.MIME.Encoding(name); err == nil && enc != nil {
+		return name, enc, nil
+	}
+	if enc, err := htmlindex.Get(name); err == nil && enc != nil {
+		return name, enc, nil
+	}
+	return name, nil, fmt.Errorf("charset %q: unsupported charset", label)
+}
+
+// Reader converts input from label to UTF-8. It has the signature of
+// message.CharsetReader. It trusts the label; use Decode when the bytes are
+// available and the label may be wrong.
+func (r *Registry) Reader(label string, input io.Reader) (io.Reader, error) {
+	name, enc, err := r.Lookup(label)
+	if err != nil {
+		return nil, err
+	}
+	if name == UTF8 {
+		return input, nil
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// Result records how one part was decoded.
+type Result struct {
+	// Label is the charset the part declared, possibly empty.
+	Label string `json:"label,omitempty"`
+	// Charset is the decoder that was actually used.
+	Charset string `json:"charset"`
+	// Detected is true when Charset came from the heuristics because the
+	// label was missing, unknown or wrong.
+	Detected bool `json:"detected,omitempty"`
+}
+
+// Decode converts raw to UTF-8. Unlike Reader it checks the label against
+// the bytes, and falls back to detection when the label is missing, unknown,
+// or clearly wrong.
+func (r *Registry) Decode(label string, raw []byte) (string, Result) {
+	result := Result{Label: label}
+	name, enc, err := r.Lookup(label)
+	switch {
+	case strings.TrimSpace(label) == "", err != nil:
+		name = Detect(raw)
+		result.Detected = true
+	case name == UTF8 && !utf8.Valid(raw):
+		name = Detect(raw)
+		result.Detected = true
+	case name == ASCII && !isASCII(raw):
+		// 8-bit bytes under an ascii label: the label is a client default.
+		name = Detect(raw)
+		result.Detected = true
+	case name == "windows-1252" && isUTF8(raw):
+		// Probably the most common mislabel: UTF-8 text from a client that
+		// hardcodes latin1 or ascii.
+		name = UTF8
+		result.Detected = true
+	case name == "iso-2022-jp" && !bytes.Contains(raw, []byte{0x1b}) && !isASCII(raw):
+		name = Detect(raw)
+		result.Detected = true
+	}
+	if result.Detected {
+		_, enc, _ = r.Lookup(name)
+	}
+	result.Charset = name
+
+	text := decodeWith(enc, raw)
+	if !result.Detected && strings.ContainsRune(text, utf8.RuneError) && !bytes.Contains(raw, []byte("\uFFFD")) {
+		// The label decodes with errors. Use the detected charset if that
+		// decodes cleanly.
+		if detected := Detect(raw); detected != name {
+			_, detectedEnc, _ := r.Lookup(detected)
+			if alt := decodeWith(detectedEnc, raw); !strings.ContainsRune(alt, utf8.RuneError) {
+				return alt, Result{Label: label, Charset: detected, Detected: true}
+			}
+		}
+	}
+	return text, result
+}
+
+func decodeWith(enc encoding.Encoding, raw []byte) string {
+	if enc == nil || enc == unicode.UTF8 {
+		return strings.ToValidUTF8(string(raw), "\uFFFD")
+	}
+	b, err := enc.NewDecoder().Bytes(raw)
+	if err != nil {
+		return strings.ToValidUTF8(string(raw), "\uFFFD")
+	}
+	return string(b)
+}
+
+func normalizeLabel(label string) string {
+	label = strings.ToLower(strings.TrimSpace(label))
+	label = strings.Trim(label, `"'`)
+	return strings.ReplaceAll(label, " ", "")
+}
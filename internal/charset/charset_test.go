@@ -0,0 +1,131 @@
+package charset
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"UTF8":           UTF8,
+		" \"GB2312\" ":   "gb18030",
+		"x-gbk":          "gb18030",
+		"ks_c_5601-1987": "euc-kr",
+		"Shift-JIS":      "shift_jis",
+		"latin1":         "windows-1252",
+		"ISO-8859-1":     "windows-1252",
+		"ascii":          ASCII,
+		"utf-16le":       "utf-16le",
+		"iso-2022-kr":    "iso-2022-kr",
+		"x-unknown":      "x-unknown",
+	}
+	for label, want := range tests {
+		if got := Default.Normalize(label); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		label    string
+		raw      string
+		want     string
+		charset  string
+		detected bool
+	}{
+		{"UTF-8", "utf-8", "naïve", "naïve", UTF8, false},
+		{"GBK labelled gb2312", "gb2312", "\xc4\xe3\xba\xc3\xa3\xac\xca\xc0\xbd\xe7", "你好，世界", "gb18030", false},
+		{"Big5", "big5", "\xa4\xa4\xa4\xe5", "中文", "big5", false},
+		{"Shift_JIS", "shift_jis", "\x93\xfa\x96\x7b\x8c\xea", "日本語", "shift_jis", false},
+		{"ISO-2022-JP", "iso-2022-jp", "\x1b$BF|K\\8l\x1b(B", "日本語", "iso-2022-jp", false},
+		{"EUC-KR", "ks_c_5601-1987", "\xc7\xd1\xb1\xb9\xbe\xee", "한국어", "euc-kr", false},
+		{"Latin-1 is Windows-1252", "iso-8859-1", "caf\xe9 \x80", "café €", "windows-1252", false},
+		{"KOI8-R", "koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет", "koi8-r", false},
+		{"UTF-16 without BOM is big-endian", "utf-16", "\x00h\x00i", "hi", "utf-16", false},
+		{"UTF-16 with little-endian BOM", "utf-16", "\xff\xfeh\x00i\x00", "hi", "utf-16", false},
+		{"UTF-16 with big-endian BOM", "utf-16", "\xfe\xff\x00h\x00i", "hi", "utf-16", false},
+		{"UTF-16LE", "utf-16le", "h\x00i\x00", "hi", "utf-16le", false},
+		{"UTF-16BE", "utf-16be", "\x00h\x00i", "hi", "utf-16be", false},
+		{"missing label", "", "caf\xc3\xa9", "café", UTF8, true},
+		{"unknown label", "x-unknown", "caf\xe9 cr\xe8me et cr\xe9pes", "café crème et crépes", "windows-1252", true},
+		{"UTF-8 label on Latin-1", "utf-8", "caf\xe9 cr\xe8me et cr\xe9pes", "café crème et crépes", "windows-1252", true},
+		{"ASCII label on UTF-8", "us-ascii", "caf\xc3\xa9", "café", UTF8, true},
+		{"Windows-1252 label on UTF-8", "windows-1252", "caf\xc3\xa9", "café", UTF8, true},
+		{"GBK labelled utf-8", "utf-8", "\xc4\xe3\xba\xc3\xa3\xac\xca\xc0\xbd\xe7", "你好，世界", "gb18030", true},
+		{"ISO-2022-JP label without escapes", "iso-2022-jp", "\xc4\xe3\xba\xc3\xa3\xac\xca\xc0\xbd\xe7", "你好，世界", "gb18030", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, result := Default.Decode(tt.label, []byte(tt.raw))
+			if got != tt.want {
+				t.Errorf("Decode = %q, want %q", got, tt.want)
+			}
+			if result.Label != tt.label || result.Charset != tt.charset || result.Detected != tt.detected {
+				t.Errorf("result = %+v, want charset %q, detected %v", result, tt.charset, tt.detected)
+			}
+		})
+	}
+}
+
+// TestISO2022KR checks that ISO-2022-KR is not decoded as EUC-KR: the two
+// share a character set but not an encoding.
+func TestISO2022KR(t *testing.T) {
+	raw := "\x1b$)C\x0e\x47\x51\x31\x39\x0f"
+	got, result := Default.Decode("iso-2022-kr", []byte(raw))
+	if result.Charset == "euc-kr" {
+		t.Errorf("decoded as EUC-KR: %q", got)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"plain text", ASCII},
+		{"naïve", UTF8},
+		{"\xef\xbb\xbfbom", UTF8},
+		{"\xff\xfeh\x00", "utf-16"},
+		{"\xfe\xff\x00h", "utf-16be"},
+		{"\x1b$BF|K\\8l\x1b(B", "iso-2022-jp"},
+		{"\xc4\xe3\xba\xc3\xa3\xac\xca\xc0\xbd\xe7", "gb18030"},
+		{"caf\xe9 cr\xe8me et cr\xe9pes", "windows-1252"},
+	}
+	for _, tt := range tests {
+		if got := Detect([]byte(tt.raw)); got != tt.want {
+			t.Errorf("Detect(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	r, err := Default.Reader("GB2312", strings.NewReader("\xc4\xe3\xba\xc3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "你好" {
+		t.Errorf("Reader = %q, %v", got, err)
+	}
+	if _, err := Default.Reader("x-unknown", strings.NewReader("")); err == nil {
+		t.Error("Reader accepted an unknown charset")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	_, enc, err := r.Lookup("iso-8859-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Register("x-custom", enc, "X-Alias")
+	if name, _, err := r.Lookup("x-alias"); err != nil || name != "x-custom" {
+		t.Errorf("Lookup(x-alias) = %q, %v", name, err)
+	}
+	if got, _ := r.Decode("x-alias", []byte("\xa4")); got != "€" {
+		t.Errorf("Decode(x-alias) = %q, want €", got)
+	}
+}
@@ -0,0 +1,114 @@
+package charset
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// detectCandidates are tried in order when the bytes are neither ASCII nor
+// UTF-8. The order breaks ties: most of our mislabeled mail comes from
+// Chinese providers.
+var detectCandidates = []struct {
+	name string
+	enc  encoding.Encoding
+}{
+	{"gb18030", simplifiedchinese.GB18030},
+	{"big5", traditionalchinese.Big5},
+	{"shift_jis", japanese.ShiftJIS},
+	{"euc-jp", japanese.EUCJP},
+	{"euc-kr", korean.EUCKR},
+}
+
+// Detect guesses the charset of raw. It never fails: when nothing else fits,
+// the answer is windows-1252, which maps every byte to something.
+func Detect(raw []byte) string {
+	switch {
+	case bytes.HasPrefix(raw, []byte{0xef, 0xbb, 0xbf}):
+		return UTF8
+	case bytes.HasPrefix(raw, []byte{0xff, 0xfe}):
+		return "utf-16"
+	case bytes.HasPrefix(raw, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	case hasISO2022JPEscape(raw):
+		return "iso-2022-jp"
+	case isASCII(raw):
+		return ASCII
+	case isUTF8(raw):
+		return UTF8
+	}
+
+	best, bestScore := "windows-1252", 0.0
+	for _, candidate := range detectCandidates {
+		decoded, err := candidate.enc.NewDecoder().Bytes(raw)
+		if err != nil {
+			continue
+		}
+		if score := cjkScore(string(decoded)); score > bestScore {
+			best, bestScore = candidate.name, score
+		}
+	}
+	// Latin text decoded as a CJK charset still produces some ideographs, so
+	// require most of the non-ASCII runes to look right before trusting it.
+	if bestScore < 0.8 {
+		return "windows-1252"
+	}
+	return best
+}
+
+// cjkScore is the share of non-ASCII runes that are common CJK characters,
+// kana, hangul or CJK punctuation. Replacement and private-use runes count
+// against it.
+func cjkScore(s string) float64 {
+	var good, total int
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			continue
+		}
+		total++
+		switch {
+		case r == utf8.RuneError, unicode.Is(unicode.Co, r):
+			good -= 4
+		case r >= 0x4e00 && r <= 0x9fff,
+			r >= 0x3000 && r <= 0x30ff,
+			r >= 0xac00 && r <= 0xd7af,
+			r >= 0xff00 && r <= 0xffef:
+			good++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(good) / float64(total)
+}
+
+func hasISO2022JPEscape(raw []byte) bool {
+	for _, seq := range []string{"\x1b$B", "\x1b$@", "\x1b(J", "\x1b$(D"} {
+		if bytes.Contains(raw, []byte(seq)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(raw []byte) bool {
+	for _, b := range raw {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// isUTF8 reports whether raw is valid UTF-8 with at least one multi-byte
+// sequence.
+func isUTF8(raw []byte) bool {
+	return !isASCII(raw) && utf8.Valid(raw) && !strings.ContainsRune(string(raw), utf8.RuneError)
+}
@@ -0,0 +1,574 @@
+// Package dedupe finds copies of the same message across the folders of an
+// account and removes the extra ones. Messages are matched by fingerprint:
+// the Message-ID when it can be trusted, else a hash of the header and body.
+package dedupe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/batch"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/fingerprint"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog/log"
+)
+
+// headerFields are all a fingerprint looks at in the header.
+var headerFields = []string{"Message-ID", "Date", "From", "To", "Cc", "Subject"}
+
+// bodyChunkSize keeps the body fetch for content fingerprints small, since
+// batch buffers a whole chunk.
+const bodyChunkSize = 50
+
+// Options tunes Scan.
+type Options struct {
+	// Concurrency is the maximum number of connections to open. Defaults
+	// to 1.
+	Concurrency int
+	// Folders restricts the scan. Empty means every selectable folder
+	// except virtual ones such as Gmail's All Mail, which show every
+	// message a second time.
+	Folders []string
+	// Prefer lists the folders whose copy is kept, best first. Defaults to
+	// INBOX. After them come ordinary folders, then Trash and Junk; ties go
+	// to the folder name and then the lowest UID.
+	Prefer []string
+}
+
+// Copy is one stored copy of a message.
+type Copy struct {
+	Folder       string      `json:"folder"`
+	UIDValidity  uint32      `json:"uid_validity"`
+	UID          imap.UID    `json:"uid"`
+	Size         int64       `json:"size"`
+	InternalDate time.Time   `json:"internal_date"`
+	Flags        []imap.Flag `json:"flags,omitempty"`
+	// MessageID is the normalized Message-ID, trusted or not. Delete
+	// checks it to be sure the kept copy is still the same message.
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// Group is a message stored more than once.
+type Group struct {
+	// Fingerprint is "id:<Message-ID>" or "sha256:...". A Message-ID that
+	// several different messages carry gets the digest of each one's date,
+	// sender and subject appended.
+	Fingerprint string `json:"fingerprint"`
+	Subject     string `json:"subject,omitempty"`
+	Keep        Copy   `json:"keep"`
+	Extra       []Copy `json:"extra"`
+}
+
+// Report is the result of a scan.
+type Report struct {
+	Folders  int     `json:"folders"`
+	Messages int     `json:"messages"`
+	Groups   []Group `json:"groups"`
+	// ReusedIDs are Message-IDs found on messages that differ in date,
+	// sender or subject. Their copies were grouped per message.
+	ReusedIDs []string `json:"reused_ids,omitempty"`
+	// Failed maps each folder that could not be scanned to the error.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// ExtraCopies is the number of copies Delete would remove.
+func (r *Report) ExtraCopies() int {
+	n := 0
+	for _, g := range r.Groups {
+		n += len(g.Extra)
+	}
+	return n
+}
+
+type folder struct {
+	name string
+	// demoted folders (Trash, Junk) keep a copy only if no other folder
+	// has one.
+	demoted bool
+}
+
+// scanned is one message as the scan saw it.
+type scanned struct {
+	Copy
+	fingerprint string
+	digest      string
+	subject     string
+}
+
+// Scan reads the fingerprint of every message in the account and groups
+// the copies.
+func Scan(ctx context.Context, dial session.Dialer, options *Options) (*Report, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	first, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	folders, err := listFolders(first, options.Folders)
+	if err != nil {
+		first.Close()
+		return nil, err
+	}
+
+	report := &Report{Folders: len(folders), Failed: map[string]string{}}
+	var (
+		mu       sync.Mutex
+		messages []scanned
+	)
+	session.Each(ctx, first, dial, options.Concurrency, folders, func(_ int, c *imapclient.Client, f folder) error {
+		found, err := scanFolder(ctx, c, f.name)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("folderName", f.name).Msg("Failed to scan folder, skipping it")
+			report.Failed[f.name] = err.Error()
+			return err
+		}
+		messages = append(messages, found...)
+		return nil
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report.Messages = len(messages)
+	report.Groups, report.ReusedIDs = group(messages, ranking(folders, options.Prefer))
+	return report, nil
+}
+
+// listFolders returns the folders to scan. Names given by the caller are
+// taken as they are, apart from the Trash and Junk ranking.
+func listFolders(c *imapclient.Client, only []string) ([]folder, error) {
+	list, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, name := range only {
+		wanted[name] = true
+	}
+	var folders []folder
+	for _, data := range list {
+		virtual := hasAttr(data.Attrs, imap.MailboxAttrAll) || hasAttr(data.Attrs, imap.MailboxAttrFlagged) || hasAttr(data.Attrs, "\\Important")
+		switch {
+		case hasAttr(data.Attrs, imap.MailboxAttrNoSelect) || hasAttr(data.Attrs, imap.MailboxAttrNonExistent):
+			continue
+		case len(only) > 0 && !wanted[data.Mailbox]:
+			continue
+		case len(only) == 0 && virtual:
+			continue
+		}
+		folders = append(folders, folder{
+			name:    data.Mailbox,
+			demoted: hasAttr(data.Attrs, imap.MailboxAttrTrash) || hasAttr(data.Attrs, imap.MailboxAttrJunk) || isTrashName(data.Mailbox),
+		})
+	}
+	return folders, nil
+}
+
+// isTrashName recognizes Trash and Junk on servers without SPECIAL-USE.
+func isTrashName(name string) bool {
+	switch strings.ToLower(name) {
+	case "trash", "deleted messages", "deleted items", "junk", "spam", "bulk mail":
+		return true
+	}
+	return false
+}
+
+func hasAttr(attrs []imap.MailboxAttr, attr imap.MailboxAttr) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(string(a), string(attr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func scanFolder(ctx context.Context, c *imapclient.Client, name string) ([]scanned, error) {
+	selected, err := c.Select(name, &imap.SelectOptions{ReadOnly: true}).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("select: %w", err)
+	}
+	if selected.NumMessages == 0 {
+		return nil, nil
+	}
+	data, err := c.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+
+	section := &imap.FetchItemBodySection{Specifier: imap.PartSpecifierHeader, HeaderFields: headerFields, Peek: true}
+	fetchOpts := &imap.FetchOptions{Flags: true, InternalDate: true, RFC822Size: true, BodySection: []*imap.FetchItemBodySection{section}}
+	var found []scanned
+	headers := make(map[imap.UID]textproto.Header)
+	err = batch.Fetch(ctx, c, data.AllUIDs(), fetchOpts, nil, func(msg *imapclient.FetchMessageBuffer) error {
+		var header textproto.Header
+		for _, raw := range msg.BodySection {
+			// A malformed line only stops the header read; the fields
+			// before it are still usable.
+			header, _ = textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+		}
+		env, _ := envelope.FromHeader(header)
+		found = append(found, scanned{
+			Copy: Copy{
+				Folder:       name,
+				UIDValidity:  selected.UIDValidity,
+				UID:          msg.UID,
+				Size:         msg.RFC822Size,
+				InternalDate: msg.InternalDate,
+				Flags:        msg.Flags,
+				MessageID:    env.MessageID,
+			},
+			fingerprint: fingerprint.FromMessageID(env.MessageID),
+			digest:      fingerprint.Digest(env),
+			subject:     env.Subject,
+		})
+		headers[msg.UID] = header
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch headers: %w", err)
+	}
+
+	// Messages without a trusted Message-ID are known by their content.
+	index := make(map[imap.UID]int)
+	var untrusted []imap.UID
+	for i, s := range found {
+		if s.fingerprint == "" {
+			index[s.UID] = i
+			untrusted = append(untrusted, s.UID)
+		}
+	}
+	if len(untrusted) == 0 {
+		return found, nil
+	}
+	text := &imap.FetchItemBodySection{Specifier: imap.PartSpecifierText, Peek: true}
+	err = batch.Fetch(ctx, c, untrusted, &imap.FetchOptions{BodySection: []*imap.FetchItemBodySection{text}}, &batch.Options{ChunkSize: bodyChunkSize}, func(msg *imapclient.FetchMessageBuffer) error {
+		i, ok := index[msg.UID]
+		if !ok {
+			return nil
+		}
+		for _, body := range msg.BodySection {
+			found[i].fingerprint = fingerprint.Content(headers[msg.UID], body)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch bodies: %w", err)
+	}
+	// A message expunged between the two fetches has no fingerprint.
+	kept := found[:0]
+	for _, s := range found {
+		if s.fingerprint != "" {
+			kept = append(kept, s)
+		}
+	}
+	return kept, nil
+}
+
+// ranking returns the sort key of a folder: lower keeps its copy first.
+func ranking(folders []folder, prefer []string) func(name string) int {
+	if len(prefer) == 0 {
+		prefer = []string{"INBOX"}
+	}
+	demoted := make(map[string]bool)
+	for _, f := range folders {
+		demoted[f.name] = f.demoted
+	}
+	return func(name string) int {
+		for i, p := range prefer {
+			if strings.EqualFold(p, name) {
+				return i
+			}
+		}
+		if demoted[name] {
+			return len(prefer) + 1
+		}
+		return len(prefer)
+	}
+}
+
+// group collects the copies of each fingerprint. Copies that share a
+// Message-ID but disagree on date, sender or subject are told apart by
+// their digest.
+func group(messages []scanned, rank func(string) int) ([]Group, []string) {
+	digests := make(map[string]map[string]bool)
+	for _, m := range messages {
+		if fingerprint.IsContent(m.fingerprint) {
+			continue
+		}
+		if digests[m.fingerprint] == nil {
+			digests[m.fingerprint] = make(map[string]bool)
+		}
+		digests[m.fingerprint][m.digest] = true
+	}
+	var reused []string
+	for fp, set := range digests {
+		if len(set) > 1 {
+			reused = append(reused, strings.TrimPrefix(fp, "id:"))
+		}
+	}
+	sort.Strings(reused)
+
+	byKey := make(map[string][]scanned)
+	var keys []string
+	for _, m := range messages {
+		key := m.fingerprint
+		if len(digests[key]) > 1 {
+			key += "#" + m.digest
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], m)
+	}
+	sort.Strings(keys)
+
+	var groups []Group
+	for _, key := range keys {
+		copies := byKey[key]
+		if len(copies) < 2 {
+			continue
+		}
+		sort.Slice(copies, func(i, j int) bool {
+			a, b := copies[i], copies[j]
+			if ra, rb := rank(a.Folder), rank(b.Folder); ra != rb {
+				return ra < rb
+			}
+			if a.Folder != b.Folder {
+				return a.Folder < b.Folder
+			}
+			return a.UID < b.UID
+		})
+		g := Group{Fingerprint: key, Subject: copies[0].subject, Keep: copies[0].Copy}
+		for _, c := range copies[1:] {
+			g.Extra = append(g.Extra, c.Copy)
+		}
+		groups = append(groups, g)
+	}
+	return groups, reused
+}
+
+// Result is what Delete did.
+type Result struct {
+	Deleted int `json:"deleted"`
+	// Flagged counts the flags copied onto kept copies from the copies
+	// deleted, so nothing read, starred or answered is lost.
+	Flagged int `json:"flagged"`
+	// Failed maps each folder that was skipped to the reason.
+	Failed map[string]string `json:"failed,omitempty"`
+	// Skipped maps the fingerprint of each group left alone, because its
+	// kept copy could not be found as scanned, to the reason.
+	Skipped map[string]string `json:"skipped,omitempty"`
+}
+
+// ErrNoUIDPlus is returned by Delete when the server cannot expunge single
+// UIDs. A plain EXPUNGE would also remove every other message marked
+// \Deleted in the folder.
+var ErrNoUIDPlus = errors.New("dedupe: server does not support UIDPLUS, refusing to expunge")
+
+// Delete removes the extra copies in report. Each kept copy is looked up
+// first, and a group whose kept copy is gone or now another message keeps
+// all its copies, since removing the extras would lose the message. Flags
+// the kept copy lacks are copied onto it; when that fails, the group's
+// copies stay. A folder whose UIDVALIDITY changed since the scan is
+// skipped, since its UIDs may now name other messages.
+func Delete(ctx context.Context, dial session.Dialer, report *Report) (*Result, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := c.Logout().Wait(); err != nil {
+			c.Close()
+		}
+	}()
+	if !c.Caps().Has(imap.CapUIDPlus) {
+		return nil, ErrNoUIDPlus
+	}
+	result := &Result{Failed: map[string]string{}, Skipped: map[string]string{}}
+	uidValidity := make(map[string]uint32)
+	for _, g := range report.Groups {
+		for _, cp := range append([]Copy{g.Keep}, g.Extra...) {
+			uidValidity[cp.Folder] = cp.UIDValidity
+		}
+	}
+	// selectFolder selects a folder unless it failed before or changed.
+	selectFolder := func(name string) bool {
+		if _, failed := result.Failed[name]; failed {
+			return false
+		}
+		selected, err := c.Select(name, nil).Wait()
+		if err != nil {
+			result.Failed[name] = fmt.Sprintf("select: %v", err)
+			return false
+		}
+		if selected.UIDValidity != uidValidity[name] {
+			result.Failed[name] = fmt.Sprintf("UIDVALIDITY changed from %d to %d since the scan", uidValidity[name], selected.UIDValidity)
+			return false
+		}
+		return true
+	}
+
+	groups, err := verifyKept(ctx, c, report.Groups, selectFolder, result)
+	if err != nil {
+		return result, err
+	}
+
+	// Flags to add to kept copies, by folder and flag.
+	flags := make(map[string]map[imap.Flag]imap.UIDSet)
+	for _, g := range groups {
+		has := make(map[imap.Flag]bool)
+		for _, f := range g.Keep.Flags {
+			has[f] = true
+		}
+		for _, extra := range g.Extra {
+			for _, f := range extra.Flags {
+				if has[f] || f == imap.FlagDeleted || f == "\\Recent" {
+					continue
+				}
+				has[f] = true
+				if flags[g.Keep.Folder] == nil {
+					flags[g.Keep.Folder] = make(map[imap.Flag]imap.UIDSet)
+				}
+				set := flags[g.Keep.Folder][f]
+				set.AddNum(g.Keep.UID)
+				flags[g.Keep.Folder][f] = set
+			}
+		}
+	}
+	for _, name := range sortedKeys(flags) {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if !selectFolder(name) {
+			continue
+		}
+		for flag, uids := range flags[name] {
+			store := &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{flag}, Silent: true}
+			if err := c.Store(uids, store, nil).Close(); err != nil {
+				result.Failed[name] = fmt.Sprintf("store %s: %v", flag, err)
+				break
+			}
+			result.Flagged += countUIDs(uids)
+		}
+	}
+
+	extra := make(map[string]imap.UIDSet)
+	for _, g := range groups {
+		if _, failed := result.Failed[g.Keep.Folder]; failed {
+			continue
+		}
+		for _, cp := range g.Extra {
+			set := extra[cp.Folder]
+			set.AddNum(cp.UID)
+			extra[cp.Folder] = set
+		}
+	}
+	for _, name := range sortedKeys(extra) {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if !selectFolder(name) {
+			continue
+		}
+		uids := extra[name]
+		store := &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagDeleted}, Silent: true}
+		if err := c.Store(uids, store, nil).Close(); err != nil {
+			result.Failed[name] = fmt.Sprintf("store \\Deleted: %v", err)
+			continue
+		}
+		if err := c.UIDExpunge(uids).Close(); err != nil {
+			result.Failed[name] = fmt.Sprintf("expunge: %v", err)
+			continue
+		}
+		result.Deleted += countUIDs(uids)
+		log.Ctx(ctx).Debug().Str("folderName", name).Str("uids", uids.String()).Msg("Deleted extra copies")
+	}
+	return result, nil
+}
+
+// verifyKept returns the groups whose kept copy is still in its folder
+// under its UID and, when it had one, its Message-ID. The others are
+// recorded in result.Skipped.
+func verifyKept(ctx context.Context, c *imapclient.Client, groups []Group, selectFolder func(string) bool, result *Result) ([]Group, error) {
+	byFolder := make(map[string][]imap.UID)
+	for _, g := range groups {
+		byFolder[g.Keep.Folder] = append(byFolder[g.Keep.Folder], g.Keep.UID)
+	}
+	// found maps each kept copy still there to its Message-ID.
+	found := make(map[string]map[imap.UID]string)
+	section := &imap.FetchItemBodySection{Specifier: imap.PartSpecifierHeader, HeaderFields: []string{"Message-ID"}, Peek: true}
+	fetchOpts := &imap.FetchOptions{BodySection: []*imap.FetchItemBodySection{section}}
+	for _, name := range sortedKeys(byFolder) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !selectFolder(name) {
+			continue
+		}
+		ids := make(map[imap.UID]string)
+		err := batch.Fetch(ctx, c, byFolder[name], fetchOpts, nil, func(msg *imapclient.FetchMessageBuffer) error {
+			var header textproto.Header
+			for _, raw := range msg.BodySection {
+				header, _ = textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+			}
+			env, _ := envelope.FromHeader(header)
+			ids[msg.UID] = env.MessageID
+			return nil
+		})
+		if err != nil {
+			result.Failed[name] = fmt.Sprintf("fetch kept copies: %v", err)
+			continue
+		}
+		found[name] = ids
+	}
+
+	var verified []Group
+	for _, g := range groups {
+		ids, ok := found[g.Keep.Folder]
+		if !ok {
+			result.Skipped[g.Fingerprint] = fmt.Sprintf("kept copy in %s not checked: %s", g.Keep.Folder, result.Failed[g.Keep.Folder])
+			continue
+		}
+		id, ok := ids[g.Keep.UID]
+		switch {
+		case !ok:
+			result.Skipped[g.Fingerprint] = fmt.Sprintf("kept copy %s/%d is gone", g.Keep.Folder, g.Keep.UID)
+		case id != g.Keep.MessageID:
+			result.Skipped[g.Fingerprint] = fmt.Sprintf("kept copy %s/%d now has Message-ID %q", g.Keep.Folder, g.Keep.UID, id)
+		default:
+			verified = append(verified, g)
+		}
+	}
+	return verified, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func countUIDs(set imap.UIDSet) int {
+	n := 0
+	for _, r := range set {
+		n += int(r.Stop-r.Start) + 1
+	}
+	return n
+}
@@ -0,0 +1,229 @@
+package dedupe
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+)
+
+func message(id, subject, body string) []byte {
+	return []byte(fmt.Sprintf("From: Dana <dana@example.com>\r\n"+
+		"To: lee@example.com\r\n"+
+		"Subject: %s\r\n"+
+		"Message-ID: %s\r\n"+
+		"Date: Tue, 2 Apr 2024 16:12:40 +0000\r\n\r\n"+
+		"%s\r\n", subject, id, body))
+}
+
+type stored struct {
+	folder string
+	raw    []byte
+	flags  []imap.Flag
+}
+
+func seed(t *testing.T) *fakeserver.Server {
+	t.Helper()
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	for _, name := range []string{"Archive", "Trash"} {
+		if err := server.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	date := time.Date(2024, 4, 2, 16, 12, 40, 0, time.UTC)
+	for _, m := range []stored{
+		// Filed twice; the archived copy was starred.
+		{"INBOX", message("<budget-q3@example.com>", "Q3 budget", "Numbers attached."), nil},
+		{"Archive", message("<budget-q3@example.com>", "Q3 budget", "Numbers attached."), []imap.Flag{imap.FlagFlagged, imap.FlagSeen}},
+		// Only copies outside INBOX: the one not in Trash is kept.
+		{"Trash", message("<lunch-friday@example.com>", "Lunch", "Friday?"), nil},
+		{"Archive", message("<lunch-friday@example.com>", "Lunch", "Friday?"), nil},
+		// Untrusted IDs: grouped by content, trailing whitespace aside.
+		{"INBOX", message("<1@localhost>", "Alert", "Disk full"), nil},
+		{"Archive", message("<1@localhost>", "Alert", "Disk full   \r\n"), nil},
+		{"INBOX", message("<1@localhost>", "Alert", "Disk fine"), nil},
+		// One ID on two different messages, one of them copied.
+		{"INBOX", message("<reused-id@example.com>", "First", "One"), nil},
+		{"Archive", message("<reused-id@example.com>", "Second", "Two"), nil},
+		{"Trash", message("<reused-id@example.com>", "Second", "Two"), nil},
+		{"INBOX", message("<unique-one@example.com>", "Unique", "Only here"), nil},
+	} {
+		if _, err := server.Append(m.folder, m.raw, m.flags, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server
+}
+
+func TestScanAndDelete(t *testing.T) {
+	server := seed(t)
+	ctx := context.Background()
+	dial := server.Config().Dial
+
+	report, err := Scan(ctx, dial, &Options{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Folders != 3 || report.Messages != 11 || len(report.Failed) != 0 {
+		t.Fatalf("scanned %d folders, %d messages, failed %v", report.Folders, report.Messages, report.Failed)
+	}
+	type summary struct {
+		keep  string
+		extra []string
+	}
+	got := make(map[string]summary)
+	for _, g := range report.Groups {
+		s := summary{keep: g.Keep.Folder}
+		for _, c := range g.Extra {
+			s.extra = append(s.extra, c.Folder)
+		}
+		got[g.Subject] = s
+	}
+	want := map[string]summary{
+		"Q3 budget": {"INBOX", []string{"Archive"}},
+		"Lunch":     {"Archive", []string{"Trash"}},
+		"Alert":     {"INBOX", []string{"Archive"}},
+		"Second":    {"Archive", []string{"Trash"}},
+	}
+	if len(got) != len(want) {
+		t.Errorf("groups = %+v, want %+v", got, want)
+	}
+	for subject, w := range want {
+		if g := got[subject]; g.keep != w.keep || !slices.Equal(g.extra, w.extra) {
+			t.Errorf("%s: keep %s extra %v, want keep %s extra %v", subject, g.keep, g.extra, w.keep, w.extra)
+		}
+	}
+	if !slices.Equal(report.ReusedIDs, []string{"<reused-id@example.com>"}) {
+		t.Errorf("reused IDs = %v", report.ReusedIDs)
+	}
+
+	result, err := Delete(ctx, dial, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted != 4 || result.Flagged != 2 || len(result.Failed) != 0 {
+		t.Errorf("result = %+v", result)
+	}
+
+	again, err := Scan(ctx, dial, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Messages != 7 || len(again.Groups) != 0 {
+		t.Errorf("after delete: %d messages, groups %+v", again.Messages, again.Groups)
+	}
+
+	// The starred, read state of the archived copy moved to INBOX.
+	c, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(report.Groups, func(g Group) bool { return g.Subject == "Q3 budget" })
+	msgs, err := c.Fetch(imap.UIDSetNum(report.Groups[i].Keep.UID), &imap.FetchOptions{Flags: true, UID: true}).Collect()
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("fetch kept copy: %v", err)
+	}
+	if !slices.Contains(msgs[0].Flags, imap.FlagFlagged) {
+		t.Errorf("kept copy flags = %v, want \\Flagged", msgs[0].Flags)
+	}
+}
+
+func TestDeleteSkipsChangedFolder(t *testing.T) {
+	server := seed(t)
+	ctx := context.Background()
+	report, err := Scan(ctx, server.Config().Dial, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend Trash was recreated after the scan.
+	for i := range report.Groups {
+		for j := range report.Groups[i].Extra {
+			if report.Groups[i].Extra[j].Folder == "Trash" {
+				report.Groups[i].Extra[j].UIDValidity++
+			}
+		}
+	}
+	result, err := Delete(ctx, server.Config().Dial, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := result.Failed["Trash"]; !ok || result.Deleted != 2 {
+		t.Errorf("result = %+v, want Trash skipped and 2 deleted", result)
+	}
+}
+
+func TestDeleteSkipsMissingKeep(t *testing.T) {
+	server := seed(t)
+	ctx := context.Background()
+	dial := server.Config().Dial
+	report, err := Scan(ctx, dial, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byKeep := func(subject string) Group {
+		t.Helper()
+		i := slices.IndexFunc(report.Groups, func(g Group) bool { return g.Subject == subject })
+		if i < 0 {
+			t.Fatalf("no group for %s", subject)
+		}
+		return report.Groups[i]
+	}
+	budget, lunch := byKeep("Q3 budget"), byKeep("Lunch")
+
+	// After the scan, the kept budget copy is deleted elsewhere, and the
+	// report's kept lunch copy is pointed at another message.
+	c, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(budget.Keep.Folder, nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	store := &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagDeleted}, Silent: true}
+	if err := c.Store(imap.UIDSetNum(budget.Keep.UID), store, nil).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UIDExpunge(imap.UIDSetNum(budget.Keep.UID)).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Unselect().Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range report.Groups {
+		if report.Groups[i].Subject == "Lunch" {
+			report.Groups[i].Keep.UID = budget.Extra[0].UID
+		}
+	}
+
+	result, err := Delete(ctx, dial, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Skipped) != 2 || result.Skipped[budget.Fingerprint] == "" || result.Skipped[lunch.Fingerprint] == "" {
+		t.Errorf("skipped = %v, want the budget and lunch groups", result.Skipped)
+	}
+	if result.Deleted != 2 {
+		t.Errorf("deleted %d, want the 2 other extra copies", result.Deleted)
+	}
+	// Both groups' extra copies are still there.
+	again, err := Scan(ctx, dial, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Messages != 8 {
+		t.Errorf("after delete: %d messages, want 8", again.Messages)
+	}
+}
@@ -0,0 +1,187 @@
+package envelope
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Address is a normalized mailbox. Addresses listed under RFC 5322 group
+// syntax ("Team: a@example.com, b@example.com;") carry the group name; an
+// empty group ("undisclosed-recipients:;") is kept as one Address with only
+// Group set.
+type Address struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+	Group   string `json:"group,omitempty"`
+}
+
+// String renders the address for display, e.g. `Zhi Qu <zhi@example.com>`.
+// Names are not re-encoded.
+func (a Address) String() string {
+	switch {
+	case a.Address == "":
+		return a.Group + ":;"
+	case a.Name == "":
+		return a.Address
+	default:
+		return a.Name + " <" + a.Address + ">"
+	}
+}
+
+// FormatList renders a list for display, with group members written inside
+// their group.
+func FormatList(list []Address) string {
+	var b strings.Builder
+	for i := 0; i < len(list); i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		a := list[i]
+		if a.Group == "" {
+			b.WriteString(a.String())
+			continue
+		}
+		if a.Address == "" {
+			b.WriteString(a.String())
+			continue
+		}
+		b.WriteString(a.Group + ": " + a.String())
+		for i+1 < len(list) && list[i+1].Group == a.Group && list[i+1].Address != "" {
+			i++
+			b.WriteString(", " + list[i].String())
+		}
+		b.WriteString(";")
+	}
+	return b.String()
+}
+
+// NormalizeAddress returns a normalized address: decoded display name with
+// quotes and extra whitespace removed, lowercased address. A name that only
+// repeats the address is dropped.
+func NormalizeAddress(name, address, group string) Address {
+	a := Address{
+		Name:    normalizeName(name),
+		Address: strings.ToLower(strings.Trim(strings.TrimSpace(address), "<>")),
+		Group:   normalizeName(group),
+	}
+	if strings.EqualFold(a.Name, a.Address) {
+		a.Name = ""
+	}
+	return a
+}
+
+func normalizeName(name string) string {
+	name = collapseSpace(DecodeWords(name))
+	if len(name) >= 2 && (name[0] == '"' && name[len(name)-1] == '"' || name[0] == '\'' && name[len(name)-1] == '\'') {
+		name = strings.TrimSpace(name[1 : len(name)-1])
+	}
+	return strings.ReplaceAll(name, `\"`, `"`)
+}
+
+var addressParser = mail.AddressParser{WordDecoder: &wordDecoder}
+
+// ParseAddressList parses an address header value. Unlike net/mail it keeps
+// group names, and a member it cannot parse does not drop the rest of the
+// list: the members that parse are returned together with an error naming
+// the ones that did not.
+func ParseAddressList(value string) ([]Address, error) {
+	var (
+		list []Address
+		bad  []string
+	)
+	parse := func(member, group string) {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			return
+		}
+		a, err := addressParser.Parse(member)
+		if err != nil {
+			bad = append(bad, member)
+			return
+		}
+		list = append(list, NormalizeAddress(a.Name, a.Address, group))
+	}
+
+	for _, item := range splitTopLevel(unfold(value), ',', true) {
+		name, members, isGroup := cutGroup(item)
+		if !isGroup {
+			parse(item, "")
+			continue
+		}
+		group := normalizeName(name)
+		before := len(list)
+		for _, member := range splitTopLevel(members, ',', false) {
+			parse(member, group)
+		}
+		if len(list) == before {
+			list = append(list, Address{Group: group})
+		}
+	}
+	if len(bad) > 0 {
+		return list, fmt.Errorf("envelope: cannot parse %q", bad)
+	}
+	return list, nil
+}
+
+// splitTopLevel splits v at sep outside quotes, comments and angle brackets.
+// With groups set, separators inside "name: ...;" do not split, so a group
+// comes back as one item.
+func splitTopLevel(v string, sep byte, groups bool) []string {
+	var (
+		items                          []string
+		start, comment                 int
+		inQuote, escaped, inAngle, grp bool
+	)
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case inQuote:
+			inQuote = c != '"'
+		case c == '"':
+			inQuote = true
+		case c == '(':
+			comment++
+		case c == ')' && comment > 0:
+			comment--
+		case comment > 0:
+		case c == '<':
+			inAngle = true
+		case c == '>':
+			inAngle = false
+		case inAngle:
+		case groups && c == ':':
+			grp = true
+		case groups && c == ';':
+			grp = false
+		case c == sep && !grp:
+			items = append(items, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, v[start:])
+}
+
+// cutGroup splits "name: members;" into its name and members.
+func cutGroup(item string) (name, members string, ok bool) {
+	parts := splitTopLevel(item, ':', false)
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	colon := len(parts[0])
+	members = strings.TrimSpace(item[colon+1:])
+	members = strings.TrimSuffix(members, ";")
+	return item[:colon], members, true
+}
+
+func unfold(v string) string {
+	return strings.NewReplacer("\r\n", "", "\n", "").Replace(v)
+}
+
+func collapseSpace(v string) string {
+	return strings.Join(strings.Fields(v), " ")
+}
@@ -0,0 +1,335 @@
+// Package envelope is the normalized form of a message envelope, shared by
+// the go-imap v1 and v2 clients and the parser. Names and subjects are
+// RFC 2047-decoded, addresses are lowercased, group syntax is kept, the date
+// is in UTC with the sender's offset on the side and Message-IDs are in one
+// canonical "<local@domain>" form, so output from every command compares
+// equal whatever produced it.
+package envelope
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	imapv1 "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	imapfork "github.com/quzhi1/go-imap"
+	"github.com/quzhi1/imap-playground/internal/charset"
+	"github.com/rs/zerolog"
+)
+
+var wordDecoder = mime.WordDecoder{CharsetReader: charset.Default.Reader}
+
+// Envelope is a normalized message envelope.
+type Envelope struct {
+	MessageID string `json:"message_id,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	// Date is in UTC. DateOffset is the offset the sender wrote, e.g.
+	// "+02:00"; Local puts the two back together.
+	Date       *time.Time `json:"date,omitempty"`
+	DateOffset string     `json:"date_offset,omitempty"`
+	From       []Address  `json:"from,omitempty"`
+	Sender     []Address  `json:"sender,omitempty"`
+	ReplyTo    []Address  `json:"reply_to,omitempty"`
+	To         []Address  `json:"to,omitempty"`
+	Cc         []Address  `json:"cc,omitempty"`
+	Bcc        []Address  `json:"bcc,omitempty"`
+	InReplyTo  []string   `json:"in_reply_to,omitempty"`
+	// References is only known when the envelope was read from the header;
+	// the IMAP ENVELOPE does not carry it.
+	References []string `json:"references,omitempty"`
+}
+
+// FromV2 normalizes a go-imap v2 envelope. It returns nil for nil.
+func FromV2(e *imap.Envelope) *Envelope {
+	if e == nil {
+		return nil
+	}
+	env := &Envelope{
+		MessageID: NormalizeMessageID(e.MessageID),
+		Subject:   NormalizeSubject(e.Subject),
+		From:      fromV2Addresses(e.From),
+		Sender:    fromV2Addresses(e.Sender),
+		ReplyTo:   fromV2Addresses(e.ReplyTo),
+		To:        fromV2Addresses(e.To),
+		Cc:        fromV2Addresses(e.Cc),
+		Bcc:       fromV2Addresses(e.Bcc),
+	}
+	env.setDate(e.Date)
+	for _, id := range e.InReplyTo {
+		if id = NormalizeMessageID(id); id != "" {
+			env.InReplyTo = append(env.InReplyTo, id)
+		}
+	}
+	return env
+}
+
+// FromV1 normalizes a go-imap v1 envelope. It returns nil for nil.
+func FromV1(e *imapv1.Envelope) *Envelope {
+	if e == nil {
+		return nil
+	}
+	env := &Envelope{
+		MessageID: NormalizeMessageID(e.MessageId),
+		Subject:   NormalizeSubject(e.Subject),
+		From:      fromV1Addresses(e.From),
+		Sender:    fromV1Addresses(e.Sender),
+		ReplyTo:   fromV1Addresses(e.ReplyTo),
+		To:        fromV1Addresses(e.To),
+		Cc:        fromV1Addresses(e.Cc),
+		Bcc:       fromV1Addresses(e.Bcc),
+		InReplyTo: NormalizeMessageIDs(e.InReplyTo),
+	}
+	env.setDate(e.Date)
+	return env
+}
+
+// FromV1Fork normalizes an envelope from the quzhi1/go-imap fork of v1,
+// which the XOAUTH2 commands use. It returns nil for nil.
+func FromV1Fork(e *imapfork.Envelope) *Envelope {
+	if e == nil {
+		return nil
+	}
+	addresses := func(list []*imapfork.Address) []*imapv1.Address {
+		converted := make([]*imapv1.Address, len(list))
+		for i, a := range list {
+			if a != nil {
+				converted[i] = (*imapv1.Address)(a)
+			}
+		}
+		return converted
+	}
+	return FromV1(&imapv1.Envelope{
+		Date:      e.Date,
+		Subject:   e.Subject,
+		From:      addresses(e.From),
+		Sender:    addresses(e.Sender),
+		ReplyTo:   addresses(e.ReplyTo),
+		To:        addresses(e.To),
+		Cc:        addresses(e.Cc),
+		Bcc:       addresses(e.Bcc),
+		InReplyTo: e.InReplyTo,
+		MessageId: e.MessageId,
+	})
+}
+
+// FromHeader builds an envelope from a message header. Fields that cannot be
+// parsed are left empty or partly filled, and each is reported in the
+// returned errors; the envelope is never nil. Like an IMAP server building
+// ENVELOPE (RFC 3501 section 7.4.2), it fills a missing Sender or Reply-To
+// with From, so the result compares equal to FromV1 and FromV2.
+func FromHeader(header textproto.Header) (*Envelope, []error) {
+	var errs []error
+	h := mail.Header{Header: message.Header{Header: header}}
+	env := &Envelope{
+		MessageID:  NormalizeMessageID(header.Get("Message-Id")),
+		Subject:    NormalizeSubject(header.Get("Subject")),
+		InReplyTo:  NormalizeMessageIDs(header.Get("In-Reply-To")),
+		References: NormalizeMessageIDs(header.Get("References")),
+	}
+	if raw := header.Get("Message-Id"); env.MessageID == "" && strings.TrimSpace(raw) != "" {
+		errs = append(errs, fmt.Errorf("Message-ID: cannot parse %q", raw))
+	}
+	if header.Get("Date") != "" {
+		if date, err := h.Date(); err != nil {
+			errs = append(errs, fmt.Errorf("Date: %w", err))
+		} else {
+			env.setDate(date)
+		}
+	}
+
+	lists := []struct {
+		key string
+		out *[]Address
+	}{
+		{"From", &env.From},
+		{"Sender", &env.Sender},
+		{"Reply-To", &env.ReplyTo},
+		{"To", &env.To},
+		{"Cc", &env.Cc},
+		{"Bcc", &env.Bcc},
+	}
+	for _, list := range lists {
+		value := header.Get(list.key)
+		if value == "" {
+			continue
+		}
+		addresses, err := ParseAddressList(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", list.key, err))
+		}
+		*list.out = addresses
+	}
+	if len(env.Sender) == 0 {
+		env.Sender = env.From
+	}
+	if len(env.ReplyTo) == 0 {
+		env.ReplyTo = env.From
+	}
+	return env, errs
+}
+
+// Local returns the date in the offset the sender used, or the zero time if
+// the envelope has no date.
+func (e *Envelope) Local() time.Time {
+	if e.Date == nil {
+		return time.Time{}
+	}
+	offset, err := time.Parse("-07:00", e.DateOffset)
+	if err != nil {
+		return *e.Date
+	}
+	_, seconds := offset.Zone()
+	return e.Date.In(time.FixedZone(e.DateOffset, seconds))
+}
+
+// MarshalZerologObject lets commands log an envelope with EmbedObject.
+func (e *Envelope) MarshalZerologObject(event *zerolog.Event) {
+	event.Str("messageId", e.MessageID).Str("subject", e.Subject)
+	if e.Date != nil {
+		event.Time("date", *e.Date).Str("dateOffset", e.DateOffset)
+	}
+	addresses := func(key string, list []Address) {
+		if len(list) > 0 {
+			event.Str(key, FormatList(list))
+		}
+	}
+	addresses("from", e.From)
+	addresses("sender", e.Sender)
+	addresses("replyTo", e.ReplyTo)
+	addresses("to", e.To)
+	addresses("cc", e.Cc)
+	addresses("bcc", e.Bcc)
+	if len(e.InReplyTo) > 0 {
+		event.Strs("inReplyTo", e.InReplyTo)
+	}
+}
+
+func (e *Envelope) setDate(date time.Time) {
+	if date.IsZero() {
+		return
+	}
+	utc := date.UTC()
+	e.Date = &utc
+	e.DateOffset = date.Format("-07:00")
+}
+
+// NormalizeSubject decodes encoded-words and collapses folding whitespace.
+func NormalizeSubject(subject string) string {
+	return collapseSpace(DecodeWords(unfold(subject)))
+}
+
+// NormalizeMessageID returns the first Message-ID in v as "<local@domain>",
+// with the domain lowercased. The local part is case-sensitive and kept.
+// Brackets are added when the sender (or the IMAP library) left them out. It
+// returns "" if v holds no ID.
+func NormalizeMessageID(v string) string {
+	ids := NormalizeMessageIDs(v)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+// NormalizeMessageIDs returns every Message-ID in a header value such as
+// References or In-Reply-To, normalized like NormalizeMessageID.
+func NormalizeMessageIDs(v string) []string {
+	v = strings.TrimSpace(unfold(v))
+	var ids []string
+	if !strings.Contains(v, "<") {
+		// Bare IDs, as go-imap v2 returns them or as broken mailers send
+		// them.
+		for _, id := range strings.Fields(v) {
+			ids = appendID(ids, id)
+		}
+		return ids
+	}
+	for {
+		start := strings.IndexByte(v, '<')
+		if start < 0 {
+			return ids
+		}
+		end := strings.IndexByte(v[start:], '>')
+		if end < 0 {
+			return appendID(ids, v[start+1:])
+		}
+		ids = appendID(ids, v[start+1:start+end])
+		v = v[start+end+1:]
+	}
+}
+
+func appendID(ids []string, id string) []string {
+	id = strings.Join(strings.Fields(id), "")
+	id = strings.Trim(id, "<>")
+	if id == "" {
+		return ids
+	}
+	if at := strings.LastIndexByte(id, '@'); at >= 0 {
+		id = id[:at] + strings.ToLower(id[at:])
+	}
+	return append(ids, "<"+id+">")
+}
+
+// DecodeWords decodes RFC 2047 encoded-words and returns v unchanged if it
+// has none or they are malformed.
+func DecodeWords(v string) string {
+	if !strings.Contains(v, "=?") {
+		return v
+	}
+	decoded, err := wordDecoder.DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return decoded
+}
+
+func fromV2Addresses(list []imap.Address) []Address {
+	var (
+		result []Address
+		group  string
+		empty  bool
+	)
+	for _, a := range list {
+		switch {
+		case a.IsGroupStart():
+			group, empty = normalizeName(a.Mailbox), true
+		case a.IsGroupEnd():
+			if group != "" && empty {
+				result = append(result, Address{Group: group})
+			}
+			group = ""
+		default:
+			result = append(result, NormalizeAddress(a.Name, a.Addr(), group))
+			empty = false
+		}
+	}
+	return result
+}
+
+func fromV1Addresses(list []*imapv1.Address) []Address {
+	var (
+		result []Address
+		group  string
+		empty  bool
+	)
+	for _, a := range list {
+		switch {
+		case a == nil:
+		case a.HostName == "" && a.MailboxName != "":
+			group, empty = normalizeName(a.MailboxName), true
+		case a.HostName == "" && a.MailboxName == "":
+			if group != "" && empty {
+				result = append(result, Address{Group: group})
+			}
+			group = ""
+		default:
+			result = append(result, NormalizeAddress(a.PersonalName, a.MailboxName+"@"+a.HostName, group))
+			empty = false
+		}
+	}
+	return result
+}
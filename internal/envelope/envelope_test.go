@@ -0,0 +1,406 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	imapv1 "github.com/emersion/go-imap"
+	clientv1 "github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-message/textproto"
+	imapfork "github.com/quzhi1/go-imap"
+	clientfork "github.com/quzhi1/go-imap/client"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+)
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []Address
+		wantErr bool
+	}{
+		{
+			name:  "plain",
+			value: "Bob@Example.COM",
+			want:  []Address{{Address: "bob@example.com"}},
+		},
+		{
+			name:  "quoted name with a comma",
+			value: `"Qu, Zhi" <zhi@example.com>, bob@example.com`,
+			want:  []Address{{Name: "Qu, Zhi", Address: "zhi@example.com"}, {Address: "bob@example.com"}},
+		},
+		{
+			name:  "encoded name",
+			value: "=?iso-8859-1?Q?Caf=E9_Owner?= <owner@cafe.fr>",
+			want:  []Address{{Name: "Café Owner", Address: "owner@cafe.fr"}},
+		},
+		{
+			name:  "name repeating the address",
+			value: `"bob@example.com" <bob@example.com>`,
+			want:  []Address{{Address: "bob@example.com"}},
+		},
+		{
+			name:  "empty group",
+			value: "undisclosed-recipients:;",
+			want:  []Address{{Group: "undisclosed-recipients"}},
+		},
+		{
+			name:  "group between addresses",
+			value: `alice@example.com, Team: carol@example.com, "Dave D." <DAVE@example.com>;, erin@example.com`,
+			want: []Address{
+				{Address: "alice@example.com"},
+				{Address: "carol@example.com", Group: "Team"},
+				{Name: "Dave D.", Address: "dave@example.com", Group: "Team"},
+				{Address: "erin@example.com"},
+			},
+		},
+		{
+			name:  "quoted group name with a colon",
+			value: `"Project: X": a@example.com;`,
+			want:  []Address{{Address: "a@example.com", Group: "Project: X"}},
+		},
+		{
+			name:  "comment",
+			value: "bob@example.com (Bob, at work)",
+			want:  []Address{{Name: "Bob, at work", Address: "bob@example.com"}},
+		},
+		{
+			name:  "folded",
+			value: "a@example.com,\r\n b@example.com",
+			want:  []Address{{Address: "a@example.com"}, {Address: "b@example.com"}},
+		},
+		{
+			name:    "bad member keeps the rest",
+			value:   "a@example.com, not an address, Team: b@example.com, @;",
+			want:    []Address{{Address: "a@example.com"}, {Address: "b@example.com", Group: "Team"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAddressList(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAddressList = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatList(t *testing.T) {
+	list := []Address{
+		{Group: "undisclosed-recipients"},
+		{Address: "carol@example.com", Group: "Team"},
+		{Name: "Dave", Address: "dave@example.com", Group: "Team"},
+		{Address: "erin@example.com"},
+	}
+	want := "undisclosed-recipients:;, Team: carol@example.com, Dave <dave@example.com>;, erin@example.com"
+	if got := FormatList(list); got != want {
+		t.Errorf("FormatList = %q, want %q", got, want)
+	}
+}
+
+func TestDecodeWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"plain", "plain"},
+		{"=?utf-8?Q?J=C3=BCrgen?=", "Jürgen"},
+		{"=?UTF-8?B?5L2g5aW9?=", "你好"},
+		{"=?utf-8?B?5L2g5aW9?= =?utf-8?Q?_world?=", "你好 world"},
+		{"Re: =?iso-8859-1?q?caf=E9?= menu", "Re: café menu"},
+		{"=?gb2312?B?xOO6ww==?=", "你好"},
+		{"=?ks_c_5601-1987?B?x9Gxub7u?=", "한국어"},
+		{"=?x-unknown?Q?abc?=", "=?x-unknown?Q?abc?="},
+		{"=?utf-8?X?abc?=", "=?utf-8?X?abc?="},
+		{"=?utf-8?Q?unterminated", "=?utf-8?Q?unterminated"},
+		{"a =? b", "a =? b"},
+	}
+	for _, tt := range tests {
+		if got := DecodeWords(tt.in); got != tt.want {
+			t.Errorf("DecodeWords(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeMessageID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"<AbC.123@Example.COM>", "<AbC.123@example.com>"},
+		{"  <spaced@Example.com>  ", "<spaced@example.com>"},
+		{"bare@example.com", "<bare@example.com>"},
+		{"<<double@example.com>>", "<double@example.com>"},
+		{"<first@example.com> <second@example.com>", "<first@example.com>"},
+		{"<folded\r\n @example.com>", "<folded@example.com>"},
+		{"<unterminated@example.com", "<unterminated@example.com>"},
+		{"<no-domain>", "<no-domain>"},
+		{"", ""},
+		{"<>", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeMessageID(tt.in); got != tt.want {
+			t.Errorf("NormalizeMessageID(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeMessageIDs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"<a@X.com> <b@y.com>", []string{"<a@x.com>", "<b@y.com>"}},
+		{"<a@x.com>,\r\n\t<b@y.com>", []string{"<a@x.com>", "<b@y.com>"}},
+		{"Re: your mail <a@x.com> (sent Monday)", []string{"<a@x.com>"}},
+		{"a@x.com b@y.com", []string{"<a@x.com>", "<b@y.com>"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := NormalizeMessageIDs(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("NormalizeMessageIDs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFromHeaderErrors(t *testing.T) {
+	var header textproto.Header
+	header.Set("From", "a@example.com, broken <")
+	header.Set("Date", "not a date")
+	header.Set("Message-Id", "<>")
+	env, errs := FromHeader(header)
+	if len(errs) != 3 {
+		t.Errorf("errors = %v, want From, Date and Message-ID", errs)
+	}
+	if env == nil || len(env.From) != 1 || env.From[0].Address != "a@example.com" {
+		t.Errorf("envelope = %+v", env)
+	}
+	if !reflect.DeepEqual(env.Sender, env.From) || !reflect.DeepEqual(env.ReplyTo, env.From) {
+		t.Errorf("Sender and Reply-To not filled from From: %+v", env)
+	}
+}
+
+// headers each exercise a part of the normalization: encoded-words, group
+// syntax, odd Message-IDs, dates in other offsets.
+var headers = []string{
+	"From: =?iso-8859-1?Q?Caf=E9_Owner?= <Owner@Cafe.FR>\r\n" +
+		"To: \"Zhi Qu\" <Zhi.Qu@Example.com>, bob@EXAMPLE.org\r\n" +
+		"Subject: =?utf-8?B?5L2g5aW9?= =?utf-8?Q?_world?=\r\n" +
+		"Date: Mon, 2 Oct 2023 10:00:00 +0200\r\n" +
+		"Message-ID: <AbC.123@Example.COM>\r\n",
+	"From: alice@example.com\r\n" +
+		"To: undisclosed-recipients:;\r\n" +
+		"Cc: Team: carol@example.com, \"Dave D.\" <DAVE@example.com>;, erin@example.com\r\n" +
+		"Subject: Re: group syntax\r\n" +
+		"Date: Tue, 3 Oct 2023 23:30:00 -0700\r\n" +
+		"Message-ID: <group@example.com>\r\n" +
+		"In-Reply-To: <Parent@Example.com>\r\n",
+	"From: \"=?utf-8?Q?J=C3=BCrgen?=\" <jurgen@example.de>\r\n" +
+		"Reply-To: jurgen@example.de\r\n" +
+		"To: \"jurgen@example.de\" <jurgen@example.de>\r\n" +
+		"Subject: folded\r\n subject\r\n" +
+		"Date: Wed, 4 Oct 2023 08:15:00 +0545\r\n" +
+		"Message-ID:   <spaced@Example.com>  \r\n",
+}
+
+// TestSources fetches the same messages from the fake server with go-imap
+// v2, v1 and the v1 fork, and checks that their envelopes normalize to the
+// one built from the header.
+func TestSources(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for i, header := range headers {
+		raw := header + "\r\nBody " + fmt.Sprint(i) + "\r\n"
+		if _, err := server.Append("INBOX", []byte(raw), nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fromV2, fromHeader := fetchV2(t, server)
+	fromV1 := fetchV1(t, server)
+	fromFork := fetchFork(t, server)
+	if len(fromHeader) != len(headers) {
+		t.Fatalf("%d messages fetched, want %d", len(fromHeader), len(headers))
+	}
+	for uid, want := range fromHeader {
+		// The IMAP ENVELOPE has no References, and the fake server
+		// flattens groups instead of sending group markers, so compare
+		// without them. TestGroupMarkers covers the markers.
+		want.References = nil
+		for _, list := range []*[]Address{&want.To, &want.Cc, &want.Bcc} {
+			*list = withoutGroups(*list)
+		}
+		wantJSON, _ := json.Marshal(want)
+		for source, got := range map[string]*Envelope{"v2": fromV2[uid], "v1": fromV1[uid], "fork": fromFork[uid]} {
+			gotJSON, _ := json.Marshal(got)
+			if !bytes.Equal(gotJSON, wantJSON) {
+				t.Errorf("UID %d from %s = %s, want %s", uid, source, gotJSON, wantJSON)
+			}
+		}
+	}
+
+	env := fromHeader[1]
+	if env.Subject != "你好 world" || env.MessageID != "<AbC.123@example.com>" || env.DateOffset != "+02:00" {
+		t.Errorf("envelope 1 = %+v", env)
+	}
+	if local := env.Local(); local.Hour() != 10 || !local.Equal(*env.Date) {
+		t.Errorf("Local = %v, date = %v", local, env.Date)
+	}
+}
+
+// TestGroupMarkers feeds FromV1 and FromV2 the group markers a real server
+// sends for "undisclosed-recipients:;, Team: carol@example.com;,
+// erin@example.com".
+func TestGroupMarkers(t *testing.T) {
+	want := []Address{
+		{Group: "undisclosed-recipients"},
+		{Address: "carol@example.com", Group: "Team"},
+		{Address: "erin@example.com"},
+	}
+	v2 := FromV2(&imap.Envelope{To: []imap.Address{
+		{Mailbox: "undisclosed-recipients"}, {},
+		{Mailbox: "Team"}, {Mailbox: "Carol", Host: "Example.com"}, {},
+		{Mailbox: "erin", Host: "example.com"},
+	}})
+	v1 := FromV1(&imapv1.Envelope{To: []*imapv1.Address{
+		{MailboxName: "undisclosed-recipients"}, {},
+		{MailboxName: "Team"}, {MailboxName: "Carol", HostName: "Example.com"}, {},
+		{MailboxName: "erin", HostName: "example.com"},
+	}})
+	fork := FromV1Fork(&imapfork.Envelope{To: []*imapfork.Address{
+		{MailboxName: "undisclosed-recipients"}, {},
+		{MailboxName: "Team"}, {MailboxName: "Carol", HostName: "Example.com"}, {},
+		{MailboxName: "erin", HostName: "example.com"},
+	}})
+	for source, got := range map[string][]Address{"v2": v2.To, "v1": v1.To, "fork": fork.To} {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v, want %+v", source, got, want)
+		}
+	}
+	if FromV2(nil) != nil || FromV1(nil) != nil || FromV1Fork(nil) != nil {
+		t.Error("nil envelope not kept nil")
+	}
+}
+
+func withoutGroups(list []Address) []Address {
+	var result []Address
+	for _, a := range list {
+		if a.Address != "" {
+			a.Group = ""
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+func fetchV2(t *testing.T, server *fakeserver.Server) (envelopes, fromHeader map[uint32]*Envelope) {
+	t.Helper()
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	section := &imap.FetchItemBodySection{Specifier: imap.PartSpecifierHeader, Peek: true}
+	messages, err := c.Fetch(imap.UIDSet{{Start: 1, Stop: 0}}, &imap.FetchOptions{
+		UID:         true,
+		Envelope:    true,
+		BodySection: []*imap.FetchItemBodySection{section},
+	}).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelopes = make(map[uint32]*Envelope)
+	fromHeader = make(map[uint32]*Envelope)
+	for _, msg := range messages {
+		envelopes[uint32(msg.UID)] = FromV2(msg.Envelope)
+		for _, raw := range msg.BodySection {
+			header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			env, errs := FromHeader(header)
+			if len(errs) > 0 {
+				t.Fatalf("UID %d: %v", msg.UID, errs)
+			}
+			fromHeader[uint32(msg.UID)] = env
+		}
+	}
+	return envelopes, fromHeader
+}
+
+func fetchV1(t *testing.T, server *fakeserver.Server) map[uint32]*Envelope {
+	t.Helper()
+	c, err := clientv1.Dial(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if err := c.Login(fakeserver.Username, fakeserver.Password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+	set := new(imapv1.SeqSet)
+	set.AddRange(1, 0)
+	messages := make(chan *imapv1.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(set, []imapv1.FetchItem{imapv1.FetchUid, imapv1.FetchEnvelope}, messages)
+	}()
+	envelopes := make(map[uint32]*Envelope)
+	for msg := range messages {
+		envelopes[msg.Uid] = FromV1(msg.Envelope)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return envelopes
+}
+
+func fetchFork(t *testing.T, server *fakeserver.Server) map[uint32]*Envelope {
+	t.Helper()
+	c, err := clientfork.Dial(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if err := c.Login(fakeserver.Username, fakeserver.Password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+	set := new(imapfork.SeqSet)
+	set.AddRange(1, 0)
+	messages := make(chan *imapfork.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(set, []imapfork.FetchItem{imapfork.FetchUid, imapfork.FetchEnvelope}, messages)
+	}()
+	envelopes := make(map[uint32]*Envelope)
+	for msg := range messages {
+		envelopes[msg.Uid] = FromV1Fork(msg.Envelope)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return envelopes
+}
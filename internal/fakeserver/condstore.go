@@ -0,0 +1,474 @@
+package fakeserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// condStore adds CONDSTORE (RFC 7162) in front of the in-memory server,
+// which has none, by rewriting the conversation:
+//
+//   - CONDSTORE is added to every capability list;
+//   - SELECT and EXAMINE accept "(CONDSTORE)" and answer HIGHESTMODSEQ;
+//   - UID FETCH accepts the MODSEQ item and "(CHANGEDSINCE n)", returns
+//     MODSEQ and leaves out messages not changed since n;
+//   - UID STORE accepts "(UNCHANGEDSINCE n)": messages changed since n are
+//     left alone and listed in a MODIFIED response code, and the FETCH
+//     responses of the others carry MODSEQ.
+//
+// Mod-sequences are handed out when someone looks: before answering, the
+// mailbox's flags are compared with the last look and every message that
+// is new or changed gets the next mod-sequence, as does the mailbox when a
+// message is gone. A client cannot tell this from a server that counts
+// every change. Plain FETCH and STORE, STORE .SILENT with UNCHANGEDSINCE
+// and SEARCH MODSEQ are not supported.
+type condStore struct {
+	backendAddr string
+
+	mu      sync.Mutex
+	backend *imapclient.Client
+	last    uint64
+	boxes   map[string]*modBox
+}
+
+type modBox struct {
+	uidValidity uint32
+	highest     uint64
+	flags       map[imap.UID]string
+	modSeq      map[imap.UID]uint64
+}
+
+var (
+	capabilityCode = regexp.MustCompile(`\[CAPABILITY ([^\]]*)\]`)
+	changedSince   = regexp.MustCompile(`(?i) \(CHANGEDSINCE (\d+)\)\r\n$`)
+	unchangedSince = regexp.MustCompile(`(?i)^STORE (\S+) \(UNCHANGEDSINCE (\d+)\) `)
+	modSeqItem     = regexp.MustCompile(`(?i)\(MODSEQ\)| MODSEQ\b|\bMODSEQ `)
+	fetchUID       = regexp.MustCompile(`(?i)[( ]UID (\d+)`)
+	literalEnd     = regexp.MustCompile(`\{(\d+)\+?\}\r\n$`)
+)
+
+// refresh brings the mod-sequences of mailbox up to date and returns them.
+// The caller holds cs.mu.
+func (cs *condStore) refresh(mailbox string) (*modBox, error) {
+	if cs.backend == nil {
+		c, err := imapclient.DialInsecure(cs.backendAddr, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Login(Username, Password).Wait(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		cs.backend = c
+	}
+	selected, err := cs.backend.Select(mailbox, &imap.SelectOptions{ReadOnly: true}).Wait()
+	if err != nil {
+		return nil, err
+	}
+	box := cs.boxes[mailbox]
+	if box == nil || box.uidValidity != selected.UIDValidity {
+		box = &modBox{uidValidity: selected.UIDValidity, flags: map[imap.UID]string{}, modSeq: map[imap.UID]uint64{}}
+		cs.boxes[mailbox] = box
+	}
+	seen := make(map[imap.UID]bool)
+	if selected.NumMessages > 0 {
+		msgs, err := cs.backend.Fetch(imap.SeqSet{imap.SeqRange{Start: 1, Stop: 0}}, &imap.FetchOptions{UID: true, Flags: true}).Collect()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			seen[msg.UID] = true
+			flags := make([]string, len(msg.Flags))
+			for i, f := range msg.Flags {
+				flags[i] = strings.ToLower(string(f))
+			}
+			slices.Sort(flags)
+			key := strings.Join(flags, " ")
+			if old, ok := box.flags[msg.UID]; !ok || old != key {
+				cs.last++
+				box.flags[msg.UID], box.modSeq[msg.UID], box.highest = key, cs.last, cs.last
+			}
+		}
+	}
+	for uid := range box.flags {
+		if !seen[uid] {
+			delete(box.flags, uid)
+			delete(box.modSeq, uid)
+			cs.last++
+			box.highest = cs.last
+		}
+	}
+	if box.highest == 0 {
+		// Zero would mean the mailbox has no mod-sequences.
+		cs.last++
+		box.highest = cs.last
+	}
+	return box, nil
+}
+
+func (cs *condStore) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go cs.proxy(conn)
+	}
+}
+
+func (cs *condStore) close() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.backend != nil {
+		cs.backend.Close()
+	}
+}
+
+// pending is a command sent to the server whose response is not complete.
+type pending struct {
+	tag     string
+	mailbox string // SELECT or EXAMINE
+	select_ bool
+	cond    bool // SELECT (CONDSTORE), or UID FETCH with MODSEQ
+	fetch   bool
+	since   uint64
+	box     *modBox
+	// modified are the UIDs a STORE UNCHANGEDSINCE left alone.
+	modified imap.UIDSet
+}
+
+type proxyConn struct {
+	cs *condStore
+
+	mu      sync.Mutex
+	queue   []*pending
+	mailbox string
+}
+
+func (cs *condStore) proxy(client net.Conn) {
+	defer client.Close()
+	server, err := net.Dial("tcp", cs.backendAddr)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+	p := &proxyConn{cs: cs}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.fromServer(bufio.NewReader(server), client)
+		client.Close()
+	}()
+	p.fromClient(bufio.NewReader(client), server)
+	server.Close()
+	<-done
+}
+
+func (p *proxyConn) push(cmd *pending) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queue = append(p.queue, cmd)
+}
+
+func (p *proxyConn) head() *pending {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return nil
+	}
+	return p.queue[0]
+}
+
+// pop removes the command tag completes.
+func (p *proxyConn) pop(tag string) *pending {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, cmd := range p.queue {
+		if cmd.tag == tag {
+			p.queue = slices.Delete(p.queue, i, i+1)
+			return cmd
+		}
+	}
+	return nil
+}
+
+// fromClient copies commands to the server, taking out what it does not
+// understand.
+func (p *proxyConn) fromClient(r *bufio.Reader, w io.Writer) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = p.command(line)
+		// A literal and the rest of the command follow.
+		for {
+			if _, err := io.WriteString(w, line); err != nil {
+				return
+			}
+			m := literalEnd.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			n, _ := strconv.ParseInt(m[1], 10, 64)
+			if _, err := io.CopyN(w, r, n); err != nil {
+				return
+			}
+			if line, err = r.ReadString('\n'); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (p *proxyConn) command(line string) string {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 3 {
+		// DONE, or an AUTHENTICATE response.
+		return line
+	}
+	cmd := &pending{tag: fields[0]}
+	defer p.push(cmd)
+	name, rest := strings.ToUpper(fields[1]), fields[2]
+	switch {
+	case name == "SELECT" || name == "EXAMINE":
+		cmd.select_ = true
+		if trimmed, ok := strings.CutSuffix(rest, " (CONDSTORE)\r\n"); ok {
+			cmd.cond = true
+			rest = trimmed + "\r\n"
+		}
+		cmd.mailbox = mailboxName(strings.TrimSuffix(rest, "\r\n"))
+		return fields[0] + " " + fields[1] + " " + rest
+	case name == "UID" && strings.HasPrefix(strings.ToUpper(rest), "FETCH "):
+		cmd.fetch = true
+		if m := changedSince.FindStringSubmatch(rest); m != nil {
+			cmd.cond = true
+			cmd.since, _ = strconv.ParseUint(m[1], 10, 64)
+			rest = rest[:len(rest)-len(m[0])] + "\r\n"
+		}
+		if modSeqItem.MatchString(rest) {
+			cmd.cond = true
+			rest = modSeqItem.ReplaceAllStringFunc(rest, func(item string) string {
+				if item[0] == '(' {
+					return "(UID)"
+				}
+				return ""
+			})
+		}
+		return fields[0] + " " + fields[1] + " " + rest
+	case name == "UID" && strings.HasPrefix(strings.ToUpper(rest), "STORE "):
+		m := unchangedSince.FindStringSubmatch(rest)
+		if m == nil {
+			return line
+		}
+		cmd.fetch, cmd.cond = true, true
+		since, _ := strconv.ParseUint(m[2], 10, 64)
+		keep, modified := p.unchanged(parseUIDSet(m[1]), since)
+		cmd.modified = modified
+		if len(keep) == 0 {
+			return fields[0] + " NOOP\r\n"
+		}
+		return fields[0] + " " + fields[1] + " STORE " + keep.String() + " " + rest[len(m[0]):]
+	}
+	return line
+}
+
+// unchanged splits the messages of set in the selected mailbox into those
+// not changed since modSeq and the others.
+func (p *proxyConn) unchanged(set imap.UIDSet, modSeq uint64) (keep, modified imap.UIDSet) {
+	p.cs.mu.Lock()
+	defer p.cs.mu.Unlock()
+	box, err := p.cs.refresh(p.selected())
+	if err != nil {
+		return nil, set
+	}
+	uids := make([]imap.UID, 0, len(box.modSeq))
+	for uid := range box.modSeq {
+		if set.Contains(uid) {
+			uids = append(uids, uid)
+		}
+	}
+	slices.Sort(uids)
+	for _, uid := range uids {
+		if box.modSeq[uid] > modSeq {
+			modified.AddNum(uid)
+		} else {
+			keep.AddNum(uid)
+		}
+	}
+	return keep, modified
+}
+
+// parseUIDSet reads a UID set such as "1:3,7,9:*".
+func parseUIDSet(s string) imap.UIDSet {
+	var set imap.UIDSet
+	for _, r := range strings.Split(s, ",") {
+		first, last, ok := strings.Cut(r, ":")
+		if !ok {
+			last = first
+		}
+		start, stop := parseUID(first), parseUID(last)
+		if start > stop {
+			start, stop = stop, start
+		}
+		set.AddRange(start, stop)
+	}
+	return set
+}
+
+func parseUID(s string) imap.UID {
+	if s == "*" {
+		return imap.UID(^uint32(0))
+	}
+	n, _ := strconv.ParseUint(s, 10, 32)
+	return imap.UID(n)
+}
+
+// mailboxName reads an atom or a quoted string.
+func mailboxName(s string) string {
+	if !strings.HasPrefix(s, `"`) {
+		name, _, _ := strings.Cut(s, " ")
+		return name
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String()
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// fromServer copies responses to the client, adding what CONDSTORE adds.
+func (p *proxyConn) fromServer(r *bufio.Reader, w io.Writer) {
+	for {
+		resp, text, err := readResponse(r)
+		if err != nil {
+			return
+		}
+		out, err := p.response(resp, text)
+		if err != nil {
+			out = fmt.Appendf(nil, "* BYE fake CONDSTORE failed: %v\r\n", err)
+		}
+		if _, err := w.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// readResponse reads one response with its literals. text is the response
+// without the literal contents.
+func readResponse(r *bufio.Reader) (resp []byte, text string, err error) {
+	var b bytes.Buffer
+	var t strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, "", err
+		}
+		b.WriteString(line)
+		t.WriteString(line)
+		m := literalEnd.FindStringSubmatch(line)
+		if m == nil {
+			return b.Bytes(), t.String(), nil
+		}
+		n, _ := strconv.ParseInt(m[1], 10, 64)
+		if _, err := io.CopyN(&b, r, n); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+func (p *proxyConn) response(resp []byte, text string) ([]byte, error) {
+	if i := bytes.IndexByte(resp, '\n'); i >= 0 {
+		first := capabilityCode.ReplaceAll(resp[:i+1], []byte("[CAPABILITY $1 CONDSTORE]"))
+		if bytes.HasPrefix(first, []byte("* CAPABILITY ")) {
+			first = append(bytes.TrimSuffix(first, []byte("\r\n")), " CONDSTORE\r\n"...)
+		}
+		resp = append(first, resp[i+1:]...)
+	}
+
+	tag, rest, _ := strings.Cut(text, " ")
+	switch {
+	case tag == "+":
+		return resp, nil
+	case tag != "*":
+		cmd := p.pop(tag)
+		if cmd != nil && len(cmd.modified) > 0 && strings.HasPrefix(strings.ToUpper(rest), "OK") {
+			return fmt.Appendf(nil, "%s OK [MODIFIED %s] Conditional STORE completed\r\n", tag, cmd.modified), nil
+		}
+		if cmd == nil || !cmd.select_ || !strings.HasPrefix(strings.ToUpper(rest), "OK") {
+			return resp, nil
+		}
+		p.mu.Lock()
+		p.mailbox = cmd.mailbox
+		p.mu.Unlock()
+		if !cmd.cond {
+			return resp, nil
+		}
+		p.cs.mu.Lock()
+		box, err := p.cs.refresh(cmd.mailbox)
+		p.cs.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return append(fmt.Appendf(nil, "* OK [HIGHESTMODSEQ %d] Highest\r\n", box.highest), resp...), nil
+	}
+
+	cmd := p.head()
+	num, item, _ := strings.Cut(rest, " ")
+	if cmd == nil || !cmd.fetch || !cmd.cond || !strings.HasPrefix(strings.ToUpper(item), "FETCH (") {
+		return resp, nil
+	}
+	if _, err := strconv.Atoi(num); err != nil {
+		return resp, nil
+	}
+	m := fetchUID.FindStringSubmatch(text)
+	if m == nil {
+		return resp, nil
+	}
+	uid, _ := strconv.ParseUint(m[1], 10, 32)
+	if cmd.box == nil {
+		p.cs.mu.Lock()
+		box, err := p.cs.refresh(p.selected())
+		p.cs.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		cmd.box = box
+	}
+	p.cs.mu.Lock()
+	modSeq := cmd.box.modSeq[imap.UID(uid)]
+	p.cs.mu.Unlock()
+	if modSeq <= cmd.since {
+		return nil, nil
+	}
+	i := bytes.Index(resp, []byte("FETCH ("))
+	return slices.Concat(resp[:i+len("FETCH (")], fmt.Appendf(nil, "MODSEQ (%d) ", modSeq), resp[i+len("FETCH ("):]), nil
+}
+
+// selected is the mailbox of the last SELECT or EXAMINE.
+func (p *proxyConn) selected() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mailbox
+}
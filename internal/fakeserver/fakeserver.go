@@ -0,0 +1,140 @@
+// Package fakeserver runs an in-memory IMAP server on localhost for the
+// tests of the other packages. It fakes what the in-memory server lacks,
+// such as CONDSTORE, by rewriting the conversation, which is good enough
+// for tests and nothing else: only _test.go files may import it, and
+// TestImportedByTestsOnly checks that.
+package fakeserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+	"github.com/quzhi1/imap-playground/internal/session"
+)
+
+const (
+	Username = "user"
+	Password = "password"
+)
+
+// Server is a running fake server with one user and an INBOX.
+type Server struct {
+	Addr string
+
+	user      *imapmemserver.User
+	listener  net.Listener
+	server    *imapserver.Server
+	proxy     net.Listener
+	condStore *condStore
+}
+
+// Options tunes Start.
+type Options struct {
+	// Caps are the advertised capabilities. Nil means IMAP4rev1 and
+	// IMAP4rev2.
+	Caps imap.CapSet
+	// DebugWriter, when set, receives the raw IMAP conversation.
+	DebugWriter io.Writer
+	// CondStore adds CONDSTORE to Caps. The in-memory server has no
+	// mod-sequences, so clients then talk to a proxy that fakes them; see
+	// condstore.go for what it covers.
+	CondStore bool
+}
+
+// Start listens on a random localhost port and serves in the background.
+func Start(opts *Options) (*Server, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	caps := opts.Caps
+	if caps == nil {
+		caps = imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIMAP4rev2: {}}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser(Username, Password)
+	if err := user.Create("INBOX", nil); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	memServer.AddUser(user)
+
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:         caps,
+		InsecureAuth: true,
+		DebugWriter:  opts.DebugWriter,
+	})
+	go server.Serve(listener) //nolint:errcheck // Serve returns when Close is called
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		user:     user,
+		listener: listener,
+		server:   server,
+	}
+	if opts.CondStore {
+		proxy, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
+		s.proxy = proxy
+		s.condStore = &condStore{backendAddr: s.Addr, boxes: map[string]*modBox{}}
+		s.Addr = proxy.Addr().String()
+		go s.condStore.serve(proxy)
+	}
+	return s, nil
+}
+
+// Config returns the session config for logging into the server.
+func (s *Server) Config() session.Config {
+	return session.Config{
+		Address:   s.Addr,
+		Username:  Username,
+		Password:  Password,
+		PlainText: true,
+	}
+}
+
+// Create creates a mailbox.
+func (s *Server) Create(mailbox string) error {
+	return s.user.Create(mailbox, nil)
+}
+
+// Delete deletes a mailbox. Creating it again gives it a new UIDVALIDITY.
+func (s *Server) Delete(mailbox string) error {
+	return s.user.Delete(mailbox)
+}
+
+// Append stores a message directly, without going through a client.
+func (s *Server) Append(mailbox string, raw []byte, flags []imap.Flag, date time.Time) (imap.UID, error) {
+	data, err := s.user.Append(mailbox, bytes.NewReader(raw), &imap.AppendOptions{
+		Flags: flags,
+		Time:  date,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return data.UID, nil
+}
+
+// Close stops the server and drops every connection.
+func (s *Server) Close() error {
+	if s.proxy != nil {
+		s.proxy.Close()
+		s.condStore.close()
+	}
+	return s.server.Close()
+}
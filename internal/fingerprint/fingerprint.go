@@ -0,0 +1,138 @@
+// Package fingerprint identifies a message independently of the folder and
+// UID it is stored under, so that copies of it can be found across folders.
+// A message is known by its Message-ID when the ID can be trusted to be
+// unique, and otherwise by a hash of its normalized header and body.
+package fingerprint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+)
+
+const (
+	idPrefix      = "id:"
+	contentPrefix = "sha256:"
+)
+
+// minLocalPart is the shortest Message-ID local part that is trusted.
+// Counters such as "<1@host>" repeat across senders and restarts.
+const minLocalPart = 6
+
+// untrustedDomains are what misconfigured hosts put after the "@".
+var untrustedDomains = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"localdomain":           true,
+	"local":                 true,
+}
+
+// Of returns the fingerprint of a message: "id:<local@domain>" when its
+// Message-ID is trusted, else "sha256:" and the hash of Content. body is the
+// message text after the header; it is only read for the hash, so callers
+// that have checked Trusted may pass nil.
+func Of(header textproto.Header, body []byte) string {
+	if id := envelope.NormalizeMessageID(header.Get("Message-Id")); Trusted(id) {
+		return idPrefix + id
+	}
+	return Content(header, body)
+}
+
+// FromMessageID returns the fingerprint of a trusted, normalized
+// Message-ID, or "" if it is not trusted.
+func FromMessageID(id string) string {
+	if !Trusted(id) {
+		return ""
+	}
+	return idPrefix + id
+}
+
+// Trusted reports whether a normalized Message-ID is unique enough to
+// stand for the message: a single "@", a local part that is not a short
+// counter, and a domain that names a real host.
+func Trusted(id string) bool {
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, ">") {
+		return false
+	}
+	local, domain, ok := strings.Cut(id[1:len(id)-1], "@")
+	if !ok || strings.Contains(domain, "@") || strings.ContainsAny(id, " \t") {
+		return false
+	}
+	return len(local) >= minLocalPart && domain != "" && !untrustedDomains[domain]
+}
+
+// Content returns the content fingerprint of a message. It hashes the date
+// (as an instant), the From, To and Cc addresses, the subject and the body
+// with line endings and trailing whitespace normalized. Header fields a
+// server or a mailing list adds on the way, such as Received, are left out,
+// so the copies a provider files into several folders hash the same.
+func Content(header textproto.Header, body []byte) string {
+	env, _ := envelope.FromHeader(header)
+	h := sha256.New()
+	field := func(s string) {
+		h.Write([]byte(strconv.Itoa(len(s)))) //nolint:errcheck // hash writes do not fail
+		h.Write([]byte{':'})                  //nolint:errcheck
+		h.Write([]byte(s))                    //nolint:errcheck
+	}
+	if env.Date != nil {
+		field(strconv.FormatInt(env.Date.Unix(), 10))
+	} else {
+		field("")
+	}
+	field(addresses(env.From, false))
+	field(addresses(append(append([]envelope.Address{}, env.To...), env.Cc...), true))
+	field(env.Subject)
+	field(string(normalizeBody(body)))
+	return contentPrefix + hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Digest summarizes what copies of one message must agree on: date, sender
+// and subject. Two messages with the same Message-ID but different digests
+// are different messages sharing an ID.
+func Digest(env *envelope.Envelope) string {
+	date := ""
+	if env.Date != nil {
+		date = strconv.FormatInt(env.Date.Unix(), 10)
+	}
+	sum := sha256.Sum256([]byte(date + "\x00" + addresses(env.From, false) + "\x00" + env.Subject))
+	return hex.EncodeToString(sum[:8])
+}
+
+// IsContent reports whether fp was made from content rather than a
+// Message-ID.
+func IsContent(fp string) bool {
+	return strings.HasPrefix(fp, contentPrefix)
+}
+
+func addresses(list []envelope.Address, sorted bool) string {
+	out := make([]string, 0, len(list))
+	for _, a := range list {
+		if a.Address != "" {
+			out = append(out, a.Address)
+		}
+	}
+	if sorted {
+		sort.Strings(out)
+	}
+	return strings.Join(out, ",")
+}
+
+// normalizeBody makes line endings LF and drops trailing whitespace on
+// every line and trailing blank lines, which servers and clients touch when
+// they store or copy a message.
+func normalizeBody(body []byte) []byte {
+	lines := bytes.Split(bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
@@ -0,0 +1,52 @@
+package fingerprint
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func TestTrusted(t *testing.T) {
+	for id, want := range map[string]bool{
+		"<CAFx2Qv8=abc@mail.gmail.com>": true,
+		"<budget-q3@example.com>":       true,
+		"<1@example.com>":               false,
+		"<1234567@localhost>":           false,
+		"<abcdefgh@>":                   false,
+		"<no-domain-at-all>":            false,
+		"<a@b@example.com>":             false,
+		"":                              false,
+	} {
+		if got := Trusted(id); got != want {
+			t.Errorf("Trusted(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func header(t *testing.T, raw string) textproto.Header {
+	t.Helper()
+	h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(raw + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestContent(t *testing.T) {
+	a := header(t, "From: Dana <Dana@Example.com>\r\nTo: lee@example.com, sam@example.com\r\nSubject: Hi\r\nDate: Tue, 2 Apr 2024 18:12:40 +0200\r\nReceived: by one\r\n")
+	b := header(t, "From: dana@example.com\r\nTo: sam@example.com\r\nCc: lee@example.com\r\nSubject: =?utf-8?q?Hi?=\r\nDate: Tue, 2 Apr 2024 16:12:40 +0000\r\nReceived: by two\r\n")
+	if Content(a, []byte("Hello\r\n\r\n")) != Content(b, []byte("Hello  \n")) {
+		t.Error("copies of one message hash differently")
+	}
+	if Content(a, []byte("Hello")) == Content(a, []byte("Goodbye")) {
+		t.Error("different bodies hash the same")
+	}
+	if got := Of(header(t, "Message-ID: <budget-q3@Example.COM>\r\n"), nil); got != "id:<budget-q3@example.com>" {
+		t.Errorf("Of = %q", got)
+	}
+	if got := Of(header(t, "Message-ID: <1@localhost>\r\n"), []byte("x")); !IsContent(got) {
+		t.Errorf("untrusted ID gave %q", got)
+	}
+}
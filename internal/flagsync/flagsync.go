@@ -0,0 +1,457 @@
+// Package flagsync keeps message flags in agreement between a local store
+// and the server, in both directions. \Seen, \Flagged, \Answered, \Draft
+// and keywords are synced; other system flags such as \Deleted are left
+// alone.
+//
+// Each message's flags are stored with a base: the flags both sides had
+// at the last sync. Server changes are found with MODSEQ when the server
+// has CONDSTORE (RFC 7162): only messages changed since the folder's
+// HIGHESTMODSEQ are fetched. Without it the flags of every message are
+// fetched and compared with the base. Local changes are found by
+// timestamp: those made with Store.Change since the last sync started.
+// When a message changed on both sides, the Policy decides. Every change
+// applied, on either side, is appended to the store's change log.
+//
+// With CONDSTORE, changes are pushed with STORE UNCHANGEDSINCE and the
+// message's last known MODSEQ, so a change made on the server between a
+// sync's FETCH and its STORE is never overwritten. The server refuses the
+// push instead, and the next sync resolves the message as a conflict.
+package flagsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/rs/zerolog/log"
+)
+
+// Policy resolves a message whose flags changed on both sides.
+type Policy string
+
+const (
+	// ServerWins keeps the server's flags.
+	ServerWins Policy = "server"
+	// LocalWins pushes the local flags.
+	LocalWins Policy = "local"
+	// Union keeps every flag either side has.
+	Union Policy = "union"
+)
+
+// ParsePolicy returns the policy named s.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case ServerWins, LocalWins, Union:
+		return p, nil
+	}
+	return "", fmt.Errorf("flagsync: unknown policy %q (want server, local or union)", s)
+}
+
+// Options tunes Sync.
+type Options struct {
+	// Policy resolves conflicts. Defaults to ServerWins.
+	Policy Policy
+	// NoCondStore ignores CONDSTORE even when the server advertises it.
+	NoCondStore bool
+}
+
+// Result is what a sync did to one folder.
+type Result struct {
+	Folder string `json:"folder"`
+	// Reset is set when the folder's UIDVALIDITY changed, so the local
+	// flags were dropped and taken from the server again.
+	Reset    bool `json:"reset,omitempty"`
+	New      int  `json:"new"`
+	Expunged int  `json:"expunged"`
+	// Pulled counts the messages whose server flags were applied
+	// locally, Pushed those whose local flags were stored on the server.
+	Pulled    int `json:"pulled"`
+	Pushed    int `json:"pushed"`
+	Conflicts int `json:"conflicts"`
+	// Refused counts the pushes the server refused, because the message
+	// changed there since it was fetched or the STORE failed. The next
+	// sync takes them up again.
+	Refused int `json:"refused,omitempty"`
+	// CondStore is set when server changes were found with MODSEQ.
+	CondStore bool `json:"condstore,omitempty"`
+}
+
+// synced are the system flags that are synced, in canonical case.
+var synced = []imap.Flag{imap.FlagAnswered, imap.FlagDraft, imap.FlagFlagged, imap.FlagSeen}
+
+// Normalize returns the flags that are synced, sorted and without
+// duplicates: system flags in canonical case and keywords in lower case,
+// since keywords are case-insensitive and some servers lower them.
+func Normalize(flags []imap.Flag) []imap.Flag {
+	out := []imap.Flag{}
+	for _, f := range flags {
+		if strings.HasPrefix(string(f), `\`) {
+			i := slices.IndexFunc(synced, func(s imap.Flag) bool { return strings.EqualFold(string(s), string(f)) })
+			if i < 0 {
+				continue
+			}
+			f = synced[i]
+		} else {
+			f = imap.Flag(strings.ToLower(string(f)))
+		}
+		out = append(out, f)
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+func union(a, b []imap.Flag) []imap.Flag {
+	return Normalize(slices.Concat(a, b))
+}
+
+func minus(a, b []imap.Flag) []imap.Flag {
+	return slices.DeleteFunc(slices.Clone(a), func(f imap.Flag) bool { return slices.Contains(b, f) })
+}
+
+// serverMessage is a message's flags as fetched.
+type serverMessage struct {
+	flags  []imap.Flag
+	modSeq uint64
+}
+
+// push is a change to store on the server.
+type push struct {
+	uid            imap.UID
+	added, removed []imap.Flag
+	flags          []imap.Flag
+	reason         string
+	conflict       bool
+	// unchangedSince is the message's last known MODSEQ, or zero to store
+	// unconditionally.
+	unchangedSince uint64
+	// applied is set once the server took the whole change, and modSeq
+	// is the message's MODSEQ after it.
+	applied bool
+	modSeq  uint64
+}
+
+// localChanged reports whether the local flags changed since the last sync
+// at since, or a push of them was refused.
+func localChanged(m *Message, since time.Time) bool {
+	return (m.Refused || m.ChangedAt.After(since)) && !slices.Equal(m.Flags, m.Base)
+}
+
+// Sync brings the flags of one folder into agreement between store and
+// the server. It selects the folder read-write on c.
+func Sync(ctx context.Context, c *imapclient.Client, store *Store, folder string, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	policy := opts.Policy
+	if policy == "" {
+		policy = ServerWins
+	}
+	if _, err := ParsePolicy(string(policy)); err != nil {
+		return nil, err
+	}
+	start := time.Now().UTC()
+	cond := !opts.NoCondStore && c.Caps().Has(imap.CapCondStore)
+	selected, err := c.Select(folder, &imap.SelectOptions{CondStore: cond}).Wait()
+	if err != nil && cond {
+		log.Ctx(ctx).Warn().Err(err).Str("folderName", folder).Msg("SELECT (CONDSTORE) failed, retrying without it")
+		cond = false
+		selected, err = c.Select(folder, nil).Wait()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select: %w", err)
+	}
+	cond = cond && selected.HighestModSeq != 0
+
+	prev, err := store.Folder(folder)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Folder: folder, CondStore: cond}
+	if prev != nil && prev.UIDValidity != selected.UIDValidity {
+		log.Ctx(ctx).Warn().
+			Str("folderName", folder).
+			Uint32("was", prev.UIDValidity).
+			Uint32("UIDVALIDITY", selected.UIDValidity).
+			Msg("UIDVALIDITY changed, dropping local flags")
+		prev, res.Reset = nil, true
+	}
+	if prev == nil {
+		prev = &Folder{Folder: folder}
+	}
+	server, current, err := fetchFlags(c, prev, cond, selected.NumMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	var pushes []push
+	for _, m := range prev.Messages {
+		if _, ok := slices.BinarySearch(current, m.UID); !ok {
+			continue
+		}
+		sm, fetched := server[m.UID]
+		serverChanged := fetched && !slices.Equal(sm.flags, m.Base)
+		var p push
+		switch {
+		case !localChanged(m, prev.SyncedAt):
+			continue
+		case !serverChanged:
+			p = diffPush(m.UID, m.Base, m.Flags, "local changed", false)
+		case slices.Equal(sm.flags, m.Flags):
+			// Both sides made the same change.
+			continue
+		default:
+			res.Conflicts++
+			reason := "conflict, " + string(policy)
+			switch policy {
+			case LocalWins:
+				p = diffPush(m.UID, sm.flags, m.Flags, reason, true)
+			case Union:
+				p = diffPush(m.UID, sm.flags, union(sm.flags, m.Flags), reason, true)
+			default:
+				continue
+			}
+		}
+		if cond {
+			p.unchangedSince = m.ModSeq
+			if fetched {
+				p.unchangedSince = sm.modSeq
+			}
+		}
+		pushes = append(pushes, p)
+	}
+	if err := storeFlags(c, pushes); err != nil {
+		return nil, err
+	}
+	for _, p := range pushes {
+		switch {
+		case !p.applied:
+			res.Refused++
+			log.Ctx(ctx).Warn().Str("folderName", folder).Uint32("uid", uint32(p.uid)).Msg("Flag change refused by the server, will retry as a conflict")
+		case len(p.added) > 0 || len(p.removed) > 0:
+			res.Pushed++
+		}
+	}
+
+	// Apply under the store lock, so that local changes made during the
+	// sync are kept for the next one.
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	cur, err := store.load(folder)
+	if err != nil {
+		return nil, err
+	}
+	if cur == nil || res.Reset {
+		cur = &Folder{Folder: folder}
+	}
+	cur = cur.clone()
+	byUID := make(map[imap.UID]*push, len(pushes))
+	for i := range pushes {
+		byUID[pushes[i].uid] = &pushes[i]
+	}
+	var changes []Change
+	now := time.Now().UTC()
+	next := make([]*Message, 0, len(current))
+	for _, uid := range current {
+		i, known := cur.find(uid)
+		sm, fetched := server[uid]
+		if !known {
+			if !fetched {
+				// New since the FETCH; the next sync picks it up.
+				continue
+			}
+			next = append(next, &Message{UID: uid, Flags: sm.flags, Base: sm.flags, ModSeq: sm.modSeq})
+			res.New++
+			continue
+		}
+		m := cur.Messages[i]
+		if fetched {
+			m.ModSeq = sm.modSeq
+		}
+		next = append(next, m)
+		p := byUID[uid]
+		if p != nil && p.applied && p.modSeq != 0 {
+			m.ModSeq = p.modSeq
+		}
+		changed := localChanged(m, prev.SyncedAt)
+		m.Refused = p != nil && !p.applied
+		if m.ChangedAt.After(start) {
+			// Changed locally during the sync: the next sync pushes
+			// it, from what the server has now.
+			if p != nil && p.applied {
+				m.Base = p.flags
+			}
+			continue
+		}
+		if m.Refused {
+			// The server changed since the FETCH; the next sync sees
+			// both changes.
+			continue
+		}
+		if p != nil {
+			if p.conflict && !slices.Equal(p.flags, m.Flags) {
+				changes = append(changes, logChange(folder, uid, "local", m.Flags, p.flags, p.reason, now))
+				m.Flags = p.flags
+			}
+			if len(p.added) > 0 || len(p.removed) > 0 {
+				changes = append(changes, Change{Time: now, Folder: folder, UID: uid, Side: "server", Added: p.added, Removed: p.removed, Reason: p.reason})
+			}
+			m.Base = m.Flags
+			continue
+		}
+		if !fetched || slices.Equal(sm.flags, m.Flags) {
+			m.Base = m.Flags
+			continue
+		}
+		reason := "server changed"
+		if changed {
+			reason = "conflict, " + string(policy)
+		}
+		changes = append(changes, logChange(folder, uid, "local", m.Flags, sm.flags, reason, now))
+		m.Flags, m.Base = sm.flags, sm.flags
+		res.Pulled++
+	}
+	res.Expunged = len(cur.Messages) + res.New - len(next)
+	cur.Messages = next
+	cur.UIDValidity = selected.UIDValidity
+	cur.HighestModSeq = 0
+	if cond {
+		cur.HighestModSeq = selected.HighestModSeq
+	}
+	cur.SyncedAt = start
+	if err := store.record(changes); err != nil {
+		return nil, fmt.Errorf("change log: %w", err)
+	}
+	if err := store.save(cur); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// fetchFlags returns the server flags of the messages changed since the
+// last sync, or of every message without MODSEQ, and the UIDs of every
+// message in the folder.
+func fetchFlags(c *imapclient.Client, prev *Folder, cond bool, exists uint32) (map[imap.UID]serverMessage, []imap.UID, error) {
+	server := map[imap.UID]serverMessage{}
+	if exists == 0 {
+		return server, nil, nil
+	}
+	all := imap.UIDSet{imap.UIDRange{Start: 1, Stop: 0}}
+	fetchOpts := &imap.FetchOptions{UID: true, Flags: true, ModSeq: cond}
+	changedOnly := cond && prev.HighestModSeq != 0 && len(prev.Messages) > 0
+	if changedOnly {
+		fetchOpts.ChangedSince = prev.HighestModSeq
+	}
+	msgs, err := c.Fetch(all, fetchOpts).Collect()
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch flags: %w", err)
+	}
+	var current []imap.UID
+	for _, msg := range msgs {
+		server[msg.UID] = serverMessage{flags: Normalize(msg.Flags), modSeq: msg.ModSeq}
+		current = append(current, msg.UID)
+	}
+	if changedOnly {
+		data, err := c.UIDSearch(&imap.SearchCriteria{UID: []imap.UIDSet{all}}, nil).Wait()
+		if err != nil {
+			return nil, nil, fmt.Errorf("search: %w", err)
+		}
+		current = data.AllUIDs()
+	}
+	slices.Sort(current)
+	return server, current, nil
+}
+
+func diffPush(uid imap.UID, from, to []imap.Flag, reason string, conflict bool) push {
+	return push{uid: uid, added: minus(to, from), removed: minus(from, to), flags: to, reason: reason, conflict: conflict}
+}
+
+// storeFlags sends the pushes, pipelined, and marks those the server took
+// as applied. Additions go first and removals second, each from the
+// MODSEQ the step before left. A push the server refuses, with NO or by
+// leaving the message unchanged in a conditional STORE (the MODIFIED
+// response code, which the client does not report), is not applied; its
+// later steps are not sent. A conditional STORE counts as taken only when
+// its answer shows the new flags, since the server may also answer with
+// another client's change. Other errors end the sync.
+func storeFlags(c *imapclient.Client, pushes []push) error {
+	type sent struct {
+		p     *push
+		since uint64
+		cmd   *imapclient.FetchCommand
+	}
+	refused := make(map[imap.UID]bool)
+	for i := range pushes {
+		pushes[i].modSeq = pushes[i].unchangedSince
+	}
+	for _, step := range []struct {
+		op    imap.StoreFlagsOp
+		flags func(*push) []imap.Flag
+	}{
+		{imap.StoreFlagsAdd, func(p *push) []imap.Flag { return p.added }},
+		{imap.StoreFlagsDel, func(p *push) []imap.Flag { return p.removed }},
+	} {
+		var cmds []sent
+		for i := range pushes {
+			p := &pushes[i]
+			flags := step.flags(p)
+			if refused[p.uid] || len(flags) == 0 {
+				continue
+			}
+			var opts *imap.StoreOptions
+			if p.modSeq != 0 {
+				opts = &imap.StoreOptions{UnchangedSince: p.modSeq}
+			}
+			store := &imap.StoreFlags{Op: step.op, Flags: flags, Silent: opts == nil}
+			cmds = append(cmds, sent{p: p, since: p.modSeq, cmd: c.Store(imap.UIDSetNum(p.uid), store, opts)})
+		}
+		for _, s := range cmds {
+			msgs, err := s.cmd.Collect()
+			var imapErr *imap.Error
+			switch {
+			case errors.As(err, &imapErr):
+				refused[s.p.uid] = true
+				continue
+			case err != nil:
+				return fmt.Errorf("store: %w", err)
+			case s.since == 0:
+				continue
+			}
+			i := slices.IndexFunc(msgs, func(msg *imapclient.FetchMessageBuffer) bool {
+				return msg.UID == s.p.uid && shows(msg.Flags, step.op, step.flags(s.p))
+			})
+			if i < 0 {
+				refused[s.p.uid] = true
+				continue
+			}
+			s.p.modSeq = msgs[i].ModSeq
+		}
+	}
+	for i := range pushes {
+		pushes[i].applied = !refused[pushes[i].uid]
+		if !pushes[i].applied {
+			pushes[i].modSeq = 0
+		}
+	}
+	return nil
+}
+
+// shows reports whether flags, as the server answered a STORE, have the
+// change made.
+func shows(flags []imap.Flag, op imap.StoreFlagsOp, changed []imap.Flag) bool {
+	has := Normalize(flags)
+	for _, f := range changed {
+		if slices.Contains(has, f) != (op == imap.StoreFlagsAdd) {
+			return false
+		}
+	}
+	return true
+}
+
+func logChange(folder string, uid imap.UID, side string, from, to []imap.Flag, reason string, now time.Time) Change {
+	return Change{Time: now, Folder: folder, UID: uid, Side: side, Added: minus(to, from), Removed: minus(from, to), Reason: reason}
+}
@@ -0,0 +1,377 @@
+package flagsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+)
+
+func TestNormalize(t *testing.T) {
+	got := Normalize([]imap.Flag{`\SEEN`, "Work", `\Deleted`, `\flagged`, "work", `\Recent`, "$Forwarded"})
+	want := []imap.Flag{"$forwarded", imap.FlagFlagged, imap.FlagSeen, "work"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Normalize = %v, want %v", got, want)
+	}
+	if _, err := ParsePolicy("newest"); err == nil {
+		t.Error("unknown policy parsed")
+	}
+}
+
+func storeServer(t *testing.T, c *imapclient.Client, uid imap.UID, op imap.StoreFlagsOp, flags ...imap.Flag) {
+	t.Helper()
+	if err := c.Store(imap.UIDSetNum(uid), &imap.StoreFlags{Op: op, Flags: flags, Silent: true}, nil).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serverFlags(t *testing.T, c *imapclient.Client) map[imap.UID][]imap.Flag {
+	t.Helper()
+	msgs, err := c.Fetch(imap.UIDSet{imap.UIDRange{Start: 1, Stop: 0}}, &imap.FetchOptions{UID: true, Flags: true}).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := map[imap.UID][]imap.Flag{}
+	for _, msg := range msgs {
+		flags[msg.UID] = Normalize(msg.Flags)
+	}
+	return flags
+}
+
+func TestSync(t *testing.T) {
+	for _, condStore := range []bool{false, true} {
+		for _, policy := range []Policy{ServerWins, LocalWins, Union} {
+			t.Run(fmt.Sprintf("condstore=%v/%s", condStore, policy), func(t *testing.T) {
+				testSync(t, condStore, policy)
+			})
+		}
+	}
+}
+
+func testSync(t *testing.T, condStore bool, policy Policy) {
+	server, err := fakeserver.Start(&fakeserver.Options{CondStore: condStore})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	date := time.Date(2024, 4, 2, 16, 12, 40, 0, time.UTC)
+	seed := [][]imap.Flag{{imap.FlagSeen}, {"Work"}, nil, nil, nil, {imap.FlagSeen}}
+	for i, flags := range seed {
+		raw := fmt.Sprintf("From: sender@example.com\r\nSubject: %d\r\n\r\nBody\r\n", i)
+		if _, err := server.Append("INBOX", []byte(raw), flags, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	ctx := context.Background()
+	opts := &Options{Policy: policy}
+	sync := func() *Result {
+		t.Helper()
+		res, err := Sync(ctx, c, store, "INBOX", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.CondStore != condStore {
+			t.Errorf("condstore = %v", res.CondStore)
+		}
+		return res
+	}
+
+	if res := sync(); res.New != 6 || res.Pulled != 0 || res.Pushed != 0 {
+		t.Fatalf("first sync = %+v", res)
+	}
+	if flags, _, _ := store.Get("INBOX", 2); !slices.Equal(flags, []imap.Flag{"work"}) {
+		t.Errorf("UID 2 local flags = %v", flags)
+	}
+
+	// Local changes: UID 3 flagged, UID 4 gets a keyword, UID 6 read
+	// elsewhere; \Deleted is not synced.
+	if err := store.Change("INBOX", []imap.UID{3}, &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagFlagged, imap.FlagDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Change("INBOX", []imap.UID{4}, &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{"ToDo"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Server changes: UID 5 answered, UID 2 loses its keyword.
+	storeServer(t, c, 5, imap.StoreFlagsAdd, imap.FlagAnswered)
+	storeServer(t, c, 2, imap.StoreFlagsDel, "Work")
+	// A conflict on UID 1: marked unread locally, flagged on the server.
+	if err := store.Change("INBOX", []imap.UID{1}, &imap.StoreFlags{Op: imap.StoreFlagsDel, Flags: []imap.Flag{imap.FlagSeen}}); err != nil {
+		t.Fatal(err)
+	}
+	storeServer(t, c, 1, imap.StoreFlagsAdd, imap.FlagFlagged)
+	// The same change on both sides is no conflict.
+	if err := store.Change("INBOX", []imap.UID{6}, &imap.StoreFlags{Op: imap.StoreFlagsSet}); err != nil {
+		t.Fatal(err)
+	}
+	storeServer(t, c, 6, imap.StoreFlagsDel, imap.FlagSeen)
+
+	res := sync()
+	wantUID1 := map[Policy][]imap.Flag{
+		ServerWins: {imap.FlagFlagged, imap.FlagSeen},
+		LocalWins:  {},
+		Union:      {imap.FlagFlagged, imap.FlagSeen},
+	}[policy]
+	wantPushed, wantPulled := 2, 2
+	switch policy {
+	case ServerWins:
+		wantPulled++
+	case LocalWins:
+		wantPushed++
+	}
+	if res.Conflicts != 1 || res.Pushed != wantPushed || res.Pulled != wantPulled {
+		t.Errorf("sync = %+v, want 1 conflict, %d pushed, %d pulled", res, wantPushed, wantPulled)
+	}
+	want := map[imap.UID][]imap.Flag{
+		1: wantUID1,
+		2: {},
+		3: {imap.FlagFlagged},
+		4: {"todo"},
+		5: {imap.FlagAnswered},
+		6: {},
+	}
+	got := serverFlags(t, c)
+	for uid, flags := range want {
+		if !slices.Equal(got[uid], flags) {
+			t.Errorf("UID %d server flags = %v, want %v", uid, got[uid], flags)
+		}
+		local, ok, err := store.Get("INBOX", uid)
+		if err != nil || !ok || !slices.Equal(local, flags) {
+			t.Errorf("UID %d local flags = %v, want %v", uid, local, flags)
+		}
+	}
+
+	// Once in agreement, a sync changes nothing, and our own STOREs are
+	// not taken for server changes.
+	if res := sync(); res.Pushed != 0 || res.Pulled != 0 || res.Conflicts != 0 || res.New != 0 {
+		t.Errorf("second sync = %+v", res)
+	}
+
+	changes, err := store.ReadLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]int{}
+	for _, c := range changes {
+		reasons[c.Side+": "+c.Reason]++
+	}
+	wantReasons := map[string]int{"server: local changed": 2, "local: server changed": 2}
+	switch policy {
+	case ServerWins:
+		wantReasons["local: conflict, server"] = 1
+	case LocalWins:
+		wantReasons["server: conflict, local"] = 1
+	case Union:
+		wantReasons["local: conflict, union"] = 1
+	}
+	if fmt.Sprint(reasons) != fmt.Sprint(wantReasons) {
+		t.Errorf("change log = %v, want %v", reasons, wantReasons)
+	}
+
+	// Expunges and new mail on the server.
+	storeServer(t, c, 3, imap.StoreFlagsAdd, imap.FlagDeleted)
+	if err := c.Expunge().Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Append("INBOX", []byte("Subject: new\r\n\r\nBody\r\n"), []imap.Flag{imap.FlagFlagged}, date); err != nil {
+		t.Fatal(err)
+	}
+	if res := sync(); res.New != 1 || res.Expunged != 1 {
+		t.Errorf("after expunge = %+v", res)
+	}
+	if _, ok, _ := store.Get("INBOX", 3); ok {
+		t.Error("expunged message still stored")
+	}
+	if flags, _, _ := store.Get("INBOX", 7); !slices.Equal(flags, []imap.Flag{imap.FlagFlagged}) {
+		t.Errorf("new message flags = %v", flags)
+	}
+}
+
+func TestSyncUIDValidity(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err := server.Create("Work"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Append("Work", []byte("Subject: a\r\n\r\nBody\r\n"), nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := Sync(context.Background(), c, store, "Work", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Change("Work", []imap.UID{1}, &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagFlagged}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The local change is for a message that no longer exists.
+	if err := c.Unselect().Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Delete("Work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Create("Work"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Append("Work", []byte("Subject: b\r\n\r\nBody\r\n"), []imap.Flag{imap.FlagSeen}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	store, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	res, err := Sync(context.Background(), c, store, "Work", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Reset || res.New != 1 || res.Pushed != 0 {
+		t.Errorf("after UIDVALIDITY change = %+v", res)
+	}
+	if got := serverFlags(t, c); !slices.Equal(got[1], []imap.Flag{imap.FlagSeen}) {
+		t.Errorf("server flags = %v", got)
+	}
+	if flags, _, _ := store.Get("Work", 1); !slices.Equal(flags, []imap.Flag{imap.FlagSeen}) {
+		t.Errorf("local flags = %v", flags)
+	}
+}
+
+// beforeStore runs f once, just before the first UID STORE is sent.
+type beforeStore struct {
+	net.Conn
+	once sync.Once
+	f    func()
+}
+
+func (c *beforeStore) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("UID STORE")) {
+		c.once.Do(c.f)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestSyncChangedBeforeStore(t *testing.T) {
+	server, err := fakeserver.Start(&fakeserver.Options{CondStore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := server.Append("INBOX", []byte("Subject: race\r\n\r\nBody\r\n"), nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	other, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Logout() //nolint:errcheck
+	if _, err := other.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sync's connection lets another client mark UID 2 read between
+	// the sync's FETCH and its STORE.
+	conn, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &beforeStore{Conn: conn}
+	c := imapclient.New(hook, nil)
+	defer c.Logout() //nolint:errcheck
+	if err := c.Login(fakeserver.Username, fakeserver.Password).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	opts := &Options{Policy: Union}
+	if _, err := Sync(ctx, c, store, "INBOX", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	hook.f = func() { storeServer(t, other, 2, imap.StoreFlagsAdd, imap.FlagSeen) }
+	for _, uid := range []imap.UID{2, 3} {
+		if err := store.Change("INBOX", []imap.UID{uid}, &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagFlagged}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := Sync(ctx, c, store, "INBOX", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Refused != 1 || res.Pushed != 1 {
+		t.Errorf("sync = %+v, want UID 2 refused and UID 3 pushed", res)
+	}
+	got := serverFlags(t, other)
+	if !slices.Equal(got[2], []imap.Flag{imap.FlagSeen}) || !slices.Equal(got[3], []imap.Flag{imap.FlagFlagged}) {
+		t.Errorf("server flags = %v, want the other client's change kept", got)
+	}
+	if flags, _, _ := store.Get("INBOX", 2); !slices.Equal(flags, []imap.Flag{imap.FlagFlagged}) {
+		t.Errorf("UID 2 local flags = %v, want the refused change kept", flags)
+	}
+
+	// The next sync sees both changes and resolves them by the policy.
+	res, err = Sync(ctx, c, store, "INBOX", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Conflicts != 1 || res.Refused != 0 {
+		t.Errorf("next sync = %+v, want 1 conflict", res)
+	}
+	want := []imap.Flag{imap.FlagFlagged, imap.FlagSeen}
+	if got := serverFlags(t, other); !slices.Equal(got[2], want) {
+		t.Errorf("UID 2 server flags = %v, want %v", got[2], want)
+	}
+	if flags, _, _ := store.Get("INBOX", 2); !slices.Equal(flags, want) {
+		t.Errorf("UID 2 local flags = %v, want %v", flags, want)
+	}
+	changes, err := store.ReadLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reasons []string
+	for _, c := range changes {
+		reasons = append(reasons, fmt.Sprintf("%d %s: %s", c.UID, c.Side, c.Reason))
+	}
+	wantReasons := []string{"3 server: local changed", "2 local: conflict, union", "2 server: conflict, union"}
+	if !slices.Equal(reasons, wantReasons) {
+		t.Errorf("change log = %q, want %q", reasons, wantReasons)
+	}
+}
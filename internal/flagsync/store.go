@@ -0,0 +1,285 @@
+package flagsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// StateVersion is written into every folder file. A file with another
+// version is ignored, which makes its folder start over from the server's
+// flags.
+const StateVersion = 1
+
+const (
+	folderExt = ".json"
+	logName   = "changes.log"
+)
+
+// Message is the local record of one message's flags.
+type Message struct {
+	UID   imap.UID    `json:"uid"`
+	Flags []imap.Flag `json:"flags"`
+	// Base is the flags both sides had at the last sync. A side whose
+	// flags differ from it has changed them since.
+	Base []imap.Flag `json:"base"`
+	// ModSeq is the message's MODSEQ at the last sync, or zero without
+	// CONDSTORE.
+	ModSeq uint64 `json:"modseq,omitempty"`
+	// ChangedAt is when Change last changed the local flags.
+	ChangedAt time.Time `json:"changed_at,omitempty"`
+	// Refused is set when the server refused the last push of the local
+	// flags, because the message changed there first. The next sync
+	// pushes them again, or treats the message as a conflict.
+	Refused bool `json:"refused,omitempty"`
+}
+
+// Folder is the local flags of one folder.
+type Folder struct {
+	Version     int    `json:"version"`
+	Folder      string `json:"folder"`
+	UIDValidity uint32 `json:"uid_validity"`
+	// HighestModSeq is the folder's HIGHESTMODSEQ at the last sync, or
+	// zero when it was synced without CONDSTORE.
+	HighestModSeq uint64 `json:"highest_modseq,omitempty"`
+	// SyncedAt is when the last sync started. Local changes made after it
+	// are pushed by the next one.
+	SyncedAt time.Time `json:"synced_at"`
+	// Messages is sorted by UID.
+	Messages []*Message `json:"messages"`
+}
+
+func (f *Folder) find(uid imap.UID) (int, bool) {
+	return slices.BinarySearchFunc(f.Messages, uid, func(m *Message, uid imap.UID) int {
+		return int(m.UID) - int(uid)
+	})
+}
+
+// Change is one line of the change log.
+type Change struct {
+	Time   time.Time `json:"time"`
+	Folder string    `json:"folder"`
+	UID    imap.UID  `json:"uid"`
+	// Side is where the change was applied: "local" or "server".
+	Side    string      `json:"side"`
+	Added   []imap.Flag `json:"added,omitempty"`
+	Removed []imap.Flag `json:"removed,omitempty"`
+	// Reason is "server changed", "local changed" or, when both did,
+	// "conflict" and the policy.
+	Reason string `json:"reason"`
+}
+
+// Store keeps the local flags, one file per folder, and the change log in
+// a directory. It is safe for concurrent use.
+type Store struct {
+	dir string
+
+	mu      sync.Mutex
+	folders map[string]*Folder
+	log     *os.File
+}
+
+// Open opens the store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, folders: map[string]*Folder{}, log: log}, nil
+}
+
+// Dir is the store directory.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Close closes the change log.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+// Get returns the local flags of a message, and false when the store does
+// not know it.
+func (s *Store) Get(folder string, uid imap.UID) ([]imap.Flag, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.load(folder)
+	if err != nil || f == nil {
+		return nil, false, err
+	}
+	i, ok := f.find(uid)
+	if !ok {
+		return nil, false, nil
+	}
+	return slices.Clone(f.Messages[i].Flags), true, nil
+}
+
+// Change changes the local flags of messages the way STORE changes them
+// on the server; the next sync pushes the change. Flags that are not
+// synced, such as \Deleted, are ignored. It fails for a message the store
+// does not know.
+func (s *Store) Change(folder string, uids []imap.UID, store *imap.StoreFlags) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.load(folder)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return fmt.Errorf("flagsync: unknown folder %s", folder)
+	}
+	now := time.Now().UTC()
+	flags := Normalize(store.Flags)
+	for _, uid := range uids {
+		i, ok := f.find(uid)
+		if !ok {
+			return fmt.Errorf("flagsync: unknown message %s/%d", folder, uid)
+		}
+		m := f.Messages[i]
+		switch store.Op {
+		case imap.StoreFlagsSet:
+			m.Flags = flags
+		case imap.StoreFlagsAdd:
+			m.Flags = union(m.Flags, flags)
+		case imap.StoreFlagsDel:
+			m.Flags = minus(m.Flags, flags)
+		}
+		m.ChangedAt = now
+	}
+	return s.save(f)
+}
+
+// Folder returns a copy of the local flags of a folder, or nil when it has
+// never been synced.
+func (s *Store) Folder(folder string) (*Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.load(folder)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	return f.clone(), nil
+}
+
+func (f *Folder) clone() *Folder {
+	c := *f
+	c.Messages = make([]*Message, len(f.Messages))
+	for i, m := range f.Messages {
+		mc := *m
+		c.Messages[i] = &mc
+	}
+	return &c
+}
+
+func (s *Store) path(folder string) string {
+	return filepath.Join(s.dir, url.PathEscape(folder)+folderExt)
+}
+
+// load returns the cached folder, reading it on first use. The caller
+// holds s.mu.
+func (s *Store) load(folder string) (*Folder, error) {
+	if f, ok := s.folders[folder]; ok {
+		return f, nil
+	}
+	b, err := os.ReadFile(s.path(folder))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f Folder
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("flagsync: %s: %w", folder, err)
+	}
+	if f.Version != StateVersion || f.Folder != folder {
+		return nil, nil
+	}
+	s.folders[folder] = &f
+	return &f, nil
+}
+
+// save writes a folder in one rename, so a crash leaves either the old
+// file or the new one. The caller holds s.mu.
+func (s *Store) save(f *Folder) error {
+	f.Version = StateVersion
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".folder-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone after the rename
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(f.Folder)); err != nil {
+		return err
+	}
+	s.folders[f.Folder] = f
+	return nil
+}
+
+// record appends changes to the change log. The caller holds s.mu.
+func (s *Store) record(changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	var b []byte
+	for _, c := range changes {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if _, err := s.log.Write(b); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// ReadLog returns every change in the log, oldest first.
+func (s *Store) ReadLog() ([]Change, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, logName))
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		var c Change
+		if err := json.Unmarshal([]byte(line), &c); err != nil {
+			// A torn last line from a crash.
+			break
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
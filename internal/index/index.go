@@ -0,0 +1,477 @@
+// Package index keeps a local index of synced messages: envelope, flags,
+// folder, UID, size, thread and attachment metadata, but no bodies. It is
+// stored in one directory as an append-only log of JSON lines, compacted
+// when it is mostly dead lines, and held in memory while open, so queries
+// never touch the IMAP server.
+//
+// An *Index is a mailsync.Handler; sync with FetchOptions to fill it.
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/lazy"
+)
+
+// logName is the index log in the index directory.
+const logName = "index.log"
+
+// compactAfter is how many dead lines the log may have before it is
+// rewritten, as long as they outnumber the live entries.
+const compactAfter = 1000
+
+// FetchOptions are what Message needs. The References header is fetched
+// besides the ENVELOPE, which lacks it, to thread replies to replies.
+var FetchOptions = &imap.FetchOptions{
+	UID:           true,
+	Flags:         true,
+	Envelope:      true,
+	InternalDate:  true,
+	RFC822Size:    true,
+	BodyStructure: &imap.FetchItemBodyStructure{Extended: true},
+	BodySection: []*imap.FetchItemBodySection{{
+		Specifier:    imap.PartSpecifierHeader,
+		HeaderFields: []string{"References"},
+		Peek:         true,
+	}},
+}
+
+// Attachment describes an attachment without its content.
+type Attachment struct {
+	// Section is the IMAP section number, e.g. "2.1".
+	Section     string `json:"section"`
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename,omitempty"`
+	// Size is the encoded size on the server.
+	Size uint32 `json:"size"`
+}
+
+// Entry is one indexed message.
+type Entry struct {
+	Folder       string             `json:"folder"`
+	UID          imap.UID           `json:"uid"`
+	Envelope     *envelope.Envelope `json:"envelope,omitempty"`
+	InternalDate time.Time          `json:"internal_date"`
+	Size         int64              `json:"size"`
+	Flags        []imap.Flag        `json:"flags,omitempty"`
+	// ThreadID is the Message-ID the message's thread is filed under,
+	// normally the root's, or "folder/uid" for a message without any IDs.
+	// Threads are joined as their messages arrive; two threads found to be
+	// one only by a later message stay apart.
+	ThreadID    string       `json:"thread_id"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Date is the envelope date, or INTERNALDATE when the message has none.
+func (e *Entry) Date() time.Time {
+	if e.Envelope != nil && e.Envelope.Date != nil {
+		return *e.Envelope.Date
+	}
+	return e.InternalDate
+}
+
+type key struct {
+	folder string
+	uid    imap.UID
+}
+
+// record is one line of the log: an entry stored, a message removed, or a
+// folder dropped.
+type record struct {
+	Put    *Entry   `json:"put,omitempty"`
+	Folder string   `json:"folder,omitempty"`
+	UID    imap.UID `json:"uid,omitempty"`
+	Reset  string   `json:"reset,omitempty"`
+}
+
+// Index is an open index. It is safe for concurrent use.
+type Index struct {
+	dir string
+
+	mu      sync.RWMutex
+	entries map[key]*Entry
+	// byMessageID, byRef and byThread find entries for threading. byRef
+	// maps a Message-ID to the entries that refer to it.
+	byMessageID map[string][]key
+	byRef       map[string][]key
+	byThread    map[string][]key
+	log         *os.File
+	dead        int
+}
+
+// Open opens the index in dir, creating it if needed.
+func Open(dir string) (*Index, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	ix := &Index{
+		dir:         dir,
+		entries:     make(map[key]*Entry),
+		byMessageID: make(map[string][]key),
+		byRef:       make(map[string][]key),
+		byThread:    make(map[string][]key),
+	}
+	if err := ix.load(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	ix.log = f
+	return ix, nil
+}
+
+// Dir returns the index directory.
+func (ix *Index) Dir() string {
+	return ix.dir
+}
+
+// Close syncs the log to disk and closes it.
+func (ix *Index) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.log == nil {
+		return nil
+	}
+	err := ix.log.Sync()
+	if closeErr := ix.log.Close(); err == nil {
+		err = closeErr
+	}
+	ix.log = nil
+	return err
+}
+
+// load replays the log. A torn last line, left by a crash mid-write, is cut
+// off; damage anywhere else is an error.
+func (ix *Index) load() error {
+	path := filepath.Join(ix.dir, logName)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var good int64
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return os.Truncate(path, good)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				return os.Truncate(path, good)
+			}
+			return fmt.Errorf("index: %s line %d: %w", logName, n, err)
+		}
+		ix.apply(&rec)
+		good += int64(len(line))
+	}
+}
+
+// apply changes the in-memory index. It counts every line that replaces or
+// removes an entry as dead.
+func (ix *Index) apply(rec *record) {
+	switch {
+	case rec.Put != nil:
+		k := key{rec.Put.Folder, rec.Put.UID}
+		if ix.entries[k] != nil {
+			ix.remove(k)
+			ix.dead++
+		}
+		ix.add(rec.Put)
+	case rec.Reset != "":
+		for k := range ix.entries {
+			if k.folder == rec.Reset {
+				ix.remove(k)
+				ix.dead++
+			}
+		}
+		ix.dead++
+	default:
+		k := key{rec.Folder, rec.UID}
+		if ix.entries[k] != nil {
+			ix.remove(k)
+			ix.dead++
+		}
+		ix.dead++
+	}
+}
+
+func (ix *Index) add(e *Entry) {
+	k := key{e.Folder, e.UID}
+	ix.entries[k] = e
+	if e.Envelope != nil && e.Envelope.MessageID != "" {
+		ix.byMessageID[e.Envelope.MessageID] = append(ix.byMessageID[e.Envelope.MessageID], k)
+	}
+	for _, id := range refs(e) {
+		ix.byRef[id] = append(ix.byRef[id], k)
+	}
+	ix.byThread[e.ThreadID] = append(ix.byThread[e.ThreadID], k)
+}
+
+func (ix *Index) remove(k key) {
+	e := ix.entries[k]
+	delete(ix.entries, k)
+	drop := func(m map[string][]key, id string) {
+		keys := slices.DeleteFunc(m[id], func(other key) bool { return other == k })
+		if len(keys) == 0 {
+			delete(m, id)
+		} else {
+			m[id] = keys
+		}
+	}
+	if e.Envelope != nil && e.Envelope.MessageID != "" {
+		drop(ix.byMessageID, e.Envelope.MessageID)
+	}
+	for _, id := range refs(e) {
+		drop(ix.byRef, id)
+	}
+	drop(ix.byThread, e.ThreadID)
+}
+
+// write applies recs and appends them to the log, then compacts the log if
+// it is mostly dead lines. The caller holds mu.
+func (ix *Index) write(recs ...*record) error {
+	if ix.log == nil {
+		return errors.New("index: closed")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+		ix.apply(rec)
+	}
+	if _, err := ix.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if ix.dead > compactAfter && ix.dead > len(ix.entries) {
+		return ix.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with only the live entries. The caller holds mu.
+func (ix *Index) compact() error {
+	tmp, err := os.CreateTemp(ix.dir, ".index-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone after the rename
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range ix.entries {
+		if err := enc.Encode(&record{Put: e}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(ix.dir, logName)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	ix.log.Close()
+	ix.log = f
+	ix.dead = 0
+	return nil
+}
+
+// Put stores e, replacing any entry with the same folder and UID, and
+// threads it: e joins the thread of any indexed message it refers to, and
+// messages that refer to e and were indexed before it join e's thread.
+func (ix *Index) Put(e *Entry) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	self := key{e.Folder, e.UID}
+	e.ThreadID = ix.thread(e, self)
+	recs := []*record{{Put: e}}
+	if env := e.Envelope; env != nil && env.MessageID != "" {
+		// Threads filed under e or under one of its replies.
+		merge := map[string]bool{env.MessageID: true}
+		for _, k := range slices.Concat(ix.byMessageID[env.MessageID], ix.byRef[env.MessageID]) {
+			merge[ix.entries[k].ThreadID] = true
+		}
+		delete(merge, e.ThreadID)
+		for thread := range merge {
+			for _, k := range ix.byThread[thread] {
+				if k == self {
+					continue
+				}
+				moved := *ix.entries[k]
+				moved.ThreadID = e.ThreadID
+				recs = append(recs, &record{Put: &moved})
+			}
+		}
+	}
+	return ix.write(recs...)
+}
+
+// thread picks the thread ID of e, stored under self. The caller holds mu.
+func (ix *Index) thread(e *Entry, self key) string {
+	env := e.Envelope
+	if env == nil {
+		return fmt.Sprintf("%s/%d", e.Folder, e.UID)
+	}
+	other := func(keys []key) string {
+		for _, k := range keys {
+			if k != self {
+				return ix.entries[k].ThreadID
+			}
+		}
+		return ""
+	}
+	// References lists the root first, so an indexed root wins.
+	ids := refs(e)
+	for _, id := range ids {
+		if t := other(ix.byMessageID[id]); t != "" {
+			return t
+		}
+	}
+	if len(ids) > 0 {
+		return ids[0]
+	}
+	if env.MessageID != "" {
+		// Another copy of the same message, or a reply indexed first.
+		if t := other(ix.byMessageID[env.MessageID]); t != "" {
+			return t
+		}
+		if t := other(ix.byRef[env.MessageID]); t != "" {
+			return t
+		}
+		return env.MessageID
+	}
+	return fmt.Sprintf("%s/%d", e.Folder, e.UID)
+}
+
+// refs returns the Message-IDs e refers to, root first.
+func refs(e *Entry) []string {
+	if e.Envelope == nil {
+		return nil
+	}
+	return slices.Concat(e.Envelope.References, e.Envelope.InReplyTo)
+}
+
+// Get returns the entry of a message, or nil.
+func (ix *Index) Get(folder string, uid imap.UID) *Entry {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if e := ix.entries[key{folder, uid}]; e != nil {
+		c := *e
+		return &c
+	}
+	return nil
+}
+
+// Len returns the number of indexed messages.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.entries)
+}
+
+// Reset implements mailsync.Handler: it drops every entry of folder.
+func (ix *Index) Reset(folder string) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.write(&record{Reset: folder})
+}
+
+// Message implements mailsync.Handler. msg must have been fetched with
+// FetchOptions.
+func (ix *Index) Message(folder string, msg *imapclient.FetchMessageBuffer) error {
+	e := &Entry{
+		Folder:       folder,
+		UID:          msg.UID,
+		Envelope:     envelope.FromV2(msg.Envelope),
+		InternalDate: msg.InternalDate.UTC(),
+		Size:         msg.RFC822Size,
+		Flags:        msg.Flags,
+	}
+	if e.Envelope != nil {
+		for section, raw := range msg.BodySection {
+			if section.Specifier != imap.PartSpecifierHeader {
+				continue
+			}
+			header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+			if err == nil {
+				e.Envelope.References = envelope.NormalizeMessageIDs(header.Get("References"))
+			}
+		}
+	}
+	if msg.BodyStructure != nil {
+		for _, part := range lazy.Attachments(msg.BodyStructure) {
+			e.Attachments = append(e.Attachments, Attachment{
+				Section:     part.Section,
+				ContentType: part.ContentType,
+				Filename:    part.Filename,
+				Size:        part.Size,
+			})
+		}
+	}
+	return ix.Put(e)
+}
+
+// Expunged implements mailsync.Handler.
+func (ix *Index) Expunged(folder string, uids []imap.UID) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	recs := make([]*record, 0, len(uids))
+	for _, uid := range uids {
+		if ix.entries[key{folder, uid}] != nil {
+			recs = append(recs, &record{Folder: folder, UID: uid})
+		}
+	}
+	return ix.write(recs...)
+}
+
+// Flags implements mailsync.Handler.
+func (ix *Index) Flags(folder string, uid imap.UID, flags []imap.Flag) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	e := ix.entries[key{folder, uid}]
+	if e == nil {
+		return nil
+	}
+	updated := *e
+	updated.Flags = flags
+	return ix.write(&record{Put: &updated})
+}
@@ -0,0 +1,312 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+	"github.com/quzhi1/imap-playground/internal/mailsync"
+)
+
+func entry(folder string, uid imap.UID, id, subject, from string, day int, size int64, refs ...string) *Entry {
+	date := time.Date(2024, 3, day, 12, 0, 0, 0, time.UTC)
+	for i, ref := range refs {
+		refs[i] = envelope.NormalizeMessageID(ref)
+	}
+	return &Entry{
+		Folder: folder,
+		UID:    uid,
+		Envelope: &envelope.Envelope{
+			MessageID:  envelope.NormalizeMessageID(id),
+			Subject:    subject,
+			Date:       &date,
+			From:       []envelope.Address{{Name: "Sender " + from, Address: from}},
+			To:         []envelope.Address{{Address: "me@example.com"}},
+			References: refs,
+		},
+		InternalDate: date,
+		Size:         size,
+	}
+}
+
+func uids(res *Result) []string {
+	var out []string
+	for _, e := range res.Entries {
+		out = append(out, fmt.Sprintf("%s/%d", e.Folder, e.UID))
+	}
+	return out
+}
+
+func TestQuery(t *testing.T) {
+	ix, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	seen := entry("INBOX", 1, "a@x", "Quarterly report", "alice@example.com", 1, 1000)
+	seen.Flags = []imap.Flag{imap.FlagSeen}
+	withPDF := entry("INBOX", 2, "b@x", "Invoice", "billing@shop.example", 2, 50000)
+	withPDF.Attachments = []Attachment{{Section: "2", ContentType: "application/pdf", Filename: "Invoice-42.pdf", Size: 48000}}
+	for _, e := range []*Entry{
+		seen,
+		withPDF,
+		entry("INBOX", 3, "c@x", "Lunch?", "bob@example.com", 3, 500),
+		entry("Archive", 1, "d@x", "Old report", "alice@example.com", 4, 2000),
+		entry("Archive", 2, "e@x", "Photos", "carol@example.com", 5, 900000),
+	} {
+		if err := ix.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	yes, no := true, false
+	for _, tc := range []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"default sort is newest first", Query{}, []string{"Archive/2", "Archive/1", "INBOX/3", "INBOX/2", "INBOX/1"}},
+		{"folder", Query{Folders: []string{"INBOX"}, Sort: "uid"}, []string{"INBOX/1", "INBOX/2", "INBOX/3"}},
+		{"from name or address", Query{From: "ALICE", Sort: "date"}, []string{"INBOX/1", "Archive/1"}},
+		{"subject", Query{Subject: "report", Sort: "subject"}, []string{"Archive/1", "INBOX/1"}},
+		{"message id", Query{MessageID: "<c@x>"}, []string{"INBOX/3"}},
+		{"date range", Query{Since: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), Before: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)}, []string{"INBOX/3", "INBOX/2"}},
+		{"flags", Query{Flags: []imap.Flag{"\\SEEN"}}, []string{"INBOX/1"}},
+		{"not flags", Query{NotFlags: []imap.Flag{imap.FlagSeen}, Folders: []string{"INBOX"}}, []string{"INBOX/3", "INBOX/2"}},
+		{"size", Query{MinSize: 1000, MaxSize: 50000, Sort: "-size"}, []string{"INBOX/2", "Archive/1", "INBOX/1"}},
+		{"with attachments", Query{HasAttachments: &yes}, []string{"INBOX/2"}},
+		{"without attachments", Query{HasAttachments: &no, Folders: []string{"Archive"}}, []string{"Archive/2", "Archive/1"}},
+		{"attachment name and type", Query{Attachment: "invoice", AttachmentType: "application/"}, []string{"INBOX/2"}},
+		{"attachment type mismatch", Query{AttachmentType: "image/"}, nil},
+		{"sort by folder then size", Query{Sort: "folder,-size"}, []string{"Archive/2", "Archive/1", "INBOX/2", "INBOX/1", "INBOX/3"}},
+		{"page", Query{Sort: "date", Offset: 1, Limit: 2}, []string{"INBOX/2", "INBOX/3"}},
+		{"page past the end", Query{Offset: 10}, nil},
+	} {
+		res, err := ix.Query(&tc.q)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := uids(res); !slices.Equal(got, tc.want) {
+			t.Errorf("%s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	res, _ := ix.Query(&Query{Sort: "date", Limit: 2})
+	if res.Total != 5 || len(res.Entries) != 2 {
+		t.Errorf("paged result = %d of %d", len(res.Entries), res.Total)
+	}
+	if _, err := ix.Query(&Query{Sort: "color"}); err == nil {
+		t.Error("unknown sort field accepted")
+	}
+}
+
+func TestThreads(t *testing.T) {
+	ix, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	// A reply to a reply arrives first, naming only its direct parent.
+	late := entry("INBOX", 3, "c@x", "Re: Re: plan", "a@example.com", 3, 1)
+	late.Envelope.InReplyTo = []string{"<b@x>"}
+	for _, e := range []*Entry{
+		late,
+		entry("INBOX", 2, "b@x", "Re: plan", "b@example.com", 2, 1, "a@x"),
+		entry("Sent", 1, "a@x", "plan", "me@example.com", 1, 1),
+		entry("INBOX", 4, "z@x", "other", "z@example.com", 4, 1),
+		entry("Archive", 9, "b@x", "Re: plan", "b@example.com", 2, 1, "a@x"),
+		{Folder: "INBOX", UID: 5},
+	} {
+		if err := ix.Put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, _ := ix.Query(&Query{ThreadID: "a@x", Sort: "date,folder"})
+	if got, want := uids(res), []string{"Sent/1", "Archive/9", "INBOX/2", "INBOX/3"}; !slices.Equal(got, want) {
+		t.Errorf("thread a@x = %v, want %v", got, want)
+	}
+	if e := ix.Get("INBOX", 4); e.ThreadID != "<z@x>" {
+		t.Errorf("unrelated message in thread %q", e.ThreadID)
+	}
+	if e := ix.Get("INBOX", 5); e.ThreadID != "INBOX/5" {
+		t.Errorf("message without IDs in thread %q", e.ThreadID)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	ix, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := ix.Put(entry("INBOX", imap.UID(i), fmt.Sprintf("%d@x", i), "s", "a@example.com", i, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ix.Flags("INBOX", 2, []imap.Flag{imap.FlagFlagged}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Expunged("INBOX", []imap.UID{3, 99}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Put(entry("Archive", 1, "9@x", "s", "a@example.com", 9, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Reset("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash in the middle of a write leaves a torn last line.
+	path := filepath.Join(dir, logName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"put":{"folder":"INBOX","ui`)
+	f.Close()
+
+	for run := 0; run < 2; run++ {
+		ix, err = Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _ := ix.Query(&Query{Sort: "uid"})
+		if got, want := uids(res), []string{"INBOX/1", "INBOX/2", "INBOX/4", "INBOX/5"}; !slices.Equal(got, want) {
+			t.Errorf("run %d: reopened index = %v, want %v", run, got, want)
+		}
+		if e := ix.Get("INBOX", 2); !slices.Equal(e.Flags, []imap.Flag{imap.FlagFlagged}) {
+			t.Errorf("run %d: flags = %v", run, e.Flags)
+		}
+		// The write after the torn line must not be glued to it.
+		if err := ix.Flags("INBOX", 1, []imap.Flag{imap.FlagSeen}); err != nil {
+			t.Fatal(err)
+		}
+		ix.Close()
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	ix, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3*compactAfter; i++ {
+		if err := ix.Put(entry("INBOX", imap.UID(i%10+1), fmt.Sprintf("%d@x", i%10), "s", "a@example.com", 1, int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix.Close()
+	b, err := os.ReadFile(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countLines(b) > compactAfter+20 {
+		t.Errorf("log has %d lines for 10 messages", countLines(b))
+	}
+	ix, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if ix.Len() != 10 || ix.Get("INBOX", 10).Size != 3*compactAfter-1 {
+		t.Errorf("after compaction: %d entries, UID 10 = %+v", ix.Len(), ix.Get("INBOX", 10))
+	}
+}
+
+func countLines(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c == '\n' {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSync(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	date := time.Date(2024, 4, 2, 16, 12, 40, 0, time.UTC)
+	root := "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nSubject: Plan\r\nMessage-ID: <root@example.com>\r\nDate: Tue, 02 Apr 2024 16:12:40 +0000\r\n\r\nHi\r\n"
+	reply := "From: bob@example.com\r\nTo: alice@example.com\r\nSubject: Re: Plan\r\nMessage-ID: <reply@example.com>\r\nIn-Reply-To: <root@example.com>\r\nReferences: <root@example.com>\r\n\r\nOK\r\n"
+	replyToReply := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Re: Re: Plan\r\nMessage-ID: <again@example.com>\r\nIn-Reply-To: <reply@example.com>\r\nReferences: <root@example.com> <reply@example.com>\r\n\r\nGood\r\n"
+	withAttachment := "From: carol@example.com\r\nTo: bob@example.com\r\nSubject: Photo\r\nMessage-ID: <photo@example.com>\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n" +
+		"--b\r\nContent-Type: image/png\r\nContent-Disposition: attachment; filename=cat.png\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw0KGgo=\r\n" +
+		"--b--\r\n"
+	// The reply to the reply comes first, so the root is only found
+	// through References.
+	for _, raw := range []string{replyToReply, root, reply, withAttachment} {
+		if _, err := server.Append("INBOX", []byte(raw), []imap.Flag{imap.FlagSeen}, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ix, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	store, err := mailsync.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &mailsync.Options{Fetch: FetchOptions, Flags: true}
+	if _, err := mailsync.Sync(context.Background(), server.Config().Dial, store, ix, opts); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := ix.Query(&Query{ThreadID: "root@example.com", Sort: "uid"})
+	if got, want := uids(res), []string{"INBOX/1", "INBOX/2", "INBOX/3"}; !slices.Equal(got, want) {
+		t.Errorf("thread = %v, want %v", got, want)
+	}
+	e := ix.Get("INBOX", 4)
+	if e == nil || len(e.Attachments) != 1 {
+		t.Fatalf("UID 4 = %+v", e)
+	}
+	if a := e.Attachments[0]; a.Filename != "cat.png" || a.ContentType != "image/png" || a.Section != "2" {
+		t.Errorf("attachment = %+v", a)
+	}
+	if e.Envelope.From[0].Address != "carol@example.com" || e.Size != int64(len(withAttachment)) || !slices.Equal(e.Flags, []imap.Flag{imap.FlagSeen}) {
+		t.Errorf("UID 4 = %+v", e)
+	}
+
+	// Flag changes and expunges reach the index on the next sync.
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(imap.UIDSetNum(2), &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagFlagged}, Silent: true}, nil).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(imap.UIDSetNum(4), &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{imap.FlagDeleted}, Silent: true}, nil).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expunge().Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mailsync.Sync(context.Background(), server.Config().Dial, store, ix, opts); err != nil {
+		t.Fatal(err)
+	}
+	res, _ = ix.Query(&Query{Flags: []imap.Flag{imap.FlagFlagged}})
+	if got := uids(res); !slices.Equal(got, []string{"INBOX/2"}) || ix.Len() != 3 {
+		t.Errorf("after changes: flagged %v, %d entries", got, ix.Len())
+	}
+}
@@ -0,0 +1,229 @@
+package index
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+)
+
+// Query selects, sorts and pages entries. Zero fields match everything.
+// Text matches are case-insensitive substring matches.
+type Query struct {
+	// Folders matches any of the folders.
+	Folders []string
+	// From and To match an address or display name. With AnyRecipient,
+	// To also matches Cc and Bcc.
+	From         string
+	To           string
+	AnyRecipient bool
+	Subject      string
+	MessageID    string
+	ThreadID     string
+	// Since and Before bound the message date: the Date header, or
+	// INTERNALDATE without one. Since is inclusive, Before exclusive.
+	Since  time.Time
+	Before time.Time
+	// Flags must all be set and NotFlags all be unset.
+	Flags    []imap.Flag
+	NotFlags []imap.Flag
+	// MinSize and MaxSize bound the message size in bytes; zero means no
+	// bound.
+	MinSize int64
+	MaxSize int64
+	// HasAttachments, when set, matches messages with (true) or without
+	// (false) attachments.
+	HasAttachments *bool
+	// Attachment matches a filename; AttachmentType a content type
+	// prefix such as "image/" or "application/pdf".
+	Attachment     string
+	AttachmentType string
+
+	// Sort is a comma-separated list of fields, each optionally prefixed
+	// by '-' for descending: date, internal_date, size, subject, from,
+	// folder, uid. The default is "-date". Ties go to folder and UID.
+	Sort string
+	// Offset skips the first matches, Limit caps the page. Zero Limit
+	// means no limit.
+	Offset int
+	Limit  int
+}
+
+// Result is one page of matches.
+type Result struct {
+	// Total counts every match, before paging.
+	Total   int      `json:"total"`
+	Entries []*Entry `json:"entries"`
+}
+
+type sortKey struct {
+	cmp  func(a, b *Entry) int
+	desc bool
+}
+
+var sortFields = map[string]func(a, b *Entry) int{
+	"date":          func(a, b *Entry) int { return a.Date().Compare(b.Date()) },
+	"internal_date": func(a, b *Entry) int { return a.InternalDate.Compare(b.InternalDate) },
+	"size":          func(a, b *Entry) int { return cmp.Compare(a.Size, b.Size) },
+	"subject": func(a, b *Entry) int {
+		return cmp.Compare(strings.ToLower(subject(a)), strings.ToLower(subject(b)))
+	},
+	"from":   func(a, b *Entry) int { return cmp.Compare(from(a), from(b)) },
+	"folder": func(a, b *Entry) int { return cmp.Compare(a.Folder, b.Folder) },
+	"uid":    func(a, b *Entry) int { return cmp.Compare(a.UID, b.UID) },
+}
+
+func subject(e *Entry) string {
+	if e.Envelope == nil {
+		return ""
+	}
+	return e.Envelope.Subject
+}
+
+func from(e *Entry) string {
+	if e.Envelope == nil || len(e.Envelope.From) == 0 {
+		return ""
+	}
+	return e.Envelope.From[0].Address
+}
+
+func parseSort(s string) ([]sortKey, error) {
+	if s == "" {
+		s = "-date"
+	}
+	var keys []sortKey
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		desc := strings.HasPrefix(field, "-")
+		f := sortFields[strings.TrimPrefix(field, "-")]
+		if f == nil {
+			return nil, fmt.Errorf("index: unknown sort field %q", field)
+		}
+		keys = append(keys, sortKey{f, desc})
+	}
+	return append(keys, sortKey{cmp: sortFields["folder"]}, sortKey{cmp: sortFields["uid"]}), nil
+}
+
+// Query returns the entries matching q, sorted and paged.
+func (ix *Index) Query(q *Query) (*Result, error) {
+	if q == nil {
+		q = &Query{}
+	}
+	if q.Offset < 0 || q.Limit < 0 {
+		return nil, fmt.Errorf("index: negative offset or limit")
+	}
+	keys, err := parseSort(q.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	ix.mu.RLock()
+	var matches []*Entry
+	for _, e := range ix.entries {
+		if q.match(e) {
+			c := *e
+			matches = append(matches, &c)
+		}
+	}
+	ix.mu.RUnlock()
+
+	slices.SortFunc(matches, func(a, b *Entry) int {
+		for _, k := range keys {
+			if c := k.cmp(a, b); c != 0 {
+				if k.desc {
+					return -c
+				}
+				return c
+			}
+		}
+		return 0
+	})
+	res := &Result{Total: len(matches), Entries: []*Entry{}}
+	if q.Offset < len(matches) {
+		matches = matches[q.Offset:]
+		if q.Limit > 0 && q.Limit < len(matches) {
+			matches = matches[:q.Limit]
+		}
+		res.Entries = matches
+	}
+	return res, nil
+}
+
+func (q *Query) match(e *Entry) bool {
+	if len(q.Folders) > 0 && !slices.Contains(q.Folders, e.Folder) {
+		return false
+	}
+	env := e.Envelope
+	if env == nil {
+		env = &envelope.Envelope{}
+	}
+	if q.From != "" && !matchAddresses(q.From, env.From) {
+		return false
+	}
+	if q.To != "" {
+		to := env.To
+		if q.AnyRecipient {
+			to = slices.Concat(env.To, env.Cc, env.Bcc)
+		}
+		if !matchAddresses(q.To, to) {
+			return false
+		}
+	}
+	if q.Subject != "" && !contains(env.Subject, q.Subject) {
+		return false
+	}
+	if q.MessageID != "" && env.MessageID != envelope.NormalizeMessageID(q.MessageID) {
+		return false
+	}
+	if q.ThreadID != "" && e.ThreadID != q.ThreadID && e.ThreadID != envelope.NormalizeMessageID(q.ThreadID) {
+		return false
+	}
+	date := e.Date()
+	if !q.Since.IsZero() && date.Before(q.Since) || !q.Before.IsZero() && !date.Before(q.Before) {
+		return false
+	}
+	for _, f := range q.Flags {
+		if !hasFlag(e.Flags, f) {
+			return false
+		}
+	}
+	for _, f := range q.NotFlags {
+		if hasFlag(e.Flags, f) {
+			return false
+		}
+	}
+	if q.MinSize > 0 && e.Size < q.MinSize || q.MaxSize > 0 && e.Size > q.MaxSize {
+		return false
+	}
+	if q.HasAttachments != nil && *q.HasAttachments != (len(e.Attachments) > 0) {
+		return false
+	}
+	if q.Attachment != "" || q.AttachmentType != "" {
+		found := slices.ContainsFunc(e.Attachments, func(a Attachment) bool {
+			return (q.Attachment == "" || contains(a.Filename, q.Attachment)) &&
+				(q.AttachmentType == "" || strings.HasPrefix(a.ContentType, strings.ToLower(q.AttachmentType)))
+		})
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAddresses(s string, addrs []envelope.Address) bool {
+	return slices.ContainsFunc(addrs, func(a envelope.Address) bool {
+		return contains(a.Address, s) || contains(a.Name, s)
+	})
+}
+
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func hasFlag(flags []imap.Flag, flag imap.Flag) bool {
+	return slices.ContainsFunc(flags, func(f imap.Flag) bool { return strings.EqualFold(string(f), string(flag)) })
+}
@@ -0,0 +1,313 @@
+// Package lazy fetches the text of messages without downloading their
+// attachments. It asks for BODYSTRUCTURE first, then fetches only the
+// text/plain and text/html sections (BODY.PEEK[1.1] and so on). Attachment
+// sections are fetched one by one, when a caller asks for them. Transfer
+// encodings and charsets are decoded locally, the same way the parser does,
+// while the sections are read; a text section larger than
+// Options.MaxTextSize is fetched only up to that size.
+package lazy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/charset"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/parser"
+)
+
+// DefaultMaxTextSize is how much of one text section FetchText downloads by
+// default.
+const DefaultMaxTextSize = 1 << 20
+
+// Options tunes FetchText.
+type Options struct {
+	// MaxTextSize is the most bytes fetched of one text section. Longer
+	// sections are fetched partially and cut, with a problem reported.
+	// Zero means DefaultMaxTextSize.
+	MaxTextSize int64
+}
+
+// Part is one leaf of a message's body structure.
+type Part struct {
+	// Section is the IMAP section number, e.g. "2.1".
+	Section     string `json:"section"`
+	ContentType string `json:"content_type"`
+	Charset     string `json:"charset,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+	// Size is the encoded size on the server, as reported by BODYSTRUCTURE.
+	Size uint32 `json:"size"`
+
+	path []int
+}
+
+// Message is a message whose text has been fetched.
+type Message struct {
+	UID  imap.UID `json:"uid"`
+	Text string   `json:"text,omitempty"`
+	HTML string   `json:"html,omitempty"`
+	// TextParts are the sections Text and HTML were built from.
+	TextParts []*Part `json:"text_parts,omitempty"`
+	// Attachments are every other leaf, including message/rfc822 parts.
+	// Use FetchPart to download one.
+	Attachments []*Part `json:"attachments,omitempty"`
+	// FetchedBytes is the size of the text section literals.
+	FetchedBytes int64 `json:"fetched_bytes"`
+	// Problems lists what went wrong decoding the text sections.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// FetchText fetches the body structure of every message in uids, then the
+// text sections of all of them. Messages come back in UID order.
+func FetchText(client *imapclient.Client, uids imap.UIDSet, opts *Options) ([]*Message, error) {
+	maxText := int64(DefaultMaxTextSize)
+	if opts != nil && opts.MaxTextSize > 0 {
+		maxText = opts.MaxTextSize
+	}
+	structures, err := client.Fetch(uids, &imap.FetchOptions{
+		UID:           true,
+		BodyStructure: &imap.FetchItemBodyStructure{Extended: true},
+	}).Collect()
+	if err != nil {
+		return nil, fmt.Errorf("lazy: fetching body structure: %w", err)
+	}
+
+	messages := make(map[imap.UID]*Message, len(structures))
+	// Messages whose text sections are fetched and decoded the same way
+	// share one command.
+	groups := make(map[string][]imap.UID)
+	for _, buf := range structures {
+		if buf.BodyStructure == nil {
+			continue
+		}
+		msg := &Message{UID: buf.UID}
+		classify(buf.BodyStructure, msg)
+		messages[buf.UID] = msg
+		if len(msg.TextParts) > 0 {
+			key := sectionsKey(msg.TextParts, maxText)
+			groups[key] = append(groups[key], buf.UID)
+		}
+	}
+
+	for _, groupUIDs := range groups {
+		if err := fetchTextSections(client, groupUIDs, messages, maxText); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*Message, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, msg)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UID < result[j].UID })
+	return result, nil
+}
+
+// Attachments returns the parts of structure that FetchText treats as
+// attachments.
+func Attachments(structure imap.BodyStructure) []*Part {
+	msg := &Message{}
+	classify(structure, msg)
+	return msg.Attachments
+}
+
+func classify(structure imap.BodyStructure, msg *Message) {
+	structure.Walk(func(path []int, part imap.BodyStructure) bool {
+		single, ok := part.(*imap.BodyStructureSinglePart)
+		if !ok {
+			return true
+		}
+		p := &Part{
+			Section:     sectionString(path),
+			ContentType: single.MediaType(),
+			Charset:     single.Params["charset"],
+			Encoding:    strings.ToLower(single.Encoding),
+			Filename:    envelope.DecodeWords(single.Filename()),
+			ContentID:   strings.Trim(single.ID, "<> "),
+			Size:        single.Size,
+			path:        append([]int(nil), path...),
+		}
+		if disposition := single.Disposition(); disposition != nil {
+			p.Disposition = strings.ToLower(disposition.Value)
+		}
+		isText := (p.ContentType == parser.PlainTextContentType || p.ContentType == parser.HTMLContentType) &&
+			p.Disposition != "attachment" && p.Filename == ""
+		if isText {
+			msg.TextParts = append(msg.TextParts, p)
+		} else {
+			msg.Attachments = append(msg.Attachments, p)
+		}
+		return true
+	})
+}
+
+// fetchTextSections fetches the text sections of uids, which all have the
+// same sections, encodings and charsets, so each section can be decoded as
+// it is read, before the UID it belongs to is known.
+func fetchTextSections(client *imapclient.Client, uids []imap.UID, messages map[imap.UID]*Message, maxText int64) error {
+	parts := make(map[string]*Part)
+	var sections []*imap.FetchItemBodySection
+	for _, part := range messages[uids[0]].TextParts {
+		parts[part.Section] = part
+		section := &imap.FetchItemBodySection{Part: part.path, Peek: true}
+		if int64(part.Size) > maxText {
+			section.Partial = &imap.SectionPartial{Offset: 0, Size: maxText}
+		}
+		sections = append(sections, section)
+	}
+	fetchCmd := client.Fetch(imap.UIDSetNum(uids...), &imap.FetchOptions{
+		UID:         true,
+		BodySection: sections,
+	})
+	for data := fetchCmd.Next(); data != nil; data = fetchCmd.Next() {
+		// The UID may come after the sections, so keep the decoded text
+		// until it is known.
+		decoded := make(map[string]string)
+		var problems []string
+		var uid imap.UID
+		var fetched int64
+		for item := data.Next(); item != nil; item = data.Next() {
+			switch item := item.(type) {
+			case imapclient.FetchItemDataUID:
+				uid = item.UID
+			case imapclient.FetchItemDataBodySection:
+				part := parts[sectionString(item.Section.Part)]
+				if item.Literal == nil || part == nil {
+					continue
+				}
+				literal := &countingReader{r: io.LimitReader(item.Literal, maxText)}
+				text, err := decodeText(part, literal, &problems)
+				if err != nil {
+					fetchCmd.Close()
+					return fmt.Errorf("lazy: reading section %s: %w", part.Section, err)
+				}
+				fetched += literal.n
+				if int64(part.Size) > maxText {
+					problems = append(problems, fmt.Sprintf("section %s: cut to %d of %d bytes", part.Section, literal.n, part.Size))
+				}
+				decoded[part.Section] = text
+			}
+		}
+		msg := messages[uid]
+		if msg == nil {
+			continue
+		}
+		msg.FetchedBytes += fetched
+		msg.Problems = append(msg.Problems, problems...)
+		for _, part := range msg.TextParts {
+			text, ok := decoded[part.Section]
+			if !ok {
+				msg.Problems = append(msg.Problems, fmt.Sprintf("section %s was not returned", part.Section))
+				continue
+			}
+			if part.ContentType == parser.HTMLContentType {
+				msg.HTML = joinBody(msg.HTML, text)
+			} else {
+				msg.Text = joinBody(msg.Text, text)
+			}
+		}
+	}
+	if err := fetchCmd.Close(); err != nil {
+		return fmt.Errorf("lazy: fetching text sections: %w", err)
+	}
+	return nil
+}
+
+// decodeText reads a text section from the literal, undoing its transfer
+// encoding on the way, and decodes its charset. A read error is returned,
+// anything else wrong with the section goes to problems.
+func decodeText(part *Part, literal io.Reader, problems *[]string) (string, error) {
+	problem := func(format string, args ...any) {
+		*problems = append(*problems, fmt.Sprintf("section %s: ", part.Section)+fmt.Sprintf(format, args...))
+	}
+	body, err := io.ReadAll(parser.DecodeTransfer(part.Encoding, part.ContentType, literal, problem))
+	if err != nil {
+		return "", err
+	}
+	text, result := charset.Default.Decode(part.Charset, body)
+	if result.Detected {
+		problem("decoded as %s instead of %q", result.Charset, result.Label)
+	}
+	return text, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// FetchPart downloads one section of the message with the given UID from the
+// selected mailbox, decodes its transfer encoding and writes it to w. It
+// returns the number of decoded bytes written.
+func FetchPart(client *imapclient.Client, uid imap.UID, part *Part, w io.Writer) (int64, error) {
+	fetchCmd := client.Fetch(imap.UIDSetNum(uid), &imap.FetchOptions{
+		UID:         true,
+		BodySection: []*imap.FetchItemBodySection{{Part: part.path, Peek: true}},
+	})
+
+	var written int64
+	found := false
+	for data := fetchCmd.Next(); data != nil; data = fetchCmd.Next() {
+		for item := data.Next(); item != nil; item = data.Next() {
+			section, ok := item.(imapclient.FetchItemDataBodySection)
+			if !ok || section.Literal == nil {
+				continue
+			}
+			found = true
+			decoded := parser.DecodeTransfer(part.Encoding, part.ContentType, section.Literal, nil)
+			n, err := io.Copy(w, decoded)
+			written += n
+			if err != nil {
+				fetchCmd.Close()
+				return written, fmt.Errorf("lazy: reading section %s: %w", part.Section, err)
+			}
+		}
+	}
+	if err := fetchCmd.Close(); err != nil {
+		return written, fmt.Errorf("lazy: fetching section %s: %w", part.Section, err)
+	}
+	if !found {
+		return 0, fmt.Errorf("lazy: section %s of UID %d was not returned", part.Section, uid)
+	}
+	return written, nil
+}
+
+func sectionString(path []int) string {
+	parts := make([]string, len(path))
+	for i, n := range path {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// sectionsKey tells apart messages whose text sections are fetched or
+// decoded differently.
+func sectionsKey(parts []*Part, maxText int64) string {
+	sections := make([]string, len(parts))
+	for i, part := range parts {
+		sections[i] = strings.Join([]string{part.Section, part.ContentType, part.Encoding, strings.ToLower(part.Charset), strconv.FormatBool(int64(part.Size) > maxText)}, ";")
+	}
+	return strings.Join(sections, " ")
+}
+
+func joinBody(existing, next string) string {
+	if existing == "" {
+		return next
+	}
+	return existing + "\n" + next
+}
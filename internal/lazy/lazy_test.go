@@ -0,0 +1,265 @@
+package lazy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+)
+
+func single(typ, subtype string, params map[string]string, disposition string, dispParams map[string]string) *imap.BodyStructureSinglePart {
+	part := &imap.BodyStructureSinglePart{Type: typ, Subtype: subtype, Params: params, Encoding: "7BIT", Size: 10}
+	if disposition != "" {
+		part.Extended = &imap.BodyStructureSinglePartExt{
+			Disposition: &imap.BodyStructureDisposition{Value: disposition, Params: dispParams},
+		}
+	}
+	return part
+}
+
+func TestClassify(t *testing.T) {
+	inner := &imap.BodyStructureMultiPart{Subtype: "mixed", Children: []imap.BodyStructure{
+		single("text", "plain", nil, "", nil),
+		single("application", "zip", nil, "attachment", map[string]string{"filename": "inner.zip"}),
+	}}
+	image := single("image", "png", nil, "inline", nil)
+	image.ID = "<logo@example.com>"
+	structure := &imap.BodyStructureMultiPart{Subtype: "mixed", Children: []imap.BodyStructure{
+		&imap.BodyStructureMultiPart{Subtype: "alternative", Children: []imap.BodyStructure{
+			single("text", "plain", map[string]string{"charset": "utf-8"}, "", nil),
+			&imap.BodyStructureMultiPart{Subtype: "related", Children: []imap.BodyStructure{
+				single("text", "html", nil, "", nil),
+				image,
+			}},
+		}},
+		single("application", "pdf", nil, "attachment", map[string]string{"filename": "=?utf-8?Q?r=C3=A9sum=C3=A9.pdf?="}),
+		&imap.BodyStructureSinglePart{Type: "message", Subtype: "rfc822", Encoding: "7BIT", Size: 99,
+			MessageRFC822: &imap.BodyStructureMessageRFC822{BodyStructure: inner}},
+		single("text", "plain", nil, "attachment", nil),
+		single("text", "plain", map[string]string{"name": "notes.txt"}, "", nil),
+	}}
+
+	msg := &Message{}
+	classify(structure, msg)
+	var text, attachments []string
+	for _, p := range msg.TextParts {
+		text = append(text, p.Section+" "+p.ContentType)
+	}
+	for _, p := range msg.Attachments {
+		attachments = append(attachments, p.Section+" "+p.ContentType+" "+p.Filename)
+	}
+	wantText := []string{"1.1 text/plain", "1.2.1 text/html"}
+	// The forwarded message is one attachment: its own parts are not
+	// walked into.
+	wantAttachments := []string{
+		"1.2.2 image/png ",
+		"2 application/pdf résumé.pdf",
+		"3 message/rfc822 ",
+		"4 text/plain ",
+		"5 text/plain notes.txt",
+	}
+	if !reflect.DeepEqual(text, wantText) {
+		t.Errorf("text parts = %q, want %q", text, wantText)
+	}
+	if !reflect.DeepEqual(attachments, wantAttachments) {
+		t.Errorf("attachments = %q, want %q", attachments, wantAttachments)
+	}
+	if p := msg.TextParts[0]; p.Charset != "utf-8" || p.Encoding != "7bit" {
+		t.Errorf("text part = %+v", p)
+	}
+	if p := msg.Attachments[0]; p.ContentID != "logo@example.com" || p.Disposition != "inline" {
+		t.Errorf("inline image = %+v", p)
+	}
+	if got := Attachments(structure); len(got) != len(wantAttachments) {
+		t.Errorf("Attachments = %d parts, want %d", len(got), len(wantAttachments))
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name     string
+		part     Part
+		raw      string
+		want     string
+		problems int
+	}{
+		{"7bit", Part{Charset: "us-ascii"}, "plain text", "plain text", 0},
+		{"quoted-printable", Part{Encoding: "quoted-printable", Charset: "utf-8"}, "caf=C3=A9 =\r\nsoft break", "café soft break", 0},
+		{"base64", Part{Encoding: "base64", Charset: "utf-8"}, "Y2Fmw6k=\r\n", "café", 0},
+		{"base64 over lines", Part{Encoding: "BASE64", Charset: "utf-8"}, "Y2Fm\r\nw6k=\r\n", "café", 0},
+		{"Latin-1", Part{Encoding: "quoted-printable", Charset: "iso-8859-1"}, "caf=E9", "café", 0},
+		{"wrong charset", Part{Charset: "us-ascii"}, "caf\xc3\xa9", "café", 1},
+		{"unknown encoding", Part{Encoding: "x-unknown", Charset: "us-ascii"}, "as is", "as is", 1},
+		{"missing charset", Part{}, "caf\xc3\xa9", "café", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := tt.part
+			part.Section = "1"
+			part.ContentType = "text/plain"
+			var problems []string
+			got, err := decodeText(&part, strings.NewReader(tt.raw), &problems)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("decodeText = %q, want %q", got, tt.want)
+			}
+			if len(problems) != tt.problems {
+				t.Errorf("problems = %q, want %d", problems, tt.problems)
+			}
+		})
+	}
+}
+
+const pdf = "%PDF-1.4 \x00\x01\x02 binary"
+
+// testMessage is multipart/mixed with an alternative (text and a related
+// HTML part with an inline image), a PDF and a forwarded message.
+var testMessage = "From: sender@example.com\r\n" +
+	"Subject: Lazy\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=alt\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=E9 menu\r\n" +
+	"--alt\r\n" +
+	"Content-Type: multipart/related; boundary=rel\r\n" +
+	"\r\n" +
+	"--rel\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Café menu</p>\r\n" +
+	"--rel\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-ID: <logo@example.com>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--rel--\r\n" +
+	"--alt--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"menu.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	base64.StdEncoding.EncodeToString([]byte(pdf)) + "\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: Forwarded\r\n" +
+	"\r\n" +
+	"Forwarded body\r\n" +
+	"--outer--\r\n"
+
+func setup(t *testing.T, messages ...string) *imapclient.Client {
+	t.Helper()
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	for _, raw := range messages {
+		if _, err := server.Append("INBOX", []byte(raw), nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFetch(t *testing.T) {
+	c := setup(t, testMessage, "Subject: Plain\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\nJust text\r\n")
+	messages, err := FetchText(c, imap.UIDSetNum(1, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("%d messages, want 2", len(messages))
+	}
+	msg := messages[0]
+	if msg.UID != 1 || msg.Text != "Café menu" || msg.HTML != "<p>Café menu</p>" {
+		t.Errorf("message 1 text = %q, html = %q", msg.Text, msg.HTML)
+	}
+	if len(msg.Problems) != 0 {
+		t.Errorf("problems = %q", msg.Problems)
+	}
+	if msg.FetchedBytes >= int64(len(testMessage))/2 {
+		t.Errorf("fetched %d bytes of a %d byte message", msg.FetchedBytes, len(testMessage))
+	}
+	var sections []string
+	for _, p := range msg.Attachments {
+		sections = append(sections, p.Section)
+	}
+	if want := []string{"1.2.2", "2", "3"}; !reflect.DeepEqual(sections, want) {
+		t.Fatalf("attachment sections = %v, want %v", sections, want)
+	}
+	if plain := messages[1]; strings.TrimSpace(plain.Text) != "Just text" || len(plain.TextParts) != 1 || plain.TextParts[0].Section != "1" {
+		t.Errorf("message 2 = %+v", plain)
+	}
+
+	// FetchPart takes the section number from BODYSTRUCTURE, nested or
+	// not, and undoes the transfer encoding.
+	for _, tt := range []struct {
+		part *Part
+		want string
+	}{
+		{msg.Attachments[0], "\x89PNG\r\n\x1a\n"},
+		{msg.Attachments[1], pdf},
+		{msg.Attachments[2], "Subject: Forwarded\r\n\r\nForwarded body"},
+		{msg.TextParts[0], "Caf\xe9 menu"},
+	} {
+		var buf bytes.Buffer
+		n, err := FetchPart(c, msg.UID, tt.part, &buf)
+		if err != nil {
+			t.Fatalf("FetchPart(%s): %v", tt.part.Section, err)
+		}
+		if got := buf.String(); got != tt.want || n != int64(buf.Len()) {
+			t.Errorf("FetchPart(%s) = %q (%d bytes), want %q", tt.part.Section, got, n, tt.want)
+		}
+	}
+
+	if _, err := FetchPart(c, 3, msg.Attachments[1], &bytes.Buffer{}); err == nil {
+		t.Error("FetchPart of a missing UID succeeded")
+	}
+}
+
+// TestFetchMaxTextSize checks that a long text section is fetched only up
+// to MaxTextSize.
+func TestFetchMaxTextSize(t *testing.T) {
+	long := strings.Repeat("0123456789", 10000)
+	c := setup(t, "Subject: Long\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\n"+long+"\r\n")
+	messages, err := FetchText(c, imap.UIDSetNum(1), &Options{MaxTextSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := messages[0]
+	if msg.Text != long[:1000] {
+		t.Errorf("text is %d bytes, want the first 1000", len(msg.Text))
+	}
+	if msg.FetchedBytes != 1000 {
+		t.Errorf("fetched %d bytes, want 1000", msg.FetchedBytes)
+	}
+	if len(msg.Problems) != 1 || !strings.Contains(msg.Problems[0], "cut to 1000") {
+		t.Errorf("problems = %q", msg.Problems)
+	}
+}
@@ -0,0 +1,306 @@
+// Package locate finds which folders of an account hold a given set of
+// Message-IDs.
+package locate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog/log"
+)
+
+// Mode controls how a folder is searched.
+type Mode int
+
+const (
+	// ModeAuto uses UID SEARCH HEADER and scans the Message-ID headers of a
+	// folder only for the IDs whose search the server rejected. Some
+	// servers' HEADER search silently returns nothing, so each connection
+	// first checks, once, that searching for the Message-ID of a message it
+	// has just read finds that message; if not, it scans instead of
+	// searching.
+	ModeAuto Mode = iota
+	// ModeSearch only uses UID SEARCH HEADER, for servers whose search can
+	// be trusted.
+	ModeSearch
+	// ModeScan fetches the Message-ID header of every message and compares
+	// locally without searching first.
+	ModeScan
+)
+
+// Options tunes Locate.
+type Options struct {
+	// Concurrency is the maximum number of connections to open. Servers
+	// often cap connections per account, so extra connections that fail to
+	// open are skipped instead of failing the whole run. Defaults to 1.
+	Concurrency int
+	Mode        Mode
+	// Folders restricts the search. Empty means every selectable folder.
+	Folders []string
+}
+
+// Match is one copy of a message. The same Message-ID can match several
+// times, in different folders or even twice in the same folder.
+type Match struct {
+	MessageID   string   `json:"message_id"`
+	Folder      string   `json:"folder"`
+	UIDValidity uint32   `json:"uid_validity"`
+	UID         imap.UID `json:"uid"`
+}
+
+// Result is what Locate found.
+type Result struct {
+	Matches []Match `json:"matches"`
+	// Failed maps each folder that could not be searched to the error.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// NormalizeMessageID makes sure the ID is wrapped in exactly one pair of
+// angle brackets, so "abc@x", "<abc@x>" and " <abc@X> " all compare equal. It
+// is envelope.NormalizeMessageID, kept here for callers of this package.
+func NormalizeMessageID(id string) string {
+	return envelope.NormalizeMessageID(id)
+}
+
+// Locate searches the account for every Message-ID in messageIDs. A folder
+// that cannot be searched is listed in Result.Failed while the others carry
+// on.
+func Locate(ctx context.Context, dial session.Dialer, messageIDs []string, options *Options) (*Result, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	wanted := make(map[string]bool)
+	for _, id := range messageIDs {
+		if id = NormalizeMessageID(id); id != "" {
+			wanted[id] = true
+		}
+	}
+	if len(wanted) == 0 {
+		return nil, errors.New("locate: no Message-ID given")
+	}
+
+	first, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	folders := options.Folders
+	if len(folders) == 0 {
+		if folders, err = selectableFolders(first); err != nil {
+			first.Close()
+			return nil, err
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		result = &Result{}
+		conns  = make([]*conn, max(1, options.Concurrency))
+	)
+	session.Each(ctx, first, dial, options.Concurrency, folders, func(n int, c *imapclient.Client, folder string) error {
+		if conns[n] == nil {
+			conns[n] = &conn{Client: c}
+		}
+		found, err := searchFolder(ctx, conns[n], folder, wanted, options.Mode)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("folderName", folder).Msg("Failed to search folder, skipping it")
+			if result.Failed == nil {
+				result.Failed = make(map[string]string)
+			}
+			result.Failed[folder] = err.Error()
+		}
+		result.Matches = append(result.Matches, found...)
+		return err
+	})
+
+	matches := result.Matches
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.MessageID != b.MessageID {
+			return a.MessageID < b.MessageID
+		}
+		if a.Folder != b.Folder {
+			return a.Folder < b.Folder
+		}
+		return a.UID < b.UID
+	})
+	return result, ctx.Err()
+}
+
+func selectableFolders(c *imapclient.Client) ([]string, error) {
+	list, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		return nil, err
+	}
+	var folders []string
+	for _, data := range list {
+		if hasAttr(data.Attrs, imap.MailboxAttrNoSelect) || hasAttr(data.Attrs, imap.MailboxAttrNonExistent) {
+			continue
+		}
+		folders = append(folders, data.Mailbox)
+	}
+	return folders, nil
+}
+
+func hasAttr(attrs []imap.MailboxAttr, attr imap.MailboxAttr) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(string(a), string(attr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// conn is one connection and what Locate learned about its server.
+type conn struct {
+	*imapclient.Client
+	// headerSearch is whether HEADER search finds messages; nil until
+	// probeHeaderSearch could tell.
+	headerSearch *bool
+}
+
+func searchFolder(ctx context.Context, c *conn, folder string, wanted map[string]bool, mode Mode) ([]Match, error) {
+	selected, err := c.Select(folder, &imap.SelectOptions{ReadOnly: true}).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("select: %w", err)
+	}
+	if selected.NumMessages == 0 {
+		return nil, nil
+	}
+
+	if mode == ModeAuto && c.headerSearch == nil {
+		if err := probeHeaderSearch(ctx, c, selected.NumMessages); err != nil {
+			return nil, err
+		}
+		if c.headerSearch != nil && !*c.headerSearch {
+			log.Ctx(ctx).Info().Msg("Server's HEADER search does not find messages, scanning Message-ID headers instead")
+		}
+	}
+
+	// Every wanted ID is either searched for or, when the search cannot be
+	// used, looked for in a scan of the whole folder.
+	var candidates imap.UIDSet
+	scan := mode == ModeScan || (mode == ModeAuto && c.headerSearch != nil && !*c.headerSearch)
+	if !scan {
+		for id := range wanted {
+			uids, err := searchMessageID(c.Client, id)
+			if err != nil {
+				if mode == ModeSearch {
+					return nil, err
+				}
+				log.Ctx(ctx).Debug().Err(err).Str("folderName", folder).Str("messageId", id).Msg("HEADER search failed, scanning Message-ID headers instead")
+				scan = true
+				continue
+			}
+			candidates.AddNum(uids...)
+		}
+	}
+	if scan {
+		candidates = imap.UIDSet{{Start: 1, Stop: 0}}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	// Search is a substring match and some servers are sloppy about it, so
+	// every candidate is confirmed against its actual header.
+	ids, err := fetchMessageIDs(c.Client, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("fetch Message-ID: %w", err)
+	}
+	var matches []Match
+	for uid, id := range ids {
+		if wanted[id] {
+			matches = append(matches, Match{
+				MessageID:   id,
+				Folder:      folder,
+				UIDValidity: selected.UIDValidity,
+				UID:         uid,
+			})
+		}
+	}
+	return matches, nil
+}
+
+// probeHeaderSearch reads the Message-ID of the last message in the
+// selected folder and searches for it. If the search does not find that
+// message, or the server rejects it, HEADER search cannot be trusted on this
+// connection. A last message without a Message-ID tells nothing, and the
+// next folder is tried.
+func probeHeaderSearch(ctx context.Context, c *conn, numMessages uint32) error {
+	ids, err := fetchMessageIDs(c.Client, imap.SeqSetNum(numMessages))
+	if err != nil {
+		return fmt.Errorf("fetch Message-ID: %w", err)
+	}
+	for uid, id := range ids {
+		uids, err := searchMessageID(c.Client, id)
+		if err != nil {
+			log.Ctx(ctx).Debug().Err(err).Msg("HEADER search failed")
+		}
+		found := err == nil && slices.Contains(uids, uid)
+		c.headerSearch = &found
+	}
+	return nil
+}
+
+// searchMessageID returns the UIDs the server claims have id in their
+// Message-ID header.
+func searchMessageID(c *imapclient.Client, id string) ([]imap.UID, error) {
+	// Search without the brackets: servers disagree on whether they index
+	// them, and the substring match covers both.
+	criteria := imap.SearchCriteria{
+		Header: []imap.SearchCriteriaHeaderField{{Key: "Message-ID", Value: strings.Trim(id, "<>")}},
+	}
+	data, err := c.UIDSearch(&criteria, nil).Wait()
+	if err != nil {
+		return nil, err
+	}
+	return data.AllUIDs(), nil
+}
+
+func fetchMessageIDs(c *imapclient.Client, numSet imap.NumSet) (map[imap.UID]string, error) {
+	section := &imap.FetchItemBodySection{
+		Specifier:    imap.PartSpecifierHeader,
+		HeaderFields: []string{"Message-ID"},
+		Peek:         true,
+	}
+	fetchCmd := c.Fetch(numSet, &imap.FetchOptions{
+		UID:         true,
+		BodySection: []*imap.FetchItemBodySection{section},
+	})
+
+	ids := make(map[imap.UID]string)
+	for {
+		msg := fetchCmd.Next()
+		if msg == nil {
+			break
+		}
+		buf, err := msg.Collect()
+		if err != nil {
+			fetchCmd.Close()
+			return nil, err
+		}
+		for _, raw := range buf.BodySection {
+			// A malformed line only stops the header read; the fields before
+			// it are still usable.
+			header, _ := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+			if id := NormalizeMessageID(header.Get("Message-Id")); id != "" {
+				ids[buf.UID] = id
+			}
+		}
+	}
+	return ids, fetchCmd.Close()
+}
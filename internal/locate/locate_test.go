@@ -0,0 +1,248 @@
+package locate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+// server is an in-memory IMAP server on localhost holding an INBOX, an
+// Archive and an Empty folder. Message-IDs repeat, so some are in two
+// folders.
+type server struct {
+	addr string
+	// wrap, when set, wraps every client connection.
+	wrap func(net.Conn) net.Conn
+}
+
+func setup(t *testing.T) *server {
+	t.Helper()
+	user := imapmemserver.NewUser("user", "password")
+	for _, name := range []string{"INBOX", "Archive", "Empty"} {
+		if err := user.Create(name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, folder := range []string{"INBOX", "INBOX", "Archive", "Archive"} {
+		raw := fmt.Sprintf("From: a@example.com\r\nSubject: %d\r\nMessage-ID: <msg-%d@example.com>\r\n\r\nBody\r\n", i, i%3)
+		if _, err := user.Append(folder, strings.NewReader(raw), &imap.AppendOptions{Time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	memServer := imapmemserver.New()
+	memServer.AddUser(user)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imapServer := imapserver.New(&imapserver.Options{
+		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		Caps:         imap.CapSet{imap.CapIMAP4rev1: {}, imap.CapIMAP4rev2: {}},
+		InsecureAuth: true,
+	})
+	go imapServer.Serve(listener) //nolint:errcheck // Serve returns when Close is called
+	t.Cleanup(func() { imapServer.Close() })
+	return &server{addr: listener.Addr().String()}
+}
+
+// dial logs into the server over plain TCP.
+func (s *server) dial() (*imapclient.Client, error) {
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.wrap != nil {
+		conn = s.wrap(conn)
+	}
+	c := imapclient.New(conn, nil)
+	if err := c.Login("user", "password").Wait(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func TestLocate(t *testing.T) {
+	server := setup(t)
+	result, err := Locate(context.Background(), server.dial, []string{"msg-0@example.com", " <msg-1@example.com> "}, &Options{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Match{
+		{MessageID: "<msg-0@example.com>", Folder: "Archive", UID: 2},
+		{MessageID: "<msg-0@example.com>", Folder: "INBOX", UID: 1},
+		{MessageID: "<msg-1@example.com>", Folder: "INBOX", UID: 2},
+	}
+	checkMatches(t, result, want)
+	if len(result.Failed) != 0 {
+		t.Errorf("failed = %v", result.Failed)
+	}
+}
+
+// TestLocateBrokenSearch talks to a server whose HEADER search finds
+// nothing: ModeSearch misses the message, ModeAuto's probe notices and it
+// scans instead.
+func TestLocateBrokenSearch(t *testing.T) {
+	server := setup(t)
+	server.wrap = func(conn net.Conn) net.Conn { return &brokenSearch{Conn: conn} }
+	ids := []string{"msg-2@example.com"}
+
+	result, err := Locate(context.Background(), server.dial, ids, &Options{Mode: ModeSearch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, result, nil)
+
+	result, err = Locate(context.Background(), server.dial, ids, &Options{Mode: ModeAuto})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, result, []Match{{MessageID: "<msg-2@example.com>", Folder: "Archive", UID: 1}})
+}
+
+// TestLocateNoScan checks that ModeAuto, on a server whose HEADER search
+// works, does not scan a folder just because a Message-ID is not in it.
+func TestLocateNoScan(t *testing.T) {
+	server := setup(t)
+	sent := &recorder{}
+	server.wrap = func(conn net.Conn) net.Conn { return &recordWrites{Conn: conn, to: sent} }
+	result, err := Locate(context.Background(), server.dial, []string{"msg-2@example.com", "missing@example.com"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, result, []Match{{MessageID: "<msg-2@example.com>", Folder: "Archive", UID: 1}})
+	if commands := sent.String(); strings.Contains(commands, "FETCH 1:*") {
+		t.Errorf("folders were scanned:\n%s", commands)
+	}
+}
+
+// TestLocateSearchError makes the server reject the search for one
+// Message-ID: ModeAuto scans for that one and still searches for the other,
+// ModeSearch gives up on every folder that has messages.
+func TestLocateSearchError(t *testing.T) {
+	server := setup(t)
+	server.wrap = func(conn net.Conn) net.Conn { return &rejectSearch{Conn: conn, id: "msg-2"} }
+	ids := []string{"msg-0@example.com", "msg-2@example.com"}
+
+	result, err := Locate(context.Background(), server.dial, ids, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, result, []Match{
+		{MessageID: "<msg-0@example.com>", Folder: "Archive", UID: 2},
+		{MessageID: "<msg-0@example.com>", Folder: "INBOX", UID: 1},
+		{MessageID: "<msg-2@example.com>", Folder: "Archive", UID: 1},
+	})
+	if len(result.Failed) != 0 {
+		t.Errorf("failed = %v", result.Failed)
+	}
+
+	result, err = Locate(context.Background(), server.dial, ids, &Options{Mode: ModeSearch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, result, nil)
+	if len(result.Failed) != 2 || result.Failed["INBOX"] == "" || result.Failed["Archive"] == "" {
+		t.Errorf("failed = %v, want INBOX and Archive", result.Failed)
+	}
+}
+
+func TestLocateFailedFolder(t *testing.T) {
+	server := setup(t)
+	result, err := Locate(context.Background(), server.dial, []string{"msg-0@example.com"}, &Options{
+		Folders: []string{"INBOX", "Missing", "Empty"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMatches(t, result, []Match{{MessageID: "<msg-0@example.com>", Folder: "INBOX", UID: 1}})
+	if len(result.Failed) != 1 || result.Failed["Missing"] == "" {
+		t.Errorf("failed = %v, want Missing", result.Failed)
+	}
+}
+
+func checkMatches(t *testing.T, result *Result, want []Match) {
+	t.Helper()
+	if len(result.Matches) != len(want) {
+		t.Fatalf("matches = %+v, want %+v", result.Matches, want)
+	}
+	for i, m := range result.Matches {
+		if m.UIDValidity == 0 {
+			t.Errorf("match %d has no UIDVALIDITY", i)
+		}
+		m.UIDValidity = 0
+		if m != want[i] {
+			t.Errorf("match %d = %+v, want %+v", i, m, want[i])
+		}
+	}
+}
+
+// brokenSearch makes every HEADER search look for a header no message has,
+// like servers whose HEADER search silently returns nothing.
+type brokenSearch struct {
+	net.Conn
+}
+
+func (b *brokenSearch) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("SEARCH")) {
+		if _, err := b.Conn.Write(bytes.ReplaceAll(p, []byte("Message-ID"), []byte("X-Nothing"))); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return b.Conn.Write(p)
+}
+
+// rejectSearch turns every search for a Message-ID containing id into a
+// command the server answers with BAD.
+type rejectSearch struct {
+	net.Conn
+	id string
+}
+
+func (r *rejectSearch) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("SEARCH")) && bytes.Contains(p, []byte(r.id)) {
+		if _, err := r.Conn.Write(bytes.Replace(p, []byte("SEARCH"), []byte("SEARCH BOGUS"), 1)); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return r.Conn.Write(p)
+}
+
+// recorder collects the commands of every connection.
+type recorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.String()
+}
+
+type recordWrites struct {
+	net.Conn
+	to *recorder
+}
+
+func (r *recordWrites) Write(p []byte) (int, error) {
+	r.to.mu.Lock()
+	r.to.buf.Write(p)
+	r.to.mu.Unlock()
+	return r.Conn.Write(p)
+}
@@ -0,0 +1,514 @@
+// Package maildir stores synced messages in a Maildir++ tree that mutt,
+// neomutt, Dovecot and other Maildir readers open directly. INBOX is the
+// root maildir and every other folder a ".Name" subfolder beside its cur,
+// new and tmp. IMAP flags become the info suffix of the file name, the
+// file's mtime is the message's INTERNALDATE, and each folder keeps a UID
+// map so that later syncs rename or remove a message in place.
+//
+// A *Maildir is a mailsync.Handler.
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// FetchOptions are what Message needs: the whole message, its flags and
+// INTERNALDATE.
+var FetchOptions = &imap.FetchOptions{
+	UID:          true,
+	Flags:        true,
+	InternalDate: true,
+	RFC822Size:   true,
+	BodySection:  []*imap.FetchItemBodySection{{Peek: true}},
+}
+
+// uidMapName is the UID map in each maildir. It is an append-only log of
+// "uid base" lines, with "uid -" for a removal, compacted when it is mostly
+// dead lines.
+const uidMapName = "imap-uidmap"
+
+// flagLetters maps IMAP flags to Maildir info letters. Keywords have no
+// standard letter and are not stored.
+var flagLetters = map[imap.Flag]byte{
+	imap.FlagDraft:    'D',
+	imap.FlagFlagged:  'F',
+	imap.FlagAnswered: 'R',
+	imap.FlagSeen:     'S',
+	imap.FlagDeleted:  'T',
+}
+
+// Options tunes Open.
+type Options struct {
+	// Delimiter is the server's hierarchy delimiter. "Work/Reports" with
+	// "/" is stored as ".Work.Reports". Defaults to "/".
+	Delimiter string
+}
+
+// Maildir is a Maildir++ tree. It is safe for concurrent use.
+type Maildir struct {
+	root  string
+	delim string
+	host  string
+
+	mu      sync.Mutex
+	folders map[string]*folder
+}
+
+type folder struct {
+	mu   sync.Mutex
+	dir  string
+	uids map[imap.UID]string // UID to the unique part of the file name
+	log  *os.File
+	dead int
+	// paths maps the unique part of each file name in cur and new to its
+	// path. It is read when first needed and again when a file is not
+	// where it was, since a mail reader may move or rename files.
+	paths map[string]string
+}
+
+// Open opens or creates the tree at root.
+func Open(root string, opts *Options) (*Maildir, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	delim := opts.Delimiter
+	if delim == "" {
+		delim = "/"
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	// "/" and ":" cannot appear in the unique part of a file name.
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	if err := makeMaildir(root); err != nil {
+		return nil, err
+	}
+	return &Maildir{root: root, delim: delim, host: host, folders: map[string]*folder{}}, nil
+}
+
+// Close closes the UID maps.
+func (m *Maildir) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for _, f := range m.folders {
+		f.mu.Lock()
+		if f.log != nil {
+			errs = append(errs, f.log.Close())
+			f.log = nil
+		}
+		f.mu.Unlock()
+	}
+	m.folders = map[string]*folder{}
+	return errors.Join(errs...)
+}
+
+// Dir is the maildir of an IMAP folder. A "." or "%" in a folder name is
+// written as "%2E" or "%25", since "." separates Maildir++ levels.
+func (m *Maildir) Dir(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return m.root
+	}
+	escape := strings.NewReplacer("%", "%25", ".", "%2E", "/", "%2F")
+	parts := strings.Split(name, m.delim)
+	for i, p := range parts {
+		parts[i] = escape.Replace(p)
+	}
+	return filepath.Join(m.root, "."+strings.Join(parts, "."))
+}
+
+func makeMaildir(dir string) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// folder opens the maildir of name and reads its UID map.
+func (m *Maildir) folder(name string) (*folder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f := m.folders[name]; f != nil {
+		return f, nil
+	}
+	dir := m.Dir(name)
+	if err := makeMaildir(dir); err != nil {
+		return nil, err
+	}
+	if dir != m.root {
+		// Courier's marker for a Maildir++ subfolder.
+		marker := filepath.Join(dir, "maildirfolder")
+		if err := os.WriteFile(marker, nil, 0o600); err != nil {
+			return nil, err
+		}
+	}
+	f := &folder{dir: dir, uids: map[imap.UID]string{}}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	m.folders[name] = f
+	return f, nil
+}
+
+func (f *folder) load() error {
+	file, err := os.Open(filepath.Join(f.dir, uidMapName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		uidText, base, ok := strings.Cut(scanner.Text(), " ")
+		uid, err := strconv.ParseUint(uidText, 10, 32)
+		if !ok || err != nil {
+			// A line cut short by a crash.
+			continue
+		}
+		lines++
+		if base == "-" {
+			delete(f.uids, imap.UID(uid))
+		} else {
+			f.uids[imap.UID(uid)] = base
+		}
+	}
+	f.dead = lines - len(f.uids)
+	return scanner.Err()
+}
+
+// record appends to the UID map and compacts it when most of it is dead.
+func (f *folder) record(uid imap.UID, base string) error {
+	if base == "-" {
+		f.dead += 2 // the removal and the line it cancels
+	}
+	if f.dead > 1000 && f.dead > len(f.uids) {
+		return f.compact()
+	}
+	if f.log == nil {
+		file, err := os.OpenFile(filepath.Join(f.dir, uidMapName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		f.log = file
+	}
+	_, err := fmt.Fprintf(f.log, "%d %s\n", uid, base)
+	return err
+}
+
+// compact rewrites the UID map with the live entries only.
+func (f *folder) compact() error {
+	if f.log != nil {
+		f.log.Close()
+		f.log = nil
+	}
+	uids := make([]imap.UID, 0, len(f.uids))
+	for uid := range f.uids {
+		uids = append(uids, uid)
+	}
+	slices.Sort(uids)
+	tmp, err := os.CreateTemp(f.dir, "."+uidMapName+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone after the rename
+	w := bufio.NewWriter(tmp)
+	for _, uid := range uids {
+		fmt.Fprintf(w, "%d %s\n", uid, f.uids[uid])
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	f.dead = 0
+	return os.Rename(tmp.Name(), filepath.Join(f.dir, uidMapName))
+}
+
+// find returns the path of the file for base, or "" if there is none.
+func (f *folder) find(base string) (string, error) {
+	if path, ok := f.paths[base]; ok {
+		if _, err := os.Lstat(path); err == nil {
+			return path, nil
+		}
+	}
+	if err := f.scan(); err != nil {
+		return "", err
+	}
+	return f.paths[base], nil
+}
+
+func (f *folder) scan() error {
+	f.paths = make(map[string]string)
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(f.dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			base, _, _ := strings.Cut(e.Name(), ":")
+			f.paths[base] = filepath.Join(f.dir, sub, e.Name())
+		}
+	}
+	return nil
+}
+
+// rename gives the file at path the info suffix of flags, in cur.
+func (f *folder) rename(path, base string, flags []imap.Flag) error {
+	target := filepath.Join(f.dir, "cur", base+Info(flags))
+	if target != path {
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+	}
+	if f.paths != nil {
+		f.paths[base] = target
+	}
+	return nil
+}
+
+// remove deletes the file for base.
+func (f *folder) remove(base string) error {
+	path, err := f.find(base)
+	if err != nil || path == "" {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	delete(f.paths, base)
+	return nil
+}
+
+// Info is the Maildir info suffix for flags, such as ":2,FS".
+func Info(flags []imap.Flag) string {
+	var letters []byte
+	for _, flag := range flags {
+		for f, letter := range flagLetters {
+			if strings.EqualFold(string(flag), string(f)) && !slices.Contains(letters, letter) {
+				letters = append(letters, letter)
+			}
+		}
+	}
+	slices.Sort(letters)
+	return ":2," + string(letters)
+}
+
+// ParseInfo reads the IMAP flags from a file name's info suffix.
+func ParseInfo(name string) []imap.Flag {
+	_, info, ok := strings.Cut(filepath.Base(name), ":2,")
+	if !ok {
+		return nil
+	}
+	var flags []imap.Flag
+	for f, letter := range flagLetters {
+		if strings.IndexByte(info, letter) >= 0 {
+			flags = append(flags, f)
+		}
+	}
+	slices.Sort(flags)
+	return flags
+}
+
+// Deliver stores a message under uid, or only updates its flags if uid is
+// stored already.
+func (m *Maildir) Deliver(name string, uid imap.UID, raw []byte, flags []imap.Flag, date time.Time) error {
+	f, err := m.folder(name)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if base, ok := f.uids[uid]; ok {
+		if path, err := f.find(base); err != nil || path != "" {
+			if err != nil {
+				return err
+			}
+			return f.rename(path, base, flags)
+		}
+	}
+
+	if date.IsZero() {
+		date = time.Now()
+	}
+	base := fmt.Sprintf("%d.U%d.%s", date.Unix(), uid, m.host)
+	tmp := filepath.Join(f.dir, "tmp", base)
+	if err := writeFile(tmp, raw); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp, date, date); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	path := filepath.Join(f.dir, "cur", base+Info(flags))
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if f.paths != nil {
+		f.paths[base] = path
+	}
+	f.uids[uid] = base
+	return f.record(uid, base)
+}
+
+func writeFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// SetFlags renames the file of uid to match flags. A UID that is not
+// stored is ignored.
+func (m *Maildir) SetFlags(name string, uid imap.UID, flags []imap.Flag) error {
+	f, err := m.folder(name)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	base, ok := f.uids[uid]
+	if !ok {
+		return nil
+	}
+	path, err := f.find(base)
+	if err != nil || path == "" {
+		return err
+	}
+	return f.rename(path, base, flags)
+}
+
+// Remove deletes the files of uids.
+func (m *Maildir) Remove(name string, uids []imap.UID) error {
+	f, err := m.folder(name)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, uid := range uids {
+		base, ok := f.uids[uid]
+		if !ok {
+			continue
+		}
+		if err := f.remove(base); err != nil {
+			return err
+		}
+		delete(f.uids, uid)
+		if err := f.record(uid, "-"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lookup returns the path of the file stored for uid, or "" if there is
+// none.
+func (m *Maildir) Lookup(name string, uid imap.UID) (string, error) {
+	f, err := m.folder(name)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	base, ok := f.uids[uid]
+	if !ok {
+		return "", nil
+	}
+	return f.find(base)
+}
+
+// Reset removes every message stored for a folder and its UID map. The
+// maildir itself stays.
+func (m *Maildir) Reset(name string) error {
+	f, err := m.folder(name)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, base := range f.uids {
+		if err := f.remove(base); err != nil {
+			return err
+		}
+	}
+	f.uids = map[imap.UID]string{}
+	f.dead = 0
+	if f.log != nil {
+		f.log.Close()
+		f.log = nil
+	}
+	err = os.Remove(filepath.Join(f.dir, uidMapName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Message stores a message fetched with FetchOptions. A message fetched
+// with BODY[HEADER] instead, as a headers-only sync policy does, is stored
+// as its header alone.
+func (m *Maildir) Message(name string, msg *imapclient.FetchMessageBuffer) error {
+	var raw, header []byte
+	for section, b := range msg.BodySection {
+		if len(section.Part) > 0 {
+			continue
+		}
+		switch section.Specifier {
+		case imap.PartSpecifierNone:
+			raw = b
+		case imap.PartSpecifierHeader:
+			header = b
+		}
+	}
+	if raw == nil {
+		raw = header
+	}
+	if raw == nil {
+		return fmt.Errorf("maildir: UID %d was fetched without BODY[]", msg.UID)
+	}
+	return m.Deliver(name, msg.UID, raw, msg.Flags, msg.InternalDate)
+}
+
+// Expunged removes expunged messages.
+func (m *Maildir) Expunged(name string, uids []imap.UID) error {
+	return m.Remove(name, uids)
+}
+
+// Flags updates a message's flags. It is SetFlags under the name
+// mailsync.Handler uses.
+func (m *Maildir) Flags(name string, uid imap.UID, flags []imap.Flag) error {
+	return m.SetFlags(name, uid, flags)
+}
@@ -0,0 +1,253 @@
+package maildir
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+	"github.com/quzhi1/imap-playground/internal/mailsync"
+)
+
+func TestInfo(t *testing.T) {
+	flags := []imap.Flag{imap.FlagSeen, imap.FlagFlagged, "$Label1", imap.FlagAnswered, imap.FlagDraft, imap.FlagDeleted, "\\seen"}
+	if got := Info(flags); got != ":2,DFRST" {
+		t.Errorf("Info = %q", got)
+	}
+	if got := Info(nil); got != ":2," {
+		t.Errorf("Info(nil) = %q", got)
+	}
+	got := ParseInfo("cur/1700000000.U7.host:2,FS")
+	if want := []imap.Flag{imap.FlagFlagged, imap.FlagSeen}; !slices.Equal(got, want) {
+		t.Errorf("ParseInfo = %v, want %v", got, want)
+	}
+}
+
+func TestDir(t *testing.T) {
+	m, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"INBOX":             "",
+		"Archive":           ".Archive",
+		"Work/Reports":      ".Work.Reports",
+		"v1.2 notes":        ".v1%2E2 notes",
+		"100% done/2024.Q1": ".100%25 done.2024%2EQ1",
+	} {
+		if got, _ := filepath.Rel(m.root, m.Dir(name)); got != want && !(want == "" && got == ".") {
+			t.Errorf("Dir(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	root := t.TempDir()
+	m, err := Open(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 4, 2, 16, 12, 40, 0, time.UTC)
+	raw := []byte("Subject: hi\r\n\r\nhello\r\n")
+	if err := m.Deliver("Work/Reports", 7, raw, []imap.Flag{imap.FlagSeen}, date); err != nil {
+		t.Fatal(err)
+	}
+	path, err := m.Lookup("Work/Reports", 7)
+	if err != nil || path == "" {
+		t.Fatalf("Lookup = %q, %v", path, err)
+	}
+	if dir := filepath.Join(root, ".Work.Reports", "cur"); filepath.Dir(path) != dir || !strings.HasSuffix(path, ":2,S") {
+		t.Errorf("path = %s", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(date) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), date)
+	}
+	if b, _ := os.ReadFile(path); string(b) != string(raw) {
+		t.Errorf("content = %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".Work.Reports", "maildirfolder")); err != nil {
+		t.Error(err)
+	}
+
+	// Delivering the same UID again only updates the flags.
+	if err := m.Deliver("Work/Reports", 7, raw, []imap.Flag{imap.FlagSeen, imap.FlagFlagged}, date); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, ".Work.Reports", "cur"))
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ":2,FS") {
+		t.Errorf("cur = %v", entries)
+	}
+
+	// A mail reader renames the file; the UID map still finds it, also
+	// after reopening.
+	path, _ = m.Lookup("Work/Reports", 7)
+	moved := strings.TrimSuffix(path, ":2,FS") + ":2,RS"
+	if err := os.Rename(path, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err = Open(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if err := m.SetFlags("Work/Reports", 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	if path, _ := m.Lookup("Work/Reports", 7); !strings.HasSuffix(path, ":2,") {
+		t.Errorf("after SetFlags: %s", path)
+	}
+	if err := m.Remove("Work/Reports", []imap.UID{7, 8}); err != nil {
+		t.Fatal(err)
+	}
+	if path, _ := m.Lookup("Work/Reports", 7); path != "" {
+		t.Errorf("removed message still at %s", path)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, ".Work.Reports", "cur")); len(entries) != 0 {
+		t.Errorf("cur = %v", entries)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	root := t.TempDir()
+	m, err := Open(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 1200; i++ {
+		if err := m.Deliver("INBOX", imap.UID(i), []byte("x"), nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if i > 10 {
+			if err := m.Remove("INBOX", []imap.UID{imap.UID(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	m.Close()
+	b, err := os.ReadFile(filepath.Join(root, uidMapName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines > 1100 {
+		t.Errorf("UID map has %d lines for 10 messages", lines)
+	}
+	m, err = Open(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for i := 1; i <= 12; i++ {
+		path, _ := m.Lookup("INBOX", imap.UID(i))
+		if (path != "") != (i <= 10) {
+			t.Errorf("UID %d at %q", i, path)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err := server.Create("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 4, 2, 16, 12, 40, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		raw := fmt.Sprintf("From: sender@example.com\r\nSubject: %d\r\n\r\nBody %d\r\n", i, i)
+		if _, err := server.Append("INBOX", []byte(raw), []imap.Flag{imap.FlagSeen}, date.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := server.Append("Archive", []byte(raw), nil, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := t.TempDir()
+	m, err := Open(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	store, err := mailsync.OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &mailsync.Options{Fetch: FetchOptions, Flags: true}
+	sync := func() {
+		t.Helper()
+		report, err := mailsync.Sync(context.Background(), server.Config().Dial, store, m, opts)
+		if err != nil || len(report.Failed) != 0 {
+			t.Fatalf("sync: %v %v", err, report)
+		}
+	}
+	names := func(folder string) []string {
+		entries, err := os.ReadDir(filepath.Join(m.Dir(folder), "cur"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			_, info, _ := strings.Cut(e.Name(), ":")
+			names = append(names, info)
+		}
+		return names
+	}
+	sync()
+	if got := names("INBOX"); !slices.Equal(got, []string{"2,S", "2,S", "2,S"}) {
+		t.Errorf("INBOX = %v", got)
+	}
+	path, _ := m.Lookup("INBOX", 2)
+	if b, _ := os.ReadFile(path); !strings.Contains(string(b), "Body 1") {
+		t.Errorf("UID 2 = %q", b)
+	}
+
+	// Flag, unflag and expunge on the server.
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []struct {
+		uids  []imap.UID
+		op    imap.StoreFlagsOp
+		flags []imap.Flag
+	}{
+		{[]imap.UID{1}, imap.StoreFlagsAdd, []imap.Flag{imap.FlagFlagged, imap.FlagAnswered}},
+		{[]imap.UID{2}, imap.StoreFlagsDel, []imap.Flag{imap.FlagSeen}},
+		{[]imap.UID{3}, imap.StoreFlagsAdd, []imap.Flag{imap.FlagDeleted}},
+	} {
+		if err := c.Store(imap.UIDSetNum(op.uids...), &imap.StoreFlags{Op: op.op, Flags: op.flags, Silent: true}, nil).Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Expunge().Close(); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	got := names("INBOX")
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"2,", "2,FRS"}) {
+		t.Errorf("INBOX after changes = %v", got)
+	}
+	if got := names("Archive"); len(got) != 3 {
+		t.Errorf("Archive = %v", got)
+	}
+}
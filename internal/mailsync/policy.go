@@ -0,0 +1,326 @@
+package mailsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/session"
+)
+
+// Policy decides which folders a sync takes, and which of their messages.
+// The zero Policy takes every message of every folder. As JSON:
+//
+//	{
+//	  "window": {"days": 90, "search": "sentsince"},
+//	  "max_size": 26214400,
+//	  "exclude": ["Notes", "Archive/*"],
+//	  "roles": {"junk": {"skip": true}, "trash": {"headers_only": true}}
+//	}
+//
+// Messages already synced stay when the window moves past them or the
+// policy is narrowed. When it is widened, the messages it left out before
+// are looked at again.
+type Policy struct {
+	// Rule applies to every folder, except where Roles overrides it.
+	Rule
+	// Include, when set, limits the sync to the folders matching one of
+	// these globs; Exclude drops the folders matching one of them and
+	// wins over Include. Globs use path.Match, so "*" does not match the
+	// "/" of "Work/Reports".
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Roles overrides Rule for folders with a role: the fields set in a
+	// role's rule replace those of Rule.
+	Roles map[Role]Rule `json:"roles,omitempty"`
+}
+
+// Rule is what to take from a folder.
+type Rule struct {
+	Skip bool `json:"skip,omitempty"`
+	// HeadersOnly fetches the header of new messages instead of the
+	// whole message: BODY[] becomes BODY[HEADER].
+	HeadersOnly bool `json:"headers_only,omitempty"`
+	// Window limits the sync to recent messages. An empty window in a
+	// role's rule lifts the default one.
+	Window *Window `json:"window,omitempty"`
+	// MaxSize leaves out larger messages, in bytes. Zero means no limit.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// Window limits a sync to recent messages.
+type Window struct {
+	// Days is how many days back to go; Since is a fixed day
+	// (2006-01-02). Set at most one.
+	Days  int    `json:"days,omitempty"`
+	Since string `json:"since,omitempty"`
+	// Search is "sentsince", the default, to go by the Date header, or
+	// "since" to go by INTERNALDATE, when the server received the
+	// message. Date headers can be missing or wrong; INTERNALDATE is
+	// reset by some migrations.
+	Search string `json:"search,omitempty"`
+}
+
+// Window searches.
+const (
+	SearchSentSince = "sentsince"
+	SearchSince     = "since"
+)
+
+// LoadPolicy reads and validates a policy from a JSON file.
+func LoadPolicy(file string) (*Policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p Policy
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("mailsync: policy %s: %w", file, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate reports every mistake in the policy at once. A nil policy is
+// valid.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	var errs []error
+	if p.Skip {
+		errs = append(errs, errors.New("skip is only allowed per role"))
+	}
+	errs = append(errs, p.Rule.validate("")...)
+	for _, glob := range slices.Concat(p.Include, p.Exclude) {
+		if _, err := path.Match(glob, ""); err != nil {
+			errs = append(errs, fmt.Errorf("glob %q: %w", glob, err))
+		}
+	}
+	for role, rule := range p.Roles {
+		if !slices.Contains(roles, role) {
+			errs = append(errs, fmt.Errorf("unknown role %q", role))
+			continue
+		}
+		errs = append(errs, rule.validate(string(role)+": ")...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("mailsync: invalid policy: %w", err)
+	}
+	return nil
+}
+
+// roles are the roles a policy can name.
+var roles = []Role{RoleInbox, RoleSent, RoleDrafts, RoleArchive, RoleTrash, RoleJunk, RoleAll}
+
+func (r Rule) validate(prefix string) []error {
+	var errs []error
+	if r.MaxSize < 0 {
+		errs = append(errs, fmt.Errorf("%snegative max_size", prefix))
+	}
+	if w := r.Window; w != nil {
+		if w.Days < 0 {
+			errs = append(errs, fmt.Errorf("%snegative window days", prefix))
+		}
+		if w.Days != 0 && w.Since != "" {
+			errs = append(errs, fmt.Errorf("%swindow has both days and since", prefix))
+		}
+		if w.Since != "" {
+			if _, err := time.Parse(time.DateOnly, w.Since); err != nil {
+				errs = append(errs, fmt.Errorf("%swindow since: %w", prefix, err))
+			}
+		}
+		if w.Search != "" && w.Search != SearchSentSince && w.Search != SearchSince {
+			errs = append(errs, fmt.Errorf("%swindow search %q is neither %q nor %q", prefix, w.Search, SearchSentSince, SearchSince))
+		}
+	}
+	return errs
+}
+
+// FolderPlan is what a policy does with one folder.
+type FolderPlan struct {
+	Folder string `json:"folder"`
+	Role   Role   `json:"role,omitempty"`
+	// Skip says why the folder is not synced; it is empty when it is.
+	Skip        string `json:"skip,omitempty"`
+	HeadersOnly bool   `json:"headers_only,omitempty"`
+	// Search is "SENTSINCE" or "SINCE" and Since its day, when the folder
+	// is synced from a day on.
+	Search  string `json:"search,omitempty"`
+	Since   string `json:"since,omitempty"`
+	MaxSize int64  `json:"max_size,omitempty"`
+	// Messages and Matching, filled in by Plan, count the folder's
+	// messages and those the policy takes.
+	Messages int `json:"messages"`
+	Matching int `json:"matching"`
+	// Error is why Plan could not count the messages.
+	Error string `json:"error,omitempty"`
+
+	// key identifies which messages the plan takes, without the day a
+	// rolling window moves to, so that a changed policy can be told.
+	key string
+}
+
+// Folder returns the plan for a listed folder, with a rolling window
+// counted back from now.
+func (p *Policy) Folder(data *imap.ListData, now time.Time) *FolderPlan {
+	plan := &FolderPlan{Folder: data.Mailbox, Role: FolderRole(data)}
+	if p == nil {
+		return plan
+	}
+	switch {
+	case slices.ContainsFunc(p.Exclude, func(glob string) bool { return match(glob, data.Mailbox) }):
+		plan.Skip = "excluded"
+		return plan
+	case len(p.Include) > 0 && !slices.ContainsFunc(p.Include, func(glob string) bool { return match(glob, data.Mailbox) }):
+		plan.Skip = "not included"
+		return plan
+	}
+	rule := p.Rule
+	if override, ok := p.Roles[plan.Role]; ok && plan.Role != RoleNone {
+		rule.Skip = rule.Skip || override.Skip
+		rule.HeadersOnly = rule.HeadersOnly || override.HeadersOnly
+		if override.Window != nil {
+			rule.Window = override.Window
+		}
+		if override.MaxSize != 0 {
+			rule.MaxSize = override.MaxSize
+		}
+	}
+	if rule.Skip {
+		plan.Skip = "role " + string(plan.Role)
+		return plan
+	}
+	plan.HeadersOnly = rule.HeadersOnly
+	plan.MaxSize = rule.MaxSize
+	var keys []string
+	if w := rule.Window; w != nil && (w.Days != 0 || w.Since != "") {
+		plan.Search = strings.ToUpper(SearchSentSince)
+		if w.Search == SearchSince {
+			plan.Search = strings.ToUpper(SearchSince)
+		}
+		if w.Days != 0 {
+			y, m, d := now.Date()
+			plan.Since = time.Date(y, m, d-w.Days, 0, 0, 0, 0, time.UTC).Format(time.DateOnly)
+			keys = append(keys, fmt.Sprintf("%s %dd", plan.Search, w.Days))
+		} else {
+			plan.Since = w.Since
+			keys = append(keys, plan.Search+" "+w.Since)
+		}
+	}
+	if plan.MaxSize > 0 {
+		keys = append(keys, fmt.Sprintf("SMALLER %d", plan.MaxSize+1))
+	}
+	plan.key = strings.Join(keys, " ")
+	return plan
+}
+
+// match reports whether name matches glob, treating a bad glob as no
+// match; Validate reports those.
+func match(glob, name string) bool {
+	ok, _ := path.Match(glob, name)
+	return ok
+}
+
+// Criteria returns the search for the messages the plan takes, or nil when
+// it takes them all.
+func (fp *FolderPlan) Criteria() *imap.SearchCriteria {
+	if fp.Since == "" && fp.MaxSize == 0 {
+		return nil
+	}
+	criteria := &imap.SearchCriteria{}
+	if fp.Since != "" {
+		since, _ := time.Parse(time.DateOnly, fp.Since)
+		if fp.Search == strings.ToUpper(SearchSince) {
+			criteria.Since = since
+		} else {
+			criteria.SentSince = since
+		}
+	}
+	if fp.MaxSize > 0 {
+		criteria.Smaller = fp.MaxSize + 1
+	}
+	return criteria
+}
+
+// fetchOptions returns fetch with BODY[] turned into BODY[HEADER] when the
+// plan is headers only.
+func (fp *FolderPlan) fetchOptions(fetch *imap.FetchOptions) *imap.FetchOptions {
+	opts := *fetch
+	if !fp.HeadersOnly {
+		return &opts
+	}
+	opts.BodySection = nil
+	for _, section := range fetch.BodySection {
+		if section.Specifier == imap.PartSpecifierNone && len(section.Part) == 0 {
+			header := *section
+			header.Specifier = imap.PartSpecifierHeader
+			header.Partial = nil
+			section = &header
+		}
+		opts.BodySection = append(opts.BodySection, section)
+	}
+	opts.BinarySection = nil
+	return &opts
+}
+
+// Plan returns what a sync with opts would do with every folder, without
+// syncing anything: which folders it skips and why, and for the others
+// how many messages they hold and how many the policy takes.
+func Plan(ctx context.Context, dial session.Dialer, opts *Options) ([]*FolderPlan, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Logout(c)
+	list, err := listFolders(c, opts.Folders)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	plans := make([]*FolderPlan, len(list))
+	for i, data := range list {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		plan := opts.Policy.Folder(data, now)
+		plans[i] = plan
+		if plan.Skip != "" {
+			continue
+		}
+		selected, err := c.Select(plan.Folder, &imap.SelectOptions{ReadOnly: true}).Wait()
+		if err != nil {
+			plan.Error = fmt.Sprintf("select: %v", err)
+			continue
+		}
+		plan.Messages = int(selected.NumMessages)
+		plan.Matching = plan.Messages
+		if criteria := plan.Criteria(); criteria != nil && plan.Messages > 0 {
+			data, err := c.UIDSearch(criteria, nil).Wait()
+			if err != nil {
+				plan.Error = fmt.Sprintf("search: %v", err)
+				continue
+			}
+			plan.Matching = len(data.AllUIDs())
+		}
+	}
+	return plans, nil
+}
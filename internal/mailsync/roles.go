@@ -0,0 +1,71 @@
+package mailsync
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// Role is what a folder is for, from its SPECIAL-USE attribute (RFC 6154)
+// or, on servers without it, its name.
+type Role string
+
+const (
+	RoleNone    Role = ""
+	RoleInbox   Role = "inbox"
+	RoleSent    Role = "sent"
+	RoleDrafts  Role = "drafts"
+	RoleArchive Role = "archive"
+	RoleTrash   Role = "trash"
+	RoleJunk    Role = "junk"
+	// RoleAll is a virtual folder holding every message, like Gmail's All
+	// Mail.
+	RoleAll Role = "all"
+)
+
+var roleAttrs = []struct {
+	attr imap.MailboxAttr
+	role Role
+}{
+	{imap.MailboxAttrSent, RoleSent},
+	{imap.MailboxAttrDrafts, RoleDrafts},
+	{imap.MailboxAttrArchive, RoleArchive},
+	{imap.MailboxAttrTrash, RoleTrash},
+	{imap.MailboxAttrJunk, RoleJunk},
+	{imap.MailboxAttrAll, RoleAll},
+}
+
+// roleNames are the usual English names of folders with a role, lowercase.
+var roleNames = map[string]Role{
+	"sent":             RoleSent,
+	"sent messages":    RoleSent,
+	"sent items":       RoleSent,
+	"sent mail":        RoleSent,
+	"drafts":           RoleDrafts,
+	"archive":          RoleArchive,
+	"trash":            RoleTrash,
+	"deleted messages": RoleTrash,
+	"deleted items":    RoleTrash,
+	"junk":             RoleJunk,
+	"junk e-mail":      RoleJunk,
+	"spam":             RoleJunk,
+	"bulk mail":        RoleJunk,
+}
+
+// FolderRole returns the role of a listed folder.
+func FolderRole(data *imap.ListData) Role {
+	if strings.EqualFold(data.Mailbox, "INBOX") {
+		return RoleInbox
+	}
+	for _, r := range roleAttrs {
+		if hasAttr(data.Attrs, r.attr) {
+			return r.role
+		}
+	}
+	name := data.Mailbox
+	if data.Delim != 0 {
+		// "[Gmail]/Spam" or "INBOX.Sent".
+		name = name[strings.LastIndex(name, string(data.Delim))+1:]
+	}
+	return roleNames[strings.ToLower(name)]
+}
@@ -0,0 +1,234 @@
+package mailsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/batch"
+)
+
+// StateVersion is written into every state file. A file with another
+// version is ignored, which makes its folder resync from scratch.
+const StateVersion = 1
+
+const (
+	stateExt      = ".json"
+	checkpointExt = ".checkpoint"
+)
+
+// FolderState is what the last sync knew about a folder.
+type FolderState struct {
+	Version     int      `json:"version"`
+	Folder      string   `json:"folder"`
+	UIDValidity uint32   `json:"uid_validity"`
+	UIDNext     imap.UID `json:"uid_next"`
+	UIDs        UIDList  `json:"uids"`
+	// Skipped are the UIDs the policy left out, and Policy what it was.
+	Skipped UIDList `json:"skipped,omitempty"`
+	Policy  string  `json:"policy,omitempty"`
+	// HighestModSeq is the folder's HIGHESTMODSEQ at the last sync, or
+	// zero when it was synced without CONDSTORE.
+	HighestModSeq uint64    `json:"highest_modseq,omitempty"`
+	SyncedAt      time.Time `json:"synced_at"`
+	// ChangedAt is the last sync that found new or expunged messages, or
+	// started the folder over. Sync uses it to sync busy folders first.
+	ChangedAt time.Time `json:"changed_at,omitempty"`
+}
+
+// Checkpoint is how far the fetch of a folder's new messages got. It is
+// saved after every chunk, so that a sync killed halfway through a large
+// folder resumes there instead of starting the folder over, and removed
+// once the folder's state is saved.
+type Checkpoint struct {
+	Version     int    `json:"version"`
+	Folder      string `json:"folder"`
+	UIDValidity uint32 `json:"uid_validity"`
+	// Policy is the policy the new messages were picked by.
+	Policy string `json:"policy,omitempty"`
+	// Chunks counts the chunks fetched. Every new message up to LastUID
+	// reached the handler.
+	Chunks  int       `json:"chunks"`
+	LastUID imap.UID  `json:"last_uid"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// UIDList is a sorted list of UIDs. It is stored as a set string
+// ("1:4,7,9:10"), which keeps the state of a large folder small.
+type UIDList []imap.UID
+
+func (l UIDList) MarshalJSON() ([]byte, error) {
+	raw := make([]uint32, len(l))
+	for i, uid := range l {
+		raw[i] = uint32(uid)
+	}
+	return json.Marshal(batch.SetString(batch.Compress(raw)))
+}
+
+func (l *UIDList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	ranges, err := batch.ParseSet(s)
+	if err != nil {
+		return err
+	}
+	raw := batch.Expand(batch.Compress(batch.Expand(ranges)))
+	*l = make(UIDList, len(raw))
+	for i, uid := range raw {
+		(*l)[i] = imap.UID(uid)
+	}
+	return nil
+}
+
+// Store keeps one state file per folder in a directory.
+type Store struct {
+	dir string
+}
+
+// OpenStore opens the state directory, creating it if needed.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir is the state directory.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) path(folder, ext string) string {
+	return filepath.Join(s.dir, url.PathEscape(folder)+ext)
+}
+
+// Load returns the state of folder, or nil if it has never been synced or
+// its state was written by another version.
+func (s *Store) Load(folder string) (*FolderState, error) {
+	var state FolderState
+	if ok, err := s.read(s.path(folder, stateExt), &state); !ok || err != nil {
+		return nil, err
+	}
+	if state.Version != StateVersion || state.Folder != folder {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// Save writes the state of a folder and removes its checkpoint. The file
+// is replaced in one rename, so a crash leaves either the old state or the
+// new one.
+func (s *Store) Save(state *FolderState) error {
+	state.Version = StateVersion
+	if err := s.write(s.path(state.Folder, stateExt), state); err != nil {
+		return err
+	}
+	return remove(s.path(state.Folder, checkpointExt))
+}
+
+// LoadCheckpoint returns the checkpoint of folder, or nil if there is none
+// or it was written by another version.
+func (s *Store) LoadCheckpoint(folder string) (*Checkpoint, error) {
+	var cp Checkpoint
+	if ok, err := s.read(s.path(folder, checkpointExt), &cp); !ok || err != nil {
+		return nil, err
+	}
+	if cp.Version != StateVersion || cp.Folder != folder {
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+// SaveCheckpoint writes the checkpoint of a folder, in one rename like
+// Save.
+func (s *Store) SaveCheckpoint(cp *Checkpoint) error {
+	cp.Version = StateVersion
+	return s.write(s.path(cp.Folder, checkpointExt), cp)
+}
+
+// read decodes the JSON file at path into v. It reports false when there
+// is no such file.
+func (s *Store) read(path string, v any) (bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("mailsync: %s: %w", filepath.Base(path), err)
+	}
+	return true, nil
+}
+
+func (s *Store) write(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone after the rename
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete forgets a folder.
+func (s *Store) Delete(folder string) error {
+	if err := remove(s.path(folder, checkpointExt)); err != nil {
+		return err
+	}
+	return remove(s.path(folder, stateExt))
+}
+
+func remove(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Folders lists the folders that have a state file, sorted.
+func (s *Store) Folders() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var folders []string
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), stateExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		folder, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
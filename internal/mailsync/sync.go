@@ -0,0 +1,676 @@
+// Package mailsync keeps a local copy of an account up to date without
+// fetching it again on every run. For each folder it stores UIDVALIDITY,
+// UIDNEXT and the UIDs already seen; a run then fetches only UIDs that are
+// new, reports the ones that were expunged, and starts the folder over when
+// its UIDVALIDITY changed.
+//
+// With Options.Flags the flags of known messages are synced too. On servers
+// with CONDSTORE (RFC 7162) the folder's HIGHESTMODSEQ is stored, a folder
+// whose HIGHESTMODSEQ, UIDNEXT and message count are unchanged is skipped,
+// and only the flags changed since the stored HIGHESTMODSEQ are fetched
+// (FETCH CHANGEDSINCE). Elsewhere the flags of every message are fetched.
+// QRESYNC is not used: go-imap v2 can neither ENABLE it nor parse VANISHED,
+// so expunges are always found by listing UIDs.
+package mailsync
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/batch"
+	"github.com/quzhi1/imap-playground/internal/session"
+	"github.com/rs/zerolog/log"
+)
+
+// Handler receives the changes a sync finds. Calls for one folder are
+// made in order and never concurrently; with Options.Concurrency above 1,
+// calls for different folders can be. When a handler call fails the
+// folder's state is not saved, so the next run sees the same changes
+// again: handlers must accept a message or an expunge twice.
+type Handler interface {
+	// Reset drops everything stored for folder. Its UIDVALIDITY changed,
+	// or it was deleted, so the UIDs stored under it name nothing.
+	Reset(folder string) error
+	// Message is called for every message new since the last sync.
+	Message(folder string, msg *imapclient.FetchMessageBuffer) error
+	// Expunged is called with the UIDs removed since the last sync.
+	Expunged(folder string, uids []imap.UID) error
+	// Flags is called with the flags of a known message when
+	// Options.Flags is set: with CONDSTORE for the messages whose flags
+	// changed, without it for every message.
+	Flags(folder string, uid imap.UID, flags []imap.Flag) error
+}
+
+// DefaultFetchOptions are fetched for new messages when Options.Fetch is
+// nil.
+var DefaultFetchOptions = &imap.FetchOptions{
+	UID:          true,
+	Envelope:     true,
+	Flags:        true,
+	InternalDate: true,
+	RFC822Size:   true,
+}
+
+// Options tunes Sync.
+type Options struct {
+	// Folders restricts the sync. Empty means every selectable folder;
+	// then folders that no longer exist are reset and forgotten.
+	Folders []string
+	// Fetch is what to fetch for new messages. UID is always added.
+	Fetch *imap.FetchOptions
+	// Batch tunes the FETCH of new messages.
+	Batch *batch.Options
+	// Flags syncs the flags of known messages as well.
+	Flags bool
+	// NoCondStore ignores CONDSTORE even when the server advertises it.
+	NoCondStore bool
+	// Concurrency is the maximum number of connections to sync over.
+	// Servers often cap connections per account, so extra connections
+	// that fail to open are skipped instead of failing the sync. Defaults
+	// to 1.
+	Concurrency int
+	// Policy picks the folders and messages to sync. Nil syncs every
+	// message of every folder.
+	Policy *Policy
+}
+
+// FolderResult is what a sync did to one folder.
+type FolderResult struct {
+	Folder      string `json:"folder"`
+	UIDValidity uint32 `json:"uid_validity"`
+	// Full is set when the folder was synced from scratch: it had no
+	// state, or its UIDVALIDITY changed (then Reset is also set).
+	Full     bool `json:"full,omitempty"`
+	Reset    bool `json:"reset,omitempty"`
+	New      int  `json:"new"`
+	Expunged int  `json:"expunged"`
+	// FlagsChanged counts the Flags calls.
+	FlagsChanged int `json:"flags_changed,omitempty"`
+	// Unchanged is set when UIDNEXT and the message count (and, when
+	// syncing flags, HIGHESTMODSEQ) showed nothing had changed, so no
+	// SEARCH or FETCH was sent.
+	Unchanged bool `json:"unchanged,omitempty"`
+	// CondStore is set when the folder was synced with mod-sequences.
+	CondStore bool `json:"condstore,omitempty"`
+	// Resumed counts the new messages an interrupted sync had already
+	// fetched, found in the folder's checkpoint.
+	Resumed int `json:"resumed,omitempty"`
+	// Skipped counts the messages the policy left out: new ones, and
+	// after a policy change the ones it left out before.
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// Report is the result of a sync.
+type Report struct {
+	Folders []FolderResult `json:"folders"`
+	// Removed lists folders that were synced before and no longer exist.
+	Removed []string `json:"removed,omitempty"`
+	// Failed maps each folder that could not be synced to the error.
+	Failed map[string]string `json:"failed,omitempty"`
+	// Skipped maps each folder the policy skips to the reason.
+	Skipped map[string]string `json:"skipped,omitempty"`
+	// Connections is the number of connections the folders were synced
+	// over.
+	Connections int `json:"connections"`
+	// Timings lists every folder attempted, in the order they started.
+	Timings   []FolderTiming `json:"timings"`
+	ElapsedMS int64          `json:"elapsed_ms"`
+}
+
+// FolderTiming is when and for how long one folder was synced.
+type FolderTiming struct {
+	Folder string `json:"folder"`
+	// Conn numbers the connection the folder was synced over, from 0.
+	Conn int `json:"conn"`
+	// StartedMS is the time from the start of the sync.
+	StartedMS int64  `json:"started_ms"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Sync brings every folder's state up to date over up to
+// opts.Concurrency connections, handing out folders in the order schedule
+// gives. A folder that fails, SELECT included, is reported in Failed and
+// keeps its old state. When a connection breaks its worker stops and the
+// others take the remaining folders.
+func Sync(ctx context.Context, dial session.Dialer, store *Store, handler Handler, opts *Options) (*Report, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	first, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	list, err := listFolders(first, opts.Folders)
+	if err != nil {
+		session.Logout(first)
+		return nil, err
+	}
+	folders := make([]string, len(list))
+	for i, data := range list {
+		folders[i] = data.Mailbox
+	}
+	report := &Report{Failed: map[string]string{}}
+	for _, name := range opts.Folders {
+		if !slices.Contains(folders, name) {
+			report.Failed[name] = "no such folder"
+		}
+	}
+	if len(opts.Folders) == 0 {
+		if report.Removed, err = removeGone(store, handler, folders); err != nil {
+			session.Logout(first)
+			return nil, err
+		}
+	}
+	plans := make(map[string]*FolderPlan, len(list))
+	var take []*imap.ListData
+	for _, data := range list {
+		plan := opts.Policy.Folder(data, start)
+		if plan.Skip != "" {
+			if report.Skipped == nil {
+				report.Skipped = map[string]string{}
+			}
+			report.Skipped[plan.Folder] = plan.Skip
+			continue
+		}
+		plans[plan.Folder] = plan
+		take = append(take, data)
+	}
+	order, err := schedule(store, take)
+	if err != nil {
+		session.Logout(first)
+		return nil, err
+	}
+
+	var (
+		mu      sync.Mutex
+		results = make(map[string]FolderResult, len(order))
+	)
+	report.Connections = session.Each(ctx, first, dial, max(1, opts.Concurrency), order, func(conn int, c *imapclient.Client, name string) error {
+		began := time.Now()
+		res, err := syncFolder(ctx, c, store, handler, plans[name], opts)
+		timing := FolderTiming{
+			Folder:    name,
+			Conn:      conn,
+			StartedMS: began.Sub(start).Milliseconds(),
+			ElapsedMS: time.Since(began).Milliseconds(),
+		}
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("folderName", name).Msg("Failed to sync folder, skipping it")
+			report.Failed[name] = err.Error()
+			timing.Error = err.Error()
+		} else {
+			results[name] = *res
+		}
+		report.Timings = append(report.Timings, timing)
+		return err
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range order {
+		if res, ok := results[name]; ok {
+			report.Folders = append(report.Folders, res)
+		} else if _, failed := report.Failed[name]; !failed {
+			report.Failed[name] = "not synced: no connection left"
+		}
+	}
+	slices.SortFunc(report.Timings, func(a, b FolderTiming) int { return cmp.Compare(a.StartedMS, b.StartedMS) })
+	report.ElapsedMS = time.Since(start).Milliseconds()
+	return report, nil
+}
+
+// SyncFolder brings one folder's state up to date. It selects the folder
+// read-only on c. Without a listing, the folder's role for opts.Policy
+// comes from its name alone; a folder the policy skips is an error.
+func SyncFolder(ctx context.Context, c *imapclient.Client, store *Store, handler Handler, name string, opts *Options) (*FolderResult, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	plan := opts.Policy.Folder(&imap.ListData{Mailbox: name}, time.Now())
+	if plan.Skip != "" {
+		return nil, fmt.Errorf("mailsync: %s is skipped by the policy: %s", name, plan.Skip)
+	}
+	return syncFolder(ctx, c, store, handler, plan, opts)
+}
+
+func syncFolder(ctx context.Context, c *imapclient.Client, store *Store, handler Handler, plan *FolderPlan, opts *Options) (*FolderResult, error) {
+	name := plan.Folder
+	cond := !opts.NoCondStore && c.Caps().Has(imap.CapCondStore)
+	selected, err := c.Select(name, &imap.SelectOptions{ReadOnly: true, CondStore: cond}).Wait()
+	if err != nil && cond {
+		log.Ctx(ctx).Warn().Err(err).Str("folderName", name).Msg("SELECT (CONDSTORE) failed, retrying without it")
+		cond = false
+		selected, err = c.Select(name, &imap.SelectOptions{ReadOnly: true}).Wait()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select: %w", err)
+	}
+	// A folder without mod-sequences answers NOMODSEQ, which leaves
+	// HighestModSeq zero.
+	cond = cond && selected.HighestModSeq != 0
+	prev, err := store.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &FolderResult{Folder: name, UIDValidity: selected.UIDValidity, CondStore: cond}
+	// known are the UIDs handed to the handler, skipped those the policy
+	// left out. Both count towards the folder's messages.
+	var known, skipped []imap.UID
+	switch {
+	case prev == nil:
+		res.Full = true
+	case prev.UIDValidity != selected.UIDValidity:
+		log.Ctx(ctx).Warn().
+			Str("folderName", name).
+			Uint32("was", prev.UIDValidity).
+			Uint32("UIDVALIDITY", selected.UIDValidity).
+			Msg("UIDVALIDITY changed, resyncing folder")
+		if err := handler.Reset(name); err != nil {
+			return nil, err
+		}
+		res.Full, res.Reset = true, true
+	default:
+		known, skipped = prev.UIDs, prev.Skipped
+	}
+	cp, err := store.LoadCheckpoint(name)
+	if err != nil {
+		return nil, err
+	}
+	if cp != nil && cp.UIDValidity != selected.UIDValidity {
+		if !res.Reset {
+			// The handler holds messages of the old UIDVALIDITY that no
+			// state records.
+			log.Ctx(ctx).Warn().
+				Str("folderName", name).
+				Uint32("was", cp.UIDValidity).
+				Uint32("UIDVALIDITY", selected.UIDValidity).
+				Msg("UIDVALIDITY changed since the checkpoint, resyncing folder")
+			if err := handler.Reset(name); err != nil {
+				return nil, err
+			}
+			res.Full, res.Reset = true, true
+			known, skipped = nil, nil
+		}
+		cp = nil
+	}
+	if cp != nil && cp.Policy != plan.key {
+		cp = nil
+	}
+	seen := slices.Concat(known, skipped)
+	slices.Sort(seen)
+	// A changed policy looks at the messages it left out again.
+	replan := !res.Full && prev.Policy != plan.key
+
+	var fresh, gone []imap.UID
+	sameFlags := !opts.Flags || cond && prev != nil && prev.HighestModSeq == selected.HighestModSeq
+	switch {
+	case !res.Full && !replan && selected.UIDNext != 0 && selected.UIDNext == prev.UIDNext && int(selected.NumMessages) == len(seen) && sameFlags:
+		// Nothing was added, so nothing can have been expunged either
+		// without the count going down.
+		res.Unchanged = true
+	case selected.NumMessages == 0:
+		gone = seen
+	default:
+		fresh, gone, err = diff(c, prev, seen, selected.NumMessages, res.Full)
+		if err != nil {
+			return nil, err
+		}
+	}
+	isGone := make(map[imap.UID]bool, len(gone))
+	for _, uid := range gone {
+		isGone[uid] = true
+	}
+	keep := func(uids []imap.UID) []imap.UID {
+		return slices.DeleteFunc(slices.Clone(uids), func(uid imap.UID) bool { return isGone[uid] })
+	}
+	expunged := slices.DeleteFunc(slices.Clone(gone), func(uid imap.UID) bool {
+		_, ok := slices.BinarySearch(known, uid)
+		return !ok
+	})
+	candidates := fresh
+	if replan {
+		candidates = slices.Concat(fresh, keep(skipped))
+		slices.Sort(candidates)
+		skipped = nil
+	}
+	take, left, err := filter(c, plan, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(take)
+	delivered := make(map[imap.UID]bool, len(take))
+	if cp != nil {
+		// An interrupted sync got this far with the same messages.
+		n, _ := slices.BinarySearch(take, cp.LastUID+1)
+		for _, uid := range take[:n] {
+			delivered[uid] = true
+		}
+		take, res.Resumed = take[n:], n
+		log.Ctx(ctx).Info().Str("folderName", name).Int("done", n).Int("left", len(take)).Msg("Resuming folder from checkpoint")
+	} else {
+		cp = &Checkpoint{Folder: name, UIDValidity: selected.UIDValidity, Policy: plan.key}
+	}
+	if len(take) > 0 {
+		if err := fetch(ctx, c, store, handler, plan, cp, take, delivered, opts); err != nil {
+			return nil, fmt.Errorf("fetch: %w", err)
+		}
+	}
+	if len(expunged) > 0 {
+		if err := handler.Expunged(name, expunged); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &FolderState{
+		Folder:      name,
+		UIDValidity: selected.UIDValidity,
+		UIDNext:     selected.UIDNext,
+		UIDs:        keep(known),
+		Skipped:     slices.Concat(keep(skipped), left),
+		Policy:      plan.key,
+		SyncedAt:    time.Now().UTC(),
+	}
+	if cond {
+		state.HighestModSeq = selected.HighestModSeq
+	}
+	if opts.Flags && !res.Unchanged && len(state.UIDs) > 0 {
+		var since uint64
+		if cond {
+			since = prev.HighestModSeq
+		}
+		n, err := syncFlags(ctx, c, handler, name, state.UIDs, since)
+		if err != nil {
+			return nil, err
+		}
+		res.FlagsChanged = n
+	}
+	// A message expunged between SEARCH and FETCH was never delivered.
+	for uid := range delivered {
+		state.UIDs = append(state.UIDs, uid)
+	}
+	for _, uid := range fresh {
+		if uid >= state.UIDNext {
+			state.UIDNext = uid + 1
+		}
+	}
+	slices.Sort(state.UIDs)
+	slices.Sort(state.Skipped)
+	if res.Full || len(delivered) > 0 || len(expunged) > 0 {
+		state.ChangedAt = state.SyncedAt
+	} else {
+		state.ChangedAt = prev.ChangedAt
+	}
+	if err := store.Save(state); err != nil {
+		return nil, err
+	}
+	res.New, res.Expunged, res.Skipped = len(delivered), len(expunged), len(left)
+	return res, nil
+}
+
+// fetch passes the messages take to the handler, in UID order, and saves
+// the checkpoint cp after every chunk.
+func fetch(ctx context.Context, c *imapclient.Client, store *Store, handler Handler, plan *FolderPlan, cp *Checkpoint, take []imap.UID, delivered map[imap.UID]bool, opts *Options) error {
+	fetchOpts := plan.fetchOptions(DefaultFetchOptions)
+	if opts.Fetch != nil {
+		fetchOpts = plan.fetchOptions(opts.Fetch)
+	}
+	fetchOpts.UID = true
+	batchOpts := batch.Options{}
+	if opts.Batch != nil {
+		batchOpts = *opts.Batch
+	}
+	// In order, every chunk up to the highest UID delivered is complete
+	// once Progress is called.
+	batchOpts.Ordered = true
+	var (
+		last      imap.UID
+		saveErr   error
+		progress  = batchOpts.Progress
+		chunksWas = cp.Chunks
+	)
+	batchOpts.Progress = func(p batch.Progress) {
+		if progress != nil {
+			progress(p)
+		}
+		if last <= cp.LastUID || saveErr != nil {
+			return
+		}
+		cp.Chunks, cp.LastUID, cp.SavedAt = chunksWas+p.ChunksDone, last, time.Now().UTC()
+		saveErr = store.SaveCheckpoint(cp)
+	}
+	return batch.Fetch(ctx, c, take, fetchOpts, &batchOpts, func(msg *imapclient.FetchMessageBuffer) error {
+		if saveErr != nil {
+			return fmt.Errorf("checkpoint: %w", saveErr)
+		}
+		if err := handler.Message(plan.Folder, msg); err != nil {
+			return err
+		}
+		delivered[msg.UID] = true
+		last = max(last, msg.UID)
+		return nil
+	})
+}
+
+// filter splits uids into those the plan takes and those it leaves out,
+// with one SEARCH when the plan has criteria.
+func filter(c *imapclient.Client, plan *FolderPlan, uids []imap.UID) (take, left []imap.UID, err error) {
+	criteria := plan.Criteria()
+	if criteria == nil || len(uids) == 0 {
+		return uids, nil, nil
+	}
+	criteria.UID = []imap.UIDSet{imap.UIDSetNum(uids...)}
+	data, err := c.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return nil, nil, fmt.Errorf("search: %w", err)
+	}
+	matched := make(map[imap.UID]bool)
+	for _, uid := range data.AllUIDs() {
+		matched[uid] = true
+	}
+	for _, uid := range uids {
+		if matched[uid] {
+			take = append(take, uid)
+		} else {
+			left = append(left, uid)
+		}
+	}
+	return take, left, nil
+}
+
+// diff finds the UIDs added and removed since the last sync. New UIDs are
+// looked up above the old UIDNEXT first; only when the count then does not
+// add up is every UID listed to find the expunged ones.
+func diff(c *imapclient.Client, prev *FolderState, known []imap.UID, exists uint32, full bool) (fresh, gone []imap.UID, err error) {
+	if !full && prev.UIDNext != 0 {
+		above, err := search(c, imap.UIDRange{Start: prev.UIDNext, Stop: 0})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, uid := range above {
+			// "n:*" matches the highest UID even when it is below n.
+			if uid >= prev.UIDNext {
+				fresh = append(fresh, uid)
+			}
+		}
+		if len(known)+len(fresh) == int(exists) {
+			return fresh, nil, nil
+		}
+	}
+
+	current, err := search(c, imap.UIDRange{Start: 1, Stop: 0})
+	if err != nil {
+		return nil, nil, err
+	}
+	isKnown := make(map[imap.UID]bool, len(known))
+	for _, uid := range known {
+		isKnown[uid] = true
+	}
+	fresh = fresh[:0]
+	for _, uid := range current {
+		if isKnown[uid] {
+			delete(isKnown, uid)
+		} else {
+			fresh = append(fresh, uid)
+		}
+	}
+	for _, uid := range known {
+		if isKnown[uid] {
+			gone = append(gone, uid)
+		}
+	}
+	return fresh, gone, nil
+}
+
+// syncFlags passes the flags of the known messages to the handler: those
+// changed since the mod-sequence since, or all of them when since is zero
+// or the server rejects CHANGEDSINCE.
+func syncFlags(ctx context.Context, c *imapclient.Client, handler Handler, name string, known []imap.UID, since uint64) (int, error) {
+	all := imap.UIDSet{imap.UIDRange{Start: 1, Stop: 0}}
+	fetchOpts := &imap.FetchOptions{UID: true, Flags: true}
+	if since != 0 {
+		fetchOpts.ModSeq, fetchOpts.ChangedSince = true, since
+	}
+	msgs, err := c.Fetch(all, fetchOpts).Collect()
+	if err != nil && since != 0 {
+		log.Ctx(ctx).Warn().Err(err).Str("folderName", name).Msg("FETCH CHANGEDSINCE failed, fetching every flag")
+		msgs, err = c.Fetch(all, &imap.FetchOptions{UID: true, Flags: true}).Collect()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("fetch flags: %w", err)
+	}
+	n := 0
+	for _, msg := range msgs {
+		// New messages were passed with their flags already.
+		if _, ok := slices.BinarySearch(known, msg.UID); !ok {
+			continue
+		}
+		if err := handler.Flags(name, msg.UID, msg.Flags); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func search(c *imapclient.Client, r imap.UIDRange) ([]imap.UID, error) {
+	data, err := c.UIDSearch(&imap.SearchCriteria{UID: []imap.UIDSet{{r}}}, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	uids := data.AllUIDs()
+	slices.Sort(uids)
+	return uids, nil
+}
+
+// removeGone resets and forgets the folders in the store that are not in
+// folders any more.
+func removeGone(store *Store, handler Handler, folders []string) ([]string, error) {
+	stored, err := store.Folders()
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, name := range stored {
+		if slices.Contains(folders, name) {
+			continue
+		}
+		if err := handler.Reset(name); err != nil {
+			return nil, err
+		}
+		if err := store.Delete(name); err != nil {
+			return nil, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+// schedule orders folders for Sync: INBOX first, then the folders in
+// which a sync last found changes, most recent first, then the rest in
+// list order, with Trash, Junk and all-mail folders last since they are
+// the least read and often the largest.
+func schedule(store *Store, list []*imap.ListData) ([]string, error) {
+	type job struct {
+		name    string
+		tier    int
+		changed time.Time
+	}
+	jobs := make([]job, len(list))
+	for i, data := range list {
+		prev, err := store.Load(data.Mailbox)
+		if err != nil {
+			return nil, err
+		}
+		j := job{name: data.Mailbox, tier: 2}
+		switch FolderRole(data) {
+		case RoleInbox:
+			j.tier = 0
+		case RoleTrash, RoleJunk, RoleAll:
+			j.tier = 3
+		}
+		if prev != nil && j.tier == 2 && !prev.ChangedAt.IsZero() {
+			j.tier, j.changed = 1, prev.ChangedAt
+		}
+		jobs[i] = j
+	}
+	slices.SortStableFunc(jobs, func(a, b job) int {
+		return cmp.Or(cmp.Compare(a.tier, b.tier), b.changed.Compare(a.changed))
+	})
+	names := make([]string, len(jobs))
+	for i, j := range jobs {
+		names[i] = j.name
+	}
+	return names, nil
+}
+
+// listFolders returns the selectable folders, or those of only that
+// exist.
+func listFolders(c *imapclient.Client, only []string) ([]*imap.ListData, error) {
+	list, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		return nil, err
+	}
+	var folders []*imap.ListData
+	for _, data := range list {
+		if hasAttr(data.Attrs, imap.MailboxAttrNoSelect) || hasAttr(data.Attrs, imap.MailboxAttrNonExistent) {
+			continue
+		}
+		if len(only) > 0 && !slices.Contains(only, data.Mailbox) {
+			continue
+		}
+		folders = append(folders, data)
+	}
+	return folders, nil
+}
+
+func hasAttr(attrs []imap.MailboxAttr, attr imap.MailboxAttr) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(string(a), string(attr)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1026 @@
+package mailsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/batch"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+	"github.com/quzhi1/imap-playground/internal/session"
+)
+
+// recorder is a Handler that keeps the UIDs it was told about per folder.
+type recorder struct {
+	mu     sync.Mutex
+	uids   map[string][]imap.UID
+	flags  map[imap.UID][]imap.Flag
+	resets []string
+}
+
+func newRecorder() *recorder {
+	return &recorder{uids: map[string][]imap.UID{}, flags: map[imap.UID][]imap.Flag{}}
+}
+
+func (r *recorder) Reset(folder string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resets = append(r.resets, folder)
+	delete(r.uids, folder)
+	return nil
+}
+
+func (r *recorder) Message(folder string, msg *imapclient.FetchMessageBuffer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if msg.Envelope == nil {
+		return fmt.Errorf("UID %d: no envelope", msg.UID)
+	}
+	if !slices.Contains(r.uids[folder], msg.UID) {
+		r.uids[folder] = append(r.uids[folder], msg.UID)
+	}
+	return nil
+}
+
+func (r *recorder) Expunged(folder string, uids []imap.UID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uids[folder] = slices.DeleteFunc(r.uids[folder], func(uid imap.UID) bool {
+		return slices.Contains(uids, uid)
+	})
+	return nil
+}
+
+func (r *recorder) Flags(folder string, uid imap.UID, flags []imap.Flag) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flags[uid] = flags
+	return nil
+}
+
+func appendN(t *testing.T, server *fakeserver.Server, folder string, n int) {
+	t.Helper()
+	date := time.Date(2024, 4, 2, 16, 12, 40, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		raw := fmt.Sprintf("From: sender@example.com\r\nSubject: %s %d\r\n\r\nBody\r\n", folder, i)
+		if _, err := server.Append(folder, []byte(raw), nil, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expunge(t *testing.T, server *fakeserver.Server, folder string, uids ...imap.UID) {
+	t.Helper()
+	store(t, server, folder, imap.FlagDeleted, uids...)
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(folder, nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expunge().Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func store(t *testing.T, server *fakeserver.Server, folder string, flag imap.Flag, uids ...imap.UID) {
+	t.Helper()
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Logout() //nolint:errcheck
+	if _, err := c.Select(folder, nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(imap.UIDSetNum(uids...), &imap.StoreFlags{Op: imap.StoreFlagsAdd, Flags: []imap.Flag{flag}, Silent: true}, nil).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func results(report *Report) map[string]FolderResult {
+	m := make(map[string]FolderResult)
+	for _, r := range report.Folders {
+		r.UIDValidity = 0
+		r.CondStore = false
+		m[r.Folder] = r
+	}
+	return m
+}
+
+func TestSync(t *testing.T) {
+	for _, condStore := range []bool{false, true} {
+		t.Run(fmt.Sprintf("condstore=%v", condStore), func(t *testing.T) {
+			testSync(t, &fakeserver.Options{CondStore: condStore})
+		})
+	}
+}
+
+func testSync(t *testing.T, serverOpts *fakeserver.Options) {
+	server, err := fakeserver.Start(serverOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for _, name := range []string{"Archive", "Old"} {
+		if err := server.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendN(t, server, "INBOX", 5)
+	appendN(t, server, "Archive", 2)
+	appendN(t, server, "Old", 1)
+
+	ctx := context.Background()
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newRecorder()
+	run := func() *Report {
+		t.Helper()
+		report, err := Sync(ctx, server.Config().Dial, store, handler, &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Failed) != 0 {
+			t.Fatalf("failed: %v", report.Failed)
+		}
+		return report
+	}
+	check := func(step string, got, want map[string]FolderResult) {
+		t.Helper()
+		for name, w := range want {
+			w.Folder = name
+			if got[name] != w {
+				t.Errorf("%s: %s = %+v, want %+v", step, name, got[name], w)
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: synced %d folders, want %d", step, len(got), len(want))
+		}
+	}
+
+	check("first sync", results(run()), map[string]FolderResult{
+		"INBOX":   {Full: true, New: 5},
+		"Archive": {Full: true, New: 2},
+		"Old":     {Full: true, New: 1},
+	})
+	check("no changes", results(run()), map[string]FolderResult{
+		"INBOX":   {Unchanged: true},
+		"Archive": {Unchanged: true},
+		"Old":     {Unchanged: true},
+	})
+
+	// New mail only: found above UIDNEXT, no full listing.
+	appendN(t, server, "INBOX", 2)
+	check("new mail", results(run()), map[string]FolderResult{
+		"INBOX":   {New: 2},
+		"Archive": {Unchanged: true},
+		"Old":     {Unchanged: true},
+	})
+	// New mail and expunges together.
+	appendN(t, server, "INBOX", 1)
+	expunge(t, server, "INBOX", 2, 6)
+	// Recreating a folder changes its UIDVALIDITY.
+	if err := server.Delete("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Create("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, server, "Archive", 3)
+	if err := server.Delete("Old"); err != nil {
+		t.Fatal(err)
+	}
+	report := run()
+	check("changes", results(report), map[string]FolderResult{
+		"INBOX":   {New: 1, Expunged: 2},
+		"Archive": {Full: true, Reset: true, New: 3},
+	})
+	if !slices.Equal(report.Removed, []string{"Old"}) {
+		t.Errorf("removed = %v", report.Removed)
+	}
+	if !slices.Equal(handler.resets, []string{"Old", "Archive"}) {
+		t.Errorf("resets = %v", handler.resets)
+	}
+
+	// Expunging everything.
+	expunge(t, server, "Archive", 1, 2, 3)
+	check("emptied", results(run()), map[string]FolderResult{
+		"INBOX":   {Unchanged: true},
+		"Archive": {Expunged: 3},
+	})
+
+	want := map[string][]imap.UID{"INBOX": {1, 3, 4, 5, 7, 8}}
+	for folder, uids := range want {
+		got := slices.Clone(handler.uids[folder])
+		slices.Sort(got)
+		if !slices.Equal(got, uids) {
+			t.Errorf("handler has %s %v, want %v", folder, got, uids)
+		}
+		state, err := store.Load(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(state.UIDs, uids) || state.UIDNext != 9 {
+			t.Errorf("state of %s = %v next %d, want %v next 9", folder, state.UIDs, state.UIDNext, uids)
+		}
+	}
+	if folders, _ := store.Folders(); !slices.Equal(folders, []string{"Archive", "INBOX"}) {
+		t.Errorf("stored folders = %v", folders)
+	}
+}
+
+func TestSyncFailedFolder(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	appendN(t, server, "INBOX", 1)
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Sync(context.Background(), server.Config().Dial, store, newRecorder(), &Options{Folders: []string{"INBOX", "Missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Folders) != 1 || report.Folders[0].New != 1 {
+		t.Errorf("folders = %+v", report.Folders)
+	}
+	if report.Failed["Missing"] != "no such folder" {
+		t.Errorf("failed = %v", report.Failed)
+	}
+
+	// A handler error leaves the state as it was.
+	failing := &failHandler{newRecorder()}
+	appendN(t, server, "INBOX", 1)
+	report, err = Sync(context.Background(), server.Config().Dial, store, failing, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := report.Failed["INBOX"]; !ok {
+		t.Fatalf("failed = %v", report.Failed)
+	}
+	state, err := store.Load("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(state.UIDs, []imap.UID{1}) {
+		t.Errorf("state after failure = %v", state.UIDs)
+	}
+}
+
+func TestSyncFlags(t *testing.T) {
+	for _, condStore := range []bool{false, true} {
+		t.Run(fmt.Sprintf("condstore=%v", condStore), func(t *testing.T) {
+			server, err := fakeserver.Start(&fakeserver.Options{CondStore: condStore})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			appendN(t, server, "INBOX", 10)
+			st, err := OpenStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := newRecorder()
+			opts := &Options{Flags: true}
+			run := func() FolderResult {
+				t.Helper()
+				report, err := Sync(context.Background(), server.Config().Dial, st, handler, opts)
+				if err != nil || len(report.Failed) != 0 || len(report.Folders) != 1 {
+					t.Fatalf("sync: %v %+v", err, report)
+				}
+				res := report.Folders[0]
+				if res.CondStore != condStore {
+					t.Errorf("condstore = %v", res.CondStore)
+				}
+				return res
+			}
+			run()
+
+			store(t, server, "INBOX", imap.FlagFlagged, 3, 8)
+			appendN(t, server, "INBOX", 1)
+			res := run()
+			wantFlags := 10
+			if condStore {
+				wantFlags = 2
+			}
+			if res.New != 1 || res.FlagsChanged != wantFlags {
+				t.Errorf("after change: %+v, want 1 new and %d flag updates", res, wantFlags)
+			}
+			for _, uid := range []imap.UID{3, 8} {
+				if !slices.Contains(handler.flags[uid], imap.FlagFlagged) {
+					t.Errorf("UID %d flags = %v", uid, handler.flags[uid])
+				}
+			}
+
+			// Without CONDSTORE every flag is fetched on every run.
+			res = run()
+			if condStore && (!res.Unchanged || res.FlagsChanged != 0) {
+				t.Errorf("no change: %+v", res)
+			}
+			if !condStore && (res.Unchanged || res.FlagsChanged != 11) {
+				t.Errorf("no change: %+v", res)
+			}
+			state, err := st.Load("INBOX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (state.HighestModSeq != 0) != condStore {
+				t.Errorf("HIGHESTMODSEQ = %d", state.HighestModSeq)
+			}
+
+			// NoCondStore falls back to fetching every flag.
+			if condStore {
+				opts.NoCondStore = true
+				report, err := Sync(context.Background(), server.Config().Dial, st, handler, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res := report.Folders[0]; res.CondStore || res.FlagsChanged != 11 {
+					t.Errorf("NoCondStore: %+v", res)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncConcurrent(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	folders := []string{"INBOX", "A", "B", "C", "D", "E"}
+	for i, name := range folders {
+		if name != "INBOX" {
+			if err := server.Create(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		appendN(t, server, name, i+1)
+	}
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newRecorder()
+	report, err := Sync(context.Background(), server.Config().Dial, store, handler, &Options{Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 || report.Connections != 3 {
+		t.Fatalf("failed = %v, connections = %d", report.Failed, report.Connections)
+	}
+	got := results(report)
+	for i, name := range folders {
+		if got[name].New != i+1 || len(handler.uids[name]) != i+1 {
+			t.Errorf("%s: %+v, handler has %v", name, got[name], handler.uids[name])
+		}
+	}
+	if len(report.Timings) != len(folders) {
+		t.Fatalf("timings = %+v", report.Timings)
+	}
+	for _, timing := range report.Timings {
+		if timing.Conn < 0 || timing.Conn > 2 || timing.Error != "" {
+			t.Errorf("timing = %+v", timing)
+		}
+	}
+	if report.Folders[0].Folder != "INBOX" {
+		t.Errorf("first folder = %s", report.Folders[0].Folder)
+	}
+
+	// Connections beyond the first that fail to open are skipped.
+	var dials atomic.Int32
+	dial := func() (*imapclient.Client, error) {
+		if dials.Add(1) > 1 {
+			return nil, fmt.Errorf("too many connections")
+		}
+		return server.Config().Dial()
+	}
+	appendN(t, server, "E", 1)
+	report, err = Sync(context.Background(), dial, store, handler, &Options{Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 0 || report.Connections != 1 || len(report.Folders) != len(folders) {
+		t.Errorf("with one connection: %+v", report)
+	}
+	if res := results(report)["E"]; res.New != 1 {
+		t.Errorf("E = %+v", res)
+	}
+}
+
+func TestSyncSchedule(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for _, name := range []string{"Trash", "Archive", "Junk", "Work", "Zeta"} {
+		if err := server.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		appendN(t, server, name, 1)
+	}
+	appendN(t, server, "INBOX", 1)
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := func() []string {
+		t.Helper()
+		report, err := Sync(context.Background(), server.Config().Dial, store, newRecorder(), nil)
+		if err != nil || len(report.Failed) != 0 {
+			t.Fatalf("sync: %v %+v", err, report)
+		}
+		var names []string
+		for _, timing := range report.Timings {
+			names = append(names, timing.Folder)
+		}
+		for i, res := range report.Folders {
+			if res.Folder != names[i] {
+				t.Errorf("folders not in schedule order: %+v", report.Folders)
+			}
+		}
+		return names
+	}
+	last := []string{"Junk", "Trash"}
+	got := order()
+	if got[0] != "INBOX" || !slices.Equal(got[4:], last) {
+		t.Errorf("first sync order = %v", got)
+	}
+	// A folder where the last sync found mail comes right after INBOX.
+	order()
+	appendN(t, server, "Archive", 1)
+	order()
+	if got := order(); got[0] != "INBOX" || got[1] != "Archive" || !slices.Equal(got[4:], last) {
+		t.Errorf("order after new mail = %v", got)
+	}
+}
+
+// deleter deletes a folder from the server once INBOX is synced, so that
+// the folder is listed but cannot be selected.
+type deleter struct {
+	*recorder
+	server *fakeserver.Server
+	folder string
+}
+
+func (d deleter) Message(folder string, msg *imapclient.FetchMessageBuffer) error {
+	if folder == "INBOX" {
+		if err := d.server.Delete(d.folder); err != nil {
+			return err
+		}
+	}
+	return d.recorder.Message(folder, msg)
+}
+
+func TestSyncSelectFails(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for _, name := range []string{"Doomed", "Kept"} {
+		if err := server.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		appendN(t, server, name, 2)
+	}
+	appendN(t, server, "INBOX", 1)
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Sync(context.Background(), server.Config().Dial, store, deleter{newRecorder(), server, "Doomed"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed) != 1 || !strings.HasPrefix(report.Failed["Doomed"], "select:") {
+		t.Errorf("failed = %v", report.Failed)
+	}
+	got := results(report)
+	if got["INBOX"].New != 1 || got["Kept"].New != 2 {
+		t.Errorf("folders = %+v", report.Folders)
+	}
+	var timing FolderTiming
+	for _, timing = range report.Timings {
+		if timing.Folder == "Doomed" {
+			break
+		}
+	}
+	if timing.Folder != "Doomed" || timing.Error == "" {
+		t.Errorf("timings = %+v", report.Timings)
+	}
+	if state, _ := store.Load("Doomed"); state != nil {
+		t.Errorf("failed folder saved state %+v", state)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	valid := &Policy{
+		Rule:    Rule{Window: &Window{Days: 90}, MaxSize: 1 << 20},
+		Include: []string{"*", "Work/*"},
+		Exclude: []string{"Notes"},
+		Roles: map[Role]Rule{
+			RoleJunk:  {Skip: true},
+			RoleTrash: {HeadersOnly: true, Window: &Window{Since: "2024-01-01", Search: SearchSince}},
+			RoleInbox: {Window: &Window{}},
+		},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("valid policy: %v", err)
+	}
+	if err := (*Policy)(nil).Validate(); err != nil {
+		t.Errorf("nil policy: %v", err)
+	}
+	invalid := &Policy{
+		Rule:    Rule{Skip: true, Window: &Window{Days: 7, Since: "2024-01-01", Search: "before"}, MaxSize: -1},
+		Exclude: []string{"[Gmail"},
+		Roles: map[Role]Rule{
+			"spam":    {Skip: true},
+			RoleTrash: {Window: &Window{Since: "01/02/2024"}},
+		},
+	}
+	err := invalid.Validate()
+	if err == nil {
+		t.Fatal("invalid policy passed")
+	}
+	for _, want := range []string{"skip is only allowed", "negative max_size", "both days and since", `search "before"`, `glob "[Gmail"`, `unknown role "spam"`, "trash: window since"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestPolicyFolder(t *testing.T) {
+	policy := &Policy{
+		Rule:    Rule{Window: &Window{Days: 30}, MaxSize: 1000},
+		Exclude: []string{"Archive/*"},
+		Roles: map[Role]Rule{
+			RoleJunk:  {Skip: true},
+			RoleTrash: {HeadersOnly: true, Window: &Window{Since: "2024-01-01", Search: SearchSince}},
+			RoleSent:  {Window: &Window{}, MaxSize: 5000},
+		},
+	}
+	now := time.Date(2024, 6, 15, 23, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		data *imap.ListData
+		want FolderPlan
+	}{
+		{&imap.ListData{Mailbox: "INBOX"}, FolderPlan{Role: RoleInbox, Search: "SENTSINCE", Since: "2024-05-16", MaxSize: 1000}},
+		{&imap.ListData{Mailbox: "Work", Delim: '/'}, FolderPlan{Search: "SENTSINCE", Since: "2024-05-16", MaxSize: 1000}},
+		{&imap.ListData{Mailbox: "Archive/2023", Delim: '/'}, FolderPlan{Skip: "excluded"}},
+		{&imap.ListData{Mailbox: "INBOX.Spam", Delim: '.'}, FolderPlan{Role: RoleJunk, Skip: "role junk"}},
+		{&imap.ListData{Mailbox: "Bin", Attrs: []imap.MailboxAttr{imap.MailboxAttrTrash}}, FolderPlan{Role: RoleTrash, HeadersOnly: true, Search: "SINCE", Since: "2024-01-01", MaxSize: 1000}},
+		{&imap.ListData{Mailbox: "Sent Items"}, FolderPlan{Role: RoleSent, MaxSize: 5000}},
+	} {
+		got := policy.Folder(tt.data, now)
+		tt.want.Folder = tt.data.Mailbox
+		got.key = ""
+		if *got != tt.want {
+			t.Errorf("%s: plan = %+v, want %+v", tt.data.Mailbox, *got, tt.want)
+		}
+	}
+
+	only := &Policy{Include: []string{"INBOX", "Work/*"}}
+	if plan := only.Folder(&imap.ListData{Mailbox: "Work/Reports"}, now); plan.Skip != "" {
+		t.Errorf("included folder skipped: %s", plan.Skip)
+	}
+	if plan := only.Folder(&imap.ListData{Mailbox: "Work"}, now); plan.Skip != "not included" {
+		t.Errorf("folder outside include = %q", plan.Skip)
+	}
+}
+
+// sections records which body section each message was fetched with.
+type sections struct {
+	*recorder
+	specifiers map[string][]imap.PartSpecifier
+}
+
+func (s *sections) Message(folder string, msg *imapclient.FetchMessageBuffer) error {
+	s.mu.Lock()
+	for section := range msg.BodySection {
+		s.specifiers[folder] = append(s.specifiers[folder], section.Specifier)
+	}
+	s.mu.Unlock()
+	return s.recorder.Message(folder, msg)
+}
+
+func TestSyncPolicy(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for _, name := range []string{"Junk", "Trash", "Notes"} {
+		if err := server.Create(name); err != nil {
+			t.Fatal(err)
+		}
+		appendN(t, server, name, 2)
+	}
+	put := func(folder string, sent time.Time, size int) {
+		t.Helper()
+		raw := fmt.Sprintf("From: sender@example.com\r\nSubject: sent %s\r\nDate: %s\r\n\r\n%s\r\n",
+			sent.Format(time.DateOnly), sent.Format(time.RFC1123Z), strings.Repeat("x", size))
+		// INTERNALDATE is always recent, so only SENTSINCE tells these apart.
+		if _, err := server.Append(folder, []byte(raw), nil, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Date(2023, 12, 1, 9, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 3, 10, 9, 0, 0, 0, time.UTC)
+	put("INBOX", old, 10)      // 1: before the window
+	put("INBOX", recent, 10)   // 2
+	put("INBOX", recent, 5000) // 3: too large
+	put("INBOX", recent, 10)   // 4
+
+	policy := &Policy{
+		Rule:    Rule{Window: &Window{Since: "2024-03-01"}, MaxSize: 1000},
+		Exclude: []string{"Notes"},
+		Roles: map[Role]Rule{
+			RoleJunk:  {Skip: true},
+			RoleTrash: {HeadersOnly: true, Window: &Window{}},
+		},
+	}
+	opts := &Options{Policy: policy, Fetch: &imap.FetchOptions{Envelope: true, BodySection: []*imap.FetchItemBodySection{{Peek: true}}}}
+
+	plans, err := Plan(context.Background(), server.Config().Dial, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	planned := map[string]string{}
+	for _, plan := range plans {
+		planned[plan.Folder] = fmt.Sprintf("%d/%d %s", plan.Matching, plan.Messages, plan.Skip)
+	}
+	if want := map[string]string{"INBOX": "2/4 ", "Trash": "2/2 ", "Junk": "0/0 role junk", "Notes": "0/0 excluded"}; !maps.Equal(planned, want) {
+		t.Errorf("plan = %v, want %v", planned, want)
+	}
+
+	st, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &sections{newRecorder(), map[string][]imap.PartSpecifier{}}
+	run := func() *Report {
+		t.Helper()
+		report, err := Sync(context.Background(), server.Config().Dial, st, handler, opts)
+		if err != nil || len(report.Failed) != 0 {
+			t.Fatalf("sync: %v %+v", err, report)
+		}
+		return report
+	}
+	report := run()
+	if want := map[string]string{"Junk": "role junk", "Notes": "excluded"}; !maps.Equal(report.Skipped, want) {
+		t.Errorf("skipped = %v", report.Skipped)
+	}
+	got := results(report)
+	if res := got["INBOX"]; res.New != 2 || res.Skipped != 2 {
+		t.Errorf("INBOX = %+v", res)
+	}
+	if uids := handler.uids["INBOX"]; !slices.Equal(uids, []imap.UID{2, 4}) {
+		t.Errorf("INBOX UIDs = %v", uids)
+	}
+	if specs := handler.specifiers["Trash"]; !slices.Equal(specs, []imap.PartSpecifier{imap.PartSpecifierHeader, imap.PartSpecifierHeader}) {
+		t.Errorf("Trash fetched with %v", specs)
+	}
+	if specs := handler.specifiers["INBOX"]; !slices.Equal(specs, []imap.PartSpecifier{imap.PartSpecifierNone, imap.PartSpecifierNone}) {
+		t.Errorf("INBOX fetched with %v", specs)
+	}
+
+	// Left-out messages count as seen: an old new message is left out too,
+	// and the next run finds nothing changed.
+	put("INBOX", old, 10)
+	put("INBOX", recent, 10)
+	if res := results(run())["INBOX"]; res.New != 1 || res.Skipped != 1 || res.Expunged != 0 {
+		t.Errorf("after new mail: %+v", res)
+	}
+	if res := results(run())["INBOX"]; !res.Unchanged {
+		t.Errorf("no change: %+v", res)
+	}
+	// Expunging a left-out message is not passed on.
+	expunge(t, server, "INBOX", 1)
+	if res := results(run())["INBOX"]; res.Expunged != 0 || res.New != 0 {
+		t.Errorf("after expunge: %+v", res)
+	}
+
+	// Lifting the size limit takes the large message it left out, and
+	// leaves out the old one again.
+	policy.MaxSize = 0
+	if res := results(run())["INBOX"]; res.New != 1 || res.Skipped != 1 {
+		t.Errorf("after widening: %+v", res)
+	}
+	state, err := st.Load("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(state.UIDs, []imap.UID{2, 3, 4, 6}) || !slices.Equal(state.Skipped, []imap.UID{5}) {
+		t.Errorf("state = %v skipped %v", state.UIDs, state.Skipped)
+	}
+}
+
+// canceler cancels the sync after n messages.
+type canceler struct {
+	*recorder
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *canceler) Message(folder string, msg *imapclient.FetchMessageBuffer) error {
+	if c.n--; c.n == 0 {
+		c.cancel()
+	}
+	return c.recorder.Message(folder, msg)
+}
+
+func TestSyncCheckpoint(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	appendN(t, server, "INBOX", 100)
+	st, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Batch: &batch.Options{ChunkSize: 10, InFlight: 1}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := &canceler{newRecorder(), 25, cancel}
+	if _, err := Sync(ctx, server.Config().Dial, st, first, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted sync: %v", err)
+	}
+	cp, err := st.LoadCheckpoint("INBOX")
+	if err != nil || cp == nil {
+		t.Fatalf("checkpoint: %v %v", cp, err)
+	}
+	// The chunk in flight when the sync was canceled may finish.
+	if cp.LastUID < 30 || cp.LastUID > 40 || cp.LastUID%10 != 0 || len(first.uids["INBOX"]) != int(cp.LastUID) {
+		t.Errorf("checkpoint at %d after %d messages", cp.LastUID, len(first.uids["INBOX"]))
+	}
+	if state, _ := st.Load("INBOX"); state != nil {
+		t.Errorf("interrupted sync saved state %+v", state)
+	}
+
+	second := newRecorder()
+	report, err := Sync(context.Background(), server.Config().Dial, st, second, opts)
+	if err != nil || len(report.Failed) != 0 {
+		t.Fatalf("resumed sync: %v %+v", err, report)
+	}
+	if res := report.Folders[0]; res.New != 100 || res.Resumed != int(cp.LastUID) {
+		t.Errorf("resumed = %+v", res)
+	}
+	got := second.uids["INBOX"]
+	if len(got) != 100-int(cp.LastUID) || got[0] != cp.LastUID+1 {
+		t.Errorf("resumed sync fetched %d messages from %v", len(got), got[:1])
+	}
+	state, err := st.Load("INBOX")
+	if err != nil || state == nil || len(state.UIDs) != 100 {
+		t.Fatalf("state after resume = %+v, %v", state, err)
+	}
+	if cp, _ := st.LoadCheckpoint("INBOX"); cp != nil {
+		t.Errorf("checkpoint left after the folder finished: %+v", cp)
+	}
+}
+
+func TestSyncCheckpointUIDValidity(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if err := server.Create("Big"); err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, server, "Big", 50)
+	st, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Folders: []string{"Big"}, Batch: &batch.Options{ChunkSize: 10, InFlight: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := &canceler{newRecorder(), 15, cancel}
+	if _, err := Sync(ctx, server.Config().Dial, st, handler, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted sync: %v", err)
+	}
+
+	// The folder is recreated before the next run: the messages the
+	// handler got name nothing now.
+	if err := server.Delete("Big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Create("Big"); err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, server, "Big", 5)
+	report, err := Sync(context.Background(), server.Config().Dial, st, handler.recorder, opts)
+	if err != nil || len(report.Failed) != 0 {
+		t.Fatalf("sync: %v %+v", err, report)
+	}
+	if res := report.Folders[0]; !res.Reset || res.Resumed != 0 || res.New != 5 {
+		t.Errorf("after UIDVALIDITY change = %+v", res)
+	}
+	if !slices.Equal(handler.resets, []string{"Big"}) || len(handler.uids["Big"]) != 5 {
+		t.Errorf("resets = %v, uids = %v", handler.resets, handler.uids["Big"])
+	}
+}
+
+// killChildEnv makes the test binary run TestSyncKilled's child: one sync
+// against the fake server at the address it holds.
+const killChildEnv = "MAILSYNC_KILL_CHILD"
+
+// killChild syncs into the state directory in $MAILSYNC_STATE and appends
+// a "folder uid" line per message to $MAILSYNC_LOG. It exits with 3 when
+// interrupted by SIGINT or SIGTERM.
+func killChild() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	st, err := OpenStore(os.Getenv("MAILSYNC_STATE"))
+	if err != nil {
+		panic(err)
+	}
+	logFile, err := os.OpenFile(os.Getenv("MAILSYNC_LOG"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		panic(err)
+	}
+	cfg := session.Config{Address: os.Getenv(killChildEnv), Username: fakeserver.Username, Password: fakeserver.Password, PlainText: true}
+	opts := &Options{Concurrency: 2, Batch: &batch.Options{ChunkSize: 20, InFlight: 1}}
+	_, err = Sync(ctx, cfg.Dial, st, &fileLog{logFile}, opts)
+	switch {
+	case errors.Is(err, context.Canceled):
+		os.Exit(3)
+	case err != nil:
+		panic(err)
+	}
+	os.Exit(0)
+}
+
+// fileLog is a slow Handler that writes every message straight to a file,
+// so that what it got survives the process being killed.
+type fileLog struct{ f *os.File }
+
+func (fileLog) Reset(string) error { return nil }
+
+func (l *fileLog) Message(folder string, msg *imapclient.FetchMessageBuffer) error {
+	time.Sleep(200 * time.Microsecond)
+	_, err := fmt.Fprintf(l.f, "%s %d\n", folder, msg.UID)
+	return err
+}
+
+func (fileLog) Expunged(string, []imap.UID) error { return nil }
+
+func (fileLog) Flags(string, imap.UID, []imap.Flag) error { return nil }
+
+func TestSyncKilled(t *testing.T) {
+	if os.Getenv(killChildEnv) != "" {
+		killChild()
+		return
+	}
+	if testing.Short() {
+		t.Skip("starts and kills many processes")
+	}
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	want := map[string]int{"INBOX": 300, "Archive": 200, "Sent": 100}
+	for name, n := range want {
+		if name != "INBOX" {
+			if err := server.Create(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		appendN(t, server, name, n)
+	}
+	dir := t.TempDir()
+	stateDir, logPath := filepath.Join(dir, "state"), filepath.Join(dir, "log")
+
+	seed := time.Now().UnixNano()
+	rng := rand.New(rand.NewSource(seed))
+	kills, terms := 0, 0
+	for run := 0; ; run++ {
+		if run == 60 {
+			t.Fatalf("sync did not finish in %d runs (seed %d)", run, seed)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSyncKilled$")
+		cmd.Env = append(os.Environ(), killChildEnv+"="+server.Addr, "MAILSYNC_STATE="+stateDir, "MAILSYNC_LOG="+logPath)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// Later runs are left alone, so that the sync always finishes.
+		if run < 20 {
+			time.AfterFunc(time.Duration(rng.Int63n(int64(80*time.Millisecond))), func() {
+				if run%3 == 2 {
+					cmd.Process.Signal(syscall.SIGTERM) //nolint:errcheck // it may have exited
+				} else {
+					cmd.Process.Kill() //nolint:errcheck // it may have exited
+				}
+			})
+		}
+		err := cmd.Wait()
+		var exit *exec.ExitError
+		switch {
+		case err == nil:
+		case errors.As(err, &exit) && exit.ExitCode() == 3:
+			terms++
+			continue
+		case errors.As(err, &exit) && !exit.Exited():
+			kills++
+			continue
+		default:
+			t.Fatalf("run %d: %v (seed %d)", run, err, seed)
+		}
+		break
+	}
+	t.Logf("finished after %d kills and %d clean interruptions (seed %d)", kills, terms, seed)
+
+	st, err := OpenStore(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		deliveries[line]++
+	}
+	total, lines := 0, strings.Count(string(b), "\n")
+	for name, n := range want {
+		total += n
+		state, err := st.Load(name)
+		if err != nil || state == nil || len(state.UIDs) != n || state.UIDs[n-1] != imap.UID(n) {
+			t.Errorf("%s: state %v, %v", name, state, err)
+		}
+		if cp, _ := st.LoadCheckpoint(name); cp != nil {
+			t.Errorf("%s: checkpoint left: %+v", name, cp)
+		}
+		for uid := 1; uid <= n; uid++ {
+			if deliveries[fmt.Sprintf("%s %d", name, uid)] == 0 {
+				t.Errorf("%s UID %d never reached the handler", name, uid)
+			}
+		}
+	}
+	// Each interruption refetches at most the chunk each connection was
+	// in the middle of.
+	if extra, most := lines-total, (kills+terms)*2*20; extra > most {
+		t.Errorf("%d messages fetched again after %d interruptions, want at most %d", extra, kills+terms, most)
+	}
+}
+
+type failHandler struct{ *recorder }
+
+func (failHandler) Message(string, *imapclient.FetchMessageBuffer) error {
+	return fmt.Errorf("disk full")
+}
+
+func TestStore(t *testing.T) {
+	store, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &FolderState{Folder: "Work/Reports 2024", UIDValidity: 7, UIDNext: 12, UIDs: UIDList{1, 2, 3, 4, 7, 9, 10, 11}}
+	if err := store.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load("Work/Reports 2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || !slices.Equal(got.UIDs, state.UIDs) || got.UIDNext != 12 || got.UIDValidity != 7 {
+		t.Errorf("loaded %+v, want %+v", got, state)
+	}
+	if folders, _ := store.Folders(); !slices.Equal(folders, []string{"Work/Reports 2024"}) {
+		t.Errorf("folders = %v", folders)
+	}
+	if got, _ := store.Load("INBOX"); got != nil {
+		t.Errorf("unknown folder loaded %+v", got)
+	}
+}
@@ -0,0 +1,101 @@
+package mbox
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/batch"
+)
+
+// exportChunkSize keeps each FETCH of whole messages small, since batch
+// buffers a whole chunk.
+const exportChunkSize = 50
+
+var exportFetchOptions = &imap.FetchOptions{
+	UID:          true,
+	Flags:        true,
+	InternalDate: true,
+	Envelope:     true,
+	BodySection:  []*imap.FetchItemBodySection{{Peek: true}},
+}
+
+// ExportOptions tunes Export.
+type ExportOptions struct {
+	// Criteria selects the messages to export. Nil exports all of them.
+	Criteria *imap.SearchCriteria
+	// Batch tunes the fetch. Its ChunkSize defaults to 50 and messages are
+	// always written in UID order.
+	Batch *batch.Options
+	// Progress, if set, is called after every message with the number
+	// written and the number found by the search.
+	Progress func(done, total int)
+}
+
+// Export writes the messages of folder to w in UID order and returns how
+// many it wrote. The folder is selected read-only, so no \Seen flag is set.
+// w is not flushed.
+func Export(ctx context.Context, c *imapclient.Client, folder string, w *Writer, opts *ExportOptions) (int, error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	if _, err := c.Select(folder, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return 0, fmt.Errorf("select: %w", err)
+	}
+	criteria := opts.Criteria
+	if criteria == nil {
+		criteria = &imap.SearchCriteria{}
+	}
+	data, err := c.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return 0, fmt.Errorf("search: %w", err)
+	}
+	uids := data.AllUIDs()
+	slices.Sort(uids)
+
+	batchOpts := batch.Options{ChunkSize: exportChunkSize}
+	if opts.Batch != nil {
+		batchOpts = *opts.Batch
+	}
+	batchOpts.Ordered = true
+	n := 0
+	err = batch.Fetch(ctx, c, uids, exportFetchOptions, &batchOpts, func(msg *imapclient.FetchMessageBuffer) error {
+		var raw []byte
+		for section, body := range msg.BodySection {
+			if section.Specifier == imap.PartSpecifierNone && len(section.Part) == 0 {
+				raw = body
+			}
+		}
+		if raw == nil {
+			return fmt.Errorf("UID %d: no body in FETCH response", msg.UID)
+		}
+		if err := w.Write(&Message{Sender: sender(msg.Envelope), Date: msg.InternalDate, Flags: msg.Flags, Raw: raw}); err != nil {
+			return err
+		}
+		n++
+		if opts.Progress != nil {
+			opts.Progress(n, len(uids))
+		}
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("fetch: %w", err)
+	}
+	return n, nil
+}
+
+// sender is the Sender or else the first From address of env, or "" without
+// one.
+func sender(env *imap.Envelope) string {
+	if env == nil {
+		return ""
+	}
+	for _, addr := range slices.Concat(env.Sender, env.From) {
+		if addr.Mailbox != "" && addr.Host != "" {
+			return addr.Addr()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+package mbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// CheckpointVersion is the version of the checkpoint file format.
+const CheckpointVersion = 1
+
+// Checkpoint records how far an import got. It is saved after every APPEND,
+// so an import that is stopped, or crashes, continues with the next
+// message. A crash between an APPEND and the save imports that one message
+// twice.
+type Checkpoint struct {
+	Version int    `json:"version"`
+	Folder  string `json:"folder"`
+	// Offset is where the next message starts in the mbox file.
+	Offset int64 `json:"offset"`
+	// Imported counts the messages appended so far, over all runs.
+	Imported int `json:"imported"`
+}
+
+// ImportOptions tunes Import.
+type ImportOptions struct {
+	// Checkpoint is the path of a checkpoint file. When it exists the
+	// import resumes from it; it is written as the import goes. Empty
+	// means no resume.
+	Checkpoint string
+	// Create creates the folder if it does not exist.
+	Create bool
+	// Progress, if set, is called after every message.
+	Progress func(Progress)
+}
+
+// Progress reports how far an import is.
+type Progress struct {
+	// Imported counts the messages appended, including those of earlier
+	// runs.
+	Imported int
+	// Offset is how far into the file the import is, out of Size bytes.
+	Offset int64
+	Size   int64
+}
+
+// ImportResult is the outcome of Import.
+type ImportResult struct {
+	// Imported is the number of messages this run appended, Resumed the
+	// number earlier runs had.
+	Imported int `json:"imported"`
+	Resumed  int `json:"resumed"`
+}
+
+// Import appends the messages of the mbox file f to folder, with their
+// flags and with the From line's date as INTERNALDATE. When the context is
+// cancelled it stops between two messages and returns the context's error;
+// with a checkpoint, the next call picks up from there.
+func Import(ctx context.Context, c *imapclient.Client, folder string, f io.ReadSeeker, opts *ImportOptions) (*ImportResult, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	cp := &Checkpoint{Folder: folder}
+	if opts.Checkpoint != "" {
+		saved, err := LoadCheckpoint(opts.Checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		if saved != nil {
+			if saved.Folder != folder {
+				return nil, fmt.Errorf("mbox: checkpoint %s is for folder %q, not %q", opts.Checkpoint, saved.Folder, folder)
+			}
+			cp = saved
+		}
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Offset > size {
+		return nil, fmt.Errorf("mbox: checkpoint offset %d is past the end of the file (%d bytes)", cp.Offset, size)
+	}
+	if _, err := f.Seek(cp.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if opts.Create {
+		if err := create(c, folder); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &ImportResult{Resumed: cp.Imported}
+	r := NewReader(f, cp.Offset)
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		msg, err := r.Next()
+		if err == io.EOF {
+			return res, nil
+		} else if err != nil {
+			return res, err
+		}
+		if err := appendMessage(c, folder, msg); err != nil {
+			return res, fmt.Errorf("append message %d: %w", cp.Imported+1, err)
+		}
+		res.Imported++
+		cp.Imported++
+		cp.Offset = r.Offset()
+		if opts.Checkpoint != "" {
+			if err := SaveCheckpoint(opts.Checkpoint, cp); err != nil {
+				return res, err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(Progress{Imported: cp.Imported, Offset: cp.Offset, Size: size})
+		}
+	}
+}
+
+func appendMessage(c *imapclient.Client, folder string, msg *Message) error {
+	// \Recent can only be set by the server.
+	flags := slices.DeleteFunc(slices.Clone(msg.Flags), func(f imap.Flag) bool { return f == "\\Recent" })
+	cmd := c.Append(folder, int64(len(msg.Raw)), &imap.AppendOptions{Flags: flags, Time: msg.Date})
+	if _, err := cmd.Write(msg.Raw); err != nil {
+		cmd.Close()
+		return err
+	}
+	if err := cmd.Close(); err != nil {
+		return err
+	}
+	_, err := cmd.Wait()
+	return err
+}
+
+// create creates folder unless it exists.
+func create(c *imapclient.Client, folder string) error {
+	list, err := c.List("", folder, nil).Collect()
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	if len(list) > 0 {
+		return nil
+	}
+	if err := c.Create(folder, nil).Wait(); err != nil {
+		return fmt.Errorf("create %s: %w", folder, err)
+	}
+	return nil
+}
+
+// LoadCheckpoint reads a checkpoint file. It returns nil when there is none.
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("mbox: checkpoint %s: %w", path, err)
+	}
+	if cp.Version != CheckpointVersion {
+		return nil, fmt.Errorf("mbox: checkpoint %s has version %d, want %d", path, cp.Version, CheckpointVersion)
+	}
+	return &cp, nil
+}
+
+// SaveCheckpoint writes cp to path atomically: a crash leaves either the
+// old or the new checkpoint.
+func SaveCheckpoint(path string, cp *Checkpoint) error {
+	cp.Version = CheckpointVersion
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone after the rename
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,351 @@
+// Package mbox reads and writes mboxrd files and moves folders between an
+// IMAP account and such files. Messages are stored with LF line endings
+// after a "From sender date" line; body lines that start with "From ",
+// after any number of '>', get one more '>' so that they cannot be taken
+// for the next message, and the reader takes it off again. IMAP flags are
+// kept in the Status, X-Status and X-Keywords headers that mutt and
+// Dovecot use, and INTERNALDATE in the From line.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// fromLineLayout is asctime, the date format of From lines. It has no zone,
+// so dates are written in UTC.
+const fromLineLayout = "Mon Jan _2 15:04:05 2006"
+
+// DefaultSender is written in the From line of messages without a sender.
+const DefaultSender = "MAILER-DAEMON"
+
+// Message is one message of an mbox file.
+type Message struct {
+	// Sender is the address in the From line.
+	Sender string
+	// Date is the date in the From line, the message's INTERNALDATE. It
+	// is zero when the From line has none that can be parsed.
+	Date time.Time
+	// Flags come from the Status, X-Status and X-Keywords headers, which
+	// are not part of Raw.
+	Flags []imap.Flag
+	// Raw is the message with CRLF line endings, as IMAP has it.
+	Raw []byte
+}
+
+// statusLetters map the system flags to their letters in the Status and
+// X-Status headers. \Seen is "R" in Status; "O" only marks the message as
+// no longer new.
+var statusLetters = []struct {
+	flag   imap.Flag
+	header string
+	letter byte
+}{
+	{imap.FlagSeen, "Status", 'R'},
+	{imap.FlagAnswered, "X-Status", 'A'},
+	{imap.FlagFlagged, "X-Status", 'F'},
+	{imap.FlagDraft, "X-Status", 'T'},
+	{imap.FlagDeleted, "X-Status", 'D'},
+}
+
+// flagHeaders are the headers Writer adds and Reader strips.
+var flagHeaders = []string{"Status", "X-Status", "X-Keywords"}
+
+// Writer writes messages to an mboxrd file.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a Writer that writes to w. Call Flush when done.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write appends msg. Any Status, X-Status or X-Keywords header in msg.Raw is
+// replaced by ones made from msg.Flags.
+func (w *Writer) Write(msg *Message) error {
+	sender := msg.Sender
+	if sender == "" || strings.ContainsAny(sender, " \t\r\n") {
+		sender = DefaultSender
+	}
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Unix(0, 0)
+	}
+	fmt.Fprintf(w.w, "From %s %s\n", sender, date.UTC().Format(fromLineLayout))
+
+	header, body := splitHeader(msg.Raw)
+	for _, line := range stripHeaders(lines(header), flagHeaders) {
+		w.line(line)
+	}
+	for _, line := range flagLines(msg.Flags) {
+		w.line(line)
+	}
+	if header != nil {
+		w.w.WriteByte('\n')
+	}
+	for _, line := range lines(body) {
+		w.line(line)
+	}
+	// The blank line that ends every message.
+	return w.w.WriteByte('\n')
+}
+
+// line writes one line, escaping it when it looks like a From line.
+func (w *Writer) line(line []byte) {
+	if isFromLine(line, true) {
+		w.w.WriteByte('>')
+	}
+	w.w.Write(line)
+	w.w.WriteByte('\n')
+}
+
+// Flush writes any buffered data.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// isFromLine reports whether line starts with "From ", or with '>'
+// followed by "From " when quoted is true.
+func isFromLine(line []byte, quoted bool) bool {
+	if quoted {
+		line = bytes.TrimLeft(line, ">")
+	}
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// flagLines returns the Status, X-Status and X-Keywords lines for flags.
+func flagLines(flags []imap.Flag) [][]byte {
+	has := func(flag imap.Flag) bool {
+		return slices.ContainsFunc(flags, func(f imap.Flag) bool { return strings.EqualFold(string(f), string(flag)) })
+	}
+	status, xstatus := []byte{}, []byte{}
+	for _, s := range statusLetters {
+		if !has(s.flag) {
+			continue
+		}
+		if s.header == "Status" {
+			status = append(status, s.letter)
+		} else {
+			xstatus = append(xstatus, s.letter)
+		}
+	}
+	// Without "O" mutt lists the message as new, which IMAP has no flag
+	// for once the message is no longer \Recent.
+	status = append(status, 'O')
+	out := [][]byte{[]byte("Status: " + string(status))}
+	if len(xstatus) > 0 {
+		out = append(out, []byte("X-Status: "+string(xstatus)))
+	}
+	var keywords []string
+	for _, f := range flags {
+		if !strings.HasPrefix(string(f), `\`) {
+			keywords = append(keywords, string(f))
+		}
+	}
+	if len(keywords) > 0 {
+		out = append(out, []byte("X-Keywords: "+strings.Join(keywords, " ")))
+	}
+	return out
+}
+
+// parseFlags reads flags back from the flag headers of header lines.
+func parseFlags(header [][]byte) []imap.Flag {
+	var flags []imap.Flag
+	for _, line := range header {
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		key := strings.TrimSpace(string(name))
+		switch {
+		case strings.EqualFold(key, "Status"), strings.EqualFold(key, "X-Status"):
+			for _, s := range statusLetters {
+				if strings.EqualFold(key, s.header) && bytes.IndexByte(value, s.letter) >= 0 && !slices.Contains(flags, s.flag) {
+					flags = append(flags, s.flag)
+				}
+			}
+		case strings.EqualFold(key, "X-Keywords"):
+			for _, kw := range strings.FieldsFunc(string(value), func(r rune) bool { return r == ' ' || r == ',' || r == '\t' }) {
+				if f := imap.Flag(kw); !slices.Contains(flags, f) {
+					flags = append(flags, f)
+				}
+			}
+		}
+	}
+	return flags
+}
+
+// splitHeader splits raw at the blank line after the header. header is nil
+// when there is none.
+func splitHeader(raw []byte) (header, body []byte) {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			return raw[:i+len(sep)/2], raw[i+len(sep):]
+		}
+	}
+	for _, sep := range []string{"\r\n", "\n"} {
+		if bytes.HasPrefix(raw, []byte(sep)) {
+			return raw[:0], raw[len(sep):]
+		}
+	}
+	return raw, nil
+}
+
+// lines splits b into lines without their CRLF or LF.
+func lines(b []byte) [][]byte {
+	if len(b) == 0 {
+		return nil
+	}
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	out := bytes.Split(b, []byte("\n"))
+	for i, line := range out {
+		out[i] = bytes.TrimSuffix(line, []byte("\r"))
+	}
+	return out
+}
+
+// stripHeaders drops the named fields, with their continuation lines, from
+// header lines.
+func stripHeaders(header [][]byte, names []string) [][]byte {
+	var out [][]byte
+	drop := false
+	for _, line := range header {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !drop {
+				out = append(out, line)
+			}
+			continue
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		drop = slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, strings.TrimSpace(string(name))) })
+		if !drop {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// ErrNotMbox is returned by Reader.Next when the data does not start with a
+// From line.
+var ErrNotMbox = errors.New("mbox: data does not start with a From line")
+
+// Reader reads messages from an mboxrd file. Files in the older mboxo
+// format read the same, except that a body line ">From " written by a
+// client that did not escape it loses its '>'.
+type Reader struct {
+	r      *bufio.Reader
+	offset int64
+	// from is the From line of the next message, already read.
+	from []byte
+	err  error
+}
+
+// NewReader returns a Reader that reads from r. offset is where r starts in
+// the file, so that Offset reports file positions; it must be 0 or the
+// start of a From line.
+func NewReader(r io.Reader, offset int64) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64*1024), offset: offset}
+}
+
+// Offset returns the file position of the next message's From line, or of
+// the end of the file after the last message. A Reader made with that
+// offset continues from there.
+func (r *Reader) Offset() int64 {
+	return r.offset - int64(len(r.from))
+}
+
+// readLine returns the next line with its line ending, or io.EOF.
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	r.offset += int64(len(line))
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return line, err
+}
+
+// Next returns the next message, or io.EOF after the last one.
+func (r *Reader) Next() (*Message, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.from == nil {
+		line, err := r.readLine()
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+		if !isFromLine(line, false) {
+			r.err = ErrNotMbox
+			return nil, r.err
+		}
+		r.from = line
+	}
+	msg := &Message{}
+	msg.Sender, msg.Date = parseFromLine(r.from)
+	r.from = nil
+
+	var body [][]byte
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			r.err = io.EOF
+			break
+		} else if err != nil {
+			r.err = err
+			return nil, err
+		}
+		if isFromLine(line, false) {
+			r.from = line
+			break
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		if len(line) > 0 && line[0] == '>' && isFromLine(line, true) {
+			line = line[1:]
+		}
+		body = append(body, line)
+	}
+	// Drop the blank line that ends the message.
+	if n := len(body); n > 0 && len(body[n-1]) == 0 {
+		body = body[:n-1]
+	}
+
+	end := slices.IndexFunc(body, func(line []byte) bool { return len(line) == 0 })
+	if end < 0 {
+		end = len(body)
+	}
+	msg.Flags = parseFlags(body[:end])
+	body = append(stripHeaders(body[:end], flagHeaders), body[end:]...)
+	var raw bytes.Buffer
+	for _, line := range body {
+		raw.Write(line)
+		raw.WriteString("\r\n")
+	}
+	msg.Raw = raw.Bytes()
+	return msg, nil
+}
+
+// parseFromLine returns the sender and date of a From line. Dates that are
+// not asctime, optionally with a zone before the year, are left zero.
+func parseFromLine(line []byte) (string, time.Time) {
+	fields := strings.Fields(strings.TrimPrefix(string(line), "From "))
+	if len(fields) == 0 {
+		return "", time.Time{}
+	}
+	rest := strings.Join(fields[1:], " ")
+	for _, layout := range []string{"Mon Jan 2 15:04:05 2006", "Mon Jan 2 15:04:05 -0700 2006", "Mon Jan 2 15:04:05 MST 2006"} {
+		if date, err := time.Parse(layout, rest); err == nil {
+			return fields[0], date
+		}
+	}
+	return fields[0], time.Time{}
+}
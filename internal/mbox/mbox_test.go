@@ -0,0 +1,379 @@
+package mbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/batch"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+)
+
+// tricky is a body with every kind of line that needs escaping.
+const tricky = "Hi,\r\n" +
+	"From here on it gets odd.\r\n" +
+	">From a quote\r\n" +
+	">>From a deeper quote\r\n" +
+	"From:not a From line\r\n" +
+	" From indented\r\n" +
+	"\r\n" +
+	"From \r\n"
+
+func TestWriteRead(t *testing.T) {
+	date := time.Date(2024, 4, 2, 16, 12, 40, 0, time.UTC)
+	msgs := []*Message{{
+		Sender: "alice@example.com",
+		Date:   date,
+		Flags:  []imap.Flag{imap.FlagSeen, imap.FlagFlagged, "$Label1"},
+		Raw:    []byte("From: alice@example.com\r\nSubject: tricky\r\n\r\n" + tricky),
+	}, {
+		Date: date.Add(time.Hour),
+		Raw:  []byte("Subject: trailing blank lines\r\nStatus: RO\r\nX-Status: F\r\n\tcontinued\r\n\r\nbody\r\n\r\n\r\n"),
+	}, {
+		Sender: "bob@example.com",
+		Date:   date.Add(2 * time.Hour),
+		Flags:  []imap.Flag{imap.FlagAnswered, imap.FlagDraft, imap.FlagDeleted},
+		Raw:    []byte("Subject: empty body\r\n\r\n"),
+	}}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, msg := range msgs {
+		if err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"From alice@example.com Tue Apr  2 16:12:40 2024\n",
+		"From MAILER-DAEMON Tue Apr  2 17:12:40 2024\n",
+		"\n>From here on it gets odd.\n>>From a quote\n>>>From a deeper quote\nFrom:not a From line\n From indented\n\n>From \n\n",
+		"Status: RO\nX-Status: F\nX-Keywords: $Label1\n\nHi,",
+		"Subject: trailing blank lines\nStatus: O\n\nbody\n\n\n\n",
+		"Status: O\nX-Status: ATD\n\n\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("mbox lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "\r") {
+		t.Error("mbox has CR line endings")
+	}
+
+	r := NewReader(strings.NewReader(out), 0)
+	for i, want := range msgs {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		wantSender := want.Sender
+		if wantSender == "" {
+			wantSender = DefaultSender
+		}
+		wantRaw := want.Raw
+		if i == 1 {
+			// The old flag headers are replaced by ones from Flags.
+			wantRaw = []byte("Subject: trailing blank lines\r\n\r\nbody\r\n\r\n\r\n")
+		}
+		if got.Sender != wantSender || !got.Date.Equal(want.Date) || string(got.Raw) != string(wantRaw) {
+			t.Errorf("message %d = %q %v %q, want %q %v %q", i, got.Sender, got.Date, got.Raw, wantSender, want.Date, wantRaw)
+		}
+		if !sameFlags(got.Flags, want.Flags) {
+			t.Errorf("message %d flags = %v, want %v", i, got.Flags, want.Flags)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after last message: %v", err)
+	}
+	if r.Offset() != int64(len(out)) {
+		t.Errorf("Offset = %d, want %d", r.Offset(), len(out))
+	}
+}
+
+func TestReadOffset(t *testing.T) {
+	data := "From a@example.com Tue Apr  2 16:12:40 2024\nSubject: 1\n\none\n\n" +
+		"From b@example.com Tue Apr  2 16:12:41 2024\nSubject: 2\n\ntwo\n\n"
+	r := NewReader(strings.NewReader(data), 0)
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	off := r.Offset()
+	if !strings.HasPrefix(data[off:], "From b@") {
+		t.Fatalf("Offset %d is not at the second From line", off)
+	}
+	r = NewReader(strings.NewReader(data[off:]), off)
+	msg, err := r.Next()
+	if err != nil || msg.Sender != "b@example.com" || string(msg.Raw) != "Subject: 2\r\n\r\ntwo\r\n" {
+		t.Fatalf("resumed read = %+v, %v", msg, err)
+	}
+
+	if _, err := NewReader(strings.NewReader("Subject: no From line\n"), 0).Next(); !errors.Is(err, ErrNotMbox) {
+		t.Errorf("not an mbox: %v", err)
+	}
+	if _, err := NewReader(strings.NewReader(""), 0).Next(); err != io.EOF {
+		t.Errorf("empty file: %v", err)
+	}
+}
+
+// sameFlags compares flags as IMAP does, ignoring case and order.
+func sameFlags(a, b []imap.Flag) bool {
+	norm := func(flags []imap.Flag) []string {
+		var out []string
+		for _, f := range flags {
+			out = append(out, strings.ToLower(string(f)))
+		}
+		slices.Sort(out)
+		return out
+	}
+	return slices.Equal(norm(a), norm(b))
+}
+
+type stored struct {
+	date  time.Time
+	flags []imap.Flag
+	raw   string
+}
+
+func seed(t *testing.T, server *fakeserver.Server) []stored {
+	t.Helper()
+	zone := time.FixedZone("", -7*3600)
+	var msgs []stored
+	for i := 0; i < 12; i++ {
+		var flags []imap.Flag
+		if i%2 == 0 {
+			flags = append(flags, imap.FlagSeen)
+		}
+		if i%3 == 0 {
+			flags = append(flags, imap.FlagFlagged, "$Work")
+		}
+		if i%5 == 0 {
+			flags = append(flags, imap.FlagAnswered)
+		}
+		body := fmt.Sprintf("Body %d\r\n", i)
+		if i%4 == 0 {
+			body += tricky
+		}
+		raw := fmt.Sprintf("From: sender%d@example.com\r\nTo: receiver@example.com\r\nSubject: Message %d\r\nMessage-ID: <mbox-%d@example.com>\r\n\r\n%s", i, i, i, body)
+		date := time.Date(2023, 10, 2, 10, 0, 0, 0, zone).Add(time.Duration(i) * 25 * time.Hour)
+		if _, err := server.Append("INBOX", []byte(raw), flags, date); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, stored{date, flags, raw})
+	}
+	return msgs
+}
+
+func dial(t *testing.T, server *fakeserver.Server) *imapclient.Client {
+	t.Helper()
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() }) //nolint:errcheck
+	return c
+}
+
+// fetchAll returns the messages of folder in UID order.
+func fetchAll(t *testing.T, c *imapclient.Client, folder string) []stored {
+	t.Helper()
+	if _, err := c.Select(folder, &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.UIDSearch(&imap.SearchCriteria{}, nil).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	uids := data.AllUIDs()
+	if len(uids) == 0 {
+		return nil
+	}
+	msgs, err := c.Fetch(imap.UIDSetNum(uids...), exportFetchOptions).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(msgs, func(a, b *imapclient.FetchMessageBuffer) int { return int(a.UID) - int(b.UID) })
+	var out []stored
+	for _, msg := range msgs {
+		var raw []byte
+		for _, body := range msg.BodySection {
+			raw = body
+		}
+		out = append(out, stored{msg.InternalDate, msg.Flags, string(raw)})
+	}
+	return out
+}
+
+func compare(t *testing.T, got, want []stored) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].raw != want[i].raw {
+			t.Errorf("message %d = %q, want %q", i, got[i].raw, want[i].raw)
+		}
+		if !got[i].date.Equal(want[i].date) {
+			t.Errorf("message %d date = %v, want %v", i, got[i].date, want[i].date)
+		}
+		if !sameFlags(got[i].flags, want[i].flags) {
+			t.Errorf("message %d flags = %v, want %v", i, got[i].flags, want[i].flags)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	want := seed(t, server)
+	c := dial(t, server)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "inbox.mbox")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	var progress []int
+	n, err := Export(ctx, c, "INBOX", w, &ExportOptions{
+		Batch:    &batchOpts,
+		Progress: func(done, total int) { progress = append(progress, done, total) },
+	})
+	if err != nil || n != len(want) {
+		t.Fatalf("Export = %d, %v", n, err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(progress) != 2*len(want) || progress[len(progress)-2] != len(want) || progress[len(progress)-1] != len(want) {
+		t.Errorf("progress = %v", progress)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Import(ctx, c, "Restored", f, &ImportOptions{Create: true})
+	f.Close()
+	if err != nil || res.Imported != len(want) {
+		t.Fatalf("Import = %+v, %v", res, err)
+	}
+	compare(t, fetchAll(t, c, "Restored"), want)
+	// Exporting read-only leaves \Seen alone.
+	compare(t, fetchAll(t, c, "INBOX"), want)
+}
+
+// batchOpts makes the export fetch several chunks.
+var batchOpts = batch.Options{ChunkSize: 5}
+
+func TestExportCriteria(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	all := seed(t, server)
+	c := dial(t, server)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	n, err := Export(context.Background(), c, "INBOX", w, &ExportOptions{
+		Criteria: &imap.SearchCriteria{Flag: []imap.Flag{imap.FlagFlagged}, NotFlag: []imap.Flag{imap.FlagSeen}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	var want []int
+	for i, msg := range all {
+		if slices.Contains(msg.flags, imap.FlagFlagged) && !slices.Contains(msg.flags, imap.FlagSeen) {
+			want = append(want, i)
+		}
+	}
+	if n != len(want) {
+		t.Fatalf("exported %d messages, want %d", n, len(want))
+	}
+	r := NewReader(&buf, 0)
+	for _, i := range want {
+		msg, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Raw) != all[i].raw {
+			t.Errorf("exported %q, want message %d", msg.Raw, i)
+		}
+	}
+}
+
+func TestImportResume(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	want := seed(t, server)
+	c := dial(t, server)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "inbox.mbox")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := NewWriter(f)
+	if _, err := Export(context.Background(), c, "INBOX", w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	checkpoint := filepath.Join(dir, "inbox.checkpoint")
+	imported := 0
+	for _, stopAt := range []int{3, 4, 9} {
+		ctx, cancel := context.WithCancel(context.Background())
+		res, err := Import(ctx, c, "Restored", f, &ImportOptions{
+			Checkpoint: checkpoint,
+			Create:     true,
+			Progress: func(p Progress) {
+				if p.Imported == stopAt {
+					cancel()
+				}
+			},
+		})
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("stopped import: %v", err)
+		}
+		if res.Resumed != imported || res.Resumed+res.Imported != stopAt {
+			t.Errorf("run stopped at %d = %+v", stopAt, res)
+		}
+		imported = stopAt
+	}
+	res, err := Import(context.Background(), c, "Restored", f, &ImportOptions{Checkpoint: checkpoint})
+	if err != nil || res.Resumed != 9 || res.Imported != len(want)-9 {
+		t.Fatalf("final run = %+v, %v", res, err)
+	}
+	// A finished import has nothing left to do.
+	res, err = Import(context.Background(), c, "Restored", f, &ImportOptions{Checkpoint: checkpoint})
+	if err != nil || res.Imported != 0 {
+		t.Fatalf("run after the end = %+v, %v", res, err)
+	}
+	compare(t, fetchAll(t, c, "Restored"), want)
+
+	if _, err := Import(context.Background(), c, "Other", f, &ImportOptions{Checkpoint: checkpoint}); err == nil {
+		t.Error("checkpoint of another folder was used")
+	}
+}
@@ -0,0 +1,42 @@
+package parser
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/calendar"
+	"github.com/quzhi1/imap-playground/internal/charset"
+)
+
+func isCalendarContentType(mediaType string) bool {
+	return mediaType == "text/calendar" || mediaType == "application/ics"
+}
+
+// parseCalendar reads a calendar part into msg.Calendars. The part is still
+// listed as an attachment, so the .ics can be saved as it came.
+func parseCalendar(header textproto.Header, decoded io.Reader, msg *Message, opts *Options, section, mediaType string, params map[string]string, problem func(format string, args ...any)) error {
+	raw, err := io.ReadAll(decoded)
+	if err != nil {
+		msg.warn("%s part: %v", mediaType, err)
+	}
+	text, _ := charset.Default.Decode(params["charset"], raw)
+	// Invitations often carry the same calendar twice, as the text/calendar
+	// alternative and as an invite.ics attachment.
+	sum := sha256.Sum256([]byte(strings.TrimSpace(text)))
+	duplicate := false
+	for _, other := range msg.Calendars {
+		duplicate = duplicate || other.sum == sum
+	}
+	if !duplicate {
+		cal, err := calendar.Parse(strings.NewReader(text))
+		if err != nil {
+			problem("%v", err)
+		} else {
+			msg.Calendars = append(msg.Calendars, &PartCalendar{Part: section, Calendar: *cal, sum: sum})
+		}
+	}
+	return attach(header, bytes.NewReader(raw), msg, opts, mediaType, false)
+}
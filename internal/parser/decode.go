@@ -0,0 +1,278 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"strings"
+)
+
+// sniffSize is how much of a part transferDecoder looks at to check the
+// declared Content-Transfer-Encoding against the bytes.
+const sniffSize = 4096
+
+// DecodeTransfer undoes a Content-Transfer-Encoding as forgivingly as Parse
+// does, for callers that fetch single sections (BODY[1.2]) instead of whole
+// messages. problem receives what had to be worked around; it may be nil.
+func DecodeTransfer(encoding, mediaType string, body io.Reader, problem func(format string, args ...any)) io.Reader {
+	if problem == nil {
+		problem = func(string, ...any) {}
+	}
+	return transferDecoder(encoding, strings.ToLower(mediaType), body, problem)
+}
+
+// transferDecoder returns a reader for the decoded body. It never fails:
+// unknown or wrong encodings and damaged data are decoded as well as they can
+// be and reported through problem.
+func transferDecoder(encoding, mediaType string, body io.Reader, problem func(format string, args ...any)) io.Reader {
+	br := bufio.NewReaderSize(body, sniffSize)
+	sniff, _ := br.Peek(sniffSize)
+
+	switch normalizeEncoding(encoding) {
+	case "quoted-printable":
+		return &qpReader{r: br, problem: problem}
+	case "base64":
+		if !looksLikeBase64(sniff) {
+			problem("Content-Transfer-Encoding is base64 but the content is not, reading it as-is")
+			return br
+		}
+		return &base64Reader{r: br, problem: problem}
+	case "7bit", "8bit", "binary":
+		// Some senders base64 the attachment and forget to say so.
+		if !strings.HasPrefix(mediaType, "text/") && looksLikeBase64Block(sniff) {
+			problem("Content-Transfer-Encoding is %q but the content is base64, decoding it", encoding)
+			return &base64Reader{r: br, problem: problem}
+		}
+		return br
+	default:
+		if looksLikeBase64Block(sniff) {
+			problem("unknown Content-Transfer-Encoding %q, content looks like base64", encoding)
+			return &base64Reader{r: br, problem: problem}
+		}
+		problem("unknown Content-Transfer-Encoding %q, reading part as-is", encoding)
+		return br
+	}
+}
+
+func normalizeEncoding(encoding string) string {
+	encoding = strings.ToLower(strings.Trim(strings.TrimSpace(encoding), `"'`))
+	switch encoding {
+	case "", "7-bit", "7 bit", "us-ascii":
+		return "7bit"
+	case "8-bit", "8 bit":
+		return "8bit"
+	case "quotedprintable", "quoted printable", "qp":
+		return "quoted-printable"
+	case "base-64", "b64":
+		return "base64"
+	}
+	return encoding
+}
+
+func isStdBase64Char(b byte) bool {
+	return b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/'
+}
+
+// isBase64Char also accepts the URL-safe alphabet.
+func isBase64Char(b byte) bool {
+	return isStdBase64Char(b) || b == '-' || b == '_'
+}
+
+// looksLikeBase64 reports whether sample is mostly base64. It is the check
+// for parts that claim to be base64, so it tolerates some garbage. Spaces
+// between two base64 characters count against it: wrapped base64 only has
+// whitespace at the ends of lines, prose has it between every word.
+func looksLikeBase64(sample []byte) bool {
+	invalid := 0
+	for i, b := range sample {
+		switch {
+		case isBase64Char(b), b == '=', b == '\r', b == '\n':
+		case b == ' ' || b == '\t':
+			if i > 0 && i+1 < len(sample) && isBase64Char(sample[i-1]) && isBase64Char(sample[i+1]) {
+				invalid++
+			}
+		default:
+			invalid++
+		}
+	}
+	return invalid*20 <= len(sample)
+}
+
+// looksLikeBase64Block is the strict check for parts that do not claim to be
+// base64: at least two lines, all of the same length (except the last) and
+// made only of base64 characters.
+func looksLikeBase64Block(sample []byte) bool {
+	lines := strings.Split(strings.ReplaceAll(string(sample), "\r\n", "\n"), "\n")
+	if len(lines) > 1 && len(sample) == sniffSize {
+		// The last line was cut off by the sample.
+		lines = lines[:len(lines)-1]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) < 2 || len(lines[0]) < 40 {
+		return false
+	}
+	for i, line := range lines {
+		if i < len(lines)-1 && len(line) != len(lines[0]) {
+			return false
+		}
+		for j := 0; j < len(line); j++ {
+			if !isStdBase64Char(line[j]) && line[j] != '=' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// base64Reader decodes base64 without stopping at the first bad byte.
+// Characters outside the alphabet are skipped, the URL-safe alphabet is
+// accepted, padding in the middle (concatenated blobs) restarts decoding, and
+// a truncated final quantum is decoded as far as it goes.
+type base64Reader struct {
+	r       io.Reader
+	problem func(format string, args ...any)
+
+	quantum [4]byte
+	n       int
+	out     []byte
+	in      [3 * 1024]byte
+	invalid int
+	err     error
+}
+
+func (d *base64Reader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 && d.err == nil {
+		n, err := d.r.Read(d.in[:])
+		for _, b := range d.in[:n] {
+			switch {
+			case isBase64Char(b):
+				if b == '-' {
+					b = '+'
+				} else if b == '_' {
+					b = '/'
+				}
+				d.quantum[d.n] = b
+				d.n++
+				if d.n == 4 {
+					d.flush()
+				}
+			case b == '=':
+				d.flush()
+			case b == '\r', b == '\n', b == ' ', b == '\t':
+			default:
+				d.invalid++
+			}
+		}
+		if err != nil {
+			if d.n == 1 {
+				d.problem("base64 data ends in the middle of a byte, the last bits are lost")
+			}
+			d.flush()
+			if d.invalid > 0 {
+				d.problem("skipped %d bytes that are not base64", d.invalid)
+			}
+			d.err = err
+		}
+	}
+	if len(d.out) > 0 {
+		n := copy(p, d.out)
+		d.out = d.out[n:]
+		return n, nil
+	}
+	return 0, d.err
+}
+
+func (d *base64Reader) flush() {
+	if d.n >= 2 {
+		var decoded [3]byte
+		n, _ := base64.RawStdEncoding.Decode(decoded[:], d.quantum[:d.n])
+		d.out = append(d.out, decoded[:n]...)
+	}
+	d.n = 0
+}
+
+// qpReader decodes quoted-printable. Escapes that are not valid ("=ZZ", a
+// lone "=") are kept as they are instead of failing the part, lower-case hex
+// is accepted, and soft line breaks may have trailing whitespace.
+type qpReader struct {
+	r       *bufio.Reader
+	problem func(format string, args ...any)
+
+	// carry is the start of an escape or soft line break cut off at the end
+	// of a line longer than the buffer, decoded with the rest of the line.
+	carry   []byte
+	out     []byte
+	invalid int
+	err     error
+}
+
+func (d *qpReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 && d.err == nil {
+		line, err := d.r.ReadSlice('\n')
+		if len(d.carry) > 0 {
+			line = append(d.carry, line...)
+		}
+		n := d.decodeLine(line, err == bufio.ErrBufferFull)
+		d.carry = append(d.carry[:0], line[len(line)-n:]...)
+		if err != nil && err != bufio.ErrBufferFull {
+			if d.invalid > 0 {
+				d.problem("kept %d invalid quoted-printable escapes as-is", d.invalid)
+			}
+			d.err = err
+		}
+	}
+	if len(d.out) > 0 {
+		n := copy(p, d.out)
+		d.out = d.out[n:]
+		return n, nil
+	}
+	return 0, d.err
+}
+
+// decodeLine decodes line into d.out. When the line goes on in the next
+// read (partial), an escape or soft line break cut off at its end is left
+// undecoded, and decodeLine returns how many bytes that is.
+func (d *qpReader) decodeLine(line []byte, partial bool) int {
+	d.out = d.out[:0]
+	for i := 0; i < len(line); i++ {
+		b := line[i]
+		if b != '=' {
+			d.out = append(d.out, b)
+			continue
+		}
+		rest := line[i+1:]
+		if len(rest) >= 2 && isHex(rest[0]) && isHex(rest[1]) {
+			d.out = append(d.out, unhex(rest[0])<<4|unhex(rest[1]))
+			i += 2
+			continue
+		}
+		if partial && (len(rest) < 2 || len(rest) < sniffSize && len(bytes.TrimRight(rest, " \t\r")) == 0) {
+			return len(line) - i
+		}
+		if strings.TrimRight(string(rest), " \t\r\n") == "" {
+			// Soft line break.
+			return 0
+		}
+		d.invalid++
+		d.out = append(d.out, b)
+	}
+	return 0
+}
+
+func isHex(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
+
+func unhex(b byte) byte {
+	switch {
+	case b >= '0' && b <= '9':
+		return b - '0'
+	case b >= 'a' && b <= 'f':
+		return b - 'a' + 10
+	default:
+		return b - 'A' + 10
+	}
+}
@@ -0,0 +1,283 @@
+package parser
+
+import (
+	"bytes"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/charset"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+)
+
+const maxFilenameBytes = 255
+
+// Filename returns the attachment name the sender meant. It looks at the
+// Content-Disposition filename first and the Content-Type name second, and
+// decodes RFC 2231 (including continuations) and RFC 2047 on the way. It
+// returns an empty string when neither header carries a name.
+func Filename(header textproto.Header) string {
+	if _, params := parseParams(header.Get("Content-Disposition")); params["filename"] != "" {
+		return params["filename"]
+	}
+	_, params := parseParams(header.Get("Content-Type"))
+	return params["name"]
+}
+
+// ResolveFilename returns a name that is safe to create on disk: the
+// sanitized Filename, or a name derived from the media type when the part has
+// none.
+func ResolveFilename(header textproto.Header, mediaType string) string {
+	if name := SanitizeFilename(Filename(header)); name != "" {
+		return name
+	}
+	return FallbackFilename(mediaType)
+}
+
+// SanitizeFilename turns name into a single path component that every common
+// filesystem accepts. It returns an empty string if nothing usable is left.
+func SanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+	// Senders sometimes include the path they attached the file from.
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.TrimSpace(name), ". ")
+	if name == "" {
+		return ""
+	}
+
+	base := strings.ToUpper(strings.TrimSuffix(name, path.Ext(name)))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL",
+		"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+		"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9":
+		name = "_" + name
+	}
+
+	if len(name) > maxFilenameBytes {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := name[:maxFilenameBytes-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name
+}
+
+// fallbackExtensions covers the types we see most, so the fallback name does
+// not depend on the mime.types file of the machine it runs on.
+var fallbackExtensions = map[string]string{
+	"application/pdf":             ".pdf",
+	"application/zip":             ".zip",
+	"application/msword":          ".doc",
+	"application/vnd.ms-excel":    ".xls",
+	"application/ms-tnef":         ".dat",
+	"application/octet-stream":    ".bin",
+	"application/pkcs7-mime":      ".p7m",
+	"application/pkcs7-signature": ".p7s",
+	"application/pgp-signature":   ".asc",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       ".xlsx",
+	"image/jpeg":     ".jpg",
+	"image/png":      ".png",
+	"image/gif":      ".gif",
+	"text/plain":     ".txt",
+	"text/html":      ".html",
+	"text/calendar":  ".ics",
+	"text/csv":       ".csv",
+	"message/rfc822": ".eml",
+}
+
+// FallbackFilename builds a name such as "attachment.pdf" for a part that
+// does not carry one.
+func FallbackFilename(mediaType string) string {
+	mediaType = strings.ToLower(mediaType)
+	ext, ok := fallbackExtensions[mediaType]
+	if !ok {
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			ext = exts[0]
+		} else {
+			ext = ".bin"
+		}
+	}
+	return "attachment" + ext
+}
+
+// parseParams parses a Content-Type or Content-Disposition value. Unlike
+// mime.ParseMediaType it never gives up: unquoted values with spaces,
+// unterminated quotes, RFC 2231 values in any charset and RFC 2047 words
+// (even inside quotes, which Outlook does) are all accepted. Parameter names
+// are lower-cased.
+func parseParams(value string) (string, map[string]string) {
+	segments := splitParams(value)
+	params := make(map[string]string)
+	if len(segments) == 0 {
+		return "", params
+	}
+	first := strings.ToLower(strings.TrimSpace(segments[0]))
+
+	type continuation struct {
+		index   int
+		value   string
+		encoded bool
+	}
+	continuations := make(map[string][]continuation)
+	for _, segment := range segments[1:] {
+		key, val, found := strings.Cut(segment, "=")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = unquote(strings.TrimSpace(val))
+
+		encoded := strings.HasSuffix(key, "*")
+		key = strings.TrimSuffix(key, "*")
+		name, indexStr, isContinuation := strings.Cut(key, "*")
+		if isContinuation {
+			index, err := strconv.Atoi(indexStr)
+			if err != nil {
+				continue
+			}
+			continuations[name] = append(continuations[name], continuation{index, val, encoded})
+			continue
+		}
+		if encoded {
+			params[name] = decode2231(val)
+		} else if _, ok := params[name]; !ok {
+			// Some senders put raw 8-bit names in the header.
+			params[name] = envelope.DecodeWords(convertCharset("", []byte(val)))
+		}
+	}
+
+	for name, parts := range continuations {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].index < parts[j].index })
+		// The charset only appears in the first segment, so percent-decode
+		// everything first and convert the bytes once.
+		var raw bytes.Buffer
+		charsetName := ""
+		for i, part := range parts {
+			v := part.value
+			if part.encoded {
+				if i == 0 {
+					if cs, rest, ok := cutCharset(v); ok {
+						charsetName, v = cs, rest
+					}
+				}
+				v = percentDecode(v)
+			}
+			raw.WriteString(v)
+		}
+		params[name] = envelope.DecodeWords(convertCharset(charsetName, raw.Bytes()))
+	}
+	return first, params
+}
+
+// splitParams splits on ';' outside of quotes. It works on bytes so raw
+// 8-bit names reach the charset detection intact.
+func splitParams(value string) []string {
+	var segments []string
+	var current strings.Builder
+	inQuotes, escaped := false, false
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		switch {
+		case escaped:
+			escaped = false
+		case b == '\\' && inQuotes:
+			escaped = true
+		case b == '"':
+			inQuotes = !inQuotes
+		case b == ';' && !inQuotes:
+			segments = append(segments, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteByte(b)
+	}
+	if s := current.String(); strings.TrimSpace(s) != "" || len(segments) == 0 {
+		segments = append(segments, s)
+	}
+	return segments
+}
+
+func unquote(v string) string {
+	if !strings.HasPrefix(v, `"`) {
+		return v
+	}
+	v = strings.TrimPrefix(v, `"`)
+	v = strings.TrimSuffix(v, `"`)
+	// Only \" and \\ are treated as escapes; Outlook sends Windows paths
+	// such as "C:\Users\a.pdf" unescaped.
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) && (v[i+1] == '"' || v[i+1] == '\\') {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// decode2231 decodes a single (non-continued) extended value such as
+// utf-8'en'na%C3%AFve.txt.
+func decode2231(v string) string {
+	cs, rest, ok := cutCharset(v)
+	if !ok {
+		return envelope.DecodeWords(percentDecode(v))
+	}
+	return convertCharset(cs, []byte(percentDecode(rest)))
+}
+
+func cutCharset(v string) (charsetName, rest string, ok bool) {
+	cs, afterCharset, found := strings.Cut(v, "'")
+	if !found {
+		return "", v, false
+	}
+	_, rest, found = strings.Cut(afterCharset, "'")
+	if !found {
+		return "", v, false
+	}
+	return cs, rest, true
+}
+
+func percentDecode(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '%' && i+2 < len(v) {
+			if n, err := strconv.ParseUint(v[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+func convertCharset(charsetName string, raw []byte) string {
+	if strings.TrimSpace(charsetName) == "" && utf8.Valid(raw) {
+		return string(raw)
+	}
+	text, _ := charset.Default.Decode(charsetName, raw)
+	return text
+}
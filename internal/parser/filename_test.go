@@ -0,0 +1,220 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// TestFilename runs attachment headers seen in the wild through Filename
+// and ResolveFilename. resolved is only set when it differs from want.
+func TestFilename(t *testing.T) {
+	tests := []struct {
+		name        string
+		disposition string
+		contentType string
+		want        string
+		resolved    string
+	}{
+		{
+			name:        "quoted",
+			disposition: `attachment; filename="report.pdf"`,
+			want:        "report.pdf",
+		},
+		{
+			name:        "RFC 2231 continuations with charset and language",
+			disposition: "attachment;\r\n filename*0*=utf-8'en'na%C3%AF;\r\n filename*1*=ve%20r;\r\n filename*2=\"eport.pdf\"",
+			want:        "naïve report.pdf",
+		},
+		{
+			name:        "RFC 2231 continuations in Latin-1",
+			disposition: "attachment; filename*0*=iso-8859-1'fr'caf%E9; filename*1*=%20cr%E8me.txt",
+			want:        "café crème.txt",
+		},
+		{
+			name:        "RFC 2231 continuations out of order",
+			disposition: "attachment; filename*1*=b.txt; filename*0*=utf-8''a",
+			want:        "ab.txt",
+		},
+		{
+			name:        "RFC 2231 single extended value",
+			disposition: "attachment; filename*=utf-8''%E2%82%AC%20invoice.pdf",
+			want:        "€ invoice.pdf",
+		},
+		{
+			name:        "RFC 2231 unknown charset",
+			disposition: "attachment; filename*=x-unknown''r%C3%A9sum%C3%A9.pdf",
+			want:        "résumé.pdf",
+		},
+		{
+			name:        "encoded word in name",
+			contentType: `application/pdf; name="=?UTF-8?B?w7xiZXIucGRm?="`,
+			want:        "über.pdf",
+		},
+		{
+			name:        "encoded word in unquoted name",
+			contentType: "application/pdf; name==?utf-8?Q?Angebot_2024.pdf?=",
+			want:        "Angebot 2024.pdf",
+		},
+		{
+			name:        "encoded words split in two",
+			disposition: `inline; filename="=?utf-8?B?5pel5pys6Kqe?= =?utf-8?B?LnR4dA==?="`,
+			want:        "日本語.txt",
+		},
+		{
+			name:        "malformed encoded word",
+			disposition: `attachment; filename="=?utf-8?X?broken?=.pdf"`,
+			want:        "=?utf-8?X?broken?=.pdf",
+			resolved:    "=_utf-8_X_broken_=.pdf",
+		},
+		{
+			name:        "raw UTF-8",
+			disposition: "attachment; filename=\"r\xc3\xa9sum\xc3\xa9.pdf\"",
+			want:        "résumé.pdf",
+		},
+		{
+			name:        "raw Latin-1",
+			disposition: "attachment; filename=\"r\xe9sum\xe9.pdf\"",
+			want:        "résumé.pdf",
+		},
+		{
+			name:        "Outlook encoded word inside quotes",
+			disposition: `attachment; filename="=?iso-8859-1?Q?Pr=E9sentation.ppt?="`,
+			want:        "Présentation.ppt",
+		},
+		{
+			name:        "Outlook Windows path",
+			disposition: `attachment; filename="C:\Users\bob\Desktop\report.pdf"`,
+			want:        `C:\Users\bob\Desktop\report.pdf`,
+			resolved:    "report.pdf",
+		},
+		{
+			name:        "Outlook winmail.dat",
+			contentType: `application/ms-tnef; name="winmail.dat"`,
+			disposition: `attachment; filename="winmail.dat"`,
+			want:        "winmail.dat",
+		},
+		{
+			name:        "Apple Mail extended filename with plain name",
+			contentType: "application/pdf;\r\n x-unix-mode=0644;\r\n name=\"Scan 2024-03-01.pdf\"",
+			disposition: "attachment;\r\n filename*=utf-8''Scan%202024-03-01.pdf",
+			want:        "Scan 2024-03-01.pdf",
+		},
+		{
+			name:        "Apple Mail unencoded continuations",
+			disposition: "inline;\r\n filename*0=\"A very long file name that Apple Mail \";\r\n filename*1=\"splits over lines.png\"",
+			want:        "A very long file name that Apple Mail splits over lines.png",
+		},
+		{
+			name:        "unquoted with spaces",
+			disposition: "attachment; filename=report final.pdf",
+			want:        "report final.pdf",
+		},
+		{
+			name:        "unterminated quote",
+			disposition: `attachment; filename="unterminated.pdf`,
+			want:        "unterminated.pdf",
+		},
+		{
+			name:        "semicolon inside quotes",
+			disposition: `attachment; filename="a;b.txt"; size=3`,
+			want:        "a;b.txt",
+		},
+		{
+			name:        "upper-case parameter name",
+			disposition: `attachment; FILENAME="UPPER.PDF"`,
+			want:        "UPPER.PDF",
+		},
+		{
+			name:        "name only in Content-Type",
+			disposition: "attachment",
+			contentType: `text/plain; name="notes.txt"`,
+			want:        "notes.txt",
+		},
+		{
+			name:        "Content-Disposition wins over Content-Type",
+			disposition: `attachment; filename="right.pdf"`,
+			contentType: `application/pdf; name="wrong.pdf"`,
+			want:        "right.pdf",
+		},
+		{
+			name:        "empty filename falls back to name",
+			disposition: `attachment; filename=""`,
+			contentType: `application/pdf; name="named.pdf"`,
+			want:        "named.pdf",
+		},
+		{
+			name:        "missing",
+			disposition: "attachment",
+			contentType: "application/pdf",
+			want:        "",
+			resolved:    "attachment.pdf",
+		},
+		{
+			name:     "no headers",
+			want:     "",
+			resolved: "attachment.pdf",
+		},
+		{
+			name:        "duplicate filename keeps the first",
+			disposition: `attachment; filename="first.pdf"; filename="second.pdf"`,
+			want:        "first.pdf",
+		},
+		{
+			name:        "extended filename wins after plain",
+			disposition: `attachment; filename="euro.txt"; filename*=utf-8''%E2%82%AC.txt`,
+			want:        "€.txt",
+		},
+		{
+			name:        "extended filename wins before plain",
+			disposition: `attachment; filename*=utf-8''%E2%82%AC.txt; filename="euro.txt"`,
+			want:        "€.txt",
+		},
+		{
+			name:        "reserved characters",
+			disposition: `attachment; filename="what? <draft>.txt"`,
+			want:        "what? <draft>.txt",
+			resolved:    "what_ _draft_.txt",
+		},
+		{
+			name:        "Windows device name",
+			disposition: `attachment; filename="con.txt"`,
+			want:        "con.txt",
+			resolved:    "_con.txt",
+		},
+		{
+			name:        "only dots",
+			disposition: `attachment; filename=".."`,
+			want:        "..",
+			resolved:    "attachment.pdf",
+		},
+		{
+			name:        "too long",
+			disposition: `attachment; filename="` + strings.Repeat("é", 200) + `.pdf"`,
+			want:        strings.Repeat("é", 200) + ".pdf",
+			resolved:    strings.Repeat("é", 125) + ".pdf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header textproto.Header
+			if tt.disposition != "" {
+				header.Set("Content-Disposition", tt.disposition)
+			}
+			if tt.contentType != "" {
+				header.Set("Content-Type", tt.contentType)
+			}
+			if got := Filename(header); got != tt.want {
+				t.Errorf("Filename = %q, want %q", got, tt.want)
+			}
+			resolved := tt.resolved
+			if resolved == "" {
+				resolved = tt.want
+			}
+			if got := ResolveFilename(header, "application/pdf"); got != resolved {
+				t.Errorf("ResolveFilename = %q, want %q", got, resolved)
+			}
+		})
+	}
+}
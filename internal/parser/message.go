@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"github.com/quzhi1/imap-playground/internal/calendar"
+	"github.com/quzhi1/imap-playground/internal/charset"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/secure"
+)
+
+// Message is the typed form of an RFC 5322 message.
+type Message struct {
+	Headers []HeaderField `json:"headers"`
+	// Envelope holds the normalized Message-ID, subject, date, addresses
+	// and thread IDs. Its fields are inlined in the JSON form.
+	envelope.Envelope
+	// Text and HTML hold every text/plain and text/html body part, decoded
+	// to UTF-8 and joined in the order they appear.
+	Text string `json:"text,omitempty"`
+	HTML string `json:"html,omitempty"`
+	// Charsets records which decoder each text part went through.
+	Charsets []PartCharset `json:"charsets,omitempty"`
+
+	// Attachments are the parts a user would see as files.
+	Attachments []*Attachment `json:"attachments,omitempty"`
+	// Inline are parts referenced from the HTML body by Content-ID, such as
+	// embedded images.
+	Inline []*Attachment `json:"inline,omitempty"`
+	// Calendars are the invitations, replies and cancellations read from
+	// text/calendar parts.
+	Calendars []*PartCalendar `json:"calendars,omitempty"`
+	// Embedded are message/rfc822 parts, e.g. forwarded mail.
+	Embedded []*Message `json:"embedded,omitempty"`
+	// Security lists the S/MIME and PGP layers found, outermost first. The
+	// content inside them is parsed into Text, HTML and Attachments like any
+	// other part.
+	Security []*Security `json:"security,omitempty"`
+
+	// Warnings lists everything that was odd but not fatal while parsing.
+	Warnings []string `json:"warnings,omitempty"`
+	// Problems lists damage in the MIME structure or the encoded bodies that
+	// the parser worked around, part by part.
+	Problems []Problem `json:"problems,omitempty"`
+}
+
+// HeaderField is one raw header line. Order and duplicates are kept.
+type HeaderField struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Problem is one thing wrong with one MIME part.
+type Problem struct {
+	// Part is the IMAP section number of the part, e.g. "2.1". It is empty
+	// for the message header.
+	Part        string `json:"part,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Problem     string `json:"problem"`
+}
+
+// Address is a decoded mailbox.
+type Address = envelope.Address
+
+// PartCharset is the charset decision for one text part.
+type PartCharset struct {
+	ContentType string `json:"content_type"`
+	charset.Result
+}
+
+// PartCalendar is the calendar read from one text/calendar part.
+type PartCalendar struct {
+	// Part is the IMAP section number of the part.
+	Part string `json:"part"`
+	calendar.Calendar
+	// sum identifies the calendar text, to skip a second copy of it.
+	sum [32]byte
+}
+
+// Attachment describes a non-body part.
+type Attachment struct {
+	ContentType        string `json:"content_type"`
+	Filename           string `json:"filename,omitempty"`
+	ContentDisposition string `json:"content_disposition,omitempty"`
+	ContentID          string `json:"content_id,omitempty"`
+	// AttachmentID is the X-Attachment-Id header some providers (Gmail,
+	// iCloud) put on every attachment.
+	AttachmentID string `json:"attachment_id,omitempty"`
+	Size         int64  `json:"size"`
+	// Content is the transfer-decoded body. It is left out of the JSON form.
+	Content []byte `json:"-"`
+}
+
+// Security is one signed or encrypted layer of a message.
+type Security struct {
+	// Part is the IMAP section number of the multipart/signed,
+	// multipart/encrypted or application/pkcs7-mime part. Parts found inside
+	// decrypted content are numbered below it.
+	Part string `json:"part,omitempty"`
+	// Type is "smime" or "pgp".
+	Type string `json:"type"`
+	// Inline is set for PGP blocks inside a text body rather than PGP/MIME.
+	Inline    bool `json:"inline,omitempty"`
+	Signed    bool `json:"signed,omitempty"`
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Decrypted is set when a local key opened the encrypted content.
+	Decrypted bool `json:"decrypted,omitempty"`
+	// Signature is the result of checking the signature, if it was signed.
+	Signature *secure.Signature `json:"signature,omitempty"`
+	// SignedContent is exactly what the signature covers: the MIME entity
+	// of a multipart/signed message in canonical CRLF form, the content of
+	// an opaque S/MIME signature, or the text of a cleartext-signed block.
+	// It is left out of the JSON form.
+	SignedContent []byte `json:"-"`
+	// Error says why the layer could not be verified or opened.
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,283 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+type delimiter int
+
+const (
+	noDelimiter delimiter = iota
+	partDelimiter
+	closeDelimiter
+)
+
+// multipartReader splits a multipart body on its boundary lines. Unlike
+// textproto.MultipartReader it does not give up on damaged input: a missing
+// closing delimiter ends the last part at EOF, a part header without the
+// blank line after it ends at the first line that is not a field, and a body
+// without any delimiter comes back as a single part. What it had to work
+// around is collected in problems.
+type multipartReader struct {
+	r    *bufio.Reader
+	dash []byte
+
+	started bool
+	done    bool
+	current *partBody
+	err     error
+
+	problems []string
+}
+
+// multipartPart is one part returned by multipartReader.NextPart.
+type multipartPart struct {
+	Header textproto.Header
+	// Problems lists what was wrong with this part's framing.
+	Problems []string
+	body     *partBody
+}
+
+func (p *multipartPart) Read(b []byte) (int, error) {
+	return p.body.Read(b)
+}
+
+// Truncated reports whether the input ended inside the part. It is only
+// meaningful once the part has been read to the end.
+func (p *multipartPart) Truncated() bool {
+	return p.body.truncated
+}
+
+func newMultipartReader(r io.Reader, boundary string) *multipartReader {
+	return &multipartReader{
+		r:    bufio.NewReaderSize(r, 64*1024),
+		dash: []byte("--" + boundary),
+	}
+}
+
+// NextPart returns the next part, or io.EOF after the last one. Any other
+// error comes from the underlying reader.
+func (mr *multipartReader) NextPart() (*multipartPart, error) {
+	if mr.current != nil {
+		if _, err := io.Copy(io.Discard, mr.current); err != nil {
+			return nil, err
+		}
+		mr.current = nil
+	}
+	if mr.err != nil {
+		return nil, mr.err
+	}
+	if mr.done {
+		return nil, io.EOF
+	}
+	if !mr.started {
+		mr.started = true
+		part := mr.skipPreamble()
+		switch {
+		case mr.err != nil:
+			return nil, mr.err
+		case part != nil:
+			mr.current = part.body
+			return part, nil
+		case mr.done:
+			return nil, io.EOF
+		}
+	}
+
+	part := &multipartPart{body: &partBody{mr: mr, lineStart: true}}
+	mr.current = part.body
+	raw, first, delim, err := mr.readPartHeader()
+	if err != nil {
+		return nil, err
+	}
+	if first != nil {
+		part.Problems = append(part.Problems, "part header is not followed by a blank line")
+		part.body.buf = first
+		part.body.lineStart = first[len(first)-1] == '\n'
+	}
+	switch {
+	case delim != noDelimiter:
+		part.body.eof = true
+		mr.sawDelimiter(delim)
+	case first == nil && mr.done:
+		// The input ended inside the header.
+		part.body.eof = true
+		part.body.truncated = true
+	}
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		part.Problems = append(part.Problems, "part header: "+err.Error())
+	}
+	part.Header = header
+	return part, nil
+}
+
+// skipPreamble reads up to the first delimiter. If there is none, the whole
+// body is returned as a part with an empty header so the text is not lost.
+func (mr *multipartReader) skipPreamble() *multipartPart {
+	var preamble bytes.Buffer
+	for {
+		line, err := mr.r.ReadSlice('\n')
+		if delim := mr.delimiter(line); delim != noDelimiter {
+			mr.sawDelimiter(delim)
+			return nil
+		}
+		preamble.Write(line)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			mr.done = true
+			if err != io.EOF {
+				mr.err = err
+				return nil
+			}
+			mr.problems = append(mr.problems, "no boundary line found, reading the body as a single part")
+			return &multipartPart{body: &partBody{mr: mr, buf: preamble.Bytes(), eof: true}}
+		}
+	}
+}
+
+// readPartHeader collects header lines up to the blank line. If a line that
+// cannot be part of a header shows up first, it is returned as the start of
+// the body. If a delimiter shows up, the part is empty.
+func (mr *multipartReader) readPartHeader() (raw, first []byte, delim delimiter, err error) {
+	var header bytes.Buffer
+	for {
+		line, readErr := mr.r.ReadSlice('\n')
+		if readErr == bufio.ErrBufferFull {
+			return header.Bytes(), append([]byte(nil), line...), noDelimiter, nil
+		}
+		if readErr != nil && readErr != io.EOF {
+			return nil, nil, noDelimiter, readErr
+		}
+		if d := mr.delimiter(line); d != noDelimiter {
+			return header.Bytes(), nil, d, nil
+		}
+		switch {
+		case len(bytes.TrimRight(line, "\r\n")) == 0:
+			// End of header.
+		case (line[0] == ' ' || line[0] == '\t') && header.Len() > 0,
+			isHeaderField(line):
+			header.Write(line)
+			if readErr == nil {
+				continue
+			}
+		default:
+			return header.Bytes(), append([]byte(nil), line...), noDelimiter, nil
+		}
+		if readErr == io.EOF {
+			mr.endOfInput()
+		}
+		header.WriteString("\r\n")
+		return header.Bytes(), nil, noDelimiter, nil
+	}
+}
+
+func isHeaderField(line []byte) bool {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range bytes.TrimRight(line[:i], " \t") {
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// delimiter reports whether line is a boundary line. Trailing whitespace
+// (transport padding) is allowed after the boundary.
+func (mr *multipartReader) delimiter(line []byte) delimiter {
+	line = bytes.TrimRight(line, " \t\r\n")
+	if !bytes.HasPrefix(line, mr.dash) {
+		return noDelimiter
+	}
+	switch rest := line[len(mr.dash):]; {
+	case len(rest) == 0:
+		return partDelimiter
+	case bytes.Equal(rest, []byte("--")):
+		return closeDelimiter
+	}
+	return noDelimiter
+}
+
+func (mr *multipartReader) sawDelimiter(delim delimiter) {
+	if delim == closeDelimiter {
+		mr.done = true
+	}
+}
+
+func (mr *multipartReader) endOfInput() {
+	if !mr.done {
+		mr.done = true
+		mr.problems = append(mr.problems, "closing boundary is missing, the part is probably truncated")
+	}
+}
+
+// partBody reads one part up to the next delimiter. The line break before a
+// delimiter belongs to the delimiter, so each line break is held back until
+// the following line turns out not to be one.
+type partBody struct {
+	mr        *multipartReader
+	buf       []byte
+	eol       []byte
+	lineStart bool
+	eof       bool
+	// truncated is set when the input ended inside this part.
+	truncated bool
+}
+
+func (p *partBody) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.eof {
+			return 0, io.EOF
+		}
+		if err := p.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *partBody) fill() error {
+	line, err := p.mr.r.ReadSlice('\n')
+	if p.lineStart {
+		if delim := p.mr.delimiter(line); delim != noDelimiter {
+			p.mr.sawDelimiter(delim)
+			p.eof = true
+			return nil
+		}
+	}
+
+	p.buf = append(p.buf[:0], p.eol...)
+	p.eol = p.eol[:0]
+	content := line
+	if err == nil {
+		content = bytes.TrimSuffix(line, []byte("\n"))
+		content = bytes.TrimSuffix(content, []byte("\r"))
+		p.eol = append(p.eol, line[len(content):]...)
+	}
+	p.buf = append(p.buf, content...)
+	p.lineStart = err == nil
+
+	switch {
+	case err == nil, err == bufio.ErrBufferFull:
+		return nil
+	case err == io.EOF:
+		p.eof = true
+		p.truncated = !p.mr.done
+		p.mr.endOfInput()
+		return nil
+	default:
+		p.mr.err = err
+		return err
+	}
+}
@@ -0,0 +1,297 @@
+// Package parser turns a raw RFC 5322 message into a Message.
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/charset"
+	"github.com/quzhi1/imap-playground/internal/envelope"
+	"github.com/quzhi1/imap-playground/internal/secure"
+)
+
+const (
+	HTMLContentType      = "text/html"
+	PlainTextContentType = "text/plain"
+	rfc822ContentType    = "message/rfc822"
+	relatedContentType   = "multipart/related"
+)
+
+// Options tunes ParseWithOptions.
+type Options struct {
+	// AttachmentHandler, if set, receives every attachment and inline part
+	// as a stream instead of having it buffered into Attachment.Content. The
+	// attachment's Size is filled in after the handler returns; whatever the
+	// handler leaves unread is drained so Size is still the full size.
+	AttachmentHandler func(attachment *Attachment, body io.Reader) error
+	// Secure holds the trust store and local keys used to check signatures
+	// and decrypt S/MIME and PGP content. When nil, signatures are still
+	// checked but nobody is trusted and nothing is decrypted.
+	Secure *secure.Config
+}
+
+// Parse reads a whole message from r.
+func Parse(r io.Reader) (*Message, error) {
+	return ParseWithOptions(r, nil)
+}
+
+// ParseWithOptions is Parse with Options.
+func ParseWithOptions(r io.Reader, opts *Options) (*Message, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return parseMessage(r, opts, "")
+}
+
+// parseMessage parses a message whose parts are numbered below section, the
+// way IMAP numbers the parts of an embedded message/rfc822.
+func parseMessage(r io.Reader, opts *Options, section string) (*Message, error) {
+	br := bufio.NewReader(r)
+	header, err := textproto.ReadHeader(br)
+	msg := &Message{}
+	switch {
+	case err == io.EOF && header.Len() > 0:
+		msg.problem(section, "", "message has a header but no body")
+	case err != nil && header.Len() > 0:
+		msg.problem(section, "", "reading header: %v", err)
+	case err != nil:
+		return nil, fmt.Errorf("parser: reading header: %w", err)
+	}
+
+	readEnvelope(header, msg)
+	if err := parseEntity(header, br, msg, opts, section, "", true); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+func readEnvelope(header textproto.Header, msg *Message) {
+	for fields := header.Fields(); fields.Next(); {
+		msg.Headers = append(msg.Headers, HeaderField{Key: fields.Key(), Value: fields.Value()})
+	}
+
+	env, errs := envelope.FromHeader(header)
+	msg.Envelope = *env
+	for _, err := range errs {
+		msg.warn("%v", err)
+	}
+}
+
+// parseEntity walks one MIME entity and everything below it. section is the
+// IMAP section number of the entity; for the root entity of a message it is
+// the prefix its parts are numbered under. Damaged input is recorded in
+// msg.Problems and worked around; only errors from r itself and from the
+// attachment handler are returned.
+func parseEntity(header textproto.Header, body io.Reader, msg *Message, opts *Options, section, parent string, root bool) error {
+	mediaType, params := contentType(header, msg)
+	isMultipart := strings.HasPrefix(mediaType, "multipart/")
+	if root && (!isMultipart || params["boundary"] == "") {
+		section = childSection(section, 1)
+	}
+	problem := func(format string, args ...any) {
+		msg.problem(section, mediaType, format, args...)
+	}
+
+	if isMultipart && params["boundary"] == "" {
+		problem("multipart part has no boundary, reading it as a single part")
+		mediaType = "application/octet-stream"
+	}
+	switch {
+	case mediaType == signedContentType:
+		return parseSigned(body, msg, opts, section, params, problem)
+	case mediaType == encryptedContentType:
+		return parseEncrypted(body, msg, opts, section, params, problem)
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return parseParts(newMultipartReader(body, params["boundary"]), msg, opts, section, mediaType, nil)
+	}
+
+	decoded := transferDecoder(header.Get("Content-Transfer-Encoding"), mediaType, body, problem)
+
+	if isSMIMEContentType(mediaType) {
+		return parseSMIME(header, decoded, msg, opts, section, mediaType, params, problem)
+	}
+	if mediaType == rfc822ContentType {
+		embedded, err := parseMessage(decoded, opts, section)
+		if embedded == nil {
+			if err != nil {
+				problem("embedded message: %v", err)
+			}
+			return nil
+		}
+		msg.Embedded = append(msg.Embedded, embedded)
+		return err
+	}
+
+	disposition, _ := parseParams(header.Get("Content-Disposition"))
+	filename := Filename(header)
+	isBody := (mediaType == PlainTextContentType || mediaType == HTMLContentType) &&
+		disposition != "attachment" && filename == ""
+	if isBody {
+		text, result, err := readText(decoded, params["charset"])
+		if err != nil {
+			msg.warn("%s body: %v", mediaType, err)
+		}
+		if mediaType == PlainTextContentType {
+			text = openInlinePGP(text, msg, opts, section)
+		}
+		msg.Charsets = append(msg.Charsets, PartCharset{ContentType: mediaType, Result: result})
+		if mediaType == HTMLContentType {
+			msg.HTML = joinBody(msg.HTML, text)
+		} else {
+			msg.Text = joinBody(msg.Text, text)
+		}
+		return nil
+	}
+	if isTNEF(mediaType, filename) {
+		return parseTNEF(header, decoded, msg, opts, section, mediaType, problem)
+	}
+	if isCalendarContentType(mediaType) {
+		return parseCalendar(header, decoded, msg, opts, section, mediaType, params, problem)
+	}
+	return attach(header, decoded, msg, opts, mediaType, parent == relatedContentType)
+}
+
+// parseParts parses each part of a multipart body in turn. If take is set,
+// it sees every part first and can consume it instead; the part is then not
+// parsed as usual.
+func parseParts(mr *multipartReader, msg *Message, opts *Options, section, mediaType string, take func(i int, partSection string, part *multipartPart) (bool, error)) error {
+	for i := 1; ; i++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("parser: reading %s part: %w", mediaType, err)
+		}
+		partSection := childSection(section, i)
+		partType, _ := parseParams(part.Header.Get("Content-Type"))
+		for _, p := range part.Problems {
+			msg.problem(partSection, partType, "%s", p)
+		}
+		taken := false
+		if take != nil {
+			if taken, err = take(i, partSection, part); err != nil {
+				return err
+			}
+		}
+		if !taken {
+			if err := parseEntity(part.Header, part, msg, opts, partSection, mediaType, false); err != nil {
+				return err
+			}
+		}
+		if part.Truncated() {
+			msg.problem(partSection, partType, "input ends inside this part, it may be truncated")
+		}
+	}
+	for _, p := range mr.problems {
+		msg.problem(section, mediaType, "%s", p)
+	}
+	return nil
+}
+
+// attach records a non-body part as an attachment or inline part, reading
+// decoded through the attachment handler if there is one. related is whether
+// the part is a direct child of multipart/related.
+func attach(header textproto.Header, decoded io.Reader, msg *Message, opts *Options, mediaType string, related bool) error {
+	disposition, _ := parseParams(header.Get("Content-Disposition"))
+	attachment := &Attachment{
+		ContentType:        mediaType,
+		Filename:           Filename(header),
+		ContentDisposition: disposition,
+		ContentID:          strings.Trim(header.Get("Content-Id"), "<> "),
+		AttachmentID:       header.Get("X-Attachment-Id"),
+	}
+	if opts.AttachmentHandler != nil {
+		counter := &countingReader{r: decoded}
+		if err := opts.AttachmentHandler(attachment, counter); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, counter); err != nil {
+			msg.warn("%s attachment: %v", mediaType, err)
+		}
+		attachment.Size = counter.n
+	} else {
+		content, err := io.ReadAll(decoded)
+		if err != nil {
+			msg.warn("%s attachment: %v", mediaType, err)
+		}
+		attachment.Content = content
+		attachment.Size = int64(len(content))
+	}
+	// Parts of multipart/related are referenced from the root part by
+	// Content-ID, and are often sent without a disposition.
+	referenced := related && disposition != "attachment" && attachment.ContentID != ""
+	if !header.Has("Content-Disposition") && !referenced {
+		msg.warn("%s part has no Content-Disposition header", mediaType)
+	}
+	if referenced || disposition == "inline" && attachment.ContentID != "" {
+		msg.Inline = append(msg.Inline, attachment)
+	} else {
+		msg.Attachments = append(msg.Attachments, attachment)
+	}
+	return nil
+}
+
+// contentType returns the lower-cased media type, falling back to
+// text/plain as RFC 2045 section 5.2 says.
+func contentType(header textproto.Header, msg *Message) (string, map[string]string) {
+	value := header.Get("Content-Type")
+	if value == "" {
+		return PlainTextContentType, map[string]string{}
+	}
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		msg.warn("Content-Type %q: %v", value, err)
+		if mediaType == "" {
+			return PlainTextContentType, map[string]string{}
+		}
+	}
+	return strings.ToLower(mediaType), params
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func readText(r io.Reader, label string) (string, charset.Result, error) {
+	raw, err := io.ReadAll(r)
+	text, result := charset.Default.Decode(label, raw)
+	return text, result, err
+}
+
+func joinBody(existing, next string) string {
+	if existing == "" {
+		return next
+	}
+	return existing + "\n" + next
+}
+
+func childSection(section string, i int) string {
+	if section == "" {
+		return strconv.Itoa(i)
+	}
+	return section + "." + strconv.Itoa(i)
+}
+
+func (msg *Message) problem(section, contentType, format string, args ...any) {
+	msg.Problems = append(msg.Problems, Problem{
+		Part:        section,
+		ContentType: contentType,
+		Problem:     fmt.Sprintf(format, args...),
+	})
+}
+
+func (msg *Message) warn(format string, args ...any) {
+	msg.Warnings = append(msg.Warnings, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,240 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected .json files from the parser output")
+
+// expected is what a fixture's .json file holds: the parsed message and the
+// error Parse returned, if any.
+type expected struct {
+	Error   string   `json:"error,omitempty"`
+	Message *Message `json:"message"`
+}
+
+func fixtures(t testing.TB) []string {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*", "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no fixtures under testdata")
+	}
+	return paths
+}
+
+func marshalExpected(msg *Message, err error) []byte {
+	e := expected{Message: msg}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(e) //nolint:errcheck // plain structs always encode
+	return b.Bytes()
+}
+
+// TestCorpus parses every fixture under testdata and compares the result
+// with the .json file next to it. Run with -update to rewrite them after a
+// deliberate change, and review the diff.
+func TestCorpus(t *testing.T) {
+	for _, path := range fixtures(t) {
+		name := strings.TrimSuffix(filepath.ToSlash(strings.TrimPrefix(path, "testdata"+string(filepath.Separator))), ".eml")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Parse(bytes.NewReader(raw))
+			got := marshalExpected(msg, err)
+
+			golden := strings.TrimSuffix(path, ".eml") + ".json"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil { //nolint:gosec // fixtures are not secret
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output differs from %s:\n%s", golden, firstDifference(want, got))
+			}
+		})
+	}
+}
+
+// TestAttachmentHandler checks that streaming attachments to a handler
+// gives the same message as buffering them, apart from Content.
+func TestAttachmentHandler(t *testing.T) {
+	for _, path := range fixtures(t) {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffered, bufferedErr := Parse(bytes.NewReader(raw))
+		var streamed int64
+		msg, err := ParseWithOptions(bytes.NewReader(raw), &Options{
+			AttachmentHandler: func(_ *Attachment, body io.Reader) error {
+				n, err := io.Copy(io.Discard, body)
+				streamed += n
+				return err
+			},
+		})
+		if a, b := marshalExpected(buffered, bufferedErr), marshalExpected(msg, err); !bytes.Equal(a, b) {
+			t.Errorf("%s: streamed parse differs:\n%s", path, firstDifference(a, b))
+		}
+		if size := attachmentSize(msg); streamed != size {
+			t.Errorf("%s: handler read %d bytes, attachments add up to %d", path, streamed, size)
+		}
+	}
+}
+
+// attachmentSize adds up the attachments of msg and its embedded messages.
+func attachmentSize(msg *Message) int64 {
+	var size int64
+	for _, list := range [][]*Attachment{msg.Attachments, msg.Inline} {
+		for _, attachment := range list {
+			size += attachment.Size
+		}
+	}
+	for _, embedded := range msg.Embedded {
+		size += attachmentSize(embedded)
+	}
+	return size
+}
+
+// TestTruncated parses every prefix of every fixture, the way a connection
+// dropped mid-FETCH would hand it over. The parser must not panic and must
+// return whatever it got through.
+func TestTruncated(t *testing.T) {
+	for _, path := range fixtures(t) {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n <= len(raw); n++ {
+			msg, err := Parse(bytes.NewReader(raw[:n]))
+			if msg == nil && err == nil {
+				t.Fatalf("%s cut at %d: no message and no error", path, n)
+			}
+		}
+	}
+}
+
+// TestRelatedInline checks where an image with a Content-ID lands depending
+// on its parent and its Content-Disposition.
+func TestRelatedInline(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		parent      string
+		headers     string
+		wantInline  bool
+		wantWarning bool
+	}{
+		{"related without disposition", "related", "Content-ID: <logo@example.com>\r\n", true, false},
+		{"related inline", "related", "Content-ID: <logo@example.com>\r\nContent-Disposition: inline\r\n", true, false},
+		{"related attachment", "related", "Content-ID: <logo@example.com>\r\nContent-Disposition: attachment\r\n", false, false},
+		{"related without Content-ID", "related", "", false, true},
+		{"mixed without disposition", "mixed", "Content-ID: <logo@example.com>\r\n", false, true},
+		{"mixed inline", "mixed", "Content-ID: <logo@example.com>\r\nContent-Disposition: inline\r\n", true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "Content-Type: multipart/" + tt.parent + "; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo@example.com\">\r\n" +
+				"--b\r\nContent-Type: image/png\r\n" + tt.headers + "\r\nPNG\r\n--b--\r\n"
+			msg, err := Parse(strings.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inline := len(msg.Inline) == 1 && len(msg.Attachments) == 0; inline != tt.wantInline {
+				t.Errorf("inline = %d, attachments = %d, want inline %v", len(msg.Inline), len(msg.Attachments), tt.wantInline)
+			}
+			if warned := len(msg.Warnings) > 0; warned != tt.wantWarning {
+				t.Errorf("warnings = %q, want a warning %v", msg.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+// TestQuotedPrintableLongLine puts an escape and a soft line break across
+// the end of the decoder's buffer, at every offset, in lines longer than
+// the buffer.
+func TestQuotedPrintableLongLine(t *testing.T) {
+	for _, tt := range []struct {
+		escape string
+		want   string
+	}{
+		{"=E9", "\xe9"},
+		{"=c3=a9", "\xc3\xa9"},
+		{"=\r\n", ""},
+		{"= \t\r\n", ""},
+	} {
+		for offset := sniffSize - 4; offset <= sniffSize+1; offset++ {
+			prefix := strings.Repeat("a", offset)
+			raw := prefix + tt.escape + "after\r\n"
+			var problems []string
+			r := DecodeTransfer("quoted-printable", "text/plain", strings.NewReader(raw), func(format string, args ...any) {
+				problems = append(problems, fmt.Sprintf(format, args...))
+			})
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := prefix + tt.want + "after\r\n"; string(got) != want {
+				t.Errorf("%q at %d: got %q", tt.escape, offset, got[offset:])
+			}
+			if len(problems) > 0 {
+				t.Errorf("%q at %d: problems %q", tt.escape, offset, problems)
+			}
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, path := range fixtures(f) {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(raw)
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		msg, err := Parse(bytes.NewReader(raw))
+		if msg == nil && err == nil {
+			t.Fatal("no message and no error")
+		}
+	})
+}
+
+// firstDifference describes the first line where got differs from want.
+func firstDifference(want, got []byte) string {
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(string(got), "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Sprintf("line %d:\n  want: %s\n  got:  %s", i+1, w, g)
+		}
+	}
+	return "same lines, different bytes"
+}
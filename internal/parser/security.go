@@ -0,0 +1,289 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/secure"
+)
+
+const (
+	signedContentType    = "multipart/signed"
+	encryptedContentType = "multipart/encrypted"
+	pgpEncryptedType     = "application/pgp-encrypted"
+	pgpSignatureType     = "application/pgp-signature"
+
+	smimeType = "smime"
+	pgpType   = "pgp"
+)
+
+func isSMIMEContentType(mediaType string) bool {
+	return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+}
+
+func isSignatureType(mediaType string) bool {
+	switch mediaType {
+	case "application/pkcs7-signature", "application/x-pkcs7-signature", pgpSignatureType:
+		return true
+	}
+	return false
+}
+
+// parseSigned handles a multipart/signed entity (RFC 1847): the first part
+// is parsed as usual, the second is the signature over it and is checked
+// instead of being listed as an attachment.
+func parseSigned(body io.Reader, msg *Message, opts *Options, section string, params map[string]string, problem func(format string, args ...any)) error {
+	// The signature covers the first part byte for byte, so the body is
+	// buffered to read it both raw and parsed.
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("parser: reading %s: %w", signedContentType, err)
+	}
+	boundary := params["boundary"]
+	sec := &Security{Part: section, Signed: true}
+	switch protocol := strings.ToLower(params["protocol"]); {
+	case protocol == pgpSignatureType:
+		sec.Type = pgpType
+	case isSignatureType(protocol):
+		sec.Type = smimeType
+	default:
+		problem("unknown signature protocol %q, reading the parts as they are", params["protocol"])
+		return parseParts(newMultipartReader(bytes.NewReader(raw), boundary), msg, opts, section, signedContentType, nil)
+	}
+	msg.Security = append(msg.Security, sec)
+	sec.SignedContent = signedPart(raw, boundary)
+
+	var signature []byte
+	err = parseParts(newMultipartReader(bytes.NewReader(raw), boundary), msg, opts, section, signedContentType,
+		func(i int, partSection string, part *multipartPart) (bool, error) {
+			partType, _ := parseParams(part.Header.Get("Content-Type"))
+			if i != 2 || !isSignatureType(partType) {
+				return false, nil
+			}
+			decoded := transferDecoder(part.Header.Get("Content-Transfer-Encoding"), partType, part, func(format string, args ...any) {
+				msg.problem(partSection, partType, format, args...)
+			})
+			var readErr error
+			if signature, readErr = io.ReadAll(decoded); readErr != nil {
+				msg.warn("%s signature: %v", partType, readErr)
+			}
+			return true, nil
+		})
+
+	switch {
+	case sec.SignedContent == nil:
+		sec.Error = "signed part is missing"
+	case signature == nil:
+		sec.Error = "signature part is missing"
+	case sec.Type == smimeType:
+		sig, _, verifyErr := opts.Secure.VerifySMIME(signature, sec.SignedContent)
+		if verifyErr != nil {
+			sec.Error = verifyErr.Error()
+		}
+		sec.Signature = sig
+	default:
+		sec.Signature = opts.Secure.VerifyPGP(sec.SignedContent, signature)
+	}
+	checkSigner(sec, msg)
+	return err
+}
+
+// parseEncrypted handles a PGP/MIME multipart/encrypted entity (RFC 3156).
+// The decrypted content takes the place of the encrypted part; if no local
+// key opens it, the encrypted part is kept as an attachment.
+func parseEncrypted(body io.Reader, msg *Message, opts *Options, section string, params map[string]string, problem func(format string, args ...any)) error {
+	mr := newMultipartReader(body, params["boundary"])
+	if !strings.EqualFold(params["protocol"], pgpEncryptedType) {
+		problem("unknown encryption protocol %q, reading the parts as they are", params["protocol"])
+		return parseParts(mr, msg, opts, section, encryptedContentType, nil)
+	}
+	sec := &Security{Part: section, Type: pgpType, Encrypted: true}
+	msg.Security = append(msg.Security, sec)
+
+	found := false
+	err := parseParts(mr, msg, opts, section, encryptedContentType,
+		func(i int, partSection string, part *multipartPart) (bool, error) {
+			partType, _ := parseParams(part.Header.Get("Content-Type"))
+			switch {
+			case i == 1 && partType == pgpEncryptedType:
+				// The control part only holds "Version: 1".
+				_, err := io.Copy(io.Discard, part)
+				return true, err
+			case i != 2:
+				return false, nil
+			}
+			found = true
+			raw, err := io.ReadAll(part)
+			if err != nil {
+				return true, err
+			}
+			decoded := transferDecoder(part.Header.Get("Content-Transfer-Encoding"), partType, bytes.NewReader(raw), func(format string, args ...any) {
+				msg.problem(partSection, partType, format, args...)
+			})
+			ciphertext, _ := io.ReadAll(decoded)
+			plaintext, sig, err := opts.Secure.DecryptPGP(ciphertext)
+			if err != nil {
+				sec.Error = err.Error()
+				return true, parseEntity(part.Header, bytes.NewReader(raw), msg, opts, partSection, "", false)
+			}
+			sec.Decrypted = true
+			if sig != nil {
+				sec.Signed = true
+				sec.Signature = sig
+			}
+			return true, parseDecrypted(plaintext, msg, opts, partSection)
+		})
+	if !found && sec.Error == "" {
+		sec.Error = "encrypted part is missing"
+	}
+	checkSigner(sec, msg)
+	return err
+}
+
+// parseSMIME handles an application/pkcs7-mime part: opaque signed data is
+// verified and its content parsed, enveloped data is decrypted and parsed.
+// What cannot be opened is kept as an attachment.
+func parseSMIME(header textproto.Header, decoded io.Reader, msg *Message, opts *Options, section, mediaType string, params map[string]string, problem func(format string, args ...any)) error {
+	if strings.EqualFold(params["smime-type"], "certs-only") {
+		return attach(header, decoded, msg, opts, mediaType, false)
+	}
+	der, err := io.ReadAll(decoded)
+	if err != nil {
+		msg.warn("%s part: %v", mediaType, err)
+	}
+	kind, err := secure.DetectSMIME(der)
+	if err != nil {
+		problem("%v", err)
+		return attach(header, bytes.NewReader(der), msg, opts, mediaType, false)
+	}
+
+	sec := &Security{Part: section, Type: smimeType}
+	msg.Security = append(msg.Security, sec)
+	var content []byte
+	switch kind {
+	case secure.SMIMESigned:
+		sec.Signed = true
+		sig, signed, err := opts.Secure.VerifySMIME(der, nil)
+		if err != nil {
+			sec.Error = err.Error()
+			return attach(header, bytes.NewReader(der), msg, opts, mediaType, false)
+		}
+		sec.Signature, sec.SignedContent, content = sig, signed, signed
+		checkSigner(sec, msg)
+	case secure.SMIMEEnveloped:
+		sec.Encrypted = true
+		plaintext, err := opts.Secure.DecryptSMIME(der)
+		if err != nil {
+			sec.Error = err.Error()
+			return attach(header, bytes.NewReader(der), msg, opts, mediaType, false)
+		}
+		sec.Decrypted = true
+		content = plaintext
+	}
+	return parseDecrypted(content, msg, opts, section)
+}
+
+// parseDecrypted parses content taken out of a signature or an encryption
+// layer as a MIME entity numbered under section. Content without a MIME
+// header is read as plain text.
+func parseDecrypted(content []byte, msg *Message, opts *Options, section string) error {
+	br := bufio.NewReader(bytes.NewReader(content))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return parseEntity(textproto.Header{}, bytes.NewReader(content), msg, opts, section, "", false)
+	}
+	return parseEntity(header, br, msg, opts, section, "", false)
+}
+
+// openInlinePGP replaces the armored PGP messages and cleartext-signed
+// blocks in a text body with their content, recording each one.
+func openInlinePGP(text string, msg *Message, opts *Options, section string) string {
+	b := []byte(text)
+	if !secure.HasInlinePGP(b) {
+		return text
+	}
+	for {
+		opened, sig, found, err := opts.Secure.InlineEncrypted(b)
+		if !found {
+			break
+		}
+		sec := &Security{Part: section, Type: pgpType, Inline: true, Encrypted: true}
+		msg.Security = append(msg.Security, sec)
+		if err != nil {
+			sec.Error = err.Error()
+			break
+		}
+		sec.Decrypted = true
+		if sig != nil {
+			sec.Signed = true
+			sec.Signature = sig
+		}
+		checkSigner(sec, msg)
+		b = opened
+	}
+	for {
+		opened, signed, sig, found := opts.Secure.ClearSigned(b)
+		if !found {
+			break
+		}
+		sec := &Security{Part: section, Type: pgpType, Inline: true, Signed: true, Signature: sig, SignedContent: signed}
+		msg.Security = append(msg.Security, sec)
+		checkSigner(sec, msg)
+		b = opened
+	}
+	// The opened content comes back with LF line breaks; keep the body's.
+	if strings.Contains(text, "\r\n") {
+		b = canonicalCRLF(b)
+	}
+	return string(b)
+}
+
+// signedPart returns the first part of a multipart body as it was sent,
+// header included, without the line break that belongs to the next
+// delimiter. Line breaks are made CRLF: the signature was made over the
+// canonical form, which mbox files and some stores undo.
+func signedPart(raw []byte, boundary string) []byte {
+	mr := &multipartReader{dash: []byte("--" + boundary)}
+	start := -1
+	for offset := 0; offset < len(raw); {
+		end := bytes.IndexByte(raw[offset:], '\n') + 1
+		if end == 0 {
+			end = len(raw)
+		} else {
+			end += offset
+		}
+		if mr.delimiter(raw[offset:end]) != noDelimiter {
+			if start >= 0 {
+				part := bytes.TrimSuffix(raw[start:offset], []byte("\n"))
+				part = bytes.TrimSuffix(part, []byte("\r"))
+				return canonicalCRLF(part)
+			}
+			start = end
+		}
+		offset = end
+	}
+	return nil
+}
+
+func canonicalCRLF(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// checkSigner warns when a signature was made by someone other than the
+// sender: the signature can be valid and still not vouch for the From line.
+func checkSigner(sec *Security, msg *Message) {
+	if sec.Signature == nil || sec.Signature.Signer.Email == "" || len(msg.From) == 0 {
+		return
+	}
+	for _, addr := range append(append([]Address{}, msg.From...), msg.Sender...) {
+		if strings.EqualFold(addr.Address, sec.Signature.Signer.Email) {
+			return
+		}
+	}
+	msg.warn("%s signature in part %s is by %s, who is not the sender", sec.Type, sec.Part, sec.Signature.Signer.Email)
+}
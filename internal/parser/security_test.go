@@ -0,0 +1,339 @@
+package parser
+
+import (
+	"bytes"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/quzhi1/imap-playground/internal/secure"
+	"github.com/quzhi1/imap-playground/internal/secure/securetest"
+)
+
+const securityHeader = "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nSubject: Secret\r\n"
+
+// keys are generated once: RSA keys take a moment.
+type testKeys struct {
+	ca, otherCA    *securetest.CA
+	alice, expired secure.Identity
+	bob            secure.Identity
+	pgpAlice       *openpgp.Entity
+	pgpBob         *openpgp.Entity
+}
+
+var (
+	keysOnce sync.Once
+	keys     testKeys
+	keysErr  error
+)
+
+func generateKeys(t *testing.T) testKeys {
+	t.Helper()
+	keysOnce.Do(func() {
+		now := time.Now()
+		if keys.ca, keysErr = securetest.NewCA("Root"); keysErr != nil {
+			return
+		}
+		if keys.otherCA, keysErr = securetest.NewCA("Other Root"); keysErr != nil {
+			return
+		}
+		if keys.alice, keysErr = keys.ca.Issue("Alice", "alice@example.com", now.Add(-time.Hour), now.AddDate(0, 1, 0)); keysErr != nil {
+			return
+		}
+		if keys.expired, keysErr = keys.ca.Issue("Alice", "alice@example.com", now.AddDate(0, -2, 0), now.AddDate(0, -1, 0)); keysErr != nil {
+			return
+		}
+		if keys.bob, keysErr = keys.ca.Issue("Bob", "bob@example.com", now.Add(-time.Hour), now.AddDate(0, 1, 0)); keysErr != nil {
+			return
+		}
+		if keys.pgpAlice, keysErr = securetest.NewPGPKey("Alice", "alice@example.com"); keysErr != nil {
+			return
+		}
+		keys.pgpBob, keysErr = securetest.NewPGPKey("Bob", "bob@example.com")
+	})
+	if keysErr != nil {
+		t.Fatal(keysErr)
+	}
+	return keys
+}
+
+// bobConfig is what Bob's mail client knows: the root, Alice's PGP key and
+// his own keys.
+func bobConfig(k testKeys) *secure.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(k.ca.Certificate)
+	return &secure.Config{
+		Roots:      roots,
+		Keyring:    openpgp.EntityList{k.pgpAlice},
+		Identities: []secure.Identity{k.bob},
+		SecretKeys: openpgp.EntityList{k.pgpBob},
+	}
+}
+
+// layer is the part of a Security record the tests compare.
+type layer struct {
+	Part                                 string
+	Type                                 string
+	Inline, Signed, Encrypted, Decrypted bool
+}
+
+func TestSecurity(t *testing.T) {
+	k := generateKeys(t)
+	entity := securetest.Entity("Hello Bob\n")
+	must := func(raw []byte, err error) []byte {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(k.otherCA.Certificate)
+	smimeSigned := must(securetest.SMIMESigned(securityHeader, entity, k.alice))
+	pgpSigned := must(securetest.PGPSigned(securityHeader, entity, k.pgpAlice))
+	clearSigned, err := securetest.PGPClearSigned("Hello Bob\n", k.pgpAlice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inlineEncrypted, err := securetest.PGPInlineEncrypted("Hello Bob\n", k.pgpBob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		raw    []byte
+		config *secure.Config
+		want   layer
+		// status is the signature status, if there is a signature.
+		status secure.Status
+		// text is the body the parser should end up with; empty if the
+		// content stays locked.
+		text string
+		// attachment is the content type of the one attachment expected.
+		attachment string
+	}{
+		{
+			name:   "smime signed",
+			raw:    smimeSigned,
+			want:   layer{Type: "smime", Signed: true},
+			status: secure.StatusValid,
+			text:   "Hello Bob",
+		},
+		{
+			name:   "smime signed without trust store",
+			raw:    smimeSigned,
+			config: &secure.Config{},
+			want:   layer{Type: "smime", Signed: true},
+			status: secure.StatusUntrusted,
+			text:   "Hello Bob",
+		},
+		{
+			name:   "smime signed by another root",
+			raw:    smimeSigned,
+			config: &secure.Config{Roots: otherRoots},
+			want:   layer{Type: "smime", Signed: true},
+			status: secure.StatusUntrusted,
+			text:   "Hello Bob",
+		},
+		{
+			name:   "smime signed then tampered",
+			raw:    bytes.Replace(smimeSigned, []byte("Hello Bob"), []byte("Hello Eve"), 1),
+			want:   layer{Type: "smime", Signed: true},
+			status: secure.StatusInvalid,
+			text:   "Hello Eve",
+		},
+		{
+			name:   "smime signed with expired certificate",
+			raw:    must(securetest.SMIMESigned(securityHeader, entity, k.expired)),
+			want:   layer{Type: "smime", Signed: true},
+			status: secure.StatusExpired,
+			text:   "Hello Bob",
+		},
+		{
+			name:   "smime signed stored with LF line endings",
+			raw:    bytes.ReplaceAll(smimeSigned, []byte("\r\n"), []byte("\n")),
+			want:   layer{Type: "smime", Signed: true},
+			status: secure.StatusValid,
+			text:   "Hello Bob",
+		},
+		{
+			name:   "smime opaque signed",
+			raw:    must(securetest.SMIMEOpaque(securityHeader, entity, k.alice)),
+			want:   layer{Part: "1", Type: "smime", Signed: true},
+			status: secure.StatusValid,
+			text:   "Hello Bob",
+		},
+		{
+			name: "smime enveloped",
+			raw:  must(securetest.SMIMEEnveloped(securityHeader, entity, k.bob.Certificate)),
+			want: layer{Part: "1", Type: "smime", Encrypted: true, Decrypted: true},
+			text: "Hello Bob",
+		},
+		{
+			name:       "smime enveloped without key",
+			raw:        must(securetest.SMIMEEnveloped(securityHeader, entity, k.bob.Certificate)),
+			config:     &secure.Config{},
+			want:       layer{Part: "1", Type: "smime", Encrypted: true},
+			attachment: "application/pkcs7-mime",
+		},
+		{
+			name:   "pgp signed",
+			raw:    pgpSigned,
+			want:   layer{Type: "pgp", Signed: true},
+			status: secure.StatusValid,
+			text:   "Hello Bob",
+		},
+		{
+			name:   "pgp signed by unknown key",
+			raw:    pgpSigned,
+			config: &secure.Config{},
+			want:   layer{Type: "pgp", Signed: true},
+			status: secure.StatusUnknownKey,
+			text:   "Hello Bob",
+		},
+		{
+			name:   "pgp signed then tampered",
+			raw:    bytes.Replace(pgpSigned, []byte("Hello Bob"), []byte("Hello Eve"), 1),
+			want:   layer{Type: "pgp", Signed: true},
+			status: secure.StatusInvalid,
+			text:   "Hello Eve",
+		},
+		{
+			name:   "pgp encrypted and signed",
+			raw:    must(securetest.PGPEncrypted(securityHeader, entity, k.pgpBob, k.pgpAlice)),
+			want:   layer{Type: "pgp", Signed: true, Encrypted: true, Decrypted: true},
+			status: secure.StatusValid,
+			text:   "Hello Bob",
+		},
+		{
+			name: "pgp encrypted",
+			raw:  must(securetest.PGPEncrypted(securityHeader, entity, k.pgpBob, nil)),
+			want: layer{Type: "pgp", Encrypted: true, Decrypted: true},
+			text: "Hello Bob",
+		},
+		{
+			name:       "pgp encrypted without key",
+			raw:        must(securetest.PGPEncrypted(securityHeader, entity, k.pgpBob, nil)),
+			config:     &secure.Config{},
+			want:       layer{Type: "pgp", Encrypted: true},
+			attachment: "application/octet-stream",
+		},
+		{
+			name:   "inline pgp clearsigned",
+			raw:    securetest.TextMessage(securityHeader, "Hi,\n\n"+clearSigned+"\n-- \nAlice\n"),
+			want:   layer{Part: "1", Type: "pgp", Inline: true, Signed: true},
+			status: secure.StatusValid,
+			text:   "Hi,\r\n\r\nHello Bob\r\n-- \r\nAlice\r\n",
+		},
+		{
+			name: "inline pgp encrypted",
+			raw:  securetest.TextMessage(securityHeader, "Hi,\n\n"+inlineEncrypted+"\n"),
+			want: layer{Part: "1", Type: "pgp", Inline: true, Encrypted: true, Decrypted: true},
+			text: "Hi,\r\n\r\nHello Bob\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			if config == nil {
+				config = bobConfig(k)
+			}
+			msg, err := ParseWithOptions(bytes.NewReader(tt.raw), &Options{Secure: config})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Security) != 1 {
+				t.Fatalf("got %d security layers, want 1: %+v", len(msg.Security), msg.Security)
+			}
+			sec := msg.Security[0]
+			got := layer{Part: sec.Part, Type: sec.Type, Inline: sec.Inline, Signed: sec.Signed, Encrypted: sec.Encrypted, Decrypted: sec.Decrypted}
+			if got != tt.want {
+				t.Errorf("security = %+v, want %+v", got, tt.want)
+			}
+			switch {
+			case tt.status == "" && sec.Signature != nil:
+				t.Errorf("unexpected signature %+v", sec.Signature)
+			case tt.status != "" && sec.Signature == nil:
+				t.Errorf("no signature, want %s (error %q)", tt.status, sec.Error)
+			case tt.status != "" && sec.Signature.Status != tt.status:
+				t.Errorf("signature status = %s (%s), want %s", sec.Signature.Status, sec.Signature.Error, tt.status)
+			case tt.status != "" && tt.status != secure.StatusUnknownKey && sec.Signature.Signer.Email != "alice@example.com":
+				t.Errorf("signer = %+v", sec.Signature.Signer)
+			}
+			if tt.want.Signed && !tt.want.Encrypted && len(sec.SignedContent) == 0 {
+				t.Error("signed content is empty")
+			}
+			if tt.want.Encrypted && !tt.want.Decrypted && sec.Error == "" {
+				t.Error("locked content has no error")
+			}
+			if tt.text != "" && !strings.Contains(msg.Text, tt.text) {
+				t.Errorf("text = %q, want it to contain %q", msg.Text, tt.text)
+			}
+			if strings.Contains(msg.Text, "-----BEGIN PGP") {
+				t.Errorf("text still holds armor: %q", msg.Text)
+			}
+			var types []string
+			for _, a := range msg.Attachments {
+				types = append(types, a.ContentType)
+			}
+			if tt.attachment == "" && len(types) > 0 || tt.attachment != "" && (len(types) != 1 || types[0] != tt.attachment) {
+				t.Errorf("attachments = %v, want %q", types, tt.attachment)
+			}
+		})
+	}
+}
+
+// TestSignedContent checks that the content a multipart/signed signature
+// covers is the first part byte for byte.
+func TestSignedContent(t *testing.T) {
+	k := generateKeys(t)
+	entity := []byte("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nHello =\r\nBob\r\n\r\n")
+	raw, err := securetest.PGPSigned(securityHeader, entity, k.pgpAlice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParseWithOptions(bytes.NewReader(raw), &Options{Secure: bobConfig(k)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Security) != 1 || !bytes.Equal(msg.Security[0].SignedContent, entity) {
+		t.Fatalf("signed content = %q, want %q", msg.Security[0].SignedContent, entity)
+	}
+	if msg.Security[0].Signature.Status != secure.StatusValid {
+		t.Errorf("status = %s: %s", msg.Security[0].Signature.Status, msg.Security[0].Signature.Error)
+	}
+}
+
+func TestSignerIsNotSender(t *testing.T) {
+	k := generateKeys(t)
+	raw, err := securetest.SMIMESigned("From: mallory@example.com\r\nSubject: Hi\r\n", securetest.Entity("Hi\n"), k.alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParseWithOptions(bytes.NewReader(raw), &Options{Secure: bobConfig(k)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Warnings) != 1 || !strings.Contains(msg.Warnings[0], "alice@example.com") {
+		t.Errorf("warnings = %q", msg.Warnings)
+	}
+}
+
+func TestSecurityWithoutConfig(t *testing.T) {
+	k := generateKeys(t)
+	raw, err := securetest.SMIMESigned(securityHeader, securetest.Entity("Hi\n"), k.alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Parse(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Security) != 1 || msg.Security[0].Signature.Status != secure.StatusUntrusted {
+		t.Errorf("security = %+v", msg.Security)
+	}
+}
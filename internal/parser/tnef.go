@@ -0,0 +1,102 @@
+package parser
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/quzhi1/imap-playground/internal/tnef"
+)
+
+// tnefBodyName is the file name given to the RTF body of a winmail.dat,
+// which has none of its own.
+const tnefBodyName = "body.rtf"
+
+func isTNEF(mediaType, filename string) bool {
+	switch mediaType {
+	case "application/ms-tnef", "application/vnd.ms-tnef":
+		return true
+	case "application/octet-stream":
+		return strings.EqualFold(filename, "winmail.dat")
+	}
+	return false
+}
+
+// parseTNEF opens a winmail.dat part. Its attachments are listed as if they
+// had been sent as MIME parts, under their own names; its bodies fill in
+// Text and HTML when the message has none, and its RTF body is listed as
+// body.rtf. Attached Outlook items become embedded messages. A part that
+// does not decode is kept as an attachment.
+func parseTNEF(header textproto.Header, decoded io.Reader, msg *Message, opts *Options, section, mediaType string, problem func(format string, args ...any)) error {
+	raw, err := io.ReadAll(decoded)
+	if err != nil {
+		msg.warn("%s part: %v", mediaType, err)
+	}
+	content, err := tnef.Decode(raw)
+	if content == nil {
+		problem("%v", err)
+		return attach(header, bytes.NewReader(raw), msg, opts, mediaType, false)
+	}
+	if err != nil {
+		problem("%v", err)
+	}
+	return addTNEF(content, msg, opts, section)
+}
+
+func addTNEF(content *tnef.Message, msg *Message, opts *Options, section string) error {
+	for _, w := range content.Warnings {
+		msg.warn("TNEF part %s: %s", section, w)
+	}
+	if msg.Text == "" {
+		msg.Text = content.Body
+	}
+	if msg.HTML == "" {
+		msg.HTML = content.HTML
+	}
+	if content.RTF != nil {
+		header := tnefHeader("application/rtf", tnefBodyName, "")
+		if err := attach(header, bytes.NewReader(content.RTF), msg, opts, "application/rtf", false); err != nil {
+			return err
+		}
+	}
+	for _, a := range content.Attachments {
+		if a.Embedded != nil {
+			embedded := &Message{}
+			embedded.Subject = a.Embedded.Subject
+			if err := addTNEF(a.Embedded, embedded, opts, section); err != nil {
+				return err
+			}
+			msg.Embedded = append(msg.Embedded, embedded)
+			continue
+		}
+		// Outlook leaves out the MIME type of most attachments. The name's
+		// extension is not looked up: the answer would depend on the host.
+		mediaType, _, _ := strings.Cut(strings.ToLower(a.MIMEType), ";")
+		if mediaType = strings.TrimSpace(mediaType); mediaType == "" {
+			mediaType = "application/octet-stream"
+		}
+		header := tnefHeader(mediaType, a.Name, a.ContentID)
+		if err := attach(header, bytes.NewReader(a.Data), msg, opts, mediaType, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tnefHeader makes up the MIME header a TNEF attachment would have had.
+func tnefHeader(mediaType, name, contentID string) textproto.Header {
+	var header textproto.Header
+	header.Set("Content-Type", mediaType)
+	disposition := "attachment"
+	if contentID != "" {
+		disposition = "inline"
+		header.Set("Content-Id", "<"+contentID+">")
+	}
+	if withName := mime.FormatMediaType(disposition, map[string]string{"filename": name}); name != "" && withName != "" {
+		disposition = withName
+	}
+	header.Set("Content-Disposition", disposition)
+	return header
+}
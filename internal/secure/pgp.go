@@ -0,0 +1,230 @@
+package secure
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	beginSigned    = "-----BEGIN PGP SIGNED MESSAGE-----"
+	beginMessage   = "-----BEGIN PGP MESSAGE-----"
+	endMessage     = "-----END PGP MESSAGE-----"
+	pgpArmorPrefix = "-----BEGIN PGP"
+)
+
+func (c *Config) pgpConfig() *packet.Config {
+	return &packet.Config{Time: c.now}
+}
+
+// keyring is every key the Config knows: trusted public keys for
+// signatures, secret keys for decryption.
+func (c *Config) keyring() openpgp.EntityList {
+	if c == nil {
+		return nil
+	}
+	return append(append(openpgp.EntityList{}, c.SecretKeys...), c.Keyring...)
+}
+
+// VerifyPGP checks a detached OpenPGP signature, armored or binary, over
+// content (the signed part of a PGP/MIME message, canonicalized to CRLF).
+func (c *Config) VerifyPGP(content, signature []byte) *Signature {
+	signature, err := dearmor(signature)
+	if err != nil {
+		return &Signature{Status: StatusInvalid, Error: err.Error()}
+	}
+	sig, entity, err := openpgp.VerifyDetachedSignature(c.keyring(), bytes.NewReader(content), bytes.NewReader(signature), c.pgpConfig())
+	return c.pgpResult(sig, entity, issuerKeyID(signature), err)
+}
+
+// DecryptPGP decrypts an OpenPGP message, armored or binary. If the message
+// was also signed, the signature is checked and returned; otherwise the
+// returned Signature is nil.
+func (c *Config) DecryptPGP(ciphertext []byte) ([]byte, *Signature, error) {
+	ciphertext, err := dearmor(ciphertext)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c == nil || len(c.SecretKeys) == 0 {
+		return nil, nil, ErrNoKey
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(ciphertext), c.keyring(), nil, c.pgpConfig())
+	if err != nil {
+		if errors.Is(err, pgperrors.ErrKeyIncorrect) {
+			return nil, nil, ErrNoKey
+		}
+		return nil, nil, fmt.Errorf("secure: decrypting PGP message: %w", err)
+	}
+	// The signature is only checked once the body has been read to the end.
+	plaintext, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("secure: decrypting PGP message: %w", err)
+	}
+	if !md.IsSigned {
+		return plaintext, nil, nil
+	}
+	var entity *openpgp.Entity
+	if md.SignedBy != nil {
+		entity = md.SignedBy.Entity
+	}
+	sigErr := md.SignatureError
+	if md.SignedBy == nil && sigErr == nil {
+		sigErr = pgperrors.ErrUnknownIssuer
+	}
+	return plaintext, c.pgpResult(md.Signature, entity, md.SignedByKeyId, sigErr), nil
+}
+
+// ClearSigned finds the first cleartext-signed block in text and checks its
+// signature. It returns text with the block replaced by the signed text, the
+// signed text itself, or found=false if there is no such block.
+func (c *Config) ClearSigned(text []byte) (opened, signed []byte, sig *Signature, found bool) {
+	start := armorLine(text, beginSigned)
+	if start < 0 {
+		return text, nil, nil, false
+	}
+	block, rest := clearsign.Decode(text[start:])
+	if block == nil {
+		return text, nil, nil, false
+	}
+	signature, err := io.ReadAll(block.ArmoredSignature.Body)
+	if err != nil {
+		sig = &Signature{Status: StatusInvalid, Error: err.Error()}
+	} else {
+		var packetSig *packet.Signature
+		var entity *openpgp.Entity
+		packetSig, entity, err = openpgp.VerifyDetachedSignature(c.keyring(), bytes.NewReader(block.Bytes), bytes.NewReader(signature), c.pgpConfig())
+		sig = c.pgpResult(packetSig, entity, issuerKeyID(signature), err)
+	}
+	opened = append(append(append([]byte{}, text[:start]...), block.Plaintext...), rest...)
+	return opened, block.Plaintext, sig, true
+}
+
+// InlineEncrypted finds the first armored PGP message in text and decrypts
+// it. It returns text with the block replaced by the plaintext, or
+// found=false if there is no such block. If the block cannot be decrypted,
+// text comes back unchanged with the error.
+func (c *Config) InlineEncrypted(text []byte) (opened []byte, sig *Signature, found bool, err error) {
+	start := armorLine(text, beginMessage)
+	if start < 0 {
+		return text, nil, false, nil
+	}
+	end := bytes.Index(text[start:], []byte(endMessage))
+	if end < 0 {
+		return text, nil, true, errors.New("secure: PGP message has no end line")
+	}
+	end += start + len(endMessage)
+	plaintext, sig, err := c.DecryptPGP(text[start:end])
+	if err != nil {
+		return text, nil, true, err
+	}
+	opened = append(append(append([]byte{}, text[:start]...), plaintext...), text[end:]...)
+	return opened, sig, true, nil
+}
+
+// HasInlinePGP reports whether text holds a cleartext-signed block or an
+// armored PGP message.
+func HasInlinePGP(text []byte) bool {
+	return armorLine(text, beginSigned) >= 0 || armorLine(text, beginMessage) >= 0
+}
+
+// armorLine returns the offset of marker at the start of a line, or -1.
+func armorLine(text []byte, marker string) int {
+	for offset := 0; ; {
+		i := bytes.Index(text[offset:], []byte(marker))
+		if i < 0 {
+			return -1
+		}
+		i += offset
+		if i == 0 || text[i-1] == '\n' {
+			return i
+		}
+		offset = i + len(marker)
+	}
+}
+
+// dearmor returns the binary form of data, which may be armored.
+func dearmor(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(trimmed, []byte(pgpArmorPrefix)) {
+		return data, nil
+	}
+	block, err := armor.Decode(bytes.NewReader(trimmed))
+	if err != nil {
+		return nil, fmt.Errorf("secure: reading PGP armor: %w", err)
+	}
+	return io.ReadAll(block.Body)
+}
+
+// issuerKeyID returns the key ID of the first signature packet, so an
+// unknown signer can still be named.
+func issuerKeyID(signature []byte) uint64 {
+	p, err := packet.NewReader(bytes.NewReader(signature)).Next()
+	if err != nil {
+		return 0
+	}
+	if sig, ok := p.(*packet.Signature); ok && sig.IssuerKeyId != nil {
+		return *sig.IssuerKeyId
+	}
+	return 0
+}
+
+func keyIDString(id uint64) string {
+	if id == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%016X", id)
+}
+
+func (c *Config) pgpResult(sig *packet.Signature, entity *openpgp.Entity, keyID uint64, err error) *Signature {
+	if sig != nil && sig.IssuerKeyId != nil {
+		keyID = *sig.IssuerKeyId
+	}
+	result := &Signature{Status: StatusValid, Signer: Signer{KeyID: keyIDString(keyID)}}
+	if sig != nil {
+		t := sig.CreationTime
+		result.SigningTime = &t
+	}
+	// A signature that does not match still names a key; if that key is
+	// known, say whose it is.
+	if entity == nil && keyID != 0 {
+		if keys := c.keyring().KeysById(keyID); len(keys) > 0 {
+			entity = keys[0].Entity
+		}
+	}
+	if entity != nil {
+		result.Signer.Fingerprint = strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint))
+		created := entity.PrimaryKey.CreationTime
+		result.Signer.NotBefore = &created
+		if identity := entity.PrimaryIdentity(); identity != nil && identity.UserId != nil {
+			result.Signer.Name = identity.UserId.Name
+			result.Signer.Email = identity.UserId.Email
+			if self := identity.SelfSignature; self != nil && self.KeyLifetimeSecs != nil && *self.KeyLifetimeSecs > 0 {
+				expires := created.Add(time.Duration(*self.KeyLifetimeSecs) * time.Second)
+				result.Signer.NotAfter = &expires
+			}
+		}
+	}
+	if err == nil {
+		return result
+	}
+	result.Error = err.Error()
+	switch {
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		result.Status = StatusUnknownKey
+	case errors.Is(err, pgperrors.ErrSignatureExpired), errors.Is(err, pgperrors.ErrKeyExpired):
+		result.Status = StatusExpired
+	default:
+		result.Status = StatusInvalid
+	}
+	return result
+}
@@ -0,0 +1,267 @@
+// Package secure verifies and decrypts S/MIME and OpenPGP content. It holds
+// the local trust store (trusted root certificates and PGP public keys) and
+// the local keys used for decryption, and reports who signed what and
+// whether the signature holds. The parser finds the signed and encrypted
+// parts; this package only does the cryptography.
+package secure
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Status is the outcome of checking one signature.
+type Status string
+
+const (
+	// StatusValid means the content is unchanged and the signer is trusted:
+	// the certificate chains to a root in the trust store, or the PGP key is
+	// in the keyring.
+	StatusValid Status = "valid"
+	// StatusUntrusted means the content is unchanged, but the S/MIME
+	// certificate does not chain to a trusted root.
+	StatusUntrusted Status = "untrusted"
+	// StatusUnknownKey means the PGP key that made the signature is not in
+	// the keyring, so nothing could be checked.
+	StatusUnknownKey Status = "unknown_key"
+	// StatusExpired means the signer's certificate or key was not valid when
+	// the message was signed.
+	StatusExpired Status = "expired"
+	// StatusInvalid means the signature does not match the content: it was
+	// changed after signing, or the signature is broken.
+	StatusInvalid Status = "invalid"
+)
+
+// Signature is the result of checking one signature.
+type Signature struct {
+	Status      Status     `json:"status"`
+	Signer      Signer     `json:"signer"`
+	SigningTime *time.Time `json:"signing_time,omitempty"`
+	// Error explains a status other than valid.
+	Error string `json:"error,omitempty"`
+}
+
+// Signer identifies who made a signature.
+type Signer struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	// Issuer is the S/MIME certificate issuer.
+	Issuer string `json:"issuer,omitempty"`
+	// KeyID is the 16 hex digit PGP key ID. It is known even when the key
+	// is not.
+	KeyID string `json:"key_id,omitempty"`
+	// Fingerprint is the SHA-256 of an S/MIME certificate, or the PGP key
+	// fingerprint, in hex.
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+}
+
+// Identity is an S/MIME certificate with its private key.
+type Identity struct {
+	Certificate *x509.Certificate
+	Key         crypto.PrivateKey
+}
+
+// Config is the local trust store and keys. The zero Config checks
+// signatures but trusts nobody and decrypts nothing.
+type Config struct {
+	// Roots are the trusted S/MIME certificates. Signers must chain to one
+	// of them; a self-signed signer certificate can be trusted directly.
+	Roots *x509.CertPool
+	// Keyring holds the trusted PGP public keys.
+	Keyring openpgp.EntityList
+	// Identities decrypt S/MIME messages.
+	Identities []Identity
+	// SecretKeys decrypt PGP messages. Encrypted keys must be unlocked.
+	SecretKeys openpgp.EntityList
+	// Now replaces the clock when checking validity, for tests.
+	Now func() time.Time
+}
+
+func (c *Config) now() time.Time {
+	if c != nil && c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// ErrNoKey is returned when none of the local keys can decrypt a message.
+var ErrNoKey = errors.New("secure: no local key can decrypt this message")
+
+// Load builds a Config from a trust store directory and a key directory;
+// either may be empty.
+//
+// In trustDir, .pem, .crt and .cer files are trusted certificates (PEM or
+// DER) and .asc, .gpg and .pgp files are trusted PGP public keys (armored or
+// binary). In keyDir, .pem files hold an S/MIME certificate and its private
+// key, and .asc, .gpg and .pgp files hold PGP secret keys; encrypted ones are
+// unlocked with passphrase.
+func Load(trustDir, keyDir string, passphrase []byte) (*Config, error) {
+	c := &Config{}
+	if trustDir != "" {
+		c.Roots = x509.NewCertPool()
+		err := eachFile(trustDir, func(path, ext string, data []byte) error {
+			switch ext {
+			case ".pem", ".crt", ".cer":
+				certs, err := parseCertificates(data)
+				if err != nil {
+					return err
+				}
+				for _, cert := range certs {
+					c.Roots.AddCert(cert)
+				}
+			case ".asc", ".gpg", ".pgp":
+				keys, err := readKeyRing(data)
+				if err != nil {
+					return err
+				}
+				c.Keyring = append(c.Keyring, keys...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if keyDir != "" {
+		err := eachFile(keyDir, func(path, ext string, data []byte) error {
+			switch ext {
+			case ".pem":
+				identity, err := parseIdentity(data)
+				if err != nil {
+					return err
+				}
+				c.Identities = append(c.Identities, identity)
+			case ".asc", ".gpg", ".pgp":
+				keys, err := readKeyRing(data)
+				if err != nil {
+					return err
+				}
+				if err := unlock(keys, passphrase); err != nil {
+					return err
+				}
+				c.SecretKeys = append(c.SecretKeys, keys...)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func eachFile(dir string, fn func(path, ext string, data []byte) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := fn(path, strings.ToLower(filepath.Ext(path)), data); err != nil {
+			return fmt.Errorf("secure: %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// parseCertificates reads every certificate in PEM data, or one DER
+// certificate.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+// parseIdentity reads a certificate and its private key from PEM data.
+func parseIdentity(data []byte) (Identity, error) {
+	var identity Identity
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var err error
+		switch block.Type {
+		case "CERTIFICATE":
+			if identity.Certificate == nil {
+				identity.Certificate, err = x509.ParseCertificate(block.Bytes)
+			}
+		case "PRIVATE KEY":
+			identity.Key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			identity.Key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			identity.Key, err = x509.ParseECPrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return identity, err
+		}
+	}
+	if identity.Certificate == nil || identity.Key == nil {
+		return identity, errors.New("need a certificate and a private key")
+	}
+	return identity, nil
+}
+
+func readKeyRing(data []byte) (openpgp.EntityList, error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// unlock decrypts every encrypted private key and subkey in keys.
+func unlock(keys openpgp.EntityList, passphrase []byte) error {
+	for _, entity := range keys {
+		if entity.PrivateKey == nil {
+			return errors.New("not a secret key")
+		}
+		if entity.PrivateKey.Encrypted {
+			if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+				return err
+			}
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
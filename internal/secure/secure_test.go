@@ -0,0 +1,235 @@
+package secure_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/quzhi1/imap-playground/internal/secure"
+	"github.com/quzhi1/imap-playground/internal/secure/securetest"
+	"github.com/smallstep/pkcs7"
+)
+
+func TestSMIME(t *testing.T) {
+	ca, err := securetest.NewCA("Root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := ca.Issue("Alice", "alice@example.com", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	cfg := &secure.Config{Roots: roots, Identities: []secure.Identity{alice}}
+
+	entity := securetest.Entity("Hello\n")
+	opaque, err := signOpaque(entity, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, err := secure.DetectSMIME(opaque); err != nil || kind != secure.SMIMESigned {
+		t.Fatalf("DetectSMIME(signed) = %v, %v", kind, err)
+	}
+	sig, content, err := cfg.VerifySMIME(opaque, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Status != secure.StatusValid || !bytes.Equal(content, entity) {
+		t.Errorf("VerifySMIME = %+v, %q", sig, content)
+	}
+	if sig.Signer.Email != "alice@example.com" || sig.Signer.Name != "Alice" || sig.SigningTime == nil {
+		t.Errorf("signer = %+v", sig.Signer)
+	}
+
+	if sig, _, _ := (*secure.Config)(nil).VerifySMIME(opaque, nil); sig.Status != secure.StatusUntrusted {
+		t.Errorf("without trust store: status = %s", sig.Status)
+	}
+
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+	enveloped, err := pkcs7.Encrypt(entity, []*x509.Certificate{alice.Certificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, err := secure.DetectSMIME(enveloped); err != nil || kind != secure.SMIMEEnveloped {
+		t.Fatalf("DetectSMIME(enveloped) = %v, %v", kind, err)
+	}
+	plaintext, err := cfg.DecryptSMIME(enveloped)
+	if err != nil || !bytes.Equal(plaintext, entity) {
+		t.Errorf("DecryptSMIME = %q, %v", plaintext, err)
+	}
+	if _, err := (&secure.Config{}).DecryptSMIME(enveloped); !errors.Is(err, secure.ErrNoKey) {
+		t.Errorf("DecryptSMIME without key: err = %v, want ErrNoKey", err)
+	}
+}
+
+func TestPGP(t *testing.T) {
+	alice, err := securetest.NewPGPKey("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := securetest.NewPGPKey("Bob", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &secure.Config{Keyring: openpgp.EntityList{alice}, SecretKeys: openpgp.EntityList{bob}}
+
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, alice, bytes.NewReader([]byte("Hello\r\n")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if sig := cfg.VerifyPGP([]byte("Hello\r\n"), signature.Bytes()); sig.Status != secure.StatusValid || sig.Signer.Email != "alice@example.com" {
+		t.Errorf("VerifyPGP = %+v", sig)
+	}
+	if sig := cfg.VerifyPGP([]byte("Hallo\r\n"), signature.Bytes()); sig.Status != secure.StatusInvalid {
+		t.Errorf("VerifyPGP(tampered) status = %s", sig.Status)
+	}
+	sig := (&secure.Config{}).VerifyPGP([]byte("Hello\r\n"), signature.Bytes())
+	if sig.Status != secure.StatusUnknownKey || sig.Signer.KeyID == "" {
+		t.Errorf("VerifyPGP(unknown key) = %+v", sig)
+	}
+
+	clear, err := securetest.PGPClearSigned("Hello\n", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, signed, sig, found := cfg.ClearSigned([]byte("> quoted\n" + clear + "bye\n"))
+	if !found || sig.Status != secure.StatusValid || string(signed) != "Hello\n" || string(opened) != "> quoted\nHello\nbye\n" {
+		t.Errorf("ClearSigned = %q, %q, %+v, %v", opened, signed, sig, found)
+	}
+
+	encrypted, err := securetest.PGPInlineEncrypted("Secret\n", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, sig, found, err = cfg.InlineEncrypted([]byte("Hi\n" + encrypted + "\n"))
+	if err != nil || !found || sig != nil || string(opened) != "Hi\nSecret\n\n" {
+		t.Errorf("InlineEncrypted = %q, %+v, %v, %v", opened, sig, found, err)
+	}
+	if _, _, _, err := (&secure.Config{}).InlineEncrypted([]byte(encrypted)); !errors.Is(err, secure.ErrNoKey) {
+		t.Errorf("InlineEncrypted without key: err = %v, want ErrNoKey", err)
+	}
+	if secure.HasInlinePGP([]byte("see -----BEGIN PGP MESSAGE----- in the middle")) {
+		t.Error("HasInlinePGP matched a marker that does not start a line")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ca, err := securetest.NewCA("Root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := ca.Issue("Alice", "alice@example.com", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := securetest.NewPGPKey("Signer", "signer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := securetest.NewPGPKey("Bob", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trustDir, keyDir := t.TempDir(), t.TempDir()
+	write(t, filepath.Join(trustDir, "root.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw}))
+	public, err := securetest.PublicKey(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(trustDir, "signer.asc"), public)
+	write(t, filepath.Join(trustDir, "README"), []byte("ignored"))
+
+	key, err := x509.MarshalPKCS8PrivateKey(alice.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(keyDir, "alice.pem"), append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: alice.Certificate.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...))
+	// Encrypting the keys in place would lock the entity the test still
+	// uses to encrypt, so the secret key is written from a fresh copy.
+	secret := armoredSecretKey(t, bob, []byte("hunter2"))
+	write(t, filepath.Join(keyDir, "bob.asc"), secret)
+
+	cfg, err := secure.Load(trustDir, keyDir, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Keyring) != 1 || len(cfg.Identities) != 1 || len(cfg.SecretKeys) != 1 {
+		t.Fatalf("Load: %d public keys, %d identities, %d secret keys", len(cfg.Keyring), len(cfg.Identities), len(cfg.SecretKeys))
+	}
+
+	opaque, err := signOpaque(securetest.Entity("Hello\n"), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig, _, err := cfg.VerifySMIME(opaque, nil); err != nil || sig.Status != secure.StatusValid {
+		t.Errorf("VerifySMIME with loaded roots = %+v, %v", sig, err)
+	}
+	encrypted, err := securetest.PGPInlineEncrypted("Secret\n", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, _, err := cfg.DecryptPGP([]byte(encrypted)); err != nil || string(plaintext) != "Secret\n" {
+		t.Errorf("DecryptPGP with loaded key = %q, %v", plaintext, err)
+	}
+
+	if _, err := secure.Load("", keyDir, []byte("wrong")); err == nil {
+		t.Error("Load with the wrong passphrase succeeded")
+	}
+}
+
+func signOpaque(content []byte, signer secure.Identity) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.AddSigner(signer.Certificate, signer.Key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
+
+func armoredSecretKey(t *testing.T, key *openpgp.Entity, passphrase []byte) []byte {
+	t.Helper()
+	var raw bytes.Buffer
+	if err := key.SerializePrivate(&raw, nil); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := openpgp.ReadEntity(packet.NewReader(&raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copied.EncryptPrivateKeys(passphrase, nil); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copied.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func write(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,284 @@
+// Package securetest generates S/MIME certificates and PGP keys and builds
+// signed and encrypted messages with them, for tests and demos of the
+// secure package. Nothing here is meant for real keys.
+package securetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/quzhi1/imap-playground/internal/secure"
+	"github.com/smallstep/pkcs7"
+)
+
+// CA is a certificate authority for test certificates.
+type CA struct {
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+	serial      int64
+}
+
+// NewCA returns a self-signed CA valid from an hour ago for a year.
+func NewCA(name string) (*CA, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"Test CA"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Certificate: cert, Key: key, serial: 1}, nil
+}
+
+// Issue returns an S/MIME certificate for email signed by the CA, valid
+// between notBefore and notAfter, with its private key.
+func (ca *CA) Issue(name, email string, notBefore, notAfter time.Time) (secure.Identity, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return secure.Identity{}, err
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(ca.serial),
+		Subject:        pkix.Name{CommonName: name},
+		EmailAddresses: []string{email},
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, &key.PublicKey, ca.Key)
+	if err != nil {
+		return secure.Identity{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return secure.Identity{}, err
+	}
+	return secure.Identity{Certificate: cert, Key: key}, nil
+}
+
+// NewPGPKey returns an Ed25519 key pair with one user ID.
+func NewPGPKey(name, email string) (*openpgp.Entity, error) {
+	return openpgp.NewEntity(name, "", email, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+}
+
+// PublicKey returns the armored public part of key, as it would sit in a
+// trust store.
+func PublicKey(key *openpgp.Entity) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.Serialize(w); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Entity returns a text/plain MIME entity holding text.
+func Entity(text string) []byte {
+	return []byte("Content-Type: text/plain; charset=utf-8\r\n\r\n" + crlf(text))
+}
+
+// SMIMESigned wraps entity in a multipart/signed message with a detached
+// S/MIME signature. header holds the top-level fields such as From and
+// Subject, each ending in CRLF.
+func SMIMESigned(header string, entity []byte, signer secure.Identity) ([]byte, error) {
+	signature, err := smimeSign(entity, signer, true)
+	if err != nil {
+		return nil, err
+	}
+	return signed(header, `application/pkcs7-signature"; micalg=sha-256`, entity,
+		"Content-Type: application/pkcs7-signature; name=smime.p7s\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"Content-Disposition: attachment; filename=smime.p7s\r\n\r\n"+
+			wrap(base64.StdEncoding.EncodeToString(signature))), nil
+}
+
+// SMIMEOpaque returns an application/pkcs7-mime signed-data message, the
+// form that carries the content inside the signature.
+func SMIMEOpaque(header string, entity []byte, signer secure.Identity) ([]byte, error) {
+	der, err := smimeSign(entity, signer, false)
+	if err != nil {
+		return nil, err
+	}
+	return pkcs7Message(header, "signed-data", der), nil
+}
+
+// SMIMEEnveloped returns an application/pkcs7-mime enveloped-data message
+// encrypted to recipient with AES-256-CBC.
+func SMIMEEnveloped(header string, entity []byte, recipient *x509.Certificate) ([]byte, error) {
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+	der, err := pkcs7.Encrypt(entity, []*x509.Certificate{recipient})
+	if err != nil {
+		return nil, err
+	}
+	return pkcs7Message(header, "enveloped-data", der), nil
+}
+
+// PGPSigned wraps entity in a PGP/MIME multipart/signed message.
+func PGPSigned(header string, entity []byte, key *openpgp.Entity) ([]byte, error) {
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, key, bytes.NewReader(entity), nil); err != nil {
+		return nil, err
+	}
+	return signed(header, `application/pgp-signature"; micalg=pgp-sha256`, entity,
+		"Content-Type: application/pgp-signature; name=signature.asc\r\n"+
+			"Content-Disposition: attachment; filename=signature.asc\r\n\r\n"+
+			crlf(signature.String())+"\r\n"), nil
+}
+
+// PGPEncrypted returns a PGP/MIME multipart/encrypted message with entity
+// encrypted to to, and signed by signer unless it is nil.
+func PGPEncrypted(header string, entity []byte, to, signer *openpgp.Entity) ([]byte, error) {
+	armored, err := encrypt(entity, to, signer)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(header +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"encrypted\"\r\n" +
+		"\r\n" +
+		"--encrypted\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n" +
+		"\r\n" +
+		"Version: 1\r\n" +
+		"\r\n" +
+		"--encrypted\r\n" +
+		"Content-Type: application/octet-stream; name=encrypted.asc\r\n" +
+		"\r\n" +
+		armored + "\r\n" +
+		"--encrypted--\r\n"), nil
+}
+
+// PGPClearSigned returns text as a cleartext-signed block, the way inline
+// PGP mailers send it.
+func PGPClearSigned(text string, key *openpgp.Entity) (string, error) {
+	var b bytes.Buffer
+	w, err := clearsign.Encode(&b, key.PrivateKey, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// PGPInlineEncrypted returns text as an armored PGP message encrypted to to.
+func PGPInlineEncrypted(text string, to *openpgp.Entity) (string, error) {
+	armored, err := encrypt([]byte(text), to, nil)
+	return strings.ReplaceAll(armored, "\r\n", "\n"), err
+}
+
+// TextMessage returns a single-part text/plain message with body as is.
+func TextMessage(header, body string) []byte {
+	return []byte(header + "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + crlf(body))
+}
+
+func smimeSign(content []byte, signer secure.Identity, detached bool) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSigner(signer.Certificate, signer.Key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	if detached {
+		sd.Detach()
+	}
+	return sd.Finish()
+}
+
+func signed(header, protocol string, entity []byte, signaturePart string) []byte {
+	return []byte(header +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/signed; protocol=\"" + protocol + "; boundary=\"signed\"\r\n" +
+		"\r\n" +
+		"This is a signed message.\r\n" +
+		"--signed\r\n" +
+		string(entity) + "\r\n" +
+		"--signed\r\n" +
+		signaturePart +
+		"--signed--\r\n")
+}
+
+func pkcs7Message(header, smimeType string, der []byte) []byte {
+	return []byte(header +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=" + smimeType + "; name=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=smime.p7m\r\n" +
+		"\r\n" +
+		wrap(base64.StdEncoding.EncodeToString(der)))
+}
+
+func encrypt(plaintext []byte, to, signer *openpgp.Entity) (string, error) {
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{to}, signer, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return crlf(b.String()), nil
+}
+
+// wrap breaks base64 into 76 character CRLF lines.
+func wrap(s string) string {
+	var b strings.Builder
+	for len(s) > 76 {
+		b.WriteString(s[:76] + "\r\n")
+		s = s[76:]
+	}
+	return b.String() + s + "\r\n"
+}
+
+func crlf(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
@@ -0,0 +1,165 @@
+package secure
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// SMIMEKind tells the two application/pkcs7-mime structures apart.
+type SMIMEKind int
+
+const (
+	// SMIMESigned is signed data: opaque signed content, or the signature
+	// of a multipart/signed message.
+	SMIMESigned SMIMEKind = iota + 1
+	// SMIMEEnveloped is encrypted content.
+	SMIMEEnveloped
+)
+
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// DetectSMIME reads a CMS structure (the transfer-decoded body of an
+// application/pkcs7-mime part) and says which kind it is. The smime-type
+// parameter is often missing or wrong, so the structure decides.
+func DetectSMIME(der []byte) (SMIMEKind, error) {
+	_, kind, err := parseSMIME(der)
+	return kind, err
+}
+
+func parseSMIME(der []byte) (*pkcs7.PKCS7, SMIMEKind, error) {
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, 0, fmt.Errorf("secure: reading S/MIME structure: %w", err)
+	}
+	if len(p7.Signers) > 0 {
+		return p7, SMIMESigned, nil
+	}
+	return p7, SMIMEEnveloped, nil
+}
+
+// VerifySMIME checks a CMS signature. For a detached signature
+// (multipart/signed) content is the signed part, canonicalized to CRLF; for
+// an opaque one (application/pkcs7-mime; smime-type=signed-data) content is
+// nil and the signed content is read from the structure. It returns the
+// result and the content that was checked.
+func (c *Config) VerifySMIME(signature, content []byte) (*Signature, []byte, error) {
+	p7, kind, err := parseSMIME(signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	if kind != SMIMESigned {
+		return nil, nil, errors.New("secure: S/MIME structure is not signed data")
+	}
+	if content != nil {
+		p7.Content = content
+	}
+	return c.verifySMIME(p7), p7.Content, nil
+}
+
+func (c *Config) verifySMIME(p7 *pkcs7.PKCS7) *Signature {
+	result := &Signature{Status: StatusValid}
+	signingTime := c.now()
+	var t time.Time
+	if err := p7.UnmarshalSignedAttribute(pkcs7.OIDAttributeSigningTime, &t); err == nil {
+		result.SigningTime = &t
+		signingTime = t
+	}
+	cert := p7.GetOnlySigner()
+	if cert == nil && len(p7.Certificates) > 0 {
+		cert = p7.Certificates[0]
+	}
+	if cert != nil {
+		result.Signer = smimeSigner(cert)
+	}
+
+	// Verify without a trust store checks the digest, the signature and the
+	// signing time against the certificate. The chain is checked below,
+	// where the reason it fails can still be told apart.
+	if err := p7.Verify(); err != nil {
+		var timeErr *pkcs7.SigningTimeNotValidError
+		if errors.As(err, &timeErr) {
+			result.Status = StatusExpired
+		} else {
+			result.Status = StatusInvalid
+		}
+		result.Error = err.Error()
+		return result
+	}
+	if c == nil || c.Roots == nil {
+		result.Status = StatusUntrusted
+		result.Error = "no trust store configured"
+		return result
+	}
+	intermediates := x509.NewCertPool()
+	for _, other := range p7.Certificates {
+		intermediates.AddCert(other)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         c.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		CurrentTime:   signingTime,
+	})
+	if err != nil {
+		var invalid x509.CertificateInvalidError
+		if errors.As(err, &invalid) && invalid.Reason == x509.Expired {
+			result.Status = StatusExpired
+		} else {
+			result.Status = StatusUntrusted
+		}
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func smimeSigner(cert *x509.Certificate) Signer {
+	sum := sha256.Sum256(cert.Raw)
+	signer := Signer{
+		Name:        cert.Subject.CommonName,
+		Issuer:      cert.Issuer.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotBefore:   &cert.NotBefore,
+		NotAfter:    &cert.NotAfter,
+	}
+	if len(cert.EmailAddresses) > 0 {
+		signer.Email = cert.EmailAddresses[0]
+	}
+	// Older certificates carry the address in the subject instead.
+	for _, name := range cert.Subject.Names {
+		if value, ok := name.Value.(string); ok && signer.Email == "" && name.Type.Equal(oidEmailAddress) {
+			signer.Email = value
+		}
+	}
+	return signer
+}
+
+// DecryptSMIME opens an enveloped CMS structure with the first local
+// identity it was encrypted to.
+func (c *Config) DecryptSMIME(der []byte) ([]byte, error) {
+	p7, kind, err := parseSMIME(der)
+	if err != nil {
+		return nil, err
+	}
+	if kind != SMIMEEnveloped {
+		return nil, errors.New("secure: S/MIME structure is not enveloped data")
+	}
+	if c == nil || len(c.Identities) == 0 {
+		return nil, ErrNoKey
+	}
+	var lastErr error
+	for _, identity := range c.Identities {
+		plaintext, err := p7.Decrypt(identity.Certificate, identity.Key)
+		if err == nil {
+			return plaintext, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNoKey, lastErr)
+}
@@ -0,0 +1,65 @@
+package session
+
+import (
+	"context"
+	"sync"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/rs/zerolog/log"
+)
+
+// Each runs fn on every item over up to concurrency connections. first is
+// an open connection, usually the one the items were listed on; the others
+// are dialed up front, and servers often cap connections per account, so a
+// dial that fails only lowers the concurrency. Items are handed out in
+// order, and fn is told which connection, numbered from 0, it runs on.
+//
+// When fn returns an error and its connection no longer answers NOOP, that
+// connection stops and the others take the remaining items. Once ctx is
+// done no more items are handed out. Each logs out of every connection
+// before returning, and returns how many it used.
+func Each[T any](ctx context.Context, first *imapclient.Client, dial Dialer, concurrency int, items []T, fn func(conn int, c *imapclient.Client, item T) error) int {
+	clients := []*imapclient.Client{first}
+	for len(clients) < concurrency && len(clients) < len(items) {
+		c, err := dial()
+		if err != nil {
+			log.Ctx(ctx).Warn().Err(err).Int("connections", len(clients)).Msg("Could not open another connection, continuing with fewer")
+			break
+		}
+		clients = append(clients, c)
+	}
+
+	queue := make(chan T, len(items))
+	for _, item := range items {
+		queue <- item
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for conn, c := range clients {
+		wg.Add(1)
+		go func(conn int, c *imapclient.Client) {
+			defer wg.Done()
+			defer Logout(c)
+			for item := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				err := fn(conn, c, item)
+				if err != nil && ctx.Err() == nil && c.Noop().Wait() != nil {
+					log.Ctx(ctx).Warn().Int("conn", conn).Msg("Connection lost, leaving its remaining items to the others")
+					return
+				}
+			}
+		}(conn, c)
+	}
+	wg.Wait()
+	return len(clients)
+}
+
+// Logout logs out of c, and closes it if the server does not answer.
+func Logout(c *imapclient.Client) {
+	if err := c.Logout().Wait(); err != nil {
+		c.Close()
+	}
+}
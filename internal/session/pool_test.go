@@ -0,0 +1,102 @@
+package session_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+	"github.com/quzhi1/imap-playground/internal/session"
+)
+
+// TestEach lets the server take only three connections out of the four
+// asked for: every item is still done, once.
+func TestEach(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	dials := 0
+	dial := func() (*imapclient.Client, error) {
+		if dials++; dials > 3 {
+			return nil, errors.New("too many connections")
+		}
+		return server.Config().Dial()
+	}
+	first, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		done  []int
+		conns = map[int]bool{}
+	)
+	items := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	n := session.Each(context.Background(), first, dial, 4, items, func(conn int, c *imapclient.Client, item int) error {
+		if err := c.Noop().Wait(); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		done = append(done, item)
+		conns[conn] = true
+		return nil
+	})
+	if n != 3 {
+		t.Errorf("used %d connections, want 3", n)
+	}
+	slices.Sort(done)
+	if !slices.Equal(done, items) {
+		t.Errorf("done %v, want %v", done, items)
+	}
+	for conn := range conns {
+		if conn < 0 || conn > 2 {
+			t.Errorf("item run on connection %d", conn)
+		}
+	}
+}
+
+// TestEachLostConnection breaks the first connection on its first item,
+// while the other waits for that: the other takes every remaining item.
+func TestEachLostConnection(t *testing.T) {
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	first, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu     sync.Mutex
+		byConn = map[int][]int{}
+		broken = make(chan struct{})
+	)
+	items := []int{1, 2, 3, 4, 5, 6}
+	session.Each(context.Background(), first, server.Config().Dial, 2, items, func(conn int, c *imapclient.Client, item int) error {
+		mu.Lock()
+		byConn[conn] = append(byConn[conn], item)
+		mu.Unlock()
+		if conn == 0 {
+			c.Close()
+			close(broken)
+			return errors.New("connection broken")
+		}
+		<-broken
+		return nil
+	})
+	if len(byConn[0]) != 1 {
+		t.Errorf("broken connection ran %v, want one item", byConn[0])
+	}
+	if got := len(byConn[0]) + len(byConn[1]); got != len(items) {
+		t.Errorf("%d items run, want %d: %v", got, len(items), byConn)
+	}
+}
@@ -0,0 +1,47 @@
+// Package session opens authenticated go-imap v2 connections so commands that
+// need more than one connection (or need to reconnect) share the same setup.
+package session
+
+import (
+	"crypto/tls"
+	"io"
+
+	"github.com/emersion/go-imap/v2/imapclient"
+)
+
+// Config describes how to reach and log into an IMAP account.
+type Config struct {
+	Address  string
+	Username string
+	Password string
+	// DebugWriter, when set, receives the raw IMAP conversation.
+	DebugWriter io.Writer
+	// PlainText dials without TLS. Only the local fake server needs it.
+	PlainText bool
+}
+
+// Dialer opens a new logged-in connection.
+type Dialer func() (*imapclient.Client, error)
+
+// Dial connects over TLS and logs in. The caller owns the returned client and
+// should Logout (or Close) it when done.
+func (cfg Config) Dial() (*imapclient.Client, error) {
+	var c *imapclient.Client
+	var err error
+	if cfg.PlainText {
+		c, err = imapclient.DialInsecure(cfg.Address, &imapclient.Options{DebugWriter: cfg.DebugWriter})
+	} else {
+		c, err = imapclient.DialTLS(cfg.Address, &imapclient.Options{
+			DebugWriter: cfg.DebugWriter,
+			TLSConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // We support self signed imap server
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Login(cfg.Username, cfg.Password).Wait(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spool keeps written bytes in memory up to limit and moves them to a temp
+// file once they grow past it.
+type spool struct {
+	limit int64
+	dir   string
+
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > s.limit {
+		f, err := os.CreateTemp(s.dir, "imap-part-*")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(s.buf.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.file = f
+		s.buf = bytes.Buffer{}
+	}
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// finish closes the temp file, if any, so it can be reopened for reading.
+func (s *spool) finish() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+func (s *spool) open() (io.ReadCloser, error) {
+	if s.file != nil {
+		return os.Open(s.file.Name())
+	}
+	return io.NopCloser(bytes.NewReader(s.buf.Bytes())), nil
+}
+
+func (s *spool) remove() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
@@ -0,0 +1,156 @@
+// Package stream fetches and parses messages without holding them in memory.
+//
+// A FETCH body literal is only readable while the fetch stream is positioned
+// on it: once the next item or message is requested, imapclient discards
+// whatever is left of it. That is why handing a reader over the literal to
+// code that runs later ends in an unexpected EOF. Fetch parses each literal
+// on the spot instead, and keeps attachment bodies in memory only up to
+// Options.MemoryLimit; larger ones are spilled to temp files.
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/quzhi1/imap-playground/internal/parser"
+)
+
+// DefaultMemoryLimit is the part size above which bodies go to disk.
+const DefaultMemoryLimit = 1 << 20
+
+// Options tunes Fetch and ParseLiteral.
+type Options struct {
+	// MemoryLimit is how many bytes of one attachment are kept in memory
+	// before it is spilled to a temp file. Zero means DefaultMemoryLimit.
+	MemoryLimit int64
+	// TempDir is where spilled parts go. Empty means os.TempDir.
+	TempDir string
+}
+
+// Part is an attachment or inline part whose body is either in memory or in
+// a temp file.
+type Part struct {
+	*parser.Attachment
+	body *spool
+}
+
+// Open returns a reader over the transfer-decoded body.
+func (p *Part) Open() (io.ReadCloser, error) {
+	return p.body.open()
+}
+
+// Spilled reports whether the body went to a temp file.
+func (p *Part) Spilled() bool {
+	return p.body.file != nil
+}
+
+// Message is one fetched and parsed message. Close removes its temp files.
+type Message struct {
+	UID          imap.UID
+	Flags        []imap.Flag
+	InternalDate time.Time
+	// Size is the size of the body literal, i.e. of the raw message.
+	Size   int64
+	Parsed *parser.Message
+	// Parts are the attachment and inline bodies, in the order they appear
+	// in Parsed.Attachments and Parsed.Inline.
+	Parts []*Part
+}
+
+// Close removes the temp files of spilled parts.
+func (m *Message) Close() error {
+	var errs []error
+	for _, part := range m.Parts {
+		errs = append(errs, part.body.remove())
+	}
+	return errors.Join(errs...)
+}
+
+// ParseLiteral parses a message of size bytes from r. It never reads more
+// than size bytes from r, and it reads all of them even if the parser stops
+// early, so r is left positioned right after the message.
+func ParseLiteral(r io.Reader, size int64, opts *Options) (*Message, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	limit := opts.MemoryLimit
+	if limit <= 0 {
+		limit = DefaultMemoryLimit
+	}
+
+	msg := &Message{Size: size}
+	literal := io.LimitReader(r, size)
+	parsed, err := parser.ParseWithOptions(literal, &parser.Options{
+		AttachmentHandler: func(attachment *parser.Attachment, body io.Reader) error {
+			part := &Part{Attachment: attachment, body: &spool{limit: limit, dir: opts.TempDir}}
+			msg.Parts = append(msg.Parts, part)
+			if _, err := io.Copy(part.body, body); err != nil {
+				return fmt.Errorf("stream: buffering %s part: %w", attachment.ContentType, err)
+			}
+			return part.body.finish()
+		},
+	})
+	msg.Parsed = parsed
+	if _, drainErr := io.Copy(io.Discard, literal); err == nil {
+		err = drainErr
+	}
+	if err != nil {
+		msg.Close()
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Fetch fetches the messages in uids from the selected mailbox and calls fn
+// with each one as soon as it is parsed. The message's temp files are removed
+// when fn returns; fn must open the parts it needs before that.
+func Fetch(client *imapclient.Client, uids imap.UIDSet, opts *Options, fn func(*Message) error) error {
+	fetchCmd := client.Fetch(uids, &imap.FetchOptions{
+		UID:          true,
+		Flags:        true,
+		InternalDate: true,
+		BodySection:  []*imap.FetchItemBodySection{{Peek: true}},
+	})
+
+	for data := fetchCmd.Next(); data != nil; data = fetchCmd.Next() {
+		var msg *Message
+		var uid imap.UID
+		var flags []imap.Flag
+		var internalDate time.Time
+		for item := data.Next(); item != nil; item = data.Next() {
+			switch item := item.(type) {
+			case imapclient.FetchItemDataUID:
+				uid = item.UID
+			case imapclient.FetchItemDataFlags:
+				flags = item.Flags
+			case imapclient.FetchItemDataInternalDate:
+				internalDate = item.Time
+			case imapclient.FetchItemDataBodySection:
+				// Parse now: the literal is gone once data.Next is called.
+				parsed, err := ParseLiteral(item.Literal, item.Literal.Size(), opts)
+				if err != nil {
+					fetchCmd.Close()
+					return fmt.Errorf("stream: parsing message %d: %w", data.SeqNum, err)
+				}
+				msg = parsed
+			}
+		}
+		if msg == nil {
+			continue
+		}
+		msg.UID, msg.Flags, msg.InternalDate = uid, flags, internalDate
+		err := fn(msg)
+		if closeErr := msg.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fetchCmd.Close()
+			return err
+		}
+	}
+	return fetchCmd.Close()
+}
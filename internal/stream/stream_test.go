@@ -0,0 +1,275 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/quzhi1/imap-playground/internal/fakeserver"
+)
+
+// TestParseLiteralLarge parses a message with a 100 MB attachment straight
+// from a reader. The heap must stay bounded while the attachment spills to
+// disk, and the bytes after the message must be left untouched.
+func TestParseLiteralLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("parses a 100 MB message")
+	}
+	const (
+		size    = 100 << 20
+		maxHeap = 64 << 20
+	)
+	opts := &Options{TempDir: t.TempDir()}
+	sentinel := &touchReader{r: bytes.NewReader([]byte("* 2 FETCH (UID 2)\r\n"))}
+	sum := sha256.New()
+	r := io.MultiReader(generate(size, 1, sum), sentinel)
+
+	stop := watchHeap()
+	msg, err := ParseLiteral(r, generatedSize(size), opts)
+	growth := stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Close()
+
+	checkMessage(t, msg, size, DefaultMemoryLimit, sum.Sum(nil))
+	if sentinel.touched.Load() {
+		t.Error("parser read past the end of the literal")
+	}
+	if growth > maxHeap {
+		t.Errorf("heap grew by %d MB, limit is %d MB", growth>>20, maxHeap>>20)
+	}
+}
+
+// TestFetch fetches two messages in one FETCH, which checks that parsing
+// the first literal does not eat into the second.
+func TestFetch(t *testing.T) {
+	const size = 1 << 20
+	server, err := fakeserver.Start(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	sums := make(map[imap.UID][]byte)
+	for seed := int64(1); seed <= 2; seed++ {
+		var raw bytes.Buffer
+		sum := sha256.New()
+		if _, err := io.Copy(&raw, generate(size, seed, sum)); err != nil {
+			t.Fatal(err)
+		}
+		uid, err := server.Append("INBOX", raw.Bytes(), []imap.Flag{imap.FlagSeen}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[uid] = sum.Sum(nil)
+	}
+
+	c, err := server.Config().Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{MemoryLimit: 64 << 10, TempDir: t.TempDir()}
+	fetched := 0
+	err = Fetch(c, imap.UIDSet{{Start: 1, Stop: 0}}, opts, func(msg *Message) error {
+		fetched++
+		if msg.Size != generatedSize(size) || len(msg.Flags) != 1 {
+			t.Errorf("UID %d: %d bytes, flags %v", msg.UID, msg.Size, msg.Flags)
+		}
+		checkMessage(t, msg, size, opts.MemoryLimit, sums[msg.UID])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != len(sums) {
+		t.Errorf("fetched %d messages, want %d", fetched, len(sums))
+	}
+}
+
+func checkMessage(t *testing.T, msg *Message, size, memoryLimit int64, wantSum []byte) {
+	t.Helper()
+	if len(msg.Parsed.Problems) > 0 {
+		t.Errorf("parser reported problems: %v", msg.Parsed.Problems)
+	}
+	if len(msg.Parts) != 1 {
+		t.Fatalf("got %d parts, want 1", len(msg.Parts))
+	}
+	part := msg.Parts[0]
+	if part.Size != size {
+		t.Errorf("attachment is %d bytes, want %d", part.Size, size)
+	}
+	if size > memoryLimit && !part.Spilled() {
+		t.Errorf("attachment of %d bytes was kept in memory", size)
+	}
+	body, err := part.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, body); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sum.Sum(nil), wantSum) {
+		t.Error("attachment content does not match what was generated")
+	}
+}
+
+const boundary = "stream-test-boundary"
+
+func messageHead(seed int64) string {
+	return "From: Sender <sender@example.com>\r\n" +
+		"To: receiver@example.com\r\n" +
+		fmt.Sprintf("Subject: Large message %d\r\n", seed) +
+		fmt.Sprintf("Message-ID: <stream-%d@example.com>\r\n", seed) +
+		"Date: Mon, 2 Oct 2023 10:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"" + boundary + "\"\r\n" +
+		"\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"See the attachment.\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: application/octet-stream; name=\"large.bin\"\r\n" +
+		"Content-Disposition: attachment; filename=\"large.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n"
+}
+
+const messageTail = "--" + boundary + "--\r\n"
+
+// generatedSize is the raw size of the message generate produces for an
+// attachment of size bytes: base64 in 76-character lines, each ending in CRLF.
+func generatedSize(size int64) int64 {
+	encoded := int64(base64.StdEncoding.EncodedLen(int(size)))
+	lines := (encoded + 75) / 76
+	return int64(len(messageHead(1))) + encoded + 2*lines + int64(len(messageTail))
+}
+
+// generate streams a message with a size-byte pseudo-random attachment and
+// writes the attachment's plain bytes to sum as it goes.
+func generate(size, seed int64, sum io.Writer) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		buffered := bufio.NewWriterSize(pw, 64*1024)
+		w := &lineWrapper{w: buffered}
+		enc := base64.NewEncoder(base64.StdEncoding, w)
+		data := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(seed)), size), sum)
+		_, err := io.WriteString(buffered, messageHead(seed))
+		if err == nil {
+			_, err = io.Copy(enc, data)
+		}
+		if err == nil {
+			err = enc.Close()
+		}
+		if err == nil {
+			err = w.end()
+		}
+		if err == nil {
+			_, err = io.WriteString(buffered, messageTail)
+		}
+		if err == nil {
+			err = buffered.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// lineWrapper breaks base64 output into 76-character lines.
+type lineWrapper struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(76-l.col, len(p))
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		l.col += n
+		p = p[n:]
+		if l.col == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+	}
+	return written, nil
+}
+
+func (l *lineWrapper) end() error {
+	if l.col == 0 {
+		return nil
+	}
+	_, err := io.WriteString(l.w, "\r\n")
+	return err
+}
+
+// touchReader records whether anything tried to read from it.
+type touchReader struct {
+	r       io.Reader
+	touched atomic.Bool
+}
+
+func (t *touchReader) Read(p []byte) (int, error) {
+	t.touched.Store(true)
+	return t.r.Read(p)
+}
+
+// watchHeap samples the heap until stop is called. stop returns how far the
+// heap grew above where it was when watching started.
+func watchHeap() (stop func() uint64) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	var mu sync.Mutex
+	peak := baseline
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				mu.Lock()
+				peak = max(peak, stats.HeapAlloc)
+				mu.Unlock()
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-finished
+		mu.Lock()
+		defer mu.Unlock()
+		return peak - baseline
+	}
+}
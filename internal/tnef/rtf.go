@@ -0,0 +1,101 @@
+package tnef
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Compressed RTF (MS-OXRTFCP) starts with a 16-byte header: the size of
+// what follows the first field, the size of the RTF, a magic number and a
+// CRC of the compressed data.
+const (
+	rtfCompressed   = 0x75465a4c // "LZFu"
+	rtfUncompressed = 0x414c454d // "MELA"
+)
+
+// rtfDictionary is what the LZFu dictionary holds before the first byte.
+const rtfDictionary = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}{\\f0\\fnil \\froman " +
+	"\\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier" +
+	"{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+
+var errRTFTruncated = errors.New("tnef: compressed RTF is truncated")
+
+// DecompressRTF decodes a PR_RTF_COMPRESSED value.
+func DecompressRTF(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, errRTFTruncated
+	}
+	size := binary.LittleEndian.Uint32(data[4:])
+	magic := binary.LittleEndian.Uint32(data[8:])
+	crc := binary.LittleEndian.Uint32(data[12:])
+	body := data[16:]
+	if compSize := binary.LittleEndian.Uint32(data); uint64(compSize)+4 < uint64(len(data)) {
+		body = data[16 : compSize+4]
+	}
+	switch magic {
+	case rtfUncompressed:
+		if uint64(size) > uint64(len(body)) {
+			return body, errRTFTruncated
+		}
+		return body[:size], nil
+	case rtfCompressed:
+	default:
+		return nil, fmt.Errorf("tnef: compressed RTF has unknown magic %#08x", magic)
+	}
+	if sum := RTFChecksum(body); sum != crc {
+		return nil, fmt.Errorf("tnef: compressed RTF has CRC %#08x, want %#08x", sum, crc)
+	}
+
+	var dict [4096]byte
+	pos := copy(dict[:], rtfDictionary)
+	out := make([]byte, 0, min(int(size), 4*len(body)))
+	for i := 0; i < len(body); {
+		control := body[i]
+		i++
+		for bit := 0; bit < 8 && i < len(body); bit++ {
+			if control&(1<<bit) == 0 {
+				out = append(out, body[i])
+				dict[pos] = body[i]
+				pos = (pos + 1) % len(dict)
+				i++
+				continue
+			}
+			if i+1 >= len(body) {
+				return out, errRTFTruncated
+			}
+			token := int(body[i])<<8 | int(body[i+1])
+			i += 2
+			offset, length := token>>4, token&0xf+2
+			if offset == pos {
+				return out, nil
+			}
+			for j := 0; j < length; j++ {
+				c := dict[(offset+j)%len(dict)]
+				out = append(out, c)
+				dict[pos] = c
+				pos = (pos + 1) % len(dict)
+			}
+		}
+	}
+	// Some writers leave out the end marker when the data fills the last
+	// control byte.
+	return out, nil
+}
+
+// RTFChecksum is the CRC of compressed RTF: CRC-32 without the usual
+// inversion at the start and end.
+func RTFChecksum(data []byte) uint32 {
+	return ^crc32.Update(^uint32(0), crc32.IEEETable, data)
+}
+
+// UncompressedRTF wraps rtf as a PR_RTF_COMPRESSED value that is stored
+// rather than compressed, which MS-OXRTFCP allows.
+func UncompressedRTF(rtf []byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(rtf)+12))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(rtf)))
+	out = binary.LittleEndian.AppendUint32(out, rtfUncompressed)
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	return append(out, rtf...)
+}
@@ -0,0 +1,311 @@
+package tnef
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// signature opens every TNEF stream (MS-OXTNEF 2.1.3.1).
+const signature = 0x223e9f78
+
+// Attribute levels.
+const (
+	LevelMessage    = 0x01
+	LevelAttachment = 0x02
+)
+
+// Attribute IDs, with the attribute type in the high word (MS-OXTNEF
+// 2.1.3.3). Only the ones the decoder reads are listed.
+const (
+	AttSubject        = 0x00018004
+	AttBody           = 0x0002800c
+	AttMessageClass   = 0x00078008
+	AttAttachRendData = 0x00069002
+	AttMAPIProps      = 0x00069003
+	AttAttachment     = 0x00069005
+	AttTNEFVersion    = 0x00089006
+	AttOEMCodepage    = 0x00069007
+	AttAttachData     = 0x0006800f
+	AttAttachTitle    = 0x00018010
+)
+
+// ErrNotTNEF is returned for data that does not start with the TNEF
+// signature.
+var ErrNotTNEF = errors.New("tnef: not a TNEF stream")
+
+// Stream is a TNEF stream as it is stored: its legacy key and its
+// attributes in order.
+type Stream struct {
+	Key        uint16
+	Attributes []Attribute
+	// Warnings lists checksum mismatches, which Outlook ignores too.
+	Warnings []string
+}
+
+// Attribute is one attribute of a stream. Data is its value as stored.
+type Attribute struct {
+	Level byte
+	ID    uint32
+	Data  []byte
+	// BadChecksum is set when the stored checksum did not match. Bytes
+	// writes a wrong one again, so the damage survives a rewrite.
+	BadChecksum bool
+}
+
+// ReadStream splits data into attributes. A stream that ends inside an
+// attribute returns the attributes before it along with the error.
+func ReadStream(data []byte) (*Stream, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != signature {
+		return nil, ErrNotTNEF
+	}
+	s := &Stream{Key: binary.LittleEndian.Uint16(data[4:])}
+	for data = data[6:]; len(data) > 0; {
+		if len(data) < 9 {
+			return s, fmt.Errorf("tnef: stream ends inside an attribute header")
+		}
+		attr := Attribute{Level: data[0], ID: binary.LittleEndian.Uint32(data[1:])}
+		size := binary.LittleEndian.Uint32(data[5:])
+		if uint64(len(data)-9) < uint64(size)+2 {
+			return s, fmt.Errorf("tnef: attribute %#08x is truncated", attr.ID)
+		}
+		attr.Data = data[9 : 9+size]
+		if sum := binary.LittleEndian.Uint16(data[9+size:]); sum != checksum(attr.Data) {
+			attr.BadChecksum = true
+			s.Warnings = append(s.Warnings, fmt.Sprintf("attribute %#08x has a bad checksum", attr.ID))
+		}
+		s.Attributes = append(s.Attributes, attr)
+		data = data[9+size+2:]
+	}
+	return s, nil
+}
+
+// Bytes encodes the stream, computing the checksums afresh.
+func (s *Stream) Bytes() []byte {
+	out := binary.LittleEndian.AppendUint32(nil, signature)
+	out = binary.LittleEndian.AppendUint16(out, s.Key)
+	for _, attr := range s.Attributes {
+		out = append(out, attr.Level)
+		out = binary.LittleEndian.AppendUint32(out, attr.ID)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(attr.Data)))
+		out = append(out, attr.Data...)
+		sum := checksum(attr.Data)
+		if attr.BadChecksum {
+			sum++
+		}
+		out = binary.LittleEndian.AppendUint16(out, sum)
+	}
+	return out
+}
+
+func checksum(data []byte) uint16 {
+	var sum uint16
+	for _, b := range data {
+		sum += uint16(b)
+	}
+	return sum
+}
+
+// Property types (MS-OXCDATA 2.11.1).
+const (
+	TypeShort    = 0x0002
+	TypeLong     = 0x0003
+	TypeBoolean  = 0x000b
+	TypeObject   = 0x000d
+	TypeString8  = 0x001e
+	TypeUnicode  = 0x001f
+	TypeSystime  = 0x0040
+	TypeBinary   = 0x0102
+	MultiValued  = 0x1000
+	firstNamedID = 0x8000
+)
+
+// Property IDs the decoder reads.
+const (
+	PropMessageClass    = 0x001a
+	PropSubject         = 0x0037
+	PropBody            = 0x1000
+	PropRTFCompressed   = 0x1009
+	PropBodyHTML        = 0x1013
+	PropDisplayName     = 0x3001
+	PropAttachDataObj   = 0x3701
+	PropAttachFilename  = 0x3704
+	PropAttachMethod    = 0x3705
+	PropAttachLongName  = 0x3707
+	PropAttachMIMETag   = 0x370e
+	PropAttachContentID = 0x3712
+	PropInternetCPID    = 0x3fde
+)
+
+// attachEmbeddedMsg is the PR_ATTACH_METHOD of an attached Outlook item.
+const attachEmbeddedMsg = 5
+
+// Property is one MAPI property from an attMAPIProps or attAttachment
+// attribute.
+type Property struct {
+	Type uint16
+	ID   uint16
+	// Name is set for named properties, whose ID is only meaningful within
+	// the message.
+	Name *PropertyName
+	// Values holds each value as stored, without the padding that follows
+	// it. Single-valued properties have one.
+	Values [][]byte
+}
+
+// PropertyName identifies a named property by GUID and either a number
+// (Kind 0) or a UTF-16LE name (Kind 1).
+type PropertyName struct {
+	GUID [16]byte
+	Kind uint32
+	ID   uint32
+	Name []byte
+}
+
+// Value returns the first value of the property.
+func (p Property) Value() []byte {
+	if len(p.Values) == 0 {
+		return nil
+	}
+	return p.Values[0]
+}
+
+// fixedSize returns the stored size of a value of a fixed-size type, or 0
+// for a type whose values carry their own length.
+func fixedSize(typ uint16) (int, error) {
+	switch typ &^ MultiValued {
+	case 0x0001, TypeShort, TypeLong, 0x0004, 0x000a, TypeBoolean:
+		return 4, nil
+	case 0x0005, 0x0006, 0x0007, 0x0014, TypeSystime:
+		return 8, nil
+	case 0x0048:
+		return 16, nil
+	case TypeObject, TypeString8, TypeUnicode, TypeBinary:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("tnef: unknown property type %#04x", typ)
+}
+
+// ReadProperties reads the MAPI properties in the value of an attMAPIProps
+// or attAttachment attribute (MS-OXTNEF 2.1.3.4).
+func ReadProperties(data []byte) ([]Property, error) {
+	r := &reader{data: data}
+	count := r.uint32()
+	var props []Property
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		p := Property{Type: r.uint16(), ID: r.uint16()}
+		if p.ID >= firstNamedID {
+			name := &PropertyName{}
+			copy(name.GUID[:], r.bytes(16))
+			name.Kind = r.uint32()
+			if name.Kind == 0 {
+				name.ID = r.uint32()
+			} else {
+				name.Name = r.padded(int(r.uint32()))
+			}
+			p.Name = name
+		}
+		size, err := fixedSize(p.Type)
+		if err != nil {
+			return props, err
+		}
+		n := uint32(1)
+		if size == 0 || p.Type&MultiValued != 0 {
+			n = r.uint32()
+		}
+		for j := uint32(0); j < n && r.err == nil; j++ {
+			if size > 0 {
+				p.Values = append(p.Values, r.bytes(size))
+			} else {
+				p.Values = append(p.Values, r.padded(int(r.uint32())))
+			}
+		}
+		if r.err == nil {
+			props = append(props, p)
+		}
+	}
+	return props, r.err
+}
+
+// WriteProperties encodes props as the value of an attMAPIProps or
+// attAttachment attribute.
+func WriteProperties(props []Property) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, uint32(len(props)))
+	for _, p := range props {
+		out = binary.LittleEndian.AppendUint16(out, p.Type)
+		out = binary.LittleEndian.AppendUint16(out, p.ID)
+		if p.Name != nil {
+			out = append(out, p.Name.GUID[:]...)
+			out = binary.LittleEndian.AppendUint32(out, p.Name.Kind)
+			if p.Name.Kind == 0 {
+				out = binary.LittleEndian.AppendUint32(out, p.Name.ID)
+			} else {
+				out = binary.LittleEndian.AppendUint32(out, uint32(len(p.Name.Name)))
+				out = pad(append(out, p.Name.Name...))
+			}
+		}
+		size, _ := fixedSize(p.Type)
+		if size == 0 || p.Type&MultiValued != 0 {
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(p.Values)))
+		}
+		for _, v := range p.Values {
+			if size == 0 {
+				out = binary.LittleEndian.AppendUint32(out, uint32(len(v)))
+			}
+			out = pad(append(out, v...))
+		}
+	}
+	return out
+}
+
+// pad pads b to a multiple of four bytes. Values in a property list are
+// aligned from its start, which is itself aligned.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// reader reads little-endian values and remembers the first short read.
+type reader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data)-r.off {
+		r.err = fmt.Errorf("tnef: property list is truncated")
+		return nil
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+// padded reads n bytes and skips the padding after them.
+func (r *reader) padded(n int) []byte {
+	b := r.bytes(n)
+	if skip := (4 - n%4) % 4; r.err == nil && skip <= len(r.data)-r.off {
+		r.off += skip
+	}
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
@@ -0,0 +1,245 @@
+// Package tnef decodes TNEF (Transport Neutral Encapsulation Format), the
+// application/ms-tnef "winmail.dat" part Exchange and Outlook send in place
+// of a message's real attachments and rich text body.
+package tnef
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/quzhi1/imap-playground/internal/charset"
+)
+
+// Message is what a TNEF stream carries.
+type Message struct {
+	// Class is the Outlook message class, e.g. "IPM.Note".
+	Class   string
+	Subject string
+	// Body is the plain text body and HTML the HTML body, decoded to
+	// UTF-8. Either can be empty.
+	Body string
+	HTML string
+	// RTF is the decompressed rich text body.
+	RTF         []byte
+	Attachments []*Attachment
+	// Warnings lists what was odd but did not stop the decoding.
+	Warnings []string
+}
+
+// Attachment is one attachment of a TNEF message.
+type Attachment struct {
+	// Name is the long file name if there is one, else the 8.3 title.
+	Name      string
+	MIMEType  string
+	ContentID string
+	Data      []byte
+	// Embedded is set for an attached Outlook item, which is a TNEF
+	// message of its own.
+	Embedded *Message
+}
+
+// Decode reads a TNEF stream. A stream that ends early returns what was read
+// before the end along with the error.
+func Decode(data []byte) (*Message, error) {
+	s, err := ReadStream(data)
+	if s == nil {
+		return nil, err
+	}
+	msg := &Message{Warnings: s.Warnings}
+	// 8-bit text is in the message's code page, which may come after it.
+	var codepage uint32
+	var body, html []byte
+	var current *Attachment
+	for _, attr := range s.Attributes {
+		switch attr.ID {
+		case AttMessageClass:
+			msg.Class = cString(attr.Data)
+		case AttSubject:
+			msg.Subject = cString(attr.Data)
+		case AttBody:
+			body = bytes.TrimRight(attr.Data, "\x00")
+		case AttOEMCodepage:
+			if len(attr.Data) >= 4 {
+				codepage = binary.LittleEndian.Uint32(attr.Data)
+			}
+		case AttAttachRendData:
+			// Each attachment starts with its rendering data.
+			current = &Attachment{}
+			msg.Attachments = append(msg.Attachments, current)
+		case AttAttachTitle:
+			if current != nil && current.Name == "" {
+				current.Name = cString(attr.Data)
+			}
+		case AttAttachData:
+			if current != nil {
+				current.Data = attr.Data
+			}
+		case AttMAPIProps:
+			props, err := ReadProperties(attr.Data)
+			if err != nil {
+				msg.warn("message properties: %v", err)
+			}
+			msg.read(props, &codepage, &body, &html)
+		case AttAttachment:
+			if current == nil {
+				msg.warn("attachment properties before any attachment")
+				continue
+			}
+			props, err := ReadProperties(attr.Data)
+			if err != nil {
+				msg.warn("attachment %q properties: %v", current.Name, err)
+			}
+			msg.readAttachment(current, props)
+		}
+	}
+	// An attachment the stream was cut off in before its data is dropped.
+	if n := len(msg.Attachments); err != nil && n > 0 && msg.Attachments[n-1].Data == nil {
+		msg.Attachments = msg.Attachments[:n-1]
+	}
+	if body != nil {
+		msg.Body, _ = charset.Default.Decode(codepageLabel(codepage), body)
+	}
+	if html != nil {
+		msg.HTML, _ = charset.Default.Decode(codepageLabel(codepage), html)
+	}
+	return msg, err
+}
+
+func (msg *Message) read(props []Property, codepage *uint32, body, html *[]byte) {
+	for _, p := range props {
+		if p.Name != nil {
+			continue
+		}
+		switch p.ID {
+		case PropMessageClass:
+			msg.Class = stringValue(p)
+		case PropSubject:
+			msg.Subject = stringValue(p)
+		case PropInternetCPID:
+			if v := p.Value(); len(v) >= 4 {
+				*codepage = binary.LittleEndian.Uint32(v)
+			}
+		case PropBody:
+			if p.Type == TypeUnicode {
+				msg.Body, *body = stringValue(p), nil
+			} else {
+				*body = bytes.TrimRight(p.Value(), "\x00")
+			}
+		case PropBodyHTML:
+			if p.Type == TypeUnicode {
+				msg.HTML, *html = stringValue(p), nil
+			} else {
+				*html = bytes.TrimRight(p.Value(), "\x00")
+			}
+		case PropRTFCompressed:
+			rtf, err := DecompressRTF(p.Value())
+			if err != nil {
+				msg.warn("RTF body: %v", err)
+			}
+			msg.RTF = rtf
+		}
+	}
+}
+
+func (msg *Message) readAttachment(a *Attachment, props []Property) {
+	method := uint32(0)
+	for _, p := range props {
+		if p.Name != nil {
+			continue
+		}
+		switch p.ID {
+		case PropAttachLongName:
+			a.Name = stringValue(p)
+		case PropAttachFilename, PropDisplayName:
+			if a.Name == "" {
+				a.Name = stringValue(p)
+			}
+		case PropAttachMIMETag:
+			a.MIMEType = stringValue(p)
+		case PropAttachContentID:
+			a.ContentID = stringValue(p)
+		case PropAttachMethod:
+			if v := p.Value(); len(v) >= 4 {
+				method = binary.LittleEndian.Uint32(v)
+			}
+		case PropAttachDataObj:
+			if p.Type == TypeObject {
+				// An object value starts with the interface ID.
+				if v := p.Value(); len(v) >= 16 {
+					a.Data = v[16:]
+				}
+			} else if a.Data == nil {
+				a.Data = p.Value()
+			}
+		}
+	}
+	if method == attachEmbeddedMsg && a.Data != nil {
+		embedded, err := Decode(a.Data)
+		if err != nil {
+			msg.warn("attached item %q: %v", a.Name, err)
+		}
+		a.Embedded = embedded
+	}
+}
+
+func (msg *Message) warn(format string, args ...any) {
+	msg.Warnings = append(msg.Warnings, fmt.Sprintf(format, args...))
+}
+
+// stringValue returns a string property as UTF-8. 8-bit strings are
+// assumed to be ASCII or already UTF-8, which holds for names and MIME
+// types in practice.
+func stringValue(p Property) string {
+	v := p.Value()
+	if p.Type&^MultiValued == TypeUnicode {
+		return DecodeUTF16(v)
+	}
+	return cString(v)
+}
+
+// DecodeUTF16 decodes a UTF-16LE string, dropping its terminating NUL.
+func DecodeUTF16(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, binary.LittleEndian.Uint16(b[i:]))
+	}
+	for len(units) > 0 && units[len(units)-1] == 0 {
+		units = units[:len(units)-1]
+	}
+	return string(utf16.Decode(units))
+}
+
+// EncodeUTF16 encodes s as UTF-16LE with a terminating NUL.
+func EncodeUTF16(s string) []byte {
+	var out []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		out = binary.LittleEndian.AppendUint16(out, u)
+	}
+	return append(out, 0, 0)
+}
+
+func cString(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// codepageLabel names a Windows code page the way the charset package
+// knows it. An unknown code page leaves the charset to detection.
+func codepageLabel(codepage uint32) string {
+	switch codepage {
+	case 0:
+		return ""
+	case 65001:
+		return "utf-8"
+	case 20127:
+		return "us-ascii"
+	case 28591:
+		return "iso-8859-1"
+	case 936:
+		return "gbk"
+	case 950:
+		return "big5"
+	}
+	return fmt.Sprintf("cp%d", codepage)
+}
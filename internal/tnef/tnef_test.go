@@ -0,0 +1,145 @@
+package tnef_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/quzhi1/imap-playground/internal/tnef"
+	"github.com/quzhi1/imap-playground/internal/tnef/tneftest"
+)
+
+// TestDecompressRTF uses the worked example of MS-OXRTFCP section 3.1.1.
+func TestDecompressRTF(t *testing.T) {
+	compressed, _ := hex.DecodeString("2d0000002b0000004c5a4675f1c5c7a703000a00" +
+		"7263706731323542320af32068656c090020627705b06c647d0a800fa0")
+	got, err := tnef.DecompressRTF(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	compressed[20] ^= 1
+	if _, err := tnef.DecompressRTF(compressed); err == nil {
+		t.Error("damaged RTF decompressed without a CRC error")
+	}
+}
+
+func TestCompressRTF(t *testing.T) {
+	for _, rtf := range []string{
+		"",
+		"{\\rtf1\\ansi\\deff0 {\\fonttbl {\\f0 Calibri;}}\\f0\\fs22 Hello, hello, hello!\\par}",
+		strings.Repeat("abcabcabd", 900),
+	} {
+		got, err := tnef.DecompressRTF(tneftest.CompressRTF([]byte(rtf)))
+		if err != nil || string(got) != rtf {
+			t.Errorf("round trip of %d bytes: %v, got %d bytes", len(rtf), err, len(got))
+		}
+	}
+	stored := tnef.UncompressedRTF([]byte("{\\rtf1 plain}"))
+	if got, err := tnef.DecompressRTF(stored); err != nil || string(got) != "{\\rtf1 plain}" {
+		t.Errorf("uncompressed RTF: %q, %v", got, err)
+	}
+}
+
+func sample() tneftest.Message {
+	return tneftest.Message{
+		Class:       "IPM.Note",
+		Subject:     "Quarterly numbers",
+		Codepage:    1252,
+		Body:        "Numbers attached. Gr\xfc\xdfe",
+		HTML:        "<p>Numbers attached. Gr\xfc\xdfe</p>",
+		RTF:         "{\\rtf1\\ansi\\ansicpg1252 Numbers attached.\\par}",
+		Attachments: []tneftest.Attachment{
+			{Title: "QUARTE~1.XLS", LongName: "Quarterly numbers – Q3.xlsx", MIMEType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Data: []byte("PK\x03\x04 sheet")},
+			{Title: "image001.png", MIMEType: "image/png", ContentID: "image001.png@01DA", Data: []byte("\x89PNG\r\n")},
+			{Title: "Re: Agenda", Embedded: &tneftest.Message{
+				Class:       "IPM.Note",
+				Subject:     "Re: Agenda",
+				UnicodeBody: "Agenda attached – see you.",
+				Attachments: []tneftest.Attachment{{Title: "agenda.txt", Data: []byte("1. Numbers")}},
+			}},
+		},
+	}
+}
+
+func TestDecode(t *testing.T) {
+	msg, err := tnef.Decode(tneftest.Build(sample()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Class != "IPM.Note" || msg.Subject != "Quarterly numbers" {
+		t.Errorf("class %q subject %q", msg.Class, msg.Subject)
+	}
+	if msg.Body != "Numbers attached. Grüße" || msg.HTML != "<p>Numbers attached. Grüße</p>" {
+		t.Errorf("body %q html %q", msg.Body, msg.HTML)
+	}
+	if string(msg.RTF) != sample().RTF {
+		t.Errorf("rtf %q", msg.RTF)
+	}
+	if len(msg.Attachments) != 3 {
+		t.Fatalf("%d attachments", len(msg.Attachments))
+	}
+	sheet, image, item := msg.Attachments[0], msg.Attachments[1], msg.Attachments[2]
+	if sheet.Name != "Quarterly numbers – Q3.xlsx" || !bytes.Equal(sheet.Data, sample().Attachments[0].Data) || !strings.HasSuffix(sheet.MIMEType, ".sheet") {
+		t.Errorf("long name should win over the title: %+v", sheet)
+	}
+	if image.Name != "image001.png" || image.ContentID != "image001.png@01DA" {
+		t.Errorf("image %+v", image)
+	}
+	if item.Embedded == nil || item.Embedded.Body != "Agenda attached – see you." ||
+		len(item.Embedded.Attachments) != 1 || string(item.Embedded.Attachments[0].Data) != "1. Numbers" {
+		t.Errorf("attached item %+v", item.Embedded)
+	}
+	if len(msg.Warnings) != 0 {
+		t.Errorf("warnings %q", msg.Warnings)
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	raw := tneftest.Build(sample())
+	s, err := tnef.ReadStream(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, attr := range s.Attributes {
+		if attr.ID != tnef.AttMAPIProps && attr.ID != tnef.AttAttachment {
+			continue
+		}
+		props, err := tnef.ReadProperties(attr.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again := tnef.WriteProperties(props); !bytes.Equal(again, attr.Data) {
+			t.Errorf("attribute %#08x changed when written back", attr.ID)
+		}
+	}
+	if !bytes.Equal(s.Bytes(), raw) {
+		t.Error("stream changed when written back")
+	}
+}
+
+func TestBroken(t *testing.T) {
+	if _, err := tnef.Decode([]byte("PK\x03\x04 not tnef")); err != tnef.ErrNotTNEF {
+		t.Errorf("err = %v, want ErrNotTNEF", err)
+	}
+
+	raw := tneftest.Build(sample())
+	// Every prefix must decode to something without panicking.
+	for n := 6; n < len(raw); n++ {
+		msg, err := tnef.Decode(raw[:n])
+		if msg == nil {
+			t.Fatalf("prefix %d: no message, %v", n, err)
+		}
+	}
+
+	bad := bytes.Clone(raw)
+	bad[len(bad)-1] ^= 0xff
+	msg, err := tnef.Decode(bad)
+	if err != nil || len(msg.Attachments) != 3 || len(msg.Warnings) != 1 {
+		t.Errorf("a bad checksum should only warn: %v, %q", err, msg.Warnings)
+	}
+}
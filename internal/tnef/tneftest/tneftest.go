@@ -0,0 +1,190 @@
+// Package tneftest builds TNEF streams the way Outlook writes them, for
+// tests and fixtures of the tnef package.
+package tneftest
+
+import (
+	"encoding/binary"
+
+	"github.com/quzhi1/imap-playground/internal/tnef"
+)
+
+// Message describes a winmail.dat to build. Empty fields are left out.
+type Message struct {
+	Class   string
+	Subject string
+	// Body goes into the legacy attBody attribute, in Codepage.
+	Body string
+	// UnicodeBody goes into PR_BODY as a Unicode string.
+	UnicodeBody string
+	// HTML goes into PR_BODY_HTML as bytes in Codepage.
+	HTML string
+	// RTF is compressed into PR_RTF_COMPRESSED.
+	RTF         string
+	Codepage    uint32
+	Attachments []Attachment
+}
+
+// Attachment describes one attachment.
+type Attachment struct {
+	// Title is the 8.3 name in attAttachTitle.
+	Title string
+	// LongName goes into PR_ATTACH_LONG_FILENAME as a Unicode string.
+	LongName  string
+	MIMEType  string
+	ContentID string
+	Data      []byte
+	// Embedded makes the attachment an attached Outlook item.
+	Embedded *Message
+}
+
+// iidMessage is IID_IMessage, which starts an attached item's data.
+var iidMessage = [16]byte{0x07, 0x03, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46}
+
+// Build encodes m as a TNEF stream.
+func Build(m Message) []byte {
+	s := &tnef.Stream{Key: 0x5a3c}
+	add := func(level byte, id uint32, data []byte) {
+		s.Attributes = append(s.Attributes, tnef.Attribute{Level: level, ID: id, Data: data})
+	}
+	add(tnef.LevelMessage, tnef.AttTNEFVersion, le32(0x00010000))
+	if m.Codepage != 0 {
+		add(tnef.LevelMessage, tnef.AttOEMCodepage, append(le32(m.Codepage), 0, 0, 0, 0))
+	}
+	if m.Class != "" {
+		add(tnef.LevelMessage, tnef.AttMessageClass, cString(m.Class))
+	}
+	if m.Subject != "" {
+		add(tnef.LevelMessage, tnef.AttSubject, cString(m.Subject))
+	}
+	if m.Body != "" {
+		add(tnef.LevelMessage, tnef.AttBody, []byte(m.Body))
+	}
+	var props []tnef.Property
+	if m.Codepage != 0 {
+		props = append(props, property(tnef.TypeLong, tnef.PropInternetCPID, le32(m.Codepage)))
+	}
+	if m.UnicodeBody != "" {
+		props = append(props, property(tnef.TypeUnicode, tnef.PropBody, tnef.EncodeUTF16(m.UnicodeBody)))
+	}
+	if m.HTML != "" {
+		props = append(props, property(tnef.TypeBinary, tnef.PropBodyHTML, []byte(m.HTML)))
+	}
+	if m.RTF != "" {
+		props = append(props, property(tnef.TypeBinary, tnef.PropRTFCompressed, CompressRTF([]byte(m.RTF))))
+	}
+	if len(props) > 0 {
+		add(tnef.LevelMessage, tnef.AttMAPIProps, tnef.WriteProperties(props))
+	}
+
+	for _, a := range m.Attachments {
+		// attAttachRendData: by-value file attachment at no position.
+		rend := binary.LittleEndian.AppendUint16(nil, 1)
+		rend = append(rend, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0)
+		add(tnef.LevelAttachment, tnef.AttAttachRendData, rend)
+		if a.Title != "" {
+			add(tnef.LevelAttachment, tnef.AttAttachTitle, cString(a.Title))
+		}
+		method := uint32(1)
+		var props []tnef.Property
+		if a.Embedded != nil {
+			method = 5
+			item := append(iidMessage[:], Build(*a.Embedded)...)
+			props = append(props, property(tnef.TypeObject, tnef.PropAttachDataObj, item))
+		} else {
+			add(tnef.LevelAttachment, tnef.AttAttachData, a.Data)
+		}
+		props = append(props, property(tnef.TypeLong, tnef.PropAttachMethod, le32(method)))
+		if a.LongName != "" {
+			props = append(props, property(tnef.TypeUnicode, tnef.PropAttachLongName, tnef.EncodeUTF16(a.LongName)))
+		}
+		if a.MIMEType != "" {
+			props = append(props, property(tnef.TypeString8, tnef.PropAttachMIMETag, cString(a.MIMEType)))
+		}
+		if a.ContentID != "" {
+			props = append(props, property(tnef.TypeString8, tnef.PropAttachContentID, cString(a.ContentID)))
+		}
+		add(tnef.LevelAttachment, tnef.AttAttachment, tnef.WriteProperties(props))
+	}
+	return s.Bytes()
+}
+
+// CompressRTF compresses rtf the way Outlook does (MS-OXRTFCP), taking the
+// longest match at each point.
+func CompressRTF(rtf []byte) []byte {
+	var dict [4096]byte
+	pos := copy(dict[:], rtfDictionary)
+	var body []byte
+	control, items := -1, 0
+	emit := func(literal bool, b ...byte) {
+		if items%8 == 0 {
+			body = append(body, 0)
+			control = len(body) - 1
+		}
+		if !literal {
+			body[control] |= 1 << (items % 8)
+		}
+		body = append(body, b...)
+		items++
+	}
+	for i := 0; i < len(rtf); {
+		bestOffset, bestLength := 0, 0
+		for offset := 0; offset < len(dict); offset++ {
+			if offset == pos {
+				continue
+			}
+			n := 0
+			for n < 17 && i+n < len(rtf) {
+				// A match may run into the bytes it is writing.
+				var c byte
+				if ahead := (offset + n - pos + len(dict)) % len(dict); ahead < n {
+					c = rtf[i+ahead]
+				} else {
+					c = dict[(offset+n)%len(dict)]
+				}
+				if c != rtf[i+n] {
+					break
+				}
+				n++
+			}
+			if n > bestLength {
+				bestOffset, bestLength = offset, n
+			}
+		}
+		if bestLength < 2 {
+			bestLength = 1
+			emit(true, rtf[i])
+		} else {
+			token := bestOffset<<4 | (bestLength - 2)
+			emit(false, byte(token>>8), byte(token))
+		}
+		for j := 0; j < bestLength; j++ {
+			dict[pos] = rtf[i+j]
+			pos = (pos + 1) % len(dict)
+		}
+		i += bestLength
+	}
+	// The end marker points at the write position.
+	emit(false, byte(pos>>4), byte(pos<<4))
+
+	out := le32(uint32(len(body) + 12))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(rtf)))
+	out = binary.LittleEndian.AppendUint32(out, 0x75465a4c)
+	out = binary.LittleEndian.AppendUint32(out, tnef.RTFChecksum(body))
+	return append(out, body...)
+}
+
+const rtfDictionary = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}{\\f0\\fnil \\froman " +
+	"\\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier" +
+	"{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+
+func property(typ, id uint16, value []byte) tnef.Property {
+	return tnef.Property{Type: typ, ID: id, Values: [][]byte{value}}
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}